@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Internet-facing nodes can get their HTTPS certificate from an ACME CA
+// such as Let's Encrypt. With ACME_HOSTS set the listener obtains a
+// certificate for those names on first use and renews it before it
+// expires, answering TLS-ALPN-01 challenges itself and HTTP-01 ones on
+// ACME_HTTP_ADDR when that is set. Certificates are cached in
+// ACME_CACHE_DIR (default DATA_DIR/acme).
+//
+// TLS_CERT_FILE is still the node certificate: it is served to clients
+// that connect by another name, like peers using an IP, and whenever ACME
+// fails, and it signs peer requests and receipts.
+
+func acmeEnabled() bool {
+	return os.Getenv("ACME_HOSTS") != ""
+}
+
+// newACMEManager configures certificate management for ACME_HOSTS
+func newACMEManager() (*autocert.Manager, error) {
+	var hosts []string
+	for _, h := range strings.Split(os.Getenv("ACME_HOSTS"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	dir := os.Getenv("ACME_CACHE_DIR")
+	if dir == "" {
+		if os.Getenv("DATA_DIR") == "" {
+			return nil, errors.New("ACME_HOSTS needs ACME_CACHE_DIR or DATA_DIR to keep certificates")
+		}
+		dir = filepath.Join(os.Getenv("DATA_DIR"), "acme")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      os.Getenv("ACME_EMAIL"),
+	}
+	if u := os.Getenv("ACME_DIRECTORY_URL"); u != "" {
+		m.Client = &acme.Client{DirectoryURL: u}
+	}
+	return m, nil
+}
+
+// useACME makes cfg get certificates from ACME, falling back to the node
+// certificate in cfg.Certificates
+func useACME(cfg *tls.Config) error {
+	m, err := newACMEManager()
+	if err != nil {
+		return err
+	}
+	fallback := cfg.Certificates
+	cfg.Certificates = nil
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := m.GetCertificate(hello)
+		if err == nil || len(fallback) == 0 {
+			return cert, err
+		}
+		if hello.ServerName != "" && m.HostPolicy(hello.Context(), hello.ServerName) == nil {
+			log.Printf("ACME certificate for %s unavailable, serving TLS_CERT_FILE: %v", hello.ServerName, err)
+		}
+		return &fallback[0], nil
+	}
+	if addr := os.Getenv("ACME_HTTP_ADDR"); addr != "" {
+		go func() {
+			// everything but challenges is redirected to HTTPS
+			log.Println("answering ACME HTTP-01 challenges on", addr)
+			log.Println(http.ListenAndServe(addr, m.HTTPHandler(nil)))
+		}()
+	}
+	log.Println("obtaining certificates from ACME for", os.Getenv("ACME_HOSTS"))
+	return nil
+}
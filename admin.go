@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminEnabled reports whether management routes get their own listener
+// (ADMIN_PORT). They are then removed from the public API.
+func adminEnabled() bool {
+	return os.Getenv("ADMIN_PORT") != ""
+}
+
+// addAdminRoutes registers the operational endpoints
+func addAdminRoutes(muxRouter *mux.Router) {
+	// state changing routes need an admin client certificate on the public
+	// listener; the admin listener checks its token instead
+	guard := func(next http.HandlerFunc) http.HandlerFunc {
+		return requireAdminCredentials(requireAdminIdentity(requireAdminSignature(next)))
+	}
+	if adminEnabled() {
+		guard = requireAdminSignature
+		muxRouter.HandleFunc("/reload", guard(handleReload)).Methods("POST")
+		addProfilingRoutes(muxRouter, guard)
+	}
+	if faultInjectionEnabled() {
+		muxRouter.HandleFunc("/faults", handleGetFaults).Methods("GET")
+		muxRouter.HandleFunc("/faults", guard(validateBody(Faults{}, handleSetFaults))).Methods("PUT")
+	}
+	muxRouter.HandleFunc("/status", handleGetStatus).Methods("GET")
+	muxRouter.HandleFunc("/limits", handleGetLimits).Methods("GET")
+	muxRouter.HandleFunc("/peers", handleGetPeers).Methods("GET")
+	muxRouter.HandleFunc("/standby", handleGetStandby).Methods("GET")
+	muxRouter.HandleFunc("/cluster", handleGetCluster).Methods("GET")
+	muxRouter.HandleFunc("/cluster/join", guard(validateBody(ClusterJoinReq{}, handleClusterJoin))).Methods("POST")
+	muxRouter.HandleFunc("/cluster/members/{id}", guard(handleClusterLeave)).Methods("DELETE")
+	muxRouter.HandleFunc("/promote", guard(requireChain(handlePromote))).Methods("POST")
+	muxRouter.HandleFunc("/sinks/status", handleGetSinkStatus).Methods("GET")
+	muxRouter.HandleFunc("/devices", handleGetDevices).Methods("GET")
+	muxRouter.HandleFunc("/devices", guard(validateBody(Device{}, handleRegisterDevice))).Methods("POST")
+	muxRouter.HandleFunc("/devices/silent", handleGetSilentDevices).Methods("GET")
+	muxRouter.HandleFunc("/devices/{name}", handleGetDevice).Methods("GET")
+	muxRouter.HandleFunc("/known-hashes", guard(handleRegisterHashes)).Methods("POST")
+	muxRouter.HandleFunc("/known-hashes/{hash}", handleGetKnownHash).Methods("GET")
+	muxRouter.HandleFunc("/rejected", handleGetRejected).Methods("GET")
+	muxRouter.HandleFunc("/rejected/{id}", handleGetRejection).Methods("GET")
+	muxRouter.HandleFunc("/rejected/{id}/resubmit", guard(requireChain(handleResubmitRejection))).Methods("POST")
+	muxRouter.HandleFunc("/archives/verify", guard(handleVerifyArchives)).Methods("POST")
+	muxRouter.HandleFunc("/redactions/preview", requireChain(validateBody(RedactionPolicy{}, handlePreviewRedaction))).Methods("POST")
+	muxRouter.HandleFunc("/retention/policies", handleGetRetentionPolicies).Methods("GET")
+	muxRouter.HandleFunc("/retention/policies", guard(requireChain(validateBody(RetentionPolicy{}, handleSetRetentionPolicy)))).Methods("POST")
+	muxRouter.HandleFunc("/retention/policies/{name}", guard(requireChain(handleRetireRetentionPolicy))).Methods("DELETE")
+	muxRouter.HandleFunc("/retention/runs", handleGetRetentionRuns).Methods("GET")
+	muxRouter.HandleFunc("/retention/run", guard(requireChain(handleRunRetention))).Methods("POST")
+	muxRouter.HandleFunc("/reindex", guard(requireChain(handleReindex))).Methods("POST")
+	muxRouter.HandleFunc("/reanchor", guard(requireChain(validateBody(ReanchorReq{}, handleReanchor)))).Methods("POST")
+	muxRouter.HandleFunc("/sandbox", guard(requireChain(handleCreateSandbox))).Methods("POST")
+	muxRouter.HandleFunc("/sandbox/{id}", handleGetSandbox).Methods("GET")
+	muxRouter.HandleFunc("/sandbox/{id}", guard(handleDeleteSandbox)).Methods("DELETE")
+	muxRouter.HandleFunc("/sandbox/{id}/blocks", guard(validateBody(Block{}, handleSandboxBlock))).Methods("POST")
+	muxRouter.HandleFunc("/sandbox/{id}/validate", handleValidateSandbox).Methods("GET")
+}
+
+// startAdmin serves the admin routes on ADMIN_ADDR:ADMIN_PORT (loopback by
+// default), requiring ADMIN_TOKEN as a bearer token on every request
+func startAdmin() error {
+	if !adminEnabled() {
+		return nil
+	}
+	token := os.Getenv("ADMIN_TOKEN")
+	if len(token) < 16 {
+		return errors.New("ADMIN_PORT requires an ADMIN_TOKEN of at least 16 characters")
+	}
+	host := hostLiteral(os.Getenv("ADMIN_ADDR"))
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, os.Getenv("ADMIN_PORT")))
+	if err != nil {
+		return err
+	}
+
+	muxRouter := mux.NewRouter()
+	addAdminRoutes(muxRouter)
+	s := &http.Server{
+		Handler:        requireAdminToken(token, muxRouter.ServeHTTP),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	log.Println("admin server listening on", l.Addr())
+	go func() {
+		log.Fatal(s.Serve(l))
+	}()
+	return nil
+}
+
+// requireAdminCredentials refuses state changing admin requests on the
+// public listener when nothing would check who sent them: no admin client
+// certificate allowlist (ADMIN_CLIENT_IDS) and no ADMIN_SIGNING_KEYS.
+// Either, or ADMIN_PORT, must be set to use them.
+func requireAdminCredentials(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminKeyMutex.RLock()
+		keys := len(adminKeys)
+		adminKeyMutex.RUnlock()
+		if len(adminAllowlist) == 0 && keys == 0 {
+			log.Printf("refused admin request %s %s from %s: no admin credentials configured", r.Method, r.URL.Path, clientIP(r))
+			http.Error(w, "admin routes need ADMIN_PORT, ADMIN_CLIENT_IDS or ADMIN_SIGNING_KEYS", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAdminIdentity rejects requests whose client certificate does not
+// carry a SAN from ADMIN_CLIENT_IDS. Identities allowed to write are not
+// enough. It is a no-op when no admin allowlist is configured.
+func requireAdminIdentity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(adminAllowlist) == 0 {
+			next(w, r)
+			return
+		}
+		id, ok := allowedIdentity(r, adminAllowlist)
+		if !ok {
+			log.Printf("refused admin request %s %s from %s: client identity %v not an admin", r.Method, r.URL.Path, clientIP(r), peerIdentities(r))
+			http.Error(w, "client certificate identity not an admin", http.StatusForbidden)
+			return
+		}
+		log.Printf("admin request %s %s authorized for %s", r.Method, r.URL.Path, id)
+		next(w, r)
+	}
+}
+
+// requireAdminToken checks the Authorization: Bearer header
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			log.Printf("rejected admin request from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// re-read the config file now, as if it had changed on disk
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := reloadConfig(); err != nil {
+		http.Error(w, "config reload rejected: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// State changing admin requests must be signed when ADMIN_SIGNING_KEYS
+// ("name:base64-ed25519-public-key,...") is set, so a leaked ADMIN_TOKEN or
+// client certificate alone cannot change anything. The request carries
+//
+//	X-Admin-Key: name
+//	X-Admin-Timestamp: RFC 3339 time, within adminSignatureWindow of ours
+//	X-Admin-Signature: hex ed25519 signature of
+//	                   METHOD + " " + path + "\n" + timestamp + "\n" + body
+//
+// where path is the request URI with its query, excluding BASE_PATH. Every
+// attempt is audited.
+
+// how far X-Admin-Timestamp may be from our clock; signatures are single use
+// within it
+const adminSignatureWindow = 5 * time.Minute
+
+var adminKeys map[string]ed25519.PublicKey
+var adminKeyMutex = &sync.RWMutex{}
+
+// usedAdminSignatures remembers signatures until they fall out of the window
+var usedAdminSignatures = make(map[string]time.Time)
+var usedAdminMutex = &sync.Mutex{}
+
+// loadAdminKeys reads ADMIN_SIGNING_KEYS
+func loadAdminKeys() error {
+	keys, err := parseAdminKeys(os.Getenv("ADMIN_SIGNING_KEYS"))
+	if err != nil {
+		return err
+	}
+	adminKeys = keys
+	if len(keys) > 0 {
+		log.Println("admin requests require a signature from one of", len(keys), "admin keys")
+	}
+	return nil
+}
+
+// prepareAdminKeys validates reloaded ADMIN_SIGNING_KEYS
+func prepareAdminKeys(env map[string]string) (func(), error) {
+	keys, err := parseAdminKeys(env["ADMIN_SIGNING_KEYS"])
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		adminKeyMutex.Lock()
+		adminKeys = keys
+		adminKeyMutex.Unlock()
+	}, nil
+}
+
+func parseAdminKeys(list string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid admin key entry " + entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key for admin " + parts[0])
+		}
+		keys[parts[0]] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+// requireAdminSignature checks the detached signature of an admin request
+func requireAdminSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminKeyMutex.RLock()
+		keys := adminKeys
+		adminKeyMutex.RUnlock()
+		if len(keys) == 0 {
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		name := r.Header.Get("X-Admin-Key")
+		if err := verifyAdminSignature(keys, r, body); err != nil {
+			recordAdminAction(r, name, body, false)
+			log.Printf("refused admin request %s %s from %s: %v", r.Method, r.URL.Path, clientIP(r), err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		recordAdminAction(r, name, body, true)
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+func verifyAdminSignature(keys map[string]ed25519.PublicKey, r *http.Request, body []byte) error {
+	key, ok := keys[r.Header.Get("X-Admin-Key")]
+	if !ok {
+		return errors.New("admin request signature required: unknown or missing X-Admin-Key")
+	}
+	ts := r.Header.Get("X-Admin-Timestamp")
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return errors.New("X-Admin-Timestamp must be an RFC 3339 time")
+	}
+	if d := time.Since(t); d > adminSignatureWindow || d < -adminSignatureWindow {
+		return errors.New("X-Admin-Timestamp is too far from the node's clock")
+	}
+	sig, err := hex.DecodeString(r.Header.Get("X-Admin-Signature"))
+	if err != nil {
+		return errors.New("X-Admin-Signature must be hex")
+	}
+	msg := r.Method + " " + r.URL.RequestURI() + "\n" + ts + "\n" + string(body)
+	if !ed25519.Verify(key, []byte(msg), sig) {
+		return errors.New("invalid admin request signature")
+	}
+
+	usedAdminMutex.Lock()
+	defer usedAdminMutex.Unlock()
+	for s, expires := range usedAdminSignatures {
+		if time.Now().After(expires) {
+			delete(usedAdminSignatures, s)
+		}
+	}
+	if _, used := usedAdminSignatures[string(sig)]; used {
+		return errors.New("admin request signature was already used")
+	}
+	usedAdminSignatures[string(sig)] = t.Add(adminSignatureWindow)
+	return nil
+}
+
+// adminBodyHash identifies the signed body in the audit trail
+func adminBodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
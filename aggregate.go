@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Aggregates are the query mode for consumers outside the security team:
+// counts and histograms of events, never the events themselves. Events of
+// batch blocks count one by one. A count below AGGREGATE_MIN_COUNT (default
+// 10) is left out, and with AGGREGATE_EPSILON set every count gets Laplace
+// noise of scale 1/epsilon before the threshold applies, so an answer barely
+// changes whether any single event is on the chain or not. The noise of a
+// count is derived from the query, the group and the count itself with an
+// HMAC under AGGREGATE_NOISE_KEY, so asking again, in whatever words, gets
+// the same noise for as long as the count stays the same, and a closed range
+// always gets the same answer. Without AGGREGATE_NOISE_KEY the node keeps a
+// random key in DATA_DIR/aggregate.key, or in memory without DATA_DIR.
+//
+// AGGREGATE_PORT serves these routes and nothing else, on AGGREGATE_ADDR
+// (all interfaces by default), so it can be exposed where the block routes
+// must not be. With AGGREGATE_TOKENS ("name:token,...") every request there
+// needs one of the tokens as a bearer token.
+
+// default smallest count reported
+const defaultAggregateMinCount = 10
+
+var errAggregateNoise = errors.New("aggregate noise key is unavailable")
+
+// keys aggregates can be grouped by
+var aggregateKeys = map[string]func(tx Transaction) string{
+	"event":    func(tx Transaction) string { return tx.Event },
+	"server":   func(tx Transaction) string { return tx.Server },
+	"location": func(tx Transaction) string { return tx.Location },
+	"severity": func(tx Transaction) string { return severityOf(Block{Metadata: tx.Metadata}) },
+}
+
+// histogram intervals and the layout of their bucket labels
+var aggregateIntervals = map[string]string{
+	"hour": "2006-01-02T15",
+	"day":  "2006-01-02",
+}
+
+// AggregateGroup is one reported count
+type AggregateGroup struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// AggregateResp answers GET /aggregates/counts and /aggregates/histogram.
+// Total is zero when it is itself below MinCount.
+type AggregateResp struct {
+	By       string           `json:"by,omitempty"`
+	Interval string           `json:"interval,omitempty"`
+	Event    string           `json:"event,omitempty"`
+	From     string           `json:"from,omitempty"`
+	To       string           `json:"to,omitempty"`
+	Through  int              `json:"through"`
+	MinCount int              `json:"min_count"`
+	Epsilon  float64          `json:"epsilon,omitempty"`
+	Total    int              `json:"total"`
+	Groups   []AggregateGroup `json:"groups"`
+}
+
+// the noise key when AGGREGATE_NOISE_KEY is not set, guarded by
+// aggregateKeyMutex
+var (
+	aggregateKey      []byte
+	aggregateKeyMutex = &sync.Mutex{}
+)
+
+// aggregatePrivacy reads AGGREGATE_MIN_COUNT and AGGREGATE_EPSILON on every
+// call so they can be hot reloaded
+func aggregatePrivacy() (int, float64, error) {
+	minCount, epsilon := defaultAggregateMinCount, 0.0
+	if v := os.Getenv("AGGREGATE_MIN_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("AGGREGATE_MIN_COUNT must be a positive number")
+		}
+		minCount = n
+	}
+	if v := os.Getenv("AGGREGATE_EPSILON"); v != "" {
+		e, err := strconv.ParseFloat(v, 64)
+		if err != nil || e <= 0 || math.IsInf(e, 0) {
+			return 0, 0, errors.New("AGGREGATE_EPSILON must be a positive number")
+		}
+		epsilon = e
+	}
+	return minCount, epsilon, nil
+}
+
+// aggregateNoiseKey is the secret the noise is derived from. A consumer who
+// knew it could subtract the noise.
+func aggregateNoiseKey() ([]byte, error) {
+	if v := os.Getenv("AGGREGATE_NOISE_KEY"); v != "" {
+		return []byte(v), nil
+	}
+	aggregateKeyMutex.Lock()
+	defer aggregateKeyMutex.Unlock()
+	if aggregateKey != nil {
+		return aggregateKey, nil
+	}
+	path := ""
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		path = filepath.Join(dir, "aggregate.key")
+		key, err := ioutil.ReadFile(path)
+		if err == nil && len(key) > 0 {
+			aggregateKey = key
+			return key, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("reading the aggregate noise key failed:", err)
+			return nil, errAggregateNoise
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Println("generating an aggregate noise key failed:", err)
+		return nil, errAggregateNoise
+	}
+	if path != "" {
+		if err := ioutil.WriteFile(path, key, 0600); err != nil {
+			log.Println("saving the aggregate noise key failed:", err)
+			return nil, errAggregateNoise
+		}
+	}
+	aggregateKey = key
+	return key, nil
+}
+
+// laplaceNoise is a sample of Laplace(0, scale) drawn by the HMAC of seed
+// under key
+func laplaceNoise(scale float64, key []byte, seed string) float64 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(seed))
+	sum := mac.Sum(nil)
+	// uniform in (-0.5, 0.5)
+	u := (float64(binary.LittleEndian.Uint64(sum)>>11)+0.5)/(1<<53) - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+// releaseCount is the count reported for the n events of group in the
+// answer to query, zero when it must be left out
+func releaseCount(n, minCount int, epsilon float64, key []byte, query, group string) int {
+	if epsilon > 0 {
+		seed := strings.Join([]string{query, group, strconv.Itoa(n)}, "\x00")
+		n = int(math.Round(float64(n) + laplaceNoise(1/epsilon, key, seed)))
+	}
+	if n < minCount {
+		return 0
+	}
+	return n
+}
+
+// aggregate counts the events committed between from and to (dates, empty
+// for open ends) by the key label returns, skipping events where it's empty
+func aggregate(resp AggregateResp, label func(committed time.Time, tx Transaction) string) (AggregateResp, error) {
+	var err error
+	if resp.MinCount, resp.Epsilon, err = aggregatePrivacy(); err != nil {
+		return AggregateResp{}, err
+	}
+	var key []byte
+	if resp.Epsilon > 0 {
+		if key, err = aggregateNoiseKey(); err != nil {
+			return AggregateResp{}, err
+		}
+	}
+	// the query in a canonical form, however it was spelled
+	query := strings.Join([]string{resp.By, resp.Interval, resp.Event, resp.From, resp.To,
+		strconv.Itoa(resp.MinCount), strconv.FormatFloat(resp.Epsilon, 'g', -1, 64)}, "\x00")
+
+	counts := make(map[string]int)
+	total := 0
+	mutex.Lock()
+	resp.Through = len(Blockchain) - 1
+	for _, b := range Blockchain[1:] {
+		t, ok := parseBlockTime(b.Timestamp)
+		if !ok {
+			continue
+		}
+		day := t.UTC().Format("2006-01-02")
+		if (resp.From != "" && day < resp.From) || (resp.To != "" && day > resp.To) {
+			continue
+		}
+		for _, tx := range eventsOf(b) {
+			if resp.Event != "" && tx.Event != resp.Event {
+				continue
+			}
+			total++
+			if group := label(t.UTC(), tx); group != "" {
+				counts[group]++
+			}
+		}
+	}
+	mutex.Unlock()
+
+	// the total has no group, "" is never a group's key
+	resp.Total = releaseCount(total, resp.MinCount, resp.Epsilon, key, query, "")
+	resp.Groups = make([]AggregateGroup, 0, len(counts))
+	for group, n := range counts {
+		if n = releaseCount(n, resp.MinCount, resp.Epsilon, key, query, group); n > 0 {
+			resp.Groups = append(resp.Groups, AggregateGroup{group, n})
+		}
+	}
+	return resp, nil
+}
+
+// aggregateError answers err, 503 when there is no noise to add
+func aggregateError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, errAggregateNoise) {
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// aggregateQuery reads the filters both routes take
+func aggregateQuery(r *http.Request) (AggregateResp, error) {
+	q := r.URL.Query()
+	resp := AggregateResp{Event: q.Get("event"), From: q.Get("from"), To: q.Get("to")}
+	for _, d := range []string{resp.From, resp.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			return AggregateResp{}, errors.New("from and to must be dates like 2006-01-02")
+		}
+	}
+	return resp, nil
+}
+
+// count events by ?by= (event, server, location or severity)
+func handleGetAggregateCounts(w http.ResponseWriter, r *http.Request) {
+	resp, err := aggregateQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.By = r.URL.Query().Get("by")
+	if resp.By == "" {
+		resp.By = "event"
+	}
+	key, ok := aggregateKeys[resp.By]
+	if !ok {
+		http.Error(w, "by must be event, server, location or severity", http.StatusBadRequest)
+		return
+	}
+	resp, err = aggregate(resp, func(_ time.Time, tx Transaction) string { return key(tx) })
+	if err != nil {
+		aggregateError(w, err)
+		return
+	}
+	sort.Slice(resp.Groups, func(i, j int) bool {
+		if resp.Groups[i].Count != resp.Groups[j].Count {
+			return resp.Groups[i].Count > resp.Groups[j].Count
+		}
+		return resp.Groups[i].Key < resp.Groups[j].Key
+	})
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
+
+// count events per ?interval= (hour or day) of their commit time
+func handleGetAggregateHistogram(w http.ResponseWriter, r *http.Request) {
+	resp, err := aggregateQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Interval = r.URL.Query().Get("interval")
+	if resp.Interval == "" {
+		resp.Interval = "day"
+	}
+	layout, ok := aggregateIntervals[resp.Interval]
+	if !ok {
+		http.Error(w, "interval must be hour or day", http.StatusBadRequest)
+		return
+	}
+	resp, err = aggregate(resp, func(committed time.Time, _ Transaction) string { return committed.Format(layout) })
+	if err != nil {
+		aggregateError(w, err)
+		return
+	}
+	sort.Slice(resp.Groups, func(i, j int) bool { return resp.Groups[i].Key < resp.Groups[j].Key })
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
+
+func addAggregateRoutes(muxRouter *mux.Router) {
+	muxRouter.HandleFunc("/aggregates/counts", requireChain(handleGetAggregateCounts)).Methods("GET")
+	muxRouter.HandleFunc("/aggregates/histogram", requireChain(handleGetAggregateHistogram)).Methods("GET")
+}
+
+// startAggregates serves only the aggregate routes on AGGREGATE_PORT
+func startAggregates() error {
+	port := os.Getenv("AGGREGATE_PORT")
+	if port == "" {
+		return nil
+	}
+	if _, _, err := aggregatePrivacy(); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(hostLiteral(os.Getenv("AGGREGATE_ADDR")), port))
+	if err != nil {
+		return err
+	}
+
+	muxRouter := mux.NewRouter()
+	addAggregateRoutes(muxRouter)
+	s := &http.Server{
+		Handler:        requireAggregateToken(muxRouter.ServeHTTP),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	log.Println("aggregate server listening on", l.Addr())
+	go func() {
+		log.Fatal(s.Serve(l))
+	}()
+	return nil
+}
+
+// requireAggregateToken checks the bearer token against AGGREGATE_TOKENS,
+// read per request so tokens can be rotated. Unset lets everyone in.
+func requireAggregateToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens := os.Getenv("AGGREGATE_TOKENS")
+		if tokens == "" {
+			next(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got != r.Header.Get("Authorization") {
+			for _, entry := range strings.Split(tokens, ",") {
+				parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+				if len(parts) == 2 && parts[1] != "" && subtle.ConstantTimeCompare([]byte(got), []byte(parts[1])) == 1 {
+					next(w, r)
+					return
+				}
+			}
+		}
+		log.Printf("rejected aggregate request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "aggregate token required", http.StatusUnauthorized)
+	}
+}
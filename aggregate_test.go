@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAggregateNoiseIsStable(t *testing.T) {
+	router := newTestChain(t)
+	t.Setenv("AGGREGATE_MIN_COUNT", "2")
+	t.Setenv("AGGREGATE_EPSILON", "0.1")
+	t.Setenv("AGGREGATE_NOISE_KEY", "test-key")
+	for i := 0; i < 20; i++ {
+		event := "door opened"
+		if i%4 == 0 {
+			event = "badge read"
+		}
+		if code := call(t, router, "POST", "/v2/block", map[string]string{"event": event, "server": "s1"}, nil); code != http.StatusCreated {
+			t.Fatalf("writing %s: status %d", event, code)
+		}
+	}
+
+	var first, again, reordered AggregateResp
+	call(t, router, "GET", "/aggregates/counts?by=event", nil, &first)
+	for i := 0; i < 10; i++ {
+		call(t, router, "GET", "/aggregates/counts?by=event", nil, &again)
+		if again.Total != first.Total || len(again.Groups) != len(first.Groups) {
+			t.Fatalf("asking again answered %+v, then %+v", first, again)
+		}
+		for j := range again.Groups {
+			if again.Groups[j] != first.Groups[j] {
+				t.Fatalf("asking again answered %+v, then %+v", first, again)
+			}
+		}
+	}
+	call(t, router, "GET", "/aggregates/counts?event=&by=event", nil, &reordered)
+	if reordered.Total != first.Total {
+		t.Errorf("the same query in other words answered %d, then %d", first.Total, reordered.Total)
+	}
+
+	t.Setenv("AGGREGATE_NOISE_KEY", "other-key")
+	var rekeyed AggregateResp
+	call(t, router, "GET", "/aggregates/counts?by=event", nil, &rekeyed)
+	if rekeyed.Total == first.Total && len(rekeyed.Groups) == len(first.Groups) &&
+		(len(first.Groups) == 0 || rekeyed.Groups[0] == first.Groups[0]) {
+		t.Errorf("another key gave the same noise %+v", rekeyed)
+	}
+}
+
+func TestAggregateThreshold(t *testing.T) {
+	router := newTestChain(t)
+	t.Setenv("AGGREGATE_MIN_COUNT", "3")
+	t.Setenv("AGGREGATE_EPSILON", "")
+	for _, event := range []string{"a", "a", "a", "b"} {
+		call(t, router, "POST", "/v2/block", map[string]string{"event": event}, nil)
+	}
+	var resp AggregateResp
+	if code := call(t, router, "GET", "/aggregates/counts?by=event", nil, &resp); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if resp.Total != 4 || len(resp.Groups) != 1 || resp.Groups[0] != (AggregateGroup{"a", 3}) {
+		t.Errorf("counts are %+v", resp)
+	}
+}
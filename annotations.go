@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Annotations are auditors' notes attached to blocks. They live outside the
+// chain, in DATA_DIR/annotations.jsonl, so adding one never changes a hash.
+// Reading and writing them needs an auditor: a bearer token from
+// AUDITOR_TOKENS ("name:token,...") or an allowlisted client certificate.
+
+// Annotation is one note on a block
+type Annotation struct {
+	ID      string `json:"id"`
+	Index   int    `json:"index"`
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Note    string `json:"note"`
+	Created string `json:"created"`
+}
+
+// AnnotationReq is the body of POST /block/{hash}/annotations
+type AnnotationReq struct {
+	Note string `json:"note"`
+}
+
+// longest accepted note
+const maxAnnotation = 16 << 10
+
+var annotations []Annotation
+var annotationMutex = &sync.Mutex{}
+var annotationFile *os.File
+
+// loadAnnotations reads DATA_DIR/annotations.jsonl and keeps it open for
+// appending
+func loadAnnotations() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "annotations.jsonl"), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var a Annotation
+		if err := unmarshalCompat(scanner.Bytes(), &a); err != nil {
+			log.Println("skipping bad annotation record:", err)
+			continue
+		}
+		annotations = append(annotations, a)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	annotationFile = f
+	return nil
+}
+
+// auditorIdentity names the caller if it may use annotations
+func auditorIdentity(r *http.Request) (string, bool) {
+	if got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); got != r.Header.Get("Authorization") {
+		for _, entry := range strings.Split(os.Getenv("AUDITOR_TOKENS"), ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+			if len(parts) == 2 && parts[1] != "" && subtle.ConstantTimeCompare([]byte(got), []byte(parts[1])) == 1 {
+				return parts[0], true
+			}
+		}
+	}
+	return peerIdentity(r)
+}
+
+// requireAuditor rejects callers that aren't auditors
+func requireAuditor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := auditorIdentity(r); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "annotations are only available to auditors", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// attach a note to a block
+func handleCreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	var req AnnotationReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	req.Note = strings.TrimSpace(req.Note)
+	if req.Note == "" || len(req.Note) > maxAnnotation {
+		http.Error(w, "Note must be between 1 and 16384 bytes", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	block, ok := BlockMap[strings.ToLower(mux.Vars(r)["hash"])]
+	mutex.Unlock()
+	if !ok {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	author, _ := auditorIdentity(r)
+	a := Annotation{
+		ID:      hex.EncodeToString(raw),
+		Index:   block.Index,
+		Hash:    block.Hash,
+		Author:  author,
+		Note:    req.Note,
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	annotationMutex.Lock()
+	defer annotationMutex.Unlock()
+	if annotationFile != nil {
+		line, _ := json.Marshal(a)
+		if _, err := annotationFile.Write(append(line, '\n')); err != nil {
+			log.Println("persisting annotation failed:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	annotations = append(annotations, a)
+	respondWithJSON(w, r, http.StatusCreated, a)
+}
+
+// list the notes on one block, oldest first
+func handleGetBlockAnnotations(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(mux.Vars(r)["hash"])
+	mutex.Lock()
+	_, ok := BlockMap[hash]
+	mutex.Unlock()
+	if !ok {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	respondWithList(w, r, http.StatusOK, findAnnotations(func(a Annotation) bool { return a.Hash == hash }))
+}
+
+// search notes by ?author= and/or ?q= (case-insensitive substring)
+func handleSearchAnnotations(w http.ResponseWriter, r *http.Request) {
+	author := r.URL.Query().Get("author")
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	respondWithList(w, r, http.StatusOK, findAnnotations(func(a Annotation) bool {
+		return (author == "" || a.Author == author) && (q == "" || strings.Contains(strings.ToLower(a.Note), q))
+	}))
+}
+
+func findAnnotations(match func(Annotation) bool) []Annotation {
+	annotationMutex.Lock()
+	defer annotationMutex.Unlock()
+	found := make([]Annotation, 0)
+	for _, a := range annotations {
+		if match(a) {
+			found = append(found, a)
+		}
+	}
+	return found
+}
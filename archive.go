@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// archiveEvent marks blocks recording where a range of blocks was archived.
+// FileHash is the SHA-256 of the archived object and Location its object ID.
+// Only records the node minted itself count (see nodeMinted).
+const archiveEvent = "archive"
+
+// archiveBackend is write-once storage for archived block ranges
+type archiveBackend interface {
+	// Put stores data under key exactly once and returns the object ID
+	Put(key string, data []byte) (string, error)
+	// Get fetches an object by the ID Put returned
+	Get(id string) ([]byte, error)
+}
+
+// ArchiveRecord describes one archived range of blocks
+type ArchiveRecord struct {
+	Index    int    `json:"index"`
+	ObjectID string `json:"object_id"`
+	Digest   string `json:"digest"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+}
+
+// ArchiveCheck is the result of verifying one archived object
+type ArchiveCheck struct {
+	Record      ArchiveRecord `json:"record"`
+	DigestValid bool          `json:"digest_valid"`
+	BlocksMatch bool          `json:"blocks_match"`
+	Mismatched  []int         `json:"mismatched,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+var archiver archiveBackend
+
+var archiveKeyRe = regexp.MustCompile(`(\d{9})-(\d{9})\.json`)
+
+// startArchiver periodically archives new blocks when ARCHIVE=dir|s3
+func startArchiver() error {
+	var err error
+	switch os.Getenv("ARCHIVE") {
+	case "":
+		return nil
+	case "dir":
+		archiver, err = newDirArchive(os.Getenv("ARCHIVE_DIR"))
+	case "s3":
+		archiver, err = newS3Archive(os.Getenv("ARCHIVE_S3_BUCKET"), os.Getenv("ARCHIVE_RETENTION_DAYS"))
+	default:
+		err = errors.New("ARCHIVE must be dir or s3")
+	}
+	if err != nil {
+		return err
+	}
+	if poaEnabled() {
+		return errors.New("ARCHIVE is not supported with CONSENSUS=poa, archive records would bypass the quorum")
+	}
+
+	interval := time.Minute
+	if v := os.Getenv("ARCHIVE_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := archivePending(); err != nil {
+				log.Println("archiving failed:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// archivePending writes every block after the last archived range to the
+// archive and records the resulting object ID on-chain
+func archivePending() error {
+	mutex.Lock()
+	from := nextArchiveIndexLocked()
+	if from > len(Blockchain) {
+		mutex.Unlock()
+		return fmt.Errorf("archive records end past the head at block %d", from-1)
+	}
+	pending := append([]Block(nil), Blockchain[from:]...)
+	mutex.Unlock()
+
+	// don't archive a range that only holds the previous archive record
+	if len(pending) == 0 || (len(pending) == 1 && pending[0].Event == archiveEvent) {
+		return nil
+	}
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("blocks/%09d-%09d.json", from, from+len(pending)-1)
+	id, err := archiver.Put(key, data)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	record := CreateBlockReq{
+		FileHash:  hex.EncodeToString(sum[:]),
+		Event:     archiveEvent,
+		EventTime: time.Now().UTC().Format(time.RFC3339),
+		Location:  id,
+		system:    true,
+	}
+	if _, err := addBlock(record, ""); err != nil {
+		return err
+	}
+	log.Printf("archived blocks %d-%d to %s", from, from+len(pending)-1, id)
+	return nil
+}
+
+// nextArchiveIndexLocked returns the first block not yet archived. Caller
+// must hold mutex.
+func nextArchiveIndexLocked() int {
+	for i := len(Blockchain) - 1; i >= 0; i-- {
+		if Blockchain[i].Event != archiveEvent {
+			continue
+		}
+		if rec, ok := archiveRecord(Blockchain[i]); ok {
+			return rec.To + 1
+		}
+	}
+	return 0
+}
+
+// archiveRecord decodes an archive block. A record only covers blocks
+// before its own.
+func archiveRecord(b Block) (ArchiveRecord, bool) {
+	m := archiveKeyRe.FindStringSubmatch(b.Location)
+	if b.Event != archiveEvent || m == nil || !nodeMinted(b) {
+		return ArchiveRecord{}, false
+	}
+	from, _ := strconv.Atoi(m[1])
+	to, _ := strconv.Atoi(m[2])
+	if from > to || to >= b.Index {
+		return ArchiveRecord{}, false
+	}
+	return ArchiveRecord{b.Index, b.Location, b.FileHash, from, to}, true
+}
+
+func archiveRecords() []ArchiveRecord {
+	records := make([]ArchiveRecord, 0)
+	mutex.Lock()
+	for _, b := range Blockchain {
+		if rec, ok := archiveRecord(b); ok {
+			records = append(records, rec)
+		}
+	}
+	mutex.Unlock()
+	return records
+}
+
+// list archived ranges recorded on-chain
+func handleGetArchives(w http.ResponseWriter, r *http.Request) {
+	respondWithList(w, r, http.StatusOK, archiveRecords())
+}
+
+// fetch every archived object and check it against the live chain
+func handleVerifyArchives(w http.ResponseWriter, r *http.Request) {
+	if archiver == nil {
+		http.Error(w, "archiving is not enabled", http.StatusNotFound)
+		return
+	}
+
+	checks := make([]ArchiveCheck, 0)
+	valid := true
+	for _, rec := range archiveRecords() {
+		check := verifyArchive(rec)
+		valid = valid && check.DigestValid && check.BlocksMatch
+		checks = append(checks, check)
+	}
+
+	status := http.StatusOK
+	if !valid {
+		status = http.StatusConflict
+	}
+	respondWithJSON(w, r, status, checks)
+}
+
+func verifyArchive(rec ArchiveRecord) ArchiveCheck {
+	check := ArchiveCheck{Record: rec}
+	data, err := archiver.Get(rec.ObjectID)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	sum := sha256.Sum256(data)
+	check.DigestValid = hex.EncodeToString(sum[:]) == rec.Digest
+
+	var blocks []Block
+	if err := unmarshalCompat(data, &blocks); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	mutex.Lock()
+	for _, b := range blocks {
+		if b.Index >= len(Blockchain) || Blockchain[b.Index].Hash != b.Hash {
+			check.Mismatched = append(check.Mismatched, b.Index)
+		}
+	}
+	mutex.Unlock()
+	check.BlocksMatch = len(blocks) == rec.To-rec.From+1 && len(check.Mismatched) == 0
+	return check
+}
+
+// dirArchive writes read-only files that are never overwritten, for
+// immutable mounts or tests
+type dirArchive struct {
+	dir string
+}
+
+func newDirArchive(dir string) (*dirArchive, error) {
+	if dir == "" {
+		return nil, errors.New("ARCHIVE=dir requires ARCHIVE_DIR")
+	}
+	return &dirArchive{dir}, os.MkdirAll(dir, 0700)
+}
+
+// Put writes data to a temporary file, syncs it and renames it into place,
+// so a crash never leaves a partial object under key. An object already
+// there is never overwritten; if it holds the same bytes, as when an archive
+// run is retried after a crash, it is taken as written.
+func (a *dirArchive) Put(key string, data []byte) (string, error) {
+	path := filepath.Join(a.dir, filepath.FromSlash(key))
+	id := "file://" + filepath.ToSlash(path)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if same, err := a.holds(path, data); err != nil {
+		return "", err
+	} else if same {
+		return id, nil
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Chmod(0400); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	// another run may have written it meanwhile
+	if same, err := a.holds(path, data); err != nil {
+		return "", err
+	} else if same {
+		return id, nil
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return id, syncDir(dir)
+}
+
+// holds reports whether the object at path exists with exactly data, and
+// fails if it exists with anything else
+func (a *dirArchive) holds(path string, data []byte) (bool, error) {
+	existing, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(existing, data) {
+		return false, errors.New("archive object " + path + " already exists with different content")
+	}
+	return true, nil
+}
+
+// Get only reads files under the archive directory, whatever path a record
+// names
+func (a *dirArchive) Get(id string) ([]byte, error) {
+	if !strings.HasPrefix(id, "file://") {
+		return nil, errors.New("not a file object ID: " + id)
+	}
+	path := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(id, "file://")))
+	rel, err := filepath.Rel(filepath.Clean(a.dir), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New("object " + id + " is outside the archive directory")
+	}
+	return ioutil.ReadFile(path)
+}
+
+// s3Archive writes objects under S3 Object Lock in compliance mode, so not
+// even the bucket owner can delete or overwrite them before retention ends.
+// Credentials and region come from the standard AWS environment.
+type s3Archive struct {
+	svc       *s3.S3
+	bucket    string
+	retention time.Duration
+}
+
+func newS3Archive(bucket, retentionDays string) (*s3Archive, error) {
+	if bucket == "" {
+		return nil, errors.New("ARCHIVE=s3 requires ARCHIVE_S3_BUCKET")
+	}
+	days := 365
+	if retentionDays != "" {
+		var err error
+		if days, err = strconv.Atoi(retentionDays); err != nil || days < 1 {
+			return nil, errors.New("ARCHIVE_RETENTION_DAYS must be a positive number")
+		}
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Archive{s3.New(sess), bucket, time.Duration(days) * 24 * time.Hour}, nil
+}
+
+func (a *s3Archive) Put(key string, data []byte) (string, error) {
+	sum := md5.Sum(data)
+	out, err := a.svc.PutObject(&s3.PutObjectInput{
+		Bucket:                    aws.String(a.bucket),
+		Key:                       aws.String(key),
+		Body:                      bytes.NewReader(data),
+		ContentMD5:                aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		ObjectLockMode:            aws.String(s3.ObjectLockModeCompliance),
+		ObjectLockRetainUntilDate: aws.Time(time.Now().Add(a.retention)),
+	})
+	if err != nil {
+		return "", err
+	}
+	id := "s3://" + a.bucket + "/" + key
+	if out.VersionId != nil {
+		id += "?versionId=" + url.QueryEscape(*out.VersionId)
+	}
+	return id, nil
+}
+
+func (a *s3Archive) Get(id string) ([]byte, error) {
+	u, err := url.Parse(id)
+	if err != nil || u.Scheme != "s3" {
+		return nil, errors.New("not an s3 object ID: " + id)
+	}
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	}
+	if v := u.Query().Get("versionId"); v != "" {
+		in.VersionId = aws.String(v)
+	}
+	out, err := a.svc.GetObject(in)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirArchivePutIsRetryable(t *testing.T) {
+	a, err := newDirArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`[{"index":1}]`)
+	id, err := a.Put("ranges/1-1.json", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a run retried after a crash writes the same object again
+	if again, err := a.Put("ranges/1-1.json", data); err != nil || again != id {
+		t.Errorf("writing the same object again: %s, %v", again, err)
+	}
+	if _, err := a.Put("ranges/1-1.json", []byte(`[{"index":2}]`)); err == nil {
+		t.Error("an archived object was replaced with other content")
+	}
+
+	if got, err := a.Get(id); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("archived object is %q, %v", got, err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(a.dir, "ranges"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("archive directory holds %d files, temporary files were left behind", len(files))
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one /validation call: who validated which block and
+// what the node answered. Admin requests are audited too: Action is the
+// request line, Hash the SHA-256 of the signed body and Result whether the
+// signature was accepted.
+type AuditEntry struct {
+	Time      string `json:"time"`
+	Client    string `json:"client"`
+	Hash      string `json:"hash"`
+	Event     string `json:"event"`
+	Result    bool   `json:"result"`
+	Action    string `json:"action,omitempty"`
+	Signer    string `json:"signer,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to files in AUDIT_DIR,
+// rotating to a new file once AUDIT_MAX_BYTES is reached and keeping the
+// newest AUDIT_KEEP files
+type auditLog struct {
+	dir      string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+var audit *auditLog
+var auditMutex = &sync.Mutex{}
+
+// auditChain optionally records every validation as a block on a secondary
+// chain (AUDIT_CHAIN=true), persisted in DATA_DIR/audit when DATA_DIR is set
+var auditChain []Block
+var auditStore Store
+
+// default and maximum entries returned by GET /audit
+const (
+	defaultAuditEntries = 100
+	maxAuditEntries     = 10000
+)
+
+// openAudit starts the validation audit when AUDIT_DIR is set
+func openAudit() error {
+	dir := os.Getenv("AUDIT_DIR")
+	if dir == "" {
+		return nil
+	}
+	a := &auditLog{dir: dir, maxBytes: 10 << 20, keep: 10}
+	if v := os.Getenv("AUDIT_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("AUDIT_MAX_BYTES must be a positive number")
+		}
+		a.maxBytes = n
+	}
+	if v := os.Getenv("AUDIT_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("AUDIT_KEEP must be a positive number")
+		}
+		a.keep = n
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := a.rotate(); err != nil {
+		return err
+	}
+	audit = a
+
+	if os.Getenv("AUDIT_CHAIN") == "true" {
+		if err := openAuditChain(); err != nil {
+			return err
+		}
+	}
+	log.Println("auditing validation requests to", dir)
+	return nil
+}
+
+// openAuditChain loads the audit chain or starts it with its own genesis block
+func openAuditChain() error {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		s, err := newStore(filepath.Join(dir, "audit"))
+		if err != nil {
+			return err
+		}
+		blocks, err := s.Load()
+		if err != nil {
+			s.Close()
+			return err
+		}
+		auditStore, auditChain = s, blocks
+	}
+	if len(auditChain) == 0 {
+		genesis := Block{Index: 0, Timestamp: time.Now().String(), Hash: calculateHash(Block{})}
+		if auditStore != nil {
+			if err := auditStore.Append(genesis); err != nil {
+				return err
+			}
+		}
+		auditChain = append(auditChain, genesis)
+	}
+	return nil
+}
+
+// rotate starts a new file and drops the oldest ones beyond keep
+func (a *auditLog) rotate() error {
+	if a.file != nil {
+		a.file.Close()
+	}
+	name := filepath.Join(a.dir, "audit-"+time.Now().UTC().Format("20060102T150405.000000000")+".jsonl")
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	a.file, a.size = f, 0
+
+	files, err := a.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > a.keep {
+		os.Remove(files[len(files)-1])
+		files = files[:len(files)-1]
+	}
+	return nil
+}
+
+// files lists the audit files, newest first
+func (a *auditLog) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.dir, "audit-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files, nil
+}
+
+func (a *auditLog) write(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if a.size+int64(len(line))+1 > a.maxBytes && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(append(line, '\n'))
+	a.size += int64(n)
+	return err
+}
+
+// recordValidation audits a /validation call, if auditing is enabled
+func recordValidation(r *http.Request, v ValidationReq, result bool) {
+	if audit == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Client: clientIP(r),
+		Hash:   v.Hash,
+		Event:  v.CreateMessage.Event,
+		Result: result,
+	}
+	if ids := peerIdentities(r); len(ids) > 0 {
+		e.Client = ids[0]
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if err := audit.write(e); err != nil {
+		log.Println("auditing validation failed:", err)
+	}
+	if auditChain != nil {
+		appendAuditBlock(e)
+	}
+}
+
+// recordAdminAction audits a signed admin request, if auditing is enabled
+func recordAdminAction(r *http.Request, signer string, body []byte, accepted bool) {
+	if audit == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Client:    clientIP(r),
+		Hash:      adminBodyHash(body),
+		Result:    accepted,
+		Action:    r.Method + " " + r.URL.Path,
+		Signer:    signer,
+		Signature: r.Header.Get("X-Admin-Signature"),
+	}
+	if ids := peerIdentities(r); len(ids) > 0 {
+		e.Client = ids[0]
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if err := audit.write(e); err != nil {
+		log.Println("auditing admin request failed:", err)
+	}
+	if auditChain != nil {
+		appendAuditBlock(e)
+	}
+}
+
+// auditHeld are entries waiting for an audit chain freeze to end
+var auditHeld []AuditEntry
+
+// appendAuditBlock records e on the audit chain. Caller must hold auditMutex.
+func appendAuditBlock(e AuditEntry) {
+	if _, frozen := frozenUntil(freezeAudit, time.Now()); frozen {
+		auditHeld = append(auditHeld, e)
+		return
+	}
+	event := "validation failed"
+	switch {
+	case e.Action != "" && e.Result:
+		event = "admin request " + e.Action
+	case e.Action != "":
+		event = "admin request refused " + e.Action
+	case e.Result:
+		event = "validation passed"
+	}
+	b := generateBlock(auditChain[len(auditChain)-1], "", e.Hash, event, e.Time, e.Client, nodeID())
+	if auditStore != nil {
+		if err := auditStore.Append(b); err != nil {
+			log.Println("persisting audit block failed:", err)
+			return
+		}
+	}
+	auditChain = append(auditChain, b)
+}
+
+// flushAuditHeld appends the entries held back during an audit chain freeze
+func flushAuditHeld() {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	held := auditHeld
+	auditHeld = nil
+	for _, e := range held {
+		appendAuditBlock(e)
+	}
+	if len(held) > 0 {
+		log.Println("appended", len(held), "audit entries held during the write freeze")
+	}
+}
+
+// query the audit with ?client=, ?hash=, ?result=true|false and ?n=
+// (default 100), newest first
+func handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "validation auditing is not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	n := defaultAuditEntries
+	if v := q.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditEntries {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxAuditEntries), http.StatusBadRequest)
+			return
+		}
+	}
+	match := func(e AuditEntry) bool {
+		if c := q.Get("client"); c != "" && e.Client != c {
+			return false
+		}
+		if h := q.Get("hash"); h != "" && !strings.HasPrefix(e.Hash, strings.ToLower(h)) {
+			return false
+		}
+		if res := q.Get("result"); res != "" && strconv.FormatBool(e.Result) != res {
+			return false
+		}
+		return true
+	}
+
+	auditMutex.Lock()
+	files, err := audit.files()
+	auditMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]AuditEntry, 0)
+	for _, name := range files {
+		if len(entries) >= n {
+			break
+		}
+		fileEntries, err := readAuditFile(name)
+		if err != nil {
+			// rotated away while we were reading
+			continue
+		}
+		for i := len(fileEntries) - 1; i >= 0 && len(entries) < n; i-- {
+			if match(fileEntries[i]) {
+				entries = append(entries, fileEntries[i])
+			}
+		}
+	}
+	respondWithList(w, r, http.StatusOK, entries)
+}
+
+func readAuditFile(name string) ([]AuditEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		// skip a line cut short by a crash
+		if unmarshalCompat(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// get the audit chain
+func handleGetAuditChain(w http.ResponseWriter, r *http.Request) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if auditChain == nil {
+		http.Error(w, "audit chain is not enabled", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, auditChain)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Backfill mode imports historical events. A write with "Backfill": true is
+// only accepted from an importer listed in BACKFILL_IMPORTERS: an
+// allowlisted client certificate identity or a device KeyID whose HMAC
+// checked out. Its block carries BackfilledBy with that identity, which is
+// hashed like every other field, and its EventTime may be older than
+// EVENT_TIME_MAX_AGE.
+
+var errBackfillNotAllowed = errors.New("backfill writes need an identity listed in BACKFILL_IMPORTERS")
+
+// authorizeBackfill records the importer of a backfill write in m. Call it
+// after the device HMAC was verified.
+func authorizeBackfill(r *http.Request, m *CreateBlockReq) error {
+	if !m.Backfill {
+		return nil
+	}
+	importers := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("BACKFILL_IMPORTERS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			importers[id] = true
+		}
+	}
+	if id, ok := peerIdentity(r); ok && importers[id] {
+		m.importer = id
+		return nil
+	}
+	if m.KeyID != "" && importers[m.KeyID] {
+		m.importer = m.KeyID
+		return nil
+	}
+	return errBackfillNotAllowed
+}
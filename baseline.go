@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Baseline is an exportable digest of the chain at one height, meant to be
+// notarized outside the node. MerkleRoot covers every block hash up to
+// Height; Checkpoints are optional hashes at earlier heights that let a
+// later comparison narrow down where the chains diverged.
+type Baseline struct {
+	Height      int        `json:"height"`
+	HeadHash    string     `json:"head_hash"`
+	MerkleRoot  string     `json:"merkle_root"`
+	Checkpoints []BlockRef `json:"checkpoints,omitempty"`
+}
+
+// BaselineComparison is the response of POST /compare-baseline. Extends is
+// true when the current chain contains the baseline unchanged. Otherwise
+// MatchesThrough is the highest height known to agree (-1 if none) and
+// DivergesAt the lowest height known to differ.
+type BaselineComparison struct {
+	Extends        bool   `json:"extends"`
+	Height         int    `json:"height"`
+	MatchesThrough int    `json:"matches_through"`
+	DivergesAt     int    `json:"diverges_at,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// merkleRoot is the root of a binary Merkle tree over block hashes. Leaves
+// and inner nodes are domain separated (0x00 and 0x01 prefixes) and an odd
+// node is promoted to the next level unchanged.
+func merkleRoot(hashes []string) string {
+	if len(hashes) == 0 {
+		return ""
+	}
+	level := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		sum := sha256.Sum256(append([]byte{0}, h...))
+		level[i] = sum[:]
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{1}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// baselineLocked builds the baseline at height with up to checkpoints
+// evenly spaced earlier hashes. Caller must hold mutex.
+func baselineLocked(height, checkpoints int) Baseline {
+	hashes := make([]string, height+1)
+	for i := range hashes {
+		hashes[i] = Blockchain[i].Hash
+	}
+	b := Baseline{Height: height, HeadHash: hashes[height], MerkleRoot: merkleRoot(hashes)}
+	if checkpoints > 0 && height > 0 {
+		step := height / (checkpoints + 1)
+		if step == 0 {
+			step = 1
+		}
+		for h := step; h < height && len(b.Checkpoints) < checkpoints; h += step {
+			b.Checkpoints = append(b.Checkpoints, BlockRef{h, hashes[h]})
+		}
+	}
+	return b
+}
+
+// export a baseline of the chain at ?height= (default the head) with
+// ?checkpoints= intermediate hashes
+func handleGetBaseline(w http.ResponseWriter, r *http.Request) {
+	checkpoints := 0
+	if v := r.URL.Query().Get("checkpoints"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 1000 {
+			http.Error(w, "checkpoints must be between 0 and 1000", http.StatusBadRequest)
+			return
+		}
+		checkpoints = n
+	}
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if v := r.URL.Query().Get("height"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > height {
+			mutex.Unlock()
+			http.Error(w, "height is not on the chain", http.StatusBadRequest)
+			return
+		}
+		height = n
+	}
+	b := baselineLocked(height, checkpoints)
+	mutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusOK, b)
+}
+
+// check that the current chain strictly extends a previously exported baseline
+func handleCompareBaseline(w http.ResponseWriter, r *http.Request) {
+	var base Baseline
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&base); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if base.Height < 0 || base.HeadHash == "" || base.MerkleRoot == "" {
+		http.Error(w, "Height, HeadHash and MerkleRoot are required", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	resp := compareBaselineLocked(base)
+	mutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
+
+// compareBaselineLocked compares base with the chain. Caller must hold mutex.
+func compareBaselineLocked(base Baseline) BaselineComparison {
+	resp := BaselineComparison{Height: len(Blockchain) - 1, MatchesThrough: -1}
+	if base.Height > resp.Height {
+		resp.Reason = "chain is shorter than the baseline"
+	}
+
+	// every hash commits to all earlier blocks, so agreement at a checkpoint
+	// means agreement up to it
+	for _, c := range base.Checkpoints {
+		if c.Index < 0 || c.Index > resp.Height || c.Index > base.Height {
+			continue
+		}
+		if Blockchain[c.Index].Hash == c.Hash {
+			if c.Index > resp.MatchesThrough {
+				resp.MatchesThrough = c.Index
+			}
+		} else if resp.DivergesAt == 0 || c.Index < resp.DivergesAt {
+			resp.DivergesAt = c.Index
+		}
+	}
+	if resp.Reason != "" {
+		return resp
+	}
+
+	ours := baselineLocked(base.Height, 0)
+	switch {
+	case ours.HeadHash != base.HeadHash:
+		resp.Reason = "hash at the baseline height differs"
+		if resp.DivergesAt == 0 || base.Height < resp.DivergesAt {
+			resp.DivergesAt = base.Height
+		}
+	case ours.MerkleRoot != base.MerkleRoot:
+		resp.Reason = "Merkle root differs although the head hash matches"
+	default:
+		resp.Extends = true
+		resp.MatchesThrough = base.Height
+		resp.DivergesAt = 0
+	}
+	return resp
+}
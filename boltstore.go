@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore is the STORAGE=bolt layout: a bbolt database in DATA_DIR/chain.db
+// with one key per block in the "blocks" bucket, the block's position as a
+// big-endian uint64, so a cursor walks them in chain order. Every append is
+// one transaction, which bbolt syncs before it returns, and a crash leaves
+// the database at the last committed block.
+type boltStore struct {
+	dir string
+	db  *bolt.DB
+}
+
+var boltBlocksBucket = []byte("blocks")
+
+func newBoltStore(dir string) (*boltStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// another node on the same DATA_DIR holds the file lock
+	db, err := bolt.Open(filepath.Join(dir, "chain.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{dir: dir, db: db}
+	empty := true
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltBlocksBucket)
+		if err != nil {
+			return err
+		}
+		k, _ := b.Cursor().Last()
+		empty = k == nil
+		return nil
+	})
+	if err == nil && empty {
+		err = s.importJSONL()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// importJSONL converts an existing chain.jsonl the first time STORAGE=bolt
+// is used on a data directory. chain.jsonl is left in place.
+func (s *boltStore) importJSONL() error {
+	if _, err := os.Stat(filepath.Join(s.dir, "chain.jsonl")); err != nil {
+		return nil
+	}
+	old, err := newFileStore(s.dir)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	blocks, err := old.Load()
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+	if err := s.AppendBatch(blocks); err != nil {
+		return err
+	}
+	log.Printf("imported %d blocks from chain.jsonl into chain.db; chain.jsonl is no longer used", len(blocks))
+	return nil
+}
+
+// putBlocks adds blocks after the last one in bucket
+func putBlocks(bucket *bolt.Bucket, blocks []Block) error {
+	for _, b := range blocks {
+		raw, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq-1)
+		if err := bucket.Put(key, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Append(b Block) error {
+	return s.AppendBatch([]Block{b})
+}
+
+// AppendBatch writes the blocks in one transaction and one sync
+func (s *boltStore) AppendBatch(blocks []Block) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putBlocks(tx.Bucket(boltBlocksBucket), blocks)
+	})
+}
+
+func (s *boltStore) Load() ([]Block, error) {
+	var blocks []Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlocksBucket).ForEach(func(k, v []byte) error {
+			var b Block
+			if err := unmarshalCompat(v, &b); err != nil {
+				return err
+			}
+			blocks = append(blocks, b)
+			return nil
+		})
+	})
+	return blocks, err
+}
+
+// Rewrite replaces the bucket in one transaction, so a crash keeps either
+// the old blocks or the new ones
+func (s *boltStore) Rewrite(blocks []Block) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltBlocksBucket); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists(boltBlocksBucket)
+		if err != nil {
+			return err
+		}
+		return putBlocks(bucket, blocks)
+	})
+}
+
+func (s *boltStore) SchemaVersion() (int, error) {
+	return readSchemaVersion(s.dir)
+}
+
+func (s *boltStore) SetSchemaVersion(v int) error {
+	return writeSchemaVersion(s.dir, v)
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
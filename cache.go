@@ -0,0 +1,88 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// A committed block never changes, so its serialized form can be cached
+// forever. blockCache keeps the most recently served representations, keyed
+// by hash plus the ?fields=, ?compact=, ?ts= and ?tz= options that shaped
+// them.
+type blockCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	max     int
+}
+
+type cachedBlock struct {
+	key  string
+	body []byte
+}
+
+// number of serialized blocks kept in memory
+const blockCacheSize = 4096
+
+var cachedBlocks = &blockCache{entries: make(map[string]*list.Element), order: list.New(), max: blockCacheSize}
+
+func (c *blockCache) get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBlock).body, true
+}
+
+func (c *blockCache) put(key string, body []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedBlock{key, body})
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedBlock).key)
+	}
+}
+
+// respondWithImmutableBlock serves a block looked up by its full hash with
+// strong caching headers, answering 304 when the client already has it
+func respondWithImmutableBlock(w http.ResponseWriter, r *http.Request, b Block) {
+	etag := `"` + b.Hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	setSizeHeaders(w, b)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	q := r.URL.Query()
+	key := b.Hash + "?" + q.Get("fields") + "&" + q.Get("compact") + "&" + q.Get("ts") + "&" + q.Get("tz")
+	if body, ok := cachedBlocks.get(key); ok {
+		w.Write(body)
+		return
+	}
+
+	payload, err := selectBlockFields(r, b)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := marshalResponse(r, payload)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cachedBlocks.put(key, body)
+	w.Write(body)
+}
@@ -0,0 +1,505 @@
+// Package client writes events to a blockchain node from instrumented
+// services. Writes are retried with exponential backoff under one
+// Idempotency-Key per event, so a retry after a timeout never produces a
+// second block, and a circuit breaker stops hammering a node that keeps
+// failing. Query reads events back, a page at a time.
+//
+//	c := client.New("https://node:8080")
+//	b, err := c.WriteBlock(ctx, client.CreateBlockReq{Event: "login", Server: "vpn-1"})
+//	logins, err := c.Query().Event("login").Server("vpn-*").All(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Block mirrors the node's block representation
+type Block struct {
+	Index        int
+	Timestamp    string
+	FileHash     string
+	Event        string
+	EventTime    string
+	Location     string
+	Server       string
+	Hash         string
+	PrevHash     string
+	DeviceKey    string          `json:",omitempty"`
+	DeviceHMAC   string          `json:",omitempty"`
+	BackfilledBy string          `json:",omitempty"`
+	Signer       string          `json:",omitempty"`
+	SignerCert   string          `json:",omitempty"`
+	Metadata     json.RawMessage `json:",omitempty"`
+	Difficulty   int             `json:",omitempty"`
+	Nonce        string          `json:",omitempty"`
+	// Transactions are the events of a batch block, MerkleRoot the root
+	// of the Merkle tree over their hashes
+	Transactions []Transaction `json:",omitempty"`
+	MerkleRoot   string        `json:",omitempty"`
+}
+
+// Transaction mirrors one event of a batch block
+type Transaction struct {
+	FileHash     string
+	Event        string
+	EventTime    string
+	Location     string
+	Server       string
+	DeviceKey    string          `json:",omitempty"`
+	DeviceHMAC   string          `json:",omitempty"`
+	BackfilledBy string          `json:",omitempty"`
+	Signer       string          `json:",omitempty"`
+	SignerCert   string          `json:",omitempty"`
+	Metadata     json.RawMessage `json:",omitempty"`
+}
+
+// UnmarshalJSON accepts transactions with either field naming
+func (tx *Transaction) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain Transaction
+	return json.Unmarshal(data, (*plain)(tx))
+}
+
+// CreateBlockReq mirrors the node's write payload
+type CreateBlockReq struct {
+	FileHash  string
+	Event     string
+	EventTime string
+	Location  string
+	Server    string
+	KeyID     string `json:",omitempty"`
+	HMAC      string `json:",omitempty"`
+	// SignedAt is when the device signed the event, see SignEvent
+	SignedAt string `json:",omitempty"`
+	// Backfill imports a historical event; the node must list the caller
+	// in BACKFILL_IMPORTERS
+	Backfill bool `json:",omitempty"`
+}
+
+// Receipt is the node's answer to a write: the block and the record its hash
+// was computed over with Algorithm
+type Receipt struct {
+	Block
+	Algorithm string
+	Record    string
+}
+
+// UnmarshalJSON accepts receipts with either field naming
+func (rc *Receipt) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain Receipt
+	return json.Unmarshal(data, (*plain)(rc))
+}
+
+// snakeCaseNames maps the snake_case keys of nodes running with
+// JSON_FIELD_NAMES=snake_case, and of their data files, to the field names
+// used here. Single word names match either way.
+var snakeCaseNames = map[string]string{
+	"file_hash":     "FileHash",
+	"event_time":    "EventTime",
+	"prev_hash":     "PrevHash",
+	"device_key":    "DeviceKey",
+	"device_hmac":   "DeviceHMAC",
+	"backfilled_by": "BackfilledBy",
+	"signer_cert":   "SignerCert",
+	"merkle_root":   "MerkleRoot",
+	"event_hash":    "EventHash",
+}
+
+// legacyKeys renames the snake_case keys of a JSON object
+func legacyKeys(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for snake, name := range snakeCaseNames {
+		if v, ok := fields[snake]; ok {
+			delete(fields, snake)
+			fields[name] = v
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// ErrReceiptMismatch means the node committed something, but its receipt
+// does not prove the block holds the submitted event. Retrying won't help.
+var ErrReceiptMismatch = errors.New("client: write receipt does not match the submitted event")
+
+// ErrCircuitOpen is returned without contacting the node while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("client: circuit open, node is failing")
+
+// StatusError is a response the node gave that retrying cannot fix
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: node answered %d: %s", e.Code, e.Message)
+}
+
+// Client writes blocks to one node. The zero value is not usable, use New.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// MaxAttempts bounds tries per write, including the first
+	MaxAttempts int
+	// BaseDelay is the first backoff, doubled per retry up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// FailureThreshold consecutive failed writes open the circuit for
+	// Cooldown; then one trial write decides whether it closes again
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// New returns a client with conservative defaults
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:          baseURL,
+		HTTPClient:       &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts:      5,
+		BaseDelay:        200 * time.Millisecond,
+		MaxDelay:         10 * time.Second,
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// WriteBlock submits an event and returns the block it was committed in,
+// after checking the receipt (see VerifyReceipt). Every attempt carries the
+// same Idempotency-Key.
+func (c *Client) WriteBlock(ctx context.Context, m CreateBlockReq) (Block, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return Block{}, err
+	}
+	return c.WriteBlockWithKey(ctx, m, key)
+}
+
+// WriteBlockWithKey is WriteBlock with a caller chosen Idempotency-Key, for
+// callers that persist events and may resubmit them after their own restart
+func (c *Client) WriteBlockWithKey(ctx context.Context, m CreateBlockReq, key string) (Block, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return Block{}, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < c.MaxAttempts; attempt++ {
+		if err := c.allow(); err != nil {
+			return Block{}, err
+		}
+		rc, retryAfter, err := c.post(ctx, body, key, m.KeyID)
+		if err == nil {
+			c.record(true)
+			if err := VerifyReceipt(m, rc); err != nil {
+				return rc.Block, err
+			}
+			return rc.Block, nil
+		}
+		var permanent *StatusError
+		if errors.As(err, &permanent) {
+			// the node is up, it just refused the event
+			c.record(true)
+			return Block{}, err
+		}
+		c.record(false)
+		lastErr = err
+
+		if attempt == c.MaxAttempts-1 {
+			break
+		}
+		delay := c.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return Block{}, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return Block{}, fmt.Errorf("client: giving up after %d attempts: %v", c.MaxAttempts, lastErr)
+}
+
+// post makes one attempt. Retryable failures come back as plain errors with
+// the node's Retry-After, if any. Writes signed with a device key name it in
+// Device-Key, which gives them priority on a busy node.
+func (c *Client) post(ctx context.Context, body []byte, key, deviceKey string) (Receipt, time.Duration, error) {
+	var b Receipt
+	req, err := http.NewRequest("POST", c.BaseURL+"/block", bytes.NewReader(body))
+	if err != nil {
+		return b, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if deviceKey != "" {
+		req.Header.Set("Device-Key", deviceKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return b, 0, err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return b, 0, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		err = json.Unmarshal(msg, &b)
+		return b, 0, err
+	case resp.StatusCode == http.StatusConflict,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		// 409 is a lost race for the head or a concurrent retry of this key
+		retryAfter := time.Duration(0)
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(s) * time.Second
+		}
+		return b, retryAfter, fmt.Errorf("node answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return b, 0, &StatusError{resp.StatusCode, string(bytes.TrimSpace(msg))}
+	}
+}
+
+// backoff is the full-jitter delay before retry number attempt+1
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.BaseDelay << uint(attempt)
+	if d <= 0 || d > c.MaxDelay {
+		d = c.MaxDelay
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d)+1))
+	if err != nil {
+		return d
+	}
+	return time.Duration(n.Int64())
+}
+
+// allow reports whether a write may be attempted now
+func (c *Client) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.FailureThreshold {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.trial {
+		return ErrCircuitOpen
+	}
+	// half open: let one trial through
+	c.trial = true
+	return nil
+}
+
+// record updates the breaker with the outcome of one attempt
+func (c *Client) record(ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+	if ok {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.FailureThreshold {
+		c.openUntil = time.Now().Add(c.Cooldown)
+	}
+}
+
+func newIdempotencyKey() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// hash algorithms a node may use, see the node's reanchor.go
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256":     sha256.New,
+	"sha512-256": sha512.New512_256,
+	"sha384":     sha512.New384,
+}
+
+// VerifyReceipt recomputes the block hash from the receipt and checks that
+// the block records the submitted event (after the node's NFC
+// normalization), so a receipt can be trusted without asking the node again
+func VerifyReceipt(m CreateBlockReq, rc Receipt) error {
+	if err := verifyRecord(rc); err != nil {
+		return err
+	}
+	b := rc.Block
+
+	// nodes normalize unless EVENT_NORMALIZATION=none
+	same := func(got, sent string) bool { return got == sent || got == norm.NFC.String(sent) }
+	holds := func(fileHash, event, eventTime, location, server, deviceKey, backfilledBy string) bool {
+		return same(fileHash, m.FileHash) && same(event, m.Event) && same(eventTime, m.EventTime) &&
+			same(location, m.Location) && same(server, m.Server) && deviceKey == m.KeyID &&
+			(backfilledBy != "") == m.Backfill
+	}
+	if len(b.Transactions) == 0 {
+		if !holds(b.FileHash, b.Event, b.EventTime, b.Location, b.Server, b.DeviceKey, b.BackfilledBy) {
+			return ErrReceiptMismatch
+		}
+		return nil
+	}
+
+	// a batch block holds the event as one of its transactions
+	if TransactionsRoot(b.Transactions) != b.MerkleRoot {
+		return ErrReceiptMismatch
+	}
+	for _, tx := range b.Transactions {
+		if holds(tx.FileHash, tx.Event, tx.EventTime, tx.Location, tx.Server, tx.DeviceKey, tx.BackfilledBy) {
+			return nil
+		}
+	}
+	return ErrReceiptMismatch
+}
+
+// verifyRecord checks that the receipt's record is the block's and hashes
+// to the block hash
+func verifyRecord(rc Receipt) error {
+	if rc.Record != blockRecord(rc.Block) {
+		return ErrReceiptMismatch
+	}
+	newHash, ok := hashAlgorithms[rc.Algorithm]
+	if !ok {
+		return fmt.Errorf("client: receipt uses unknown hash algorithm %q", rc.Algorithm)
+	}
+	h := newHash()
+	h.Write([]byte(rc.Record))
+	sum := hex.EncodeToString(h.Sum(nil))
+	if rc.Algorithm != "sha256" {
+		sum = rc.Algorithm + ":" + sum
+	}
+	if sum != rc.Block.Hash {
+		return ErrReceiptMismatch
+	}
+	return nil
+}
+
+// SignEvent signs m with a device key as of now: the node accepts the MAC
+// once, within five minutes of its own clock
+func SignEvent(m CreateBlockReq, keyID string, secret []byte, now time.Time) CreateBlockReq {
+	m.KeyID, m.SignedAt = keyID, now.UTC().Format(time.RFC3339)
+	mac := hmac.New(sha256.New, secret)
+	for _, f := range []string{m.FileHash, m.Event, m.EventTime, m.Location, m.Server, m.SignedAt} {
+		mac.Write([]byte(strconv.Itoa(len(f)) + ":" + f + ","))
+	}
+	m.HMAC = hex.EncodeToString(mac.Sum(nil))
+	return m
+}
+
+// TransactionHash is the hash of tx the node builds its Merkle tree over:
+// the SHA-256 of its compact JSON encoding under the snake_case names
+func TransactionHash(tx Transaction) string {
+	data, err := json.Marshal(struct {
+		FileHash     string          `json:"file_hash"`
+		Event        string          `json:"event"`
+		EventTime    string          `json:"event_time"`
+		Location     string          `json:"location"`
+		Server       string          `json:"server"`
+		DeviceKey    string          `json:"device_key,omitempty"`
+		DeviceHMAC   string          `json:"device_hmac,omitempty"`
+		BackfilledBy string          `json:"backfilled_by,omitempty"`
+		Signer       string          `json:"signer,omitempty"`
+		SignerCert   string          `json:"signer_cert,omitempty"`
+		Metadata     json.RawMessage `json:"metadata,omitempty"`
+	}(tx))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TransactionsRoot is the Merkle root the node computes over txs. Leaves
+// and inner nodes are domain separated (0x00 and 0x01 prefixes) and an odd
+// node is promoted to the next level unchanged.
+func TransactionsRoot(txs []Transaction) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	level := make([][]byte, len(txs))
+	for i, tx := range txs {
+		sum := sha256.Sum256(append([]byte{0}, TransactionHash(tx)...))
+		level[i] = sum[:]
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{1}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// blockRecord must match the node's
+func blockRecord(b Block) string {
+	record := strconv.Itoa(b.Index) + b.Timestamp + b.FileHash + b.Event + b.EventTime + b.Location + b.Server + b.PrevHash
+	if b.DeviceKey != "" {
+		record += b.DeviceKey + b.DeviceHMAC
+	}
+	if b.BackfilledBy != "" {
+		record += "backfill" + b.BackfilledBy
+	}
+	if b.SignerCert != "" {
+		record += "cms" + b.SignerCert + b.Signer
+	}
+	if len(b.Metadata) > 0 {
+		var buf bytes.Buffer
+		if json.Compact(&buf, b.Metadata) == nil {
+			record += "meta" + buf.String()
+		} else {
+			record += "meta" + string(b.Metadata)
+		}
+	}
+	if b.MerkleRoot != "" {
+		record += "merkle" + b.MerkleRoot
+	}
+	if b.Difficulty > 0 {
+		record += "pow" + strconv.Itoa(b.Difficulty) + ":" + b.Nonce
+	}
+	return record
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// ErrProofMismatch means an inclusion proof does not prove its event is in
+// the block it names
+var ErrProofMismatch = errors.New("client: inclusion proof does not match its block")
+
+// ProofStep is the sibling of the path's node at one level of the tree.
+// Left is set when the sibling is the left child.
+type ProofStep struct {
+	Hash string
+	Left bool `json:",omitempty"`
+}
+
+// Proof shows that a batch block holds an event: the event, the Merkle
+// audit path from its hash to the block's MerkleRoot, and the block header
+// with the record its hash is computed over
+type Proof struct {
+	EventHash   string
+	Transaction Transaction
+	Position    int
+	Count       int
+	Path        []ProofStep
+	Header      Receipt
+}
+
+// UnmarshalJSON accepts proofs with either field naming
+func (p *Proof) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain Proof
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// Proof fetches the inclusion proof of the event with the given transaction
+// hash, see TransactionHash. Check it with VerifyProof before trusting it.
+func (c *Client) Proof(ctx context.Context, eventHash string) (Proof, error) {
+	var p Proof
+	req, err := http.NewRequest("GET", c.BaseURL+"/proof/"+url.PathEscape(eventHash), nil)
+	if err != nil {
+		return p, err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return p, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return p, &StatusError{resp.StatusCode, string(bytes.TrimSpace(msg))}
+	}
+	err = json.Unmarshal(msg, &p)
+	return p, err
+}
+
+// VerifyProof checks an inclusion proof offline: the transaction hashes to
+// EventHash, the audit path leads from it to the header's MerkleRoot, and
+// the header's record hashes to the block hash. A verified proof together
+// with a trusted block hash (e.g. a published chain head that links to it)
+// proves the event was committed.
+func VerifyProof(p Proof) error {
+	if TransactionHash(p.Transaction) != p.EventHash {
+		return ErrProofMismatch
+	}
+	leaf := sha256.Sum256(append([]byte{0}, p.EventHash...))
+	node := leaf[:]
+	for _, step := range p.Path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return ErrProofMismatch
+		}
+		pair := []byte{1}
+		if step.Left {
+			pair = append(append(pair, sibling...), node...)
+		} else {
+			pair = append(append(pair, node...), sibling...)
+		}
+		sum := sha256.Sum256(pair)
+		node = sum[:]
+	}
+	if p.Header.MerkleRoot == "" || hex.EncodeToString(node) != p.Header.MerkleRoot {
+		return ErrProofMismatch
+	}
+	if err := verifyRecord(p.Header); err != nil {
+		return ErrProofMismatch
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Query finds blocks by field and commit time:
+//
+//	s := c.Query().Event("unauthorized access").Server("vpn-*").Between(t1, t2).Stream(ctx)
+//	for s.Next() {
+//		b := s.Block()
+//	}
+//	err := s.Err()
+//
+// Field patterns match the whole value and * matches any run of
+// characters. The whole words of the patterns are looked up with the node's
+// GET /search, and the candidates are checked against the patterns and the
+// time range here. A query without a whole word to look up, like
+// Server("vpn*") alone, walks GET /blocks/latest instead. Either way blocks
+// come newest first, a page at a time, fetched as the stream is read.
+type Query struct {
+	c        *Client
+	fields   []fieldPattern
+	from, to time.Time
+	pageSize int
+}
+
+// fieldPattern is a wildcard pattern for one block field
+type fieldPattern struct {
+	field   string
+	pattern string
+}
+
+// the node's maximum page size
+const maxPageSize = 1000
+
+// Query starts an empty query, which matches every block
+func (c *Client) Query() *Query {
+	return &Query{c: c, pageSize: 100}
+}
+
+func (q *Query) match(field, pattern string) *Query {
+	// nodes store events NFC normalized unless EVENT_NORMALIZATION=none
+	q.fields = append(q.fields, fieldPattern{field, norm.NFC.String(pattern)})
+	return q
+}
+
+// Event matches the event name
+func (q *Query) Event(pattern string) *Query { return q.match("Event", pattern) }
+
+// Server matches the reporting server
+func (q *Query) Server(pattern string) *Query { return q.match("Server", pattern) }
+
+// Location matches the event location
+func (q *Query) Location(pattern string) *Query { return q.match("Location", pattern) }
+
+// FileHash matches the recorded file hash
+func (q *Query) FileHash(pattern string) *Query { return q.match("FileHash", pattern) }
+
+// Between keeps blocks committed from from up to and including to. A zero
+// time leaves that end open.
+func (q *Query) Between(from, to time.Time) *Query {
+	q.from, q.to = from, to
+	return q
+}
+
+// PageSize sets how many blocks each request fetches, 100 by default
+func (q *Query) PageSize(n int) *Query {
+	if n > 0 && n <= maxPageSize {
+		q.pageSize = n
+	}
+	return q
+}
+
+// Stream runs the query. Nothing is fetched until Next is called.
+func (q *Query) Stream(ctx context.Context) *BlockStream {
+	return &BlockStream{ctx: ctx, q: q, words: q.words(), before: -1}
+}
+
+// All reads the whole stream
+func (q *Query) All(ctx context.Context) ([]Block, error) {
+	var blocks []Block
+	s := q.Stream(ctx)
+	for s.Next() {
+		blocks = append(blocks, s.Block())
+	}
+	return blocks, s.Err()
+}
+
+// words are the whole words of the patterns, as the node's search index
+// splits them. Words touching a * may be partial and are left out.
+func (q *Query) words() []string {
+	var words []string
+	for _, f := range q.fields {
+		pieces := strings.Split(f.pattern, "*")
+		for i, piece := range pieces {
+			ws := strings.FieldsFunc(strings.ToLower(piece), notWordRune)
+			if i > 0 && len(ws) > 0 && !startsWithSeparator(piece) {
+				ws = ws[1:]
+			}
+			if i < len(pieces)-1 && len(ws) > 0 && !endsWithSeparator(piece) {
+				ws = ws[:len(ws)-1]
+			}
+			words = append(words, ws...)
+		}
+	}
+	return words
+}
+
+func notWordRune(c rune) bool {
+	return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+}
+
+func startsWithSeparator(s string) bool {
+	return strings.IndexFunc(s, notWordRune) == 0
+}
+
+func endsWithSeparator(s string) bool {
+	return s != "" && strings.LastIndexFunc(s, notWordRune) == len(s)-1
+}
+
+// matches checks b against the patterns and the time range
+func (q *Query) matches(b Block) bool {
+	for _, f := range q.fields {
+		var v string
+		switch f.field {
+		case "Event":
+			v = b.Event
+		case "Server":
+			v = b.Server
+		case "Location":
+			v = b.Location
+		case "FileHash":
+			v = b.FileHash
+		}
+		if !matchWildcard(f.pattern, v) {
+			return false
+		}
+	}
+	if t, ok := blockTime(b); ok {
+		if (!q.from.IsZero() && t.Before(q.from)) || (!q.to.IsZero() && t.After(q.to)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchWildcard matches s against pattern, where * matches any run of
+// characters and everything else itself
+func matchWildcard(pattern, s string) bool {
+	pieces := strings.Split(pattern, "*")
+	if len(pieces) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, pieces[0]) {
+		return false
+	}
+	s = s[len(pieces[0]):]
+	for _, piece := range pieces[1 : len(pieces)-1] {
+		i := strings.Index(s, piece)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(piece):]
+	}
+	return strings.HasSuffix(s, pieces[len(pieces)-1])
+}
+
+// blockTimeLayout must match the node's
+const blockTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// blockTime parses a block's commit Timestamp
+func blockTime(b Block) (time.Time, bool) {
+	ts := b.Timestamp
+	if i := strings.Index(ts, " m="); i >= 0 {
+		ts = ts[:i]
+	}
+	t, err := time.Parse(blockTimeLayout, ts)
+	return t, err == nil
+}
+
+// BlockStream reads the results of a Query, fetching pages as needed
+type BlockStream struct {
+	ctx    context.Context
+	q      *Query
+	words  []string
+	page   []Block
+	block  Block
+	before int // index the next page stops below, -1 for the head
+	done   bool
+	err    error
+}
+
+// Next advances to the next matching block and reports whether there is one
+func (s *BlockStream) Next() bool {
+	for s.err == nil {
+		if len(s.page) == 0 {
+			if s.done {
+				return false
+			}
+			s.fetch()
+			continue
+		}
+		b := s.page[0]
+		s.page = s.page[1:]
+		// newest first: once a block is older than the range, all the rest are
+		if t, ok := blockTime(b); ok && !s.q.from.IsZero() && t.Before(s.q.from) {
+			s.done, s.page = true, nil
+			return false
+		}
+		if s.q.matches(b) {
+			s.block = b
+			return true
+		}
+	}
+	return false
+}
+
+// Block is the block Next moved to
+func (s *BlockStream) Block() Block {
+	return s.block
+}
+
+// Err is the error that ended the stream, if any
+func (s *BlockStream) Err() error {
+	return s.err
+}
+
+// fetch gets the page below s.before from GET /search, or GET /blocks/latest
+// when there are no words to look up
+func (s *BlockStream) fetch() {
+	path := "/blocks/latest"
+	params := url.Values{"n": {strconv.Itoa(s.q.pageSize)}}
+	if len(s.words) > 0 {
+		path = "/search"
+		params.Set("q", strings.Join(s.words, " "))
+	}
+	if s.before >= 0 {
+		params.Set("before", strconv.Itoa(s.before))
+	}
+	blocks, err := s.q.c.getBlocks(s.ctx, path+"?"+params.Encode())
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.page = blocks
+	if len(blocks) < s.q.pageSize {
+		s.done = true
+	} else {
+		s.before = blocks[len(blocks)-1].Index
+	}
+	if s.before == 0 {
+		s.done = true
+	}
+}
+
+// getBlocks reads a list of blocks from the node
+func (c *Client) getBlocks(ctx context.Context, path string) ([]Block, error) {
+	req, err := http.NewRequest("GET", c.BaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{resp.StatusCode, string(bytes.TrimSpace(msg))}
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(msg, &raw); err != nil {
+		return nil, err
+	}
+	blocks := make([]Block, len(raw))
+	for i, r := range raw {
+		data, err := legacyKeys(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &blocks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// layout of time.Time.String(), which block timestamps are written with
+const blockTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// default for BLOCK_TIME_TOLERANCE, how far a new block may be stamped
+// before its predecessor
+const defaultBlockTimeTolerance = time.Second
+
+// clockBase anchors block timestamps: later readings add the monotonic time
+// elapsed since start, so wall clock steps can't move block time backwards
+var clockBase = time.Now()
+
+// blockClock returns the current time for stamping blocks
+func blockClock() time.Time {
+	return clockBase.Add(time.Since(clockBase))
+}
+
+// parseBlockTime parses a block Timestamp, ignoring the monotonic clock
+// reading ("m=+1.23") that time.Time.String() appends
+func parseBlockTime(ts string) (time.Time, bool) {
+	if i := strings.Index(ts, " m="); i >= 0 {
+		ts = ts[:i]
+	}
+	t, err := time.Parse(blockTimeLayout, ts)
+	return t, err == nil
+}
+
+// blockTimeTolerance reads BLOCK_TIME_TOLERANCE on every call so it can be
+// hot reloaded
+func blockTimeTolerance() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("BLOCK_TIME_TOLERANCE"))
+	if err != nil || d < 0 {
+		return defaultBlockTimeTolerance
+	}
+	return d
+}
+
+// isBlockTimeValid rejects a block stamped earlier than its predecessor by
+// more than the tolerance. Timestamps that don't parse, like a custom
+// GENESIS_TIMESTAMP, are not compared. It only judges new writes: blocks
+// already committed, loaded at startup, synced or gossiped from peers or
+// applied from the Raft log, were judged by the node that took them, and a
+// different tolerance here must not split the chain.
+func isBlockTimeValid(newBlock, oldBlock Block) bool {
+	newTime, ok1 := parseBlockTime(newBlock.Timestamp)
+	oldTime, ok2 := parseBlockTime(oldBlock.Timestamp)
+	if !ok1 || !ok2 {
+		return true
+	}
+	return !newTime.Before(oldTime.Add(-blockTimeTolerance()))
+}
+
+// nextBlockTime stamps a block following prev, never earlier than prev even
+// if the node restarted with a clock that is behind
+func nextBlockTime(prev Block) string {
+	now := blockClock()
+	if prevTime, ok := parseBlockTime(prev.Timestamp); ok && now.Before(prevTime) {
+		return prevTime.String()
+	}
+	return now.String()
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// CONSENSUS=raft runs the node as a member of a replicated cluster, for
+// high availability without mining or validator votes. The members elect a
+// leader over RAFT_ADDR; only the leader accepts writes, and every block it
+// mints is committed through the Raft log before any member appends it, so
+// all members hold the same chain and serve reads from it. Writes sent to a
+// follower get 503 naming the leader, and a new leader takes over when the
+// old one is lost while a majority of members is up.
+//
+// The first member starts with RAFT_BOOTSTRAP=true; the others are added
+// with POST /cluster/join on the leader and removed with DELETE
+// /cluster/members/{id}. The Raft log and snapshots of the chain live in
+// RAFT_DIR (default DATA_DIR/raft). Members replicate through Raft only, so
+// PEERS, STANDBY_PRIMARY, GROUP_COMMIT_WINDOW and FREEZE_WINDOWS are refused.
+//
+// Raft traffic is mutual TLS: every member presents TLS_CERT_FILE and
+// accepts only members whose certificate TLS_CLIENT_CA_FILE signed, for the
+// host of their RAFT_ADDR.
+
+// how long a write waits for the Raft log to commit it
+const raftApplyTimeout = 10 * time.Second
+
+var errNotLeader = errors.New("this cluster member is not the leader")
+
+var (
+	raftNode *raft.Raft
+	// serializes minting on the leader, each block builds on the last one
+	raftMutex = &sync.Mutex{}
+)
+
+// raftCommand is one entry of the Raft log. Block 1 carries the leader's
+// genesis block, see adoptGenesis.
+type raftCommand struct {
+	Block   Block  `json:"block"`
+	Genesis *Block `json:"genesis,omitempty"`
+}
+
+// ClusterMember is one member of the Raft configuration
+type ClusterMember struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// ClusterStatus is the response of GET /cluster
+type ClusterStatus struct {
+	ID      string          `json:"id"`
+	State   string          `json:"state"`
+	Leader  string          `json:"leader"`
+	Applied uint64          `json:"applied"`
+	LastLog uint64          `json:"last_log"`
+	Members []ClusterMember `json:"members"`
+}
+
+// ClusterJoinReq asks the leader to add a member. Address is its RAFT_ADDR.
+type ClusterJoinReq struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+func raftEnabled() bool {
+	return os.Getenv("CONSENSUS") == "raft"
+}
+
+// startRaft joins the Raft cluster. Call after createGenesisBlock.
+func startRaft() error {
+	if !raftEnabled() {
+		return nil
+	}
+	for _, key := range []string{"PEERS", "STANDBY_PRIMARY", "GROUP_COMMIT_WINDOW", "FREEZE_WINDOWS"} {
+		if os.Getenv(key) != "" {
+			return errors.New(key + " is not supported with CONSENSUS=raft, members replicate through the Raft log")
+		}
+	}
+	dir := os.Getenv("RAFT_DIR")
+	if dir == "" {
+		if os.Getenv("DATA_DIR") == "" {
+			return errors.New("CONSENSUS=raft requires RAFT_DIR or DATA_DIR")
+		}
+		dir = filepath.Join(os.Getenv("DATA_DIR"), "raft")
+	}
+	addr := os.Getenv("RAFT_ADDR")
+	if addr == "" {
+		return errors.New("CONSENSUS=raft requires RAFT_ADDR, the host:port other members reach this node on")
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	bind := os.Getenv("RAFT_BIND")
+	if bind == "" {
+		bind = addr
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	stream, err := newTLSStreamLayer(bind, advertise)
+	if err != nil {
+		return err
+	}
+	transport := raft.NewNetworkTransport(stream, 3, 10*time.Second, os.Stderr)
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return err
+	}
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(nodeID())
+	r, err := raft.NewRaft(config, &chainFSM{}, logs, logs, snapshots, transport)
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("RAFT_BOOTSTRAP") == "true" {
+		existing, err := raft.HasExistingState(logs, logs, snapshots)
+		if err != nil {
+			return err
+		}
+		if !existing {
+			servers := []raft.Server{{Suffrage: raft.Voter, ID: config.LocalID, Address: transport.LocalAddr()}}
+			if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+				return err
+			}
+			log.Println("bootstrapped a raft cluster as", config.LocalID)
+		}
+	}
+	raftNode = r
+	log.Println("raft member", config.LocalID, "listening on", addr)
+	return nil
+}
+
+// tlsStreamLayer carries the Raft transport over mutual TLS
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	client    *tls.Config
+}
+
+// newTLSStreamLayer listens on bind with the node's TLS config, requiring a
+// client certificate, and dials other members with the node certificate
+func newTLSStreamLayer(bind string, advertise net.Addr) (*tlsStreamLayer, error) {
+	server, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(server.Certificates) == 0 || server.ClientCAs == nil {
+		return nil, errors.New("CONSENSUS=raft requires TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE")
+	}
+	server = server.Clone()
+	server.ClientAuth = tls.RequireAndVerifyClientCert
+	client := &tls.Config{
+		Certificates: server.Certificates,
+		RootCAs:      server.ClientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	l, err := tls.Listen("tcp", bind, server)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsStreamLayer{l, advertise, client}, nil
+}
+
+// Addr is the address other members reach this one on, RAFT_ADDR
+func (s *tlsStreamLayer) Addr() net.Addr {
+	return s.advertise
+}
+
+// Dial connects to a member, verifying its certificate for the host of its
+// address
+func (s *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(string(address))
+	if err != nil {
+		return nil, err
+	}
+	config := s.client.Clone()
+	config.ServerName = host
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), config)
+}
+
+// addBlockRaft mints m on the leader and commits it through the Raft log.
+// The block is appended once the log applies it, on every member alike.
+func addBlockRaft(m CreateBlockReq, timestamp string) (Block, error) {
+	if raftNode.State() != raft.Leader {
+		return Block{}, errNotLeader
+	}
+	raftMutex.Lock()
+	defer raftMutex.Unlock()
+
+	// a new leader may not have applied all it committed yet
+	if raftNode.AppliedIndex() < raftNode.LastIndex() {
+		if err := raftNode.Barrier(raftApplyTimeout).Error(); err != nil {
+			return Block{}, raftError(err)
+		}
+	}
+
+	mutex.Lock()
+	if len(Blockchain) == 0 {
+		mutex.Unlock()
+		return Block{}, errChainNotReady
+	}
+	b, err := mintBlock(Blockchain[len(Blockchain)-1], m, timestamp)
+	cmd := raftCommand{Block: b}
+	if b.Index == 1 {
+		genesis := Blockchain[0]
+		cmd.Genesis = &genesis
+	}
+	mutex.Unlock()
+	if err != nil {
+		return Block{}, err
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return Block{}, err
+	}
+	f := raftNode.Apply(data, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return Block{}, raftError(err)
+	}
+	if err, ok := f.Response().(error); ok {
+		return Block{}, err
+	}
+	return b, nil
+}
+
+// raftError turns losing the leadership into errNotLeader
+func raftError(err error) error {
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return errNotLeader
+	}
+	return err
+}
+
+// raftLeader names the leader for errors sent to clients, empty during an
+// election
+func raftLeader() string {
+	if raftNode == nil {
+		return ""
+	}
+	addr, id := raftNode.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	return string(id) + " (" + string(addr) + ")"
+}
+
+// chainFSM applies the Raft log to the chain
+type chainFSM struct{}
+
+// Apply appends a committed block. At restart Raft replays entries the
+// store already holds, those are skipped. The leader validated the block
+// when it minted it; members only check what the entry itself proves, so
+// their clocks and settings can't make them drop an entry the others apply.
+func (f *chainFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if cmd.Genesis != nil {
+		if _, err := adoptGenesisLocked(*cmd.Genesis); err != nil {
+			return err
+		}
+	}
+	b := cmd.Block
+	if b.Index < len(Blockchain) && Blockchain[b.Index].Hash == b.Hash {
+		return nil
+	}
+	if err := appendCommittedLocked(b); err != nil {
+		log.Printf("applying raft entry %d (block %d) failed: %v", l.Index, b.Index, err)
+		return err
+	}
+	return nil
+}
+
+// Snapshot captures the chain, which holds all the applied entries
+func (f *chainFSM) Snapshot() (raft.FSMSnapshot, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return chainSnapshot(append([]Block(nil), Blockchain...)), nil
+}
+
+// Restore replaces the chain with a snapshot from the leader, unless the
+// chain already holds it
+func (f *chainFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var blocks []Block
+	dec := json.NewDecoder(rc)
+	for {
+		var b Block
+		if err := dec.Decode(&b); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		blocks = append(blocks, b)
+	}
+	if len(blocks) == 0 {
+		return errors.New("raft snapshot holds no blocks")
+	}
+	if err := verifyChain(blocks); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	last := blocks[len(blocks)-1]
+	if last.Index < len(Blockchain) && Blockchain[last.Index].Hash == last.Hash {
+		return nil
+	}
+	if store != nil {
+		if err := store.Rewrite(blocks); err != nil {
+			return err
+		}
+	}
+	Blockchain = blocks
+	reindexLocked()
+	log.Printf("restored %d blocks from a raft snapshot", len(blocks))
+	return nil
+}
+
+// chainSnapshot is a snapshot of the chain, written one JSON block per line
+type chainSnapshot []Block
+
+func (s chainSnapshot) Persist(sink raft.SnapshotSink) error {
+	enc := json.NewEncoder(sink)
+	for _, b := range s {
+		if err := enc.Encode(b); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+func (s chainSnapshot) Release() {}
+
+// report this member's view of the cluster
+func handleGetCluster(w http.ResponseWriter, r *http.Request) {
+	if raftNode == nil {
+		http.Error(w, "cluster mode is not enabled", http.StatusNotFound)
+		return
+	}
+	_, leader := raftNode.LeaderWithID()
+	s := ClusterStatus{
+		ID:      nodeID(),
+		State:   raftNode.State().String(),
+		Leader:  string(leader),
+		Applied: raftNode.AppliedIndex(),
+		LastLog: raftNode.LastIndex(),
+		Members: make([]ClusterMember, 0),
+	}
+	f := raftNode.GetConfiguration()
+	if err := f.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, srv := range f.Configuration().Servers {
+		s.Members = append(s.Members, ClusterMember{string(srv.ID), string(srv.Address), srv.Suffrage == raft.Voter, srv.ID == leader})
+	}
+	respondWithJSON(w, r, http.StatusOK, s)
+}
+
+// add a voting member, on the leader
+func handleClusterJoin(w http.ResponseWriter, r *http.Request) {
+	if raftNode == nil {
+		http.Error(w, "cluster mode is not enabled", http.StatusNotFound)
+		return
+	}
+	var req ClusterJoinReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(req.Address); err != nil {
+		http.Error(w, "address must be the member's RAFT_ADDR host:port", http.StatusBadRequest)
+		return
+	}
+	err := raftNode.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.Address), 0, raftApplyTimeout).Error()
+	if err != nil {
+		respondWithError(w, raftError(err))
+		return
+	}
+	log.Println("added cluster member", req.ID, "at", req.Address)
+	handleGetCluster(w, r)
+}
+
+// remove a member, on the leader
+func handleClusterLeave(w http.ResponseWriter, r *http.Request) {
+	if raftNode == nil {
+		http.Error(w, "cluster mode is not enabled", http.StatusNotFound)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := raftNode.RemoveServer(raft.ServerID(id), 0, raftApplyTimeout).Error(); err != nil {
+		respondWithError(w, raftError(err))
+		return
+	}
+	log.Println("removed cluster member", id)
+	handleGetCluster(w, r)
+}
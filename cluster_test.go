@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestRaftApplyIgnoresBlockTimeTolerance(t *testing.T) {
+	newTestChain(t)
+	t.Setenv("BLOCK_TIME_TOLERANCE", "0s")
+	mutex.Lock()
+	genesis := Blockchain[0]
+	mutex.Unlock()
+	genesisTime, ok := parseBlockTime(genesis.Timestamp)
+	if !ok {
+		t.Fatalf("genesis timestamp %q doesn't parse", genesis.Timestamp)
+	}
+
+	// stamped by a leader whose clock is behind ours
+	b, err := mintBlock(genesis, CreateBlockReq{Event: "login", EventTime: "2024-01-01T00:00:00Z", Server: "s1"}, genesisTime.Add(-time.Hour).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validateBlock(b, genesis) == nil {
+		t.Fatal("the block passes the write time tolerance, the test proves nothing")
+	}
+	data, err := json.Marshal(raftCommand{Block: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := (&chainFSM{}).Apply(&raft.Log{Index: 1, Data: data}).(error); err != nil {
+		t.Fatalf("applying a committed entry failed on this member: %v", err)
+	}
+	mutex.Lock()
+	height := len(Blockchain)
+	mutex.Unlock()
+	if height != 2 {
+		t.Errorf("chain holds %d blocks after the entry", height)
+	}
+}
+
+func TestRaftTransportNeedsClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificates(t, dir)
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "node.crt"))
+	t.Setenv("TLS_KEY_FILE", filepath.Join(dir, "node.key"))
+	t.Setenv("TLS_CLIENT_CA_FILE", filepath.Join(dir, "ca.crt"))
+
+	stream, err := newTLSStreamLayer("127.0.0.1:0", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	go func() {
+		for {
+			conn, err := stream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	reply := func(conn net.Conn) (string, error) {
+		defer conn.Close()
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(conn, buf)
+		return string(buf), err
+	}
+
+	conn, err := stream.Dial(raft.ServerAddress(stream.Listener.Addr().String()), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reply(conn); err != nil || got != "ok" {
+		t.Errorf("member to member: %q, %v", got, err)
+	}
+
+	anonymous, err := tls.Dial("tcp", stream.Listener.Addr().String(), &tls.Config{RootCAs: stream.client.RootCAs, ServerName: "127.0.0.1"})
+	if err == nil {
+		if _, err = reply(anonymous); err == nil {
+			t.Error("a client without a certificate reached the Raft transport")
+		}
+	}
+}
+
+// writeTestCertificates writes a CA and a node certificate for 127.0.0.1,
+// signed by it, to dir
+func writeTestCertificates(t *testing.T, dir string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca, &nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, block := range map[string]*pem.Block{
+		"ca.crt":   {Type: "CERTIFICATE", Bytes: caDER},
+		"node.crt": {Type: "CERTIFICATE", Bytes: nodeDER},
+		"node.key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
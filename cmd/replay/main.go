@@ -0,0 +1,292 @@
+// Command replay re-submits a recorded sequence of writes (RECORD_FILE) or a
+// chain snapshot (the JSON served by GET /) to a fresh node and checks that
+// the node ends up with the same chain head hash.
+//
+// The target node must run with REPLAY_MODE=true so it accepts the recorded
+// block timestamps. Set GENESIS_TIMESTAMP to the original genesis timestamp to
+// reproduce the genesis block byte for byte as well.
+//
+//	go run cmd/replay/main.go -node http://localhost:8080 -requests writes.jsonl
+//	go run cmd/replay/main.go -node http://localhost:8080 -snapshot chain.json
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Block mirrors the node's block representation
+type Block struct {
+	Index        int
+	Timestamp    string
+	FileHash     string
+	Event        string
+	EventTime    string
+	Location     string
+	Server       string
+	Hash         string
+	PrevHash     string
+	DeviceKey    string          `json:",omitempty"`
+	DeviceHMAC   string          `json:",omitempty"`
+	BackfilledBy string          `json:",omitempty"`
+	Signer       string          `json:",omitempty"`
+	SignerCert   string          `json:",omitempty"`
+	Metadata     json.RawMessage `json:",omitempty"`
+}
+
+// CreateBlockReq mirrors the node's write payload
+type CreateBlockReq struct {
+	FileHash  string
+	Event     string
+	EventTime string
+	Location  string
+	Server    string
+	KeyID     string `json:",omitempty"`
+	HMAC      string `json:",omitempty"`
+	Backfill  bool   `json:",omitempty"`
+}
+
+// UnmarshalJSON accepts blocks with either field naming
+func (b *Block) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain Block
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// UnmarshalJSON accepts recorded writes with either field naming
+func (m *CreateBlockReq) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain CreateBlockReq
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+// snakeCaseNames maps the snake_case keys of nodes running with
+// JSON_FIELD_NAMES=snake_case, and of their data files, to the field names
+// used here. Single word names match either way.
+var snakeCaseNames = map[string]string{
+	"file_hash":     "FileHash",
+	"event_time":    "EventTime",
+	"prev_hash":     "PrevHash",
+	"device_key":    "DeviceKey",
+	"device_hmac":   "DeviceHMAC",
+	"backfilled_by": "BackfilledBy",
+	"signer_cert":   "SignerCert",
+	"key_id":        "KeyID",
+}
+
+// legacyKeys renames the snake_case keys of a JSON object
+func legacyKeys(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for snake, name := range snakeCaseNames {
+		if v, ok := fields[snake]; ok {
+			delete(fields, snake)
+			fields[name] = v
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// RecordedRequest mirrors one line of the node's RECORD_FILE
+type RecordedRequest struct {
+	Method    string
+	Path      string
+	Body      CreateBlockReq
+	Timestamp string
+	Hash      string
+	// Metadata holds the write's fields the node didn't know; they are sent
+	// back alongside Body
+	Metadata json.RawMessage `json:",omitempty"`
+}
+
+func main() {
+	node := flag.String("node", "http://localhost:8080", "base URL of a fresh node running with REPLAY_MODE=true")
+	requestsFile := flag.String("requests", "", "recorded writes (JSON lines from RECORD_FILE)")
+	snapshotFile := flag.String("snapshot", "", "chain snapshot (JSON array from GET /)")
+	expect := flag.String("expect", "", "expected head hash (defaults to the last recorded hash)")
+	flag.Parse()
+
+	chain, err := getChain(*node)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(chain) != 1 {
+		log.Fatalf("node %s is not fresh: it already has %d blocks", *node, len(chain))
+	}
+
+	var requests []RecordedRequest
+	switch {
+	case *snapshotFile != "":
+		requests, err = loadSnapshot(*snapshotFile, chain[0])
+	case *requestsFile != "":
+		requests, err = loadRequests(*requestsFile)
+	default:
+		log.Fatal("Please provide -requests or -snapshot")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	want := *expect
+	if want == "" && len(requests) > 0 {
+		want = requests[len(requests)-1].Hash
+	}
+
+	for i, req := range requests {
+		b, err := submit(*node, req)
+		if err != nil {
+			log.Fatalf("request %d: %v", i, err)
+		}
+		if req.Hash != "" && b.Hash != req.Hash {
+			fmt.Printf("DIVERGED at block %d: recorded %s, replayed %s\n", b.Index, req.Hash, b.Hash)
+			os.Exit(1)
+		}
+	}
+
+	chain, err = getChain(*node)
+	if err != nil {
+		log.Fatal(err)
+	}
+	head := chain[len(chain)-1]
+	if want != "" && head.Hash != want {
+		fmt.Printf("MISMATCH: head %d is %s, expected %s\n", head.Index, head.Hash, want)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: replayed %d writes, head %d is %s\n", len(requests), head.Index, head.Hash)
+}
+
+// loadRequests reads a RECORD_FILE
+func loadRequests(path string) ([]RecordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []RecordedRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var req RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, scanner.Err()
+}
+
+// loadSnapshot turns every non-genesis block of a snapshot into a write
+func loadSnapshot(path string, genesis Block) ([]RecordedRequest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot []Block
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return nil, err
+	}
+	if len(snapshot) == 0 {
+		return nil, fmt.Errorf("snapshot %s is empty", path)
+	}
+	if snapshot[0].Hash != genesis.Hash {
+		return nil, fmt.Errorf("genesis mismatch: node has %s, snapshot has %s", genesis.Hash, snapshot[0].Hash)
+	}
+
+	var requests []RecordedRequest
+	for _, b := range snapshot[1:] {
+		requests = append(requests, RecordedRequest{
+			Method:    "POST",
+			Path:      "/block",
+			Body:      CreateBlockReq{b.FileHash, b.Event, b.EventTime, b.Location, b.Server, b.DeviceKey, b.DeviceHMAC, b.BackfilledBy != ""},
+			Timestamp: b.Timestamp,
+			Hash:      b.Hash,
+			Metadata:  b.Metadata,
+		})
+	}
+	return requests, nil
+}
+
+// submit sends one recorded write and returns the block the node minted
+func submit(node string, req RecordedRequest) (Block, error) {
+	var b Block
+	body, err := json.Marshal(req.Body)
+	if err != nil {
+		return b, err
+	}
+	if len(req.Metadata) > 0 {
+		if body, err = withMetadata(body, req.Metadata); err != nil {
+			return b, err
+		}
+	}
+	httpReq, err := http.NewRequest(req.Method, node+req.Path, bytes.NewReader(body))
+	if err != nil {
+		return b, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Replay-Timestamp", req.Timestamp)
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return b, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return b, fmt.Errorf("%s %s: %s: %s", req.Method, req.Path, resp.Status, msg)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	return b, err
+}
+
+// withMetadata adds the metadata fields to a write body
+func withMetadata(body, metadata []byte) ([]byte, error) {
+	var fields, extra map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(metadata, &extra); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func getChain(node string) ([]Block, error) {
+	resp, err := http.Get(node + "/")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var chain []Block
+	if err := json.NewDecoder(resp.Body).Decode(&chain); err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("node %s has no genesis block yet", node)
+	}
+	return chain, nil
+}
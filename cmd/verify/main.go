@@ -0,0 +1,432 @@
+// Command verify re-validates an exported chain offline: block indexes,
+// hash links, block hashes (including re-anchored algorithms), proof of
+// work, re-anchor manifests, the Merkle roots of batch blocks and, given the node's exported keys (GET /keys), validator
+// approvals. It needs nothing from the node beyond those files.
+//
+//	curl -s http://node:8080/ > chain.json
+//	curl -s http://node:8080/keys > keys.json
+//	go run cmd/verify/main.go -snapshot chain.json -keys keys.json
+//
+// -snapshot also accepts DATA_DIR/chain.jsonl. The exit status is non-zero
+// when any check fails.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Approval mirrors a validator's signature over a block hash
+type Approval struct {
+	Validator string
+	Signature string
+}
+
+// Block mirrors the node's block representation
+type Block struct {
+	Index        int
+	Timestamp    string
+	FileHash     string
+	Event        string
+	EventTime    string
+	Location     string
+	Server       string
+	Hash         string
+	PrevHash     string
+	Approvals    []Approval      `json:",omitempty"`
+	DeviceKey    string          `json:",omitempty"`
+	DeviceHMAC   string          `json:",omitempty"`
+	BackfilledBy string          `json:",omitempty"`
+	Signer       string          `json:",omitempty"`
+	SignerCert   string          `json:",omitempty"`
+	Metadata     json.RawMessage `json:",omitempty"`
+	Difficulty   int             `json:",omitempty"`
+	Nonce        string          `json:",omitempty"`
+	Transactions []Transaction   `json:",omitempty"`
+	MerkleRoot   string          `json:",omitempty"`
+}
+
+// Transaction mirrors one event of a batch block
+type Transaction struct {
+	FileHash     string
+	Event        string
+	EventTime    string
+	Location     string
+	Server       string
+	DeviceKey    string          `json:",omitempty"`
+	DeviceHMAC   string          `json:",omitempty"`
+	BackfilledBy string          `json:",omitempty"`
+	Signer       string          `json:",omitempty"`
+	SignerCert   string          `json:",omitempty"`
+	Metadata     json.RawMessage `json:",omitempty"`
+}
+
+// UnmarshalJSON accepts transactions with either field naming
+func (tx *Transaction) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain Transaction
+	return json.Unmarshal(data, (*plain)(tx))
+}
+
+// UnmarshalJSON accepts blocks with either field naming
+func (b *Block) UnmarshalJSON(data []byte) error {
+	data, err := legacyKeys(data)
+	if err != nil {
+		return err
+	}
+	type plain Block
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// snakeCaseNames maps the snake_case keys of nodes running with
+// JSON_FIELD_NAMES=snake_case, and of their data files, to the field names
+// used here. Single word names match either way.
+var snakeCaseNames = map[string]string{
+	"file_hash":     "FileHash",
+	"event_time":    "EventTime",
+	"prev_hash":     "PrevHash",
+	"device_key":    "DeviceKey",
+	"device_hmac":   "DeviceHMAC",
+	"backfilled_by": "BackfilledBy",
+	"signer_cert":   "SignerCert",
+	"epoch_quorum":  "EpochQuorum",
+	"merkle_root":   "MerkleRoot",
+}
+
+// legacyKeys renames the snake_case keys of a JSON object
+func legacyKeys(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for snake, name := range snakeCaseNames {
+		if v, ok := fields[snake]; ok {
+			delete(fields, snake)
+			fields[name] = v
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// KeyExport mirrors GET /keys
+type KeyExport struct {
+	Consensus   string
+	Quorum      int
+	EpochQuorum int `json:",omitempty"`
+	Validators  map[string]string
+}
+
+// must match the node (see reanchor.go)
+const legacyHashAlgorithm = "sha256"
+const reanchorEvent = "reanchor"
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	legacyHashAlgorithm: sha256.New,
+	"sha512-256":        sha512.New512_256,
+	"sha384":            sha512.New384,
+}
+
+var failures int
+
+func fail(index int, format string, args ...interface{}) {
+	failures++
+	fmt.Printf("block %d: %s\n", index, fmt.Sprintf(format, args...))
+}
+
+func main() {
+	snapshotFile := flag.String("snapshot", "", "chain snapshot (JSON array from GET / or DATA_DIR/chain.jsonl)")
+	keysFile := flag.String("keys", "", "exported keys (JSON from GET /keys) to check validator approvals")
+	requireQuorum := flag.Bool("require-quorum", false, "fail blocks without a quorum of approvals (for chains that always ran CONSENSUS=poa)")
+	flag.Parse()
+
+	if *snapshotFile == "" {
+		log.Fatal("Please provide -snapshot")
+	}
+	chain, err := loadChain(*snapshotFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(chain) == 0 {
+		log.Fatalf("snapshot %s is empty", *snapshotFile)
+	}
+
+	var keys *KeyExport
+	if *keysFile != "" {
+		if keys, err = loadKeys(*keysFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	verifyGenesis(chain[0])
+	for i := 1; i < len(chain); i++ {
+		prev, b := chain[i-1], chain[i]
+		if b.Index != prev.Index+1 {
+			fail(b.Index, "index follows %d", prev.Index)
+		}
+		if b.PrevHash != prev.Hash {
+			fail(b.Index, "PrevHash %s does not link to %s", b.PrevHash, prev.Hash)
+		}
+		algorithm := nextHashAlgorithm(prev)
+		if got := hashBlockWith(b, algorithm); got != b.Hash {
+			fail(b.Index, "hash is %s, recomputed %s with %s", b.Hash, got, algorithm)
+		}
+		if digest := b.Hash[strings.Index(b.Hash, ":")+1:]; b.Difficulty > 0 && !strings.HasPrefix(digest, strings.Repeat("0", b.Difficulty)) {
+			fail(b.Index, "hash does not meet proof-of-work difficulty %d", b.Difficulty)
+		}
+		if got := transactionsRoot(b.Transactions); got != b.MerkleRoot {
+			fail(b.Index, "merkle root is %s, recomputed %s", b.MerkleRoot, got)
+		}
+		if isTransition(b) {
+			verifyManifest(chain[:i], b)
+		}
+		if keys != nil {
+			verifyApprovals(b, keys, *requireQuorum)
+		}
+	}
+
+	head := chain[len(chain)-1]
+	if failures > 0 {
+		fmt.Printf("FAILED: %d problems in %d blocks\n", failures, len(chain))
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d blocks verified, head %d is %s\n", len(chain), head.Index, head.Hash)
+}
+
+// loadChain reads a JSON array or JSON lines file of blocks
+func loadChain(path string) ([]Block, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var chain []Block
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &chain)
+		return chain, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var b Block
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			return nil, err
+		}
+		chain = append(chain, b)
+	}
+	return chain, scanner.Err()
+}
+
+func loadKeys(path string) (*KeyExport, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = legacyKeys(raw); err != nil {
+		return nil, err
+	}
+	var keys KeyExport
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, err
+	}
+	if keys.Consensus == "poa" && (keys.Quorum < 1 || len(keys.Validators) < keys.Quorum) {
+		return nil, fmt.Errorf("%s: quorum %d with %d validators", path, keys.Quorum, len(keys.Validators))
+	}
+	return &keys, nil
+}
+
+// the node hashes its genesis block before filling it in
+func verifyGenesis(b Block) {
+	if b.Index != 0 || b.PrevHash != "" {
+		fail(b.Index, "chain does not start at a genesis block")
+	}
+	if want := hashBlockWith(Block{}, legacyHashAlgorithm); b.Hash != want {
+		fail(b.Index, "genesis hash is %s, expected %s", b.Hash, want)
+	}
+}
+
+// verifyManifest recomputes the root a re-anchor transition committed to
+func verifyManifest(history []Block, transition Block) {
+	newHash, ok := hashAlgorithms[transition.Location]
+	if !ok {
+		fail(transition.Index, "re-anchors to unknown algorithm %s", transition.Location)
+		return
+	}
+	root := newHash()
+	for _, b := range history {
+		h := newHash()
+		h.Write([]byte(blockRecord(b) + b.Hash))
+		root.Write([]byte(hex.EncodeToString(h.Sum(nil))))
+	}
+	if got := hex.EncodeToString(root.Sum(nil)); got != transition.FileHash {
+		fail(transition.Index, "re-anchor manifest root is %s, recomputed %s", transition.FileHash, got)
+	}
+}
+
+// transactionHash must match the node's txHash: the SHA-256 of the compact
+// JSON encoding under the snake_case names
+func transactionHash(tx Transaction) string {
+	data, err := json.Marshal(struct {
+		FileHash     string          `json:"file_hash"`
+		Event        string          `json:"event"`
+		EventTime    string          `json:"event_time"`
+		Location     string          `json:"location"`
+		Server       string          `json:"server"`
+		DeviceKey    string          `json:"device_key,omitempty"`
+		DeviceHMAC   string          `json:"device_hmac,omitempty"`
+		BackfilledBy string          `json:"backfilled_by,omitempty"`
+		Signer       string          `json:"signer,omitempty"`
+		SignerCert   string          `json:"signer_cert,omitempty"`
+		Metadata     json.RawMessage `json:"metadata,omitempty"`
+	}(tx))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// transactionsRoot must match the node's: leaves and inner nodes are domain
+// separated (0x00 and 0x01 prefixes) and an odd node is promoted unchanged
+func transactionsRoot(txs []Transaction) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	level := make([][]byte, len(txs))
+	for i, tx := range txs {
+		sum := sha256.Sum256(append([]byte{0}, transactionHash(tx)...))
+		level[i] = sum[:]
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{1}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// verifyApprovals checks every approval signature and, if required, that a
+// quorum of distinct validators signed
+func verifyApprovals(b Block, keys *KeyExport, requireQuorum bool) {
+	seen := make(map[string]bool)
+	for _, a := range b.Approvals {
+		encoded, ok := keys.Validators[a.Validator]
+		if !ok {
+			fail(b.Index, "approval by unknown validator %s", a.Validator)
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			fail(b.Index, "exported key for %s is invalid", a.Validator)
+			continue
+		}
+		sig, err := hex.DecodeString(a.Signature)
+		if err != nil || !ed25519.Verify(ed25519.PublicKey(key), []byte(b.Hash), sig) {
+			fail(b.Index, "invalid approval signature by %s", a.Validator)
+			continue
+		}
+		seen[a.Validator] = true
+	}
+	// epoch blocks may need more votes, see the node's epochs.go
+	need := keys.Quorum
+	if b.Event == "epoch" && keys.EpochQuorum > need {
+		need = keys.EpochQuorum
+	}
+	if requireQuorum && len(seen) < need {
+		fail(b.Index, "%d valid approvals, quorum is %d", len(seen), need)
+	}
+}
+
+// must match the node's blockRecord
+func blockRecord(block Block) string {
+	record := strconv.Itoa(block.Index) + block.Timestamp + block.FileHash + block.Event + block.EventTime + block.Location + block.Server + block.PrevHash
+	if block.DeviceKey != "" {
+		record += block.DeviceKey + block.DeviceHMAC
+	}
+	if block.BackfilledBy != "" {
+		record += "backfill" + block.BackfilledBy
+	}
+	if block.SignerCert != "" {
+		record += "cms" + block.SignerCert + block.Signer
+	}
+	if len(block.Metadata) > 0 {
+		var buf bytes.Buffer
+		if json.Compact(&buf, block.Metadata) == nil {
+			record += "meta" + buf.String()
+		} else {
+			record += "meta" + string(block.Metadata)
+		}
+	}
+	if block.MerkleRoot != "" {
+		record += "merkle" + block.MerkleRoot
+	}
+	if block.Difficulty > 0 {
+		record += "pow" + strconv.Itoa(block.Difficulty) + ":" + block.Nonce
+	}
+	return record
+}
+
+// isTransition reports whether b re-anchors the chain: only a transition
+// the node recorded itself, with its minter, counts
+func isTransition(b Block) bool {
+	if b.Event != reanchorEvent {
+		return false
+	}
+	var meta struct {
+		Minter *struct {
+			Node string `json:"node"`
+		} `json:"minter"`
+	}
+	return json.Unmarshal(b.Metadata, &meta) == nil && meta.Minter != nil && meta.Minter.Node != ""
+}
+
+func nextHashAlgorithm(prev Block) string {
+	if isTransition(prev) {
+		return prev.Location
+	}
+	if i := strings.Index(prev.Hash, ":"); i > 0 {
+		return prev.Hash[:i]
+	}
+	return legacyHashAlgorithm
+}
+
+func hashBlockWith(block Block, algorithm string) string {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return ""
+	}
+	h := newHash()
+	h.Write([]byte(blockRecord(block)))
+	sum := hex.EncodeToString(h.Sum(nil))
+	if algorithm == legacyHashAlgorithm {
+		return sum
+	}
+	return algorithm + ":" + sum
+}
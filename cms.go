@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// Message signing appliances can POST /block a CMS (PKCS#7) SignedData
+// message wrapping the usual JSON write, sent as application/pkcs7-mime in
+// DER, PEM or base64. The signer's certificate must chain to CMS_CA_FILE;
+// its subject and SHA-256 fingerprint are recorded, and hashed, in the
+// block's Signer and SignerCert.
+
+var errCMSDisabled = errors.New("signed writes need CMS_CA_FILE")
+var errCMSMalformed = errors.New("body is not a CMS signed message")
+
+var cmsRoots *x509.CertPool
+var cmsMutex = &sync.RWMutex{}
+
+// loadCMSTrust reads the CA bundle for signed writes
+func loadCMSTrust() error {
+	apply, err := prepareCMSTrust(map[string]string{"CMS_CA_FILE": os.Getenv("CMS_CA_FILE")})
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareCMSTrust validates a reloaded CMS_CA_FILE
+func prepareCMSTrust(env map[string]string) (func(), error) {
+	var pool *x509.CertPool
+	if caFile := env["CMS_CA_FILE"]; caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	return func() {
+		cmsMutex.Lock()
+		cmsRoots = pool
+		cmsMutex.Unlock()
+	}, nil
+}
+
+// isSignedWrite reports whether the request body is a CMS message
+func isSignedWrite(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/pkcs7-mime", "application/x-pkcs7-mime", "application/cms":
+		return true
+	}
+	return false
+}
+
+// signedContent is the verified payload of a CMS write and who signed it
+type signedContent struct {
+	body       []byte
+	signer     string
+	signerCert string
+}
+
+// openSignedWrite verifies a CMS message against CMS_CA_FILE and returns
+// the content it signs
+func openSignedWrite(data []byte) (signedContent, error) {
+	cmsMutex.RLock()
+	roots := cmsRoots
+	cmsMutex.RUnlock()
+	if roots == nil {
+		return signedContent{}, errCMSDisabled
+	}
+
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err == nil {
+		der = decoded
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil || len(p7.Signers) == 0 {
+		return signedContent{}, errCMSMalformed
+	}
+	// appliances sign one event at a time; co-signed messages are refused
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		return signedContent{}, errors.New("signed writes must have exactly one signer")
+	}
+	if err := p7.VerifyWithChain(roots); err != nil {
+		log.Println("rejected signed write from", cert.Subject, ":", err)
+		return signedContent{}, errors.New("CMS signature rejected: " + err.Error())
+	}
+	if len(p7.Content) == 0 {
+		return signedContent{}, errors.New("detached CMS signatures are not supported")
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return signedContent{p7.Content, cert.Subject.String(), hex.EncodeToString(sum[:])}, nil
+}
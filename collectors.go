@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// collectors tail OS security logs and append selected entries as blocks.
+// They shell out to journalctl and wevtutil, which ship with the OS, instead
+// of linking platform libraries. FileHash is the SHA-256 of the raw entry so
+// the original record can be checked against the chain later.
+
+// longest Event text taken from a log message
+const maxCollectedEvent = 512
+
+// how long to wait before restarting a collector that exited
+const collectorRetry = 10 * time.Second
+
+// Windows Security events recorded when WINEVENT_IDS is unset: logon,
+// failed logon, explicit credentials, account created/deleted, log cleared
+var defaultWinEventIDs = []string{"4624", "4625", "4648", "4720", "4726", "1102"}
+
+// startCollectors starts the collectors named in COLLECTORS
+// (journald, winevent)
+func startCollectors() error {
+	var names []string
+	for _, c := range strings.Split(os.Getenv("COLLECTORS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			names = append(names, c)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if poaEnabled() {
+		return errors.New("COLLECTORS is not supported with CONSENSUS=poa, collected blocks would bypass the quorum")
+	}
+
+	for _, name := range names {
+		switch name {
+		case "journald":
+			if _, err := exec.LookPath("journalctl"); err != nil {
+				return errors.New("COLLECTORS=journald requires journalctl")
+			}
+			go runCollector(name, collectJournald)
+		case "winevent":
+			if runtime.GOOS != "windows" {
+				return errors.New("COLLECTORS=winevent is only available on Windows")
+			}
+			ids := defaultWinEventIDs
+			if v := os.Getenv("WINEVENT_IDS"); v != "" {
+				ids = nil
+				for _, id := range strings.Split(v, ",") {
+					id = strings.TrimSpace(id)
+					if _, err := strconv.Atoi(id); err != nil {
+						return errors.New("invalid event ID in WINEVENT_IDS: " + id)
+					}
+					ids = append(ids, id)
+				}
+			}
+			go runCollector(name, func() error { return collectWinEvents(ids) })
+		default:
+			return errors.New("unknown collector " + name + ", COLLECTORS takes journald and winevent")
+		}
+	}
+	log.Println("collecting events from", strings.Join(names, ", "))
+	return nil
+}
+
+// runCollector keeps a collector running, restarting it when it fails
+func runCollector(name string, collect func() error) {
+	for {
+		if err := collect(); err != nil {
+			log.Printf("%s collector: %v", name, err)
+		}
+		time.Sleep(collectorRetry)
+	}
+}
+
+// appendCollected records one collected log entry
+func appendCollected(raw []byte, m CreateBlockReq) {
+	sum := sha256.Sum256(raw)
+	m.FileHash = hex.EncodeToString(sum[:])
+	if len(m.Event) > maxCollectedEvent {
+		m.Event = m.Event[:maxCollectedEvent]
+	}
+	if err := checkReservedEvent(m); err != nil {
+		log.Println("skipping collected event:", err)
+		return
+	}
+	if _, err := addBlock(enrichEvent(m), ""); err != nil {
+		log.Println("appending collected event failed:", err)
+	}
+}
+
+// collectJournald follows the journal from now on. JOURNALD_MATCHES holds
+// journalctl matches, e.g. "_SYSTEMD_UNIT=sshd.service,SYSLOG_IDENTIFIER=sudo";
+// matches on different fields must all apply, like journalctl itself.
+func collectJournald() error {
+	args := []string{"--follow", "--lines=0", "--output=json"}
+	for _, m := range strings.Split(os.Getenv("JOURNALD_MATCHES"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			args = append(args, m)
+		}
+	}
+	cmd := exec.Command("journalctl", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		// binary fields are arrays of bytes, only plain strings are used
+		field := func(k string) string {
+			s, _ := entry[k].(string)
+			return s
+		}
+		eventTime := ""
+		if us, err := strconv.ParseInt(field("__REALTIME_TIMESTAMP"), 10, 64); err == nil {
+			eventTime = time.Unix(0, us*int64(time.Microsecond)).UTC().Format(time.RFC3339Nano)
+		}
+		source := field("_SYSTEMD_UNIT")
+		if source == "" {
+			source = field("SYSLOG_IDENTIFIER")
+		}
+		appendCollected(scanner.Bytes(), CreateBlockReq{
+			Event:     field("MESSAGE"),
+			EventTime: eventTime,
+			Location:  source,
+			Server:    field("_HOSTNAME"),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+// winEvent is the part of a wevtutil XML record the collector maps
+type winEvent struct {
+	EventID  int   `xml:"System>EventID"`
+	RecordID int64 `xml:"System>EventRecordID"`
+	Time     struct {
+		SystemTime string `xml:"SystemTime,attr"`
+	} `xml:"System>TimeCreated"`
+	Computer string `xml:"System>Computer"`
+	Raw      []byte `xml:",innerxml"`
+}
+
+// how often the Security log is polled
+const winEventPoll = 5 * time.Second
+
+// collectWinEvents polls the Security log for new records with the given IDs
+func collectWinEvents(ids []string) error {
+	// start after the newest existing record
+	latest, err := queryWinEvents("*", 1, true)
+	if err != nil {
+		return err
+	}
+	var last int64
+	if len(latest) > 0 {
+		last = latest[0].RecordID
+	}
+
+	idFilter := "EventID=" + strings.Join(ids, " or EventID=")
+	for {
+		time.Sleep(winEventPoll)
+		query := fmt.Sprintf("*[System[(%s) and EventRecordID>%d]]", idFilter, last)
+		events, err := queryWinEvents(query, 0, false)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			appendCollected(e.Raw, CreateBlockReq{
+				Event:     "windows security event " + strconv.Itoa(e.EventID),
+				EventTime: e.Time.SystemTime,
+				Location:  "Security",
+				Server:    e.Computer,
+			})
+			if e.RecordID > last {
+				last = e.RecordID
+			}
+		}
+	}
+}
+
+// queryWinEvents runs wevtutil against the Security log. count 0 means all
+// matches; reverse returns the newest first.
+func queryWinEvents(query string, count int, reverse bool) ([]winEvent, error) {
+	args := []string{"qe", "Security", "/q:" + query, "/f:xml", "/rd:" + strconv.FormatBool(reverse)}
+	if count > 0 {
+		args = append(args, "/c:"+strconv.Itoa(count))
+	}
+	out, err := exec.Command("wevtutil", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// wevtutil prints bare <Event> elements without a root
+	var doc struct {
+		Events []winEvent `xml:"Event"`
+	}
+	wrapped := append(append([]byte("<Events>"), bytes.TrimSpace(out)...), []byte("</Events>")...)
+	if err := xml.Unmarshal(wrapped, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Events, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressedWriter sends the response body through a gzip or zlib writer
+type compressedWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (c compressedWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// acceptedEncoding picks gzip or deflate from Accept-Encoding, preferring
+// gzip, and returns "" when neither is acceptable
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		accepted[coding] = true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				accepted[coding] = err == nil && q > 0
+			}
+		}
+	}
+	for _, coding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[coding]; ok || (!listed && accepted["*"]) {
+			return coding
+		}
+	}
+	return ""
+}
+
+// compress compresses the response of next when the client accepts it.
+// It is meant for the large, highly compressible JSON listings.
+func compress(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r)
+		var cw io.WriteCloser
+		switch encoding {
+		case "gzip":
+			cw = gzip.NewWriter(w)
+		case "deflate":
+			// HTTP deflate is the zlib format, not a raw deflate stream
+			cw = zlib.NewWriter(w)
+		default:
+			next(w, r)
+			return
+		}
+		defer cw.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Del("Content-Length")
+		next(compressedWriter{w, cw}, r)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// deviceKey is a secret shared with one submitting appliance. Events signed
+// with it must claim to come from its Server.
+type deviceKey struct {
+	server string
+	secret []byte
+}
+
+// deviceKeys maps key IDs to device secrets (DEVICE_KEYS)
+var deviceKeys map[string]deviceKey
+var deviceKeyMutex = &sync.RWMutex{}
+
+var errDeviceHMAC = errors.New("device HMAC required")
+
+// Devices MAC, and validators sign, eventRecord with a signed_at time.
+// signed_at must be within signatureWindow of our clock and every MAC or
+// signature is accepted once, so a captured event can't be submitted again.
+// With REPLAY_MODE=true neither is checked and the MACs of the record
+// before signed_at (legacyEventRecord) are accepted, so recorded writes can
+// be replayed.
+
+// how far signed_at may be from our clock
+const signatureWindow = 5 * time.Minute
+
+var errSignatureUsed = errors.New("signature was already used")
+
+// usedSignatures remembers MACs and signatures until their signed_at falls
+// out of the window
+var usedSignatures = make(map[string]time.Time)
+var usedSignatureMutex = &sync.Mutex{}
+
+// loadDeviceKeys reads DEVICE_KEYS ("keyid:server:base64secret,...")
+func loadDeviceKeys() error {
+	keys, err := parseDeviceKeys(os.Getenv("DEVICE_KEYS"))
+	if err != nil {
+		return err
+	}
+	deviceKeys = keys
+	if len(keys) > 0 {
+		log.Println("loaded", len(keys), "device keys")
+	}
+	return nil
+}
+
+// prepareDeviceKeys validates reloaded DEVICE_KEYS
+func prepareDeviceKeys(env map[string]string) (func(), error) {
+	keys, err := parseDeviceKeys(env["DEVICE_KEYS"])
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		deviceKeyMutex.Lock()
+		deviceKeys = keys
+		deviceKeyMutex.Unlock()
+	}, nil
+}
+
+func parseDeviceKeys(list string) (map[string]deviceKey, error) {
+	keys := make(map[string]deviceKey)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("invalid device key entry, expected keyid:server:base64secret")
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil || len(secret) < 16 {
+			return nil, errors.New("device key " + parts[0] + " needs a base64 secret of at least 16 bytes")
+		}
+		keys[parts[0]] = deviceKey{parts[1], secret}
+	}
+	return keys, nil
+}
+
+// lookupDeviceKey finds a key in DEVICE_KEYS or the device registry
+func lookupDeviceKey(id string) (deviceKey, bool) {
+	deviceKeyMutex.RLock()
+	key, ok := deviceKeys[id]
+	deviceKeyMutex.RUnlock()
+	if ok {
+		return key, true
+	}
+
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	for _, d := range devices {
+		if d.KeyID == id && d.KeyID != "" {
+			secret, _ := base64.StdEncoding.DecodeString(d.Secret)
+			return deviceKey{d.Name, secret}, true
+		}
+	}
+	return deviceKey{}, false
+}
+
+// eventRecord is what a device MACs and a proposer signs: FileHash, Event,
+// EventTime, Location, Server and SignedAt, each as a netstring
+// ("<length>:<bytes>,") so no byte can move from one field to another
+func eventRecord(m CreateBlockReq) string {
+	var b strings.Builder
+	for _, f := range []string{m.FileHash, m.Event, m.EventTime, m.Location, m.Server, m.SignedAt} {
+		b.WriteString(strconv.Itoa(len(f)))
+		b.WriteByte(':')
+		b.WriteString(f)
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// legacyEventRecord is the record devices MACed before signed_at
+func legacyEventRecord(m CreateBlockReq) string {
+	return m.FileHash + m.Event + m.EventTime + m.Location + m.Server
+}
+
+// deviceHMAC is the hex HMAC-SHA256 of record under secret
+func deviceHMAC(secret []byte, record string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(record))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignedAt parses signed_at and checks it is within signatureWindow
+func checkSignedAt(signedAt string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, signedAt)
+	if err != nil {
+		return time.Time{}, errors.New("signed_at must be an RFC 3339 time")
+	}
+	if d := time.Since(t); d > signatureWindow || d < -signatureWindow {
+		return time.Time{}, errors.New("signed_at is too far from the node's clock")
+	}
+	return t, nil
+}
+
+// claimSignature marks sig, signed at signedAt, used, failing if it already
+// was
+func claimSignature(sig string, signedAt time.Time) error {
+	usedSignatureMutex.Lock()
+	defer usedSignatureMutex.Unlock()
+	now := time.Now()
+	for s, expires := range usedSignatures {
+		if now.After(expires) {
+			delete(usedSignatures, s)
+		}
+	}
+	if _, used := usedSignatures[sig]; used {
+		return errSignatureUsed
+	}
+	usedSignatures[sig] = signedAt.Add(signatureWindow)
+	return nil
+}
+
+// deviceSignature is the key a device MAC is claimed under
+func deviceSignature(m CreateBlockReq) string {
+	return "device:" + m.KeyID + ":" + strings.ToLower(m.HMAC)
+}
+
+// claimDeviceHMAC marks a verified device MAC used
+func claimDeviceHMAC(m CreateBlockReq) error {
+	if m.KeyID == "" || os.Getenv("REPLAY_MODE") == "true" {
+		return nil
+	}
+	t, err := checkSignedAt(m.SignedAt)
+	if err != nil {
+		return err
+	}
+	return claimSignature(deviceSignature(m), t)
+}
+
+// releaseDeviceHMAC forgets a claimed MAC whose write failed, so the device
+// can retry it
+func releaseDeviceHMAC(m CreateBlockReq) {
+	if m.KeyID == "" {
+		return
+	}
+	usedSignatureMutex.Lock()
+	delete(usedSignatures, deviceSignature(m))
+	usedSignatureMutex.Unlock()
+}
+
+// verifyDeviceHMAC checks an event's HMAC against the claimed device key and
+// Server, and with fresh that its signed_at is within signatureWindow.
+// Unsigned events pass unless REQUIRE_DEVICE_HMAC=true.
+func verifyDeviceHMAC(m CreateBlockReq, fresh bool) error {
+	if m.KeyID == "" && m.HMAC == "" {
+		if os.Getenv("REQUIRE_DEVICE_HMAC") == "true" {
+			return errDeviceHMAC
+		}
+		return nil
+	}
+	replay := os.Getenv("REPLAY_MODE") == "true"
+	if fresh && !replay {
+		if _, err := checkSignedAt(m.SignedAt); err != nil {
+			return err
+		}
+	}
+
+	key, ok := lookupDeviceKey(m.KeyID)
+	if !ok {
+		return errors.New("unknown device key " + m.KeyID)
+	}
+	if normalizeText(key.server) != normalizeText(m.Server) {
+		return errors.New("device key " + m.KeyID + " does not belong to Server " + m.Server)
+	}
+	// devices may sign the event as sent or in its normalized form
+	got := []byte(strings.ToLower(m.HMAC))
+	records := []string{eventRecord(m), eventRecord(normalizeEvent(m))}
+	if replay {
+		records = append(records, legacyEventRecord(m), legacyEventRecord(normalizeEvent(m)))
+	}
+	for _, record := range records {
+		if hmac.Equal(got, []byte(deviceHMAC(key.secret, record))) {
+			return nil
+		}
+	}
+	return errors.New("invalid device HMAC")
+}
+
+// Device is a registered appliance, keyed by the Server name it writes with.
+// Secret is the base64 HMAC key; it is accepted on registration but never
+// returned.
+type Device struct {
+	Name     string `json:"name"`
+	Owner    string `json:"owner"`
+	Location string `json:"location"`
+	KeyID    string `json:"key_id,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+	// Heartbeat is how often the device is expected to write, e.g. 15m
+	Heartbeat  string `json:"heartbeat,omitempty"`
+	Registered string `json:"registered"`
+}
+
+// DeviceSummary is a device with the events it has written
+type DeviceSummary struct {
+	Device     Device         `json:"device"`
+	Blocks     int            `json:"blocks"`
+	FirstBlock *BlockRef      `json:"first_block,omitempty"`
+	LastBlock  *BlockRef      `json:"last_block,omitempty"`
+	LastEvent  string         `json:"last_event,omitempty"`
+	Events     map[string]int `json:"events"`
+}
+
+// devices is the registry, saved to DATA_DIR/devices.json when DATA_DIR is set
+var devices = make(map[string]*Device)
+var deviceMutex = &sync.Mutex{}
+
+// loadDevices reads the persisted registry
+func loadDevices() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "devices.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Device
+	if err := unmarshalCompat(raw, &list); err != nil {
+		return err
+	}
+	for _, d := range list {
+		devices[d.Name] = d
+	}
+	log.Println("loaded", len(devices), "registered devices")
+	return nil
+}
+
+// saveDevicesLocked writes the registry atomically. Caller must hold
+// deviceMutex.
+func saveDevicesLocked() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	list := make([]*Device, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, d)
+	}
+	raw, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "devices.json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// verifyRegisteredDevice rejects writes from unregistered Servers when
+// REQUIRE_REGISTERED_DEVICE=true
+func verifyRegisteredDevice(m CreateBlockReq) error {
+	if os.Getenv("REQUIRE_REGISTERED_DEVICE") != "true" {
+		return nil
+	}
+	deviceMutex.Lock()
+	_, ok := devices[normalizeText(m.Server)]
+	deviceMutex.Unlock()
+	if !ok {
+		return errors.New("Server " + m.Server + " is not a registered device")
+	}
+	return nil
+}
+
+// register or update a device
+func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	var d Device
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&d); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	d.Name = normalizeText(d.Name)
+	if d.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if (d.KeyID == "") != (d.Secret == "") {
+		http.Error(w, "KeyID and Secret go together", http.StatusBadRequest)
+		return
+	}
+	if d.Secret != "" {
+		if secret, err := base64.StdEncoding.DecodeString(d.Secret); err != nil || len(secret) < 16 {
+			http.Error(w, "Secret must be base64 of at least 16 bytes", http.StatusBadRequest)
+			return
+		}
+	}
+	if d.Heartbeat != "" {
+		if interval, err := time.ParseDuration(d.Heartbeat); err != nil || interval <= 0 {
+			http.Error(w, "Heartbeat must be a positive duration like 15m", http.StatusBadRequest)
+			return
+		}
+	}
+	d.Registered = time.Now().String()
+
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	for _, other := range devices {
+		if d.KeyID != "" && other.KeyID == d.KeyID && other.Name != d.Name {
+			http.Error(w, "KeyID is already used by "+other.Name, http.StatusConflict)
+			return
+		}
+	}
+	status := http.StatusCreated
+	if _, ok := devices[d.Name]; ok {
+		status = http.StatusOK
+	}
+	devices[d.Name] = &d
+	if err := saveDevicesLocked(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("registered device %s", d.Name)
+
+	public := d
+	public.Secret = ""
+	respondWithJSON(w, r, status, public)
+}
+
+// list registered devices
+func handleGetDevices(w http.ResponseWriter, r *http.Request) {
+	deviceMutex.Lock()
+	list := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		public := *d
+		public.Secret = ""
+		list = append(list, public)
+	}
+	deviceMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	respondWithList(w, r, http.StatusOK, list)
+}
+
+// show a device and a summary of the blocks it wrote
+func handleGetDevice(w http.ResponseWriter, r *http.Request) {
+	name := normalizeText(mux.Vars(r)["name"])
+	deviceMutex.Lock()
+	d, ok := devices[name]
+	var public Device
+	if ok {
+		public = *d
+		public.Secret = ""
+	}
+	deviceMutex.Unlock()
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	summary := DeviceSummary{Device: public, Events: make(map[string]int)}
+	mutex.Lock()
+	for _, b := range Blockchain {
+		wrote := false
+		for _, tx := range eventsOf(b) {
+			if normalizeText(tx.Server) != name {
+				continue
+			}
+			wrote = true
+			summary.LastEvent = tx.EventTime
+			summary.Events[tx.Event]++
+		}
+		if !wrote {
+			continue
+		}
+		ref := &BlockRef{b.Index, b.Hash}
+		if summary.FirstBlock == nil {
+			summary.FirstBlock = ref
+		}
+		summary.LastBlock = ref
+		summary.Blocks++
+	}
+	mutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusOK, summary)
+}
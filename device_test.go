@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/repenno/blockchain/client"
+)
+
+func TestDeviceHMACs(t *testing.T) {
+	router := newTestChain(t)
+	secret := []byte("0123456789abcdef0123")
+	deviceKeyMutex.Lock()
+	deviceKeys = map[string]deviceKey{"vpn-1": {"vpn-1-sjc", secret}}
+	deviceKeyMutex.Unlock()
+	t.Cleanup(func() {
+		deviceKeyMutex.Lock()
+		deviceKeys = nil
+		deviceKeyMutex.Unlock()
+	})
+
+	event := client.CreateBlockReq{Event: "login", EventTime: "2024-01-01T00:00:00Z", Location: "SJC", Server: "vpn-1-sjc"}
+	signed := client.SignEvent(event, "vpn-1", secret, time.Now())
+	if code := call(t, router, "POST", "/block", signed, nil); code != http.StatusCreated {
+		t.Fatalf("signed write: status %d", code)
+	}
+	if code := call(t, router, "POST", "/block", signed, nil); code != http.StatusForbidden {
+		t.Errorf("the same signed write again: status %d", code)
+	}
+
+	// moving a byte from one field to the next breaks the MAC
+	shifted := event
+	shifted.Event, shifted.EventTime = "logi", "n"+event.EventTime
+	shifted = client.SignEvent(shifted, "vpn-1", secret, time.Now())
+	shifted.Event, shifted.EventTime = event.Event, event.EventTime
+	if code := call(t, router, "POST", "/block", shifted, nil); code != http.StatusForbidden {
+		t.Errorf("a write with shifted fields: status %d", code)
+	}
+
+	stale := client.SignEvent(event, "vpn-1", secret, time.Now().Add(-time.Hour))
+	if code := call(t, router, "POST", "/block", stale, nil); code != http.StatusForbidden {
+		t.Errorf("a write signed an hour ago: status %d", code)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// freeBytes is not implemented on Windows
+func freeBytes(dir string) (uint64, error) {
+	return 0, errors.New("not supported on windows")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// doctor result levels
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+	checkSkip = "skip"
+)
+
+// free space below which storage is reported as a problem
+const minFreeBytes = 1 << 30
+
+// largest clock difference to a reference that is still acceptable
+const maxClockSkew = 2 * time.Second
+
+// diagnosis collects doctor results
+type diagnosis struct {
+	failed bool
+}
+
+func (d *diagnosis) report(level, check, msg string) {
+	if level == checkFail {
+		d.failed = true
+	}
+	fmt.Printf("[%-4s] %-10s %s\n", level, check, msg)
+}
+
+// runDoctorCommand implements `go run *.go doctor`: it checks the
+// configuration and environment and exits non-zero if the node can't start
+func runDoctorCommand(args []string) {
+	d := &diagnosis{}
+	doctorConfig(d)
+	doctorStorage(d)
+	doctorKeys(d)
+	doctorClock(d)
+	doctorPort(d)
+	if d.failed {
+		fmt.Println("problems found, fix the FAIL lines before starting the node")
+		os.Exit(1)
+	}
+	fmt.Println("all checks passed")
+}
+
+func doctorConfig(d *diagnosis) {
+	if _, err := strconv.Atoi(os.Getenv("PORT")); err != nil && (os.Getenv("PORT") != "" || os.Getenv("UNIX_SOCKET") == "") {
+		d.report(checkFail, "config", "PORT must be a port number, got "+strconv.Quote(os.Getenv("PORT")))
+	}
+	for _, key := range []string{"SYNC_INTERVAL", "ARCHIVE_INTERVAL", "LIMIT_QUEUE_TIMEOUT", "LIMIT_QUEUE_TIMEOUT_DEVICE", "LIMIT_QUEUE_TIMEOUT_INTERACTIVE", "LIMIT_QUEUE_TIMEOUT_BULK", "HEAD_DNS_INTERVAL", "REQUEST_DEADLINE_DEVICE", "REQUEST_DEADLINE_INTERACTIVE", "REQUEST_DEADLINE_BULK", "BLOCK_TIME_TOLERANCE", "IDEMPOTENCY_TTL", "SUBMISSION_RETENTION", "NOTARIZE_INTERVAL", "GROUP_COMMIT_WINDOW", "MEMPOOL_INTERVAL", "SNAPSHOT_TTL", "METRICS_INTERVAL"} {
+		if v := os.Getenv(key); v != "" {
+			if _, err := time.ParseDuration(v); err != nil {
+				d.report(checkFail, "config", key+" is not a duration like 30s: "+err.Error())
+			}
+		}
+	}
+	for _, key := range []string{"LIMIT_GLOBAL", "LIMIT_CHAIN", "LIMIT_BULK", "MEMPOOL_MAX_EVENTS", "AGGREGATE_MIN_COUNT", "AUDIT_MAX_BYTES", "AUDIT_KEEP"} {
+		if v := os.Getenv(key); v != "" {
+			if n, err := strconv.Atoi(v); err != nil || n < 1 {
+				d.report(checkFail, "config", key+" must be a positive number")
+			}
+		}
+	}
+	if poaEnabled() {
+		if _, _, err := parseValidators(os.Getenv("VALIDATORS"), os.Getenv("QUORUM")); err != nil {
+			d.report(checkFail, "config", err.Error())
+		}
+	}
+	if v := os.Getenv("CONSENSUS"); v != "" && v != "poa" && v != "pow" && v != "raft" {
+		d.report(checkFail, "config", "CONSENSUS must be empty, poa, pow or raft")
+	}
+	if a := os.Getenv("ARCHIVE"); a != "" && a != "dir" && a != "s3" {
+		d.report(checkFail, "config", "ARCHIVE must be dir or s3")
+	}
+	if !d.failed {
+		d.report(checkOK, "config", "settings parse")
+	}
+}
+
+func doctorStorage(d *diagnosis) {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		d.report(checkWarn, "storage", "DATA_DIR not set, the chain will be lost on restart")
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		d.report(checkFail, "storage", "cannot create DATA_DIR: "+err.Error())
+		return
+	}
+	probe := filepath.Join(dir, ".doctor")
+	if err := ioutil.WriteFile(probe, []byte("ok"), 0600); err != nil {
+		d.report(checkFail, "storage", "DATA_DIR is not writable: "+err.Error())
+		return
+	}
+	os.Remove(probe)
+
+	s, err := newStore(dir)
+	if err != nil {
+		d.report(checkFail, "storage", err.Error())
+		return
+	}
+	defer s.Close()
+	blocks, err := s.Load()
+	if err != nil {
+		d.report(checkFail, "storage", "chain is unreadable: "+err.Error())
+		return
+	}
+	version, err := s.SchemaVersion()
+	switch {
+	case err != nil:
+		d.report(checkFail, "storage", "SCHEMA is unreadable: "+err.Error())
+	case version > latestSchemaVersion():
+		d.report(checkFail, "storage", fmt.Sprintf("schema %d is newer than this node supports (%d)", version, latestSchemaVersion()))
+	case version < latestSchemaVersion():
+		d.report(checkWarn, "storage", fmt.Sprintf("schema %d will be migrated to %d, see the migrate subcommand", version, latestSchemaVersion()))
+	default:
+		d.report(checkOK, "storage", fmt.Sprintf("%d blocks at schema %d", len(blocks), version))
+	}
+
+	free, err := freeBytes(dir)
+	switch {
+	case err != nil:
+		d.report(checkSkip, "storage", "free space unknown: "+err.Error())
+	case free < minFreeBytes:
+		d.report(checkWarn, "storage", fmt.Sprintf("only %d MiB free in DATA_DIR", free>>20))
+	default:
+		d.report(checkOK, "storage", fmt.Sprintf("%d MiB free", free>>20))
+	}
+}
+
+func doctorKeys(d *diagnosis) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	if certFile == "" {
+		if len(os.Getenv("PEERS")) > 0 || len(os.Getenv("ALLOWED_CLIENT_IDS")) > 0 || len(os.Getenv("ADMIN_CLIENT_IDS")) > 0 {
+			d.report(checkFail, "keys", "PEERS, ALLOWED_CLIENT_IDS and ADMIN_CLIENT_IDS require TLS_CERT_FILE and TLS_KEY_FILE")
+		} else {
+			d.report(checkSkip, "keys", "TLS not configured, serving plain HTTP")
+		}
+		return
+	}
+	pair, err := nodeCertificate()
+	if err != nil {
+		d.report(checkFail, "keys", "cannot load TLS_CERT_FILE/NODE_KEY: "+err.Error())
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		d.report(checkFail, "keys", err.Error())
+		return
+	}
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		d.report(checkFail, "keys", "certificate expired on "+leaf.NotAfter.String())
+	case left < 14*24*time.Hour:
+		d.report(checkWarn, "keys", "certificate expires on "+leaf.NotAfter.String())
+	default:
+		d.report(checkOK, "keys", "certificate valid until "+leaf.NotAfter.String()+", fingerprint "+certFingerprint(pair.Certificate[0]))
+	}
+
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil || !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			d.report(checkFail, "keys", "TLS_CLIENT_CA_FILE holds no usable certificates")
+		}
+	}
+	for _, pin := range strings.Split(os.Getenv("PEER_PINS"), ",") {
+		pin = strings.Replace(strings.TrimSpace(pin), ":", "", -1)
+		if pin == "" {
+			continue
+		}
+		if raw, err := hex.DecodeString(pin); err != nil || len(raw) != 32 {
+			d.report(checkFail, "keys", "PEER_PINS entry "+pin+" is not a SHA-256 fingerprint")
+		}
+	}
+}
+
+// doctorClock compares the local clock with the Date header of
+// CLOCK_REFERENCE_URL
+func doctorClock(d *diagnosis) {
+	ref := os.Getenv("CLOCK_REFERENCE_URL")
+	if ref == "" {
+		d.report(checkSkip, "clock", "set CLOCK_REFERENCE_URL to check clock skew")
+		return
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	start := time.Now()
+	resp, err := client.Head(ref)
+	if err != nil {
+		d.report(checkWarn, "clock", "cannot reach "+ref+": "+err.Error())
+		return
+	}
+	resp.Body.Close()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.report(checkWarn, "clock", ref+" sent no usable Date header")
+		return
+	}
+	// Date has one second resolution, compare against the request midpoint
+	local := start.Add(time.Since(start) / 2)
+	skew := local.Sub(remote)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew+time.Second {
+		d.report(checkFail, "clock", fmt.Sprintf("clock is off by %v, block timestamps would be wrong, check NTP", skew.Round(time.Millisecond)))
+		return
+	}
+	d.report(checkOK, "clock", fmt.Sprintf("within %v of %s", skew.Round(time.Millisecond), ref))
+}
+
+func doctorPort(d *diagnosis) {
+	if os.Getenv("PORT") == "" {
+		d.report(checkSkip, "port", "PORT not set, serving on UNIX_SOCKET only")
+		return
+	}
+	for _, addr := range listenAddrs() {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			d.report(checkFail, "port", "cannot listen: "+err.Error()+", is another node running?")
+			continue
+		}
+		l.Close()
+		d.report(checkOK, "port", addr+" is free")
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"golang.org/x/crypto/scrypt"
+)
+
+// STORAGE=encrypted keeps the chain in DATA_DIR/segments. Each segment file
+// holds up to encryptedSegmentBlocks blocks sealed with AES-256-GCM under its
+// own data key, and the data key is kept next to it wrapped by the master
+// key STORAGE_MASTER_KEY:
+//
+//	passphrase:<VAR>   derived with scrypt from the passphrase in $VAR
+//	awskms:<key id>    an AWS KMS key
+//
+// To rotate the master, set the new one and list the old one in
+// STORAGE_OLD_MASTER_KEYS. Nothing is re-encrypted: data keys of old
+// segments are re-wrapped in the background, one segment at a time, and
+// GET /status shows how many are left.
+//
+// A segment file starts with encSegmentMagic, then per block a uint32
+// ciphertext length, a 12 byte nonce and the sealed JSON block. The
+// segment and record numbers are authenticated, so records can't be moved.
+type encryptedStore struct {
+	dir     string
+	segDir  string
+	master  masterKey
+	keyring map[string]masterKey
+
+	// mutex guards the segments against the re-wrapping task
+	mutex    sync.Mutex
+	segments []*encSegment
+	// the last segment, open for appending
+	file *os.File
+	size int64
+}
+
+// encSegment is one segment file and its data key
+type encSegment struct {
+	n      int
+	master string
+	aead   cipher.AEAD
+	count  int
+}
+
+// segmentKey is a segment's .key file
+type segmentKey struct {
+	Master  string
+	Wrapped []byte
+}
+
+// masterKey wraps and unwraps data keys
+type masterKey interface {
+	ID() string
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// EncryptionStatus is reported by GET /status for STORAGE=encrypted
+type EncryptionStatus struct {
+	Master   string `json:"master"`
+	Segments int    `json:"segments"`
+	// Rewrapping counts segments still wrapped by an old master key
+	Rewrapping int            `json:"rewrapping"`
+	ByMaster   map[string]int `json:"by_master"`
+}
+
+const (
+	encSegmentMagic        = "BLKENC01"
+	encryptedSegmentBlocks = 10000
+	// pause between two segments re-wrapped in the background
+	rewrapInterval = time.Second
+	// per record: ciphertext length and nonce
+	encRecordHeader = 4 + 12
+)
+
+func newEncryptedStore(dir string) (*encryptedStore, error) {
+	s := &encryptedStore{dir: dir, segDir: filepath.Join(dir, "segments"), keyring: make(map[string]masterKey)}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := finishRewrite(s.segDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.segDir, 0700); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.master, err = parseMasterKey(os.Getenv("STORAGE_MASTER_KEY"), dir); err != nil {
+		return nil, err
+	}
+	s.keyring[s.master.ID()] = s.master
+	for _, ref := range strings.Split(os.Getenv("STORAGE_OLD_MASTER_KEYS"), ",") {
+		if ref = strings.TrimSpace(ref); ref == "" {
+			continue
+		}
+		old, err := parseMasterKey(ref, dir)
+		if err != nil {
+			return nil, err
+		}
+		s.keyring[old.ID()] = old
+	}
+
+	if err := s.openSegments(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(s.segments) == 0 {
+		if err := s.importJSONL(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if s.status().Rewrapping > 0 {
+		go s.rewrap()
+	}
+	return s, nil
+}
+
+// openSegments unwraps every data key and opens the last segment for
+// appending, cutting off a record torn by a crash
+func (s *encryptedStore) openSegments() error {
+	names, err := filepath.Glob(filepath.Join(s.segDir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".seg"))
+		if err != nil || n != i {
+			return errors.New("unexpected segment file " + name)
+		}
+		seg := &encSegment{n: n, count: encryptedSegmentBlocks}
+		if err := s.unwrapSegment(seg); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.file, _, err = openMagicFile(s.segmentPath(last.n, ".seg"), encSegmentMagic, nil); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(s.file)
+	if err != nil {
+		return err
+	}
+	count, size, err := s.readSegment(last, data, nil)
+	if err != nil {
+		return err
+	}
+	if size < int64(len(data)) {
+		log.Printf("dropping %d bytes of a torn record at the end of segment %d", int64(len(data))-size, last.n)
+		if err := s.file.Truncate(size); err != nil {
+			return err
+		}
+	}
+	last.count, s.size = count, size
+	return nil
+}
+
+func (s *encryptedStore) segmentPath(n int, ext string) string {
+	return filepath.Join(s.segDir, fmt.Sprintf("%06d%s", n, ext))
+}
+
+// unwrapSegment reads a segment's data key
+func (s *encryptedStore) unwrapSegment(seg *encSegment) error {
+	raw, err := ioutil.ReadFile(s.segmentPath(seg.n, ".key"))
+	if err != nil {
+		return err
+	}
+	var k segmentKey
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return err
+	}
+	master, ok := s.keyring[k.Master]
+	if !ok {
+		return fmt.Errorf("segment %d is wrapped by master key %s, list it in STORAGE_OLD_MASTER_KEYS", seg.n, k.Master)
+	}
+	dataKey, err := master.Unwrap(k.Wrapped)
+	if err != nil {
+		return fmt.Errorf("unwrapping the data key of segment %d: %v", seg.n, err)
+	}
+	seg.master = k.Master
+	seg.aead, err = newGCM(dataKey)
+	return err
+}
+
+// writeSegmentKey replaces a segment's .key file atomically
+func (s *encryptedStore) writeSegmentKey(n int, k segmentKey) error {
+	raw, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	name := s.segmentPath(n, ".key")
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(raw); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// newSegment starts segment n with a fresh data key and opens it
+func (s *encryptedStore) newSegment(n int) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	wrapped, err := s.master.Wrap(dataKey)
+	if err != nil {
+		return err
+	}
+	if err := s.writeSegmentKey(n, segmentKey{s.master.ID(), wrapped}); err != nil {
+		return err
+	}
+	f, _, err := openMagicFile(s.segmentPath(n, ".seg"), encSegmentMagic, nil)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.size = f, int64(len(encSegmentMagic))
+	s.segments = append(s.segments, &encSegment{n: n, master: s.master.ID(), aead: aead})
+	return nil
+}
+
+// readSegment decrypts the records in data and hands them to fn. It
+// returns how many records are complete and where the last one ends.
+func (s *encryptedStore) readSegment(seg *encSegment, data []byte, fn func(Block) error) (int, int64, error) {
+	pos, count := int64(len(encSegmentMagic)), 0
+	for pos+encRecordHeader <= int64(len(data)) {
+		n := int64(binary.LittleEndian.Uint32(data[pos:]))
+		end := pos + encRecordHeader + n
+		if end > int64(len(data)) {
+			break
+		}
+		nonce := data[pos+4 : pos+encRecordHeader]
+		plain, err := seg.aead.Open(nil, nonce, data[pos+encRecordHeader:end], recordAAD(seg.n, count))
+		if err != nil {
+			return 0, 0, fmt.Errorf("segment %d record %d does not decrypt: %v", seg.n, count, err)
+		}
+		if fn != nil {
+			var b Block
+			if err := unmarshalCompat(plain, &b); err != nil {
+				return 0, 0, err
+			}
+			if err := fn(b); err != nil {
+				return 0, 0, err
+			}
+		}
+		pos, count = end, count+1
+	}
+	return count, pos, nil
+}
+
+// recordAAD binds a record to its place in the chain
+func recordAAD(segment, record int) []byte {
+	aad := make([]byte, 16)
+	binary.LittleEndian.PutUint64(aad, uint64(segment))
+	binary.LittleEndian.PutUint64(aad[8:], uint64(record))
+	return aad
+}
+
+// importJSONL encrypts an existing chain.jsonl the first time
+// STORAGE=encrypted is used. chain.jsonl is left in place for the operator
+// to remove once the node runs.
+func (s *encryptedStore) importJSONL() error {
+	if _, err := os.Stat(filepath.Join(s.dir, "chain.jsonl")); err != nil {
+		return nil
+	}
+	old, err := newFileStore(s.dir)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	blocks, err := old.Load()
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+	if err := s.AppendBatch(blocks); err != nil {
+		return err
+	}
+	log.Printf("encrypted %d blocks from chain.jsonl into %s; remove chain.jsonl, it is no longer used", len(blocks), s.segDir)
+	return nil
+}
+
+func (s *encryptedStore) Append(b Block) error {
+	return s.AppendBatch([]Block{b})
+}
+
+// AppendBatch seals the blocks into the last segment, starting new ones as
+// segments fill, and syncs each segment written to once
+func (s *encryptedStore) AppendBatch(blocks []Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var buf []byte
+	pending := 0
+	// records only count once they are synced
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		if _, err := s.file.WriteAt(buf, s.size); err != nil {
+			return err
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		s.size += int64(len(buf))
+		s.segments[len(s.segments)-1].count += pending
+		buf, pending = buf[:0], 0
+		return nil
+	}
+
+	for _, b := range blocks {
+		if len(s.segments) == 0 || s.segments[len(s.segments)-1].count+pending == encryptedSegmentBlocks {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := s.newSegment(len(s.segments)); err != nil {
+				return err
+			}
+		}
+		seg := s.segments[len(s.segments)-1]
+		plain, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, 12)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := seg.aead.Seal(nil, nonce, plain, recordAAD(seg.n, seg.count+pending))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(sealed)))
+		buf = append(append(buf, nonce...), sealed...)
+		pending++
+	}
+	return flush()
+}
+
+func (s *encryptedStore) Load() ([]Block, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var blocks []Block
+	for _, seg := range s.segments {
+		data, err := ioutil.ReadFile(s.segmentPath(seg.n, ".seg"))
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := s.readSegment(seg, data, func(b Block) error {
+			blocks = append(blocks, b)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// Rewrite seals the blocks into a new segment directory with new data keys
+// and swaps it in
+func (s *encryptedStore) Rewrite(blocks []Block) error {
+	tmp := &encryptedStore{dir: s.dir, segDir: s.segDir + ".tmp", master: s.master, keyring: s.keyring}
+	os.RemoveAll(tmp.segDir)
+	if err := os.MkdirAll(tmp.segDir, 0700); err != nil {
+		return err
+	}
+	err := tmp.AppendBatch(blocks)
+	tmp.Close()
+	if err == nil {
+		// finishRewrite trusts a complete .tmp once .old exists
+		err = syncDir(tmp.segDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp.segDir)
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	old := s.segDir + ".old"
+	os.RemoveAll(old)
+	if err := os.Rename(s.segDir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.segDir, s.segDir); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	os.RemoveAll(old)
+	s.segments = nil
+	return s.openSegments()
+}
+
+// finishRewrite repairs what a Rewrite interrupted by a crash left behind.
+// Rewrite renames segDir to segDir.old only once segDir.tmp is complete and
+// synced, so without segDir the swap is finished from .tmp, or undone from
+// .old if .tmp is gone too. With segDir in place, .tmp is unfinished and
+// .old replaced.
+func finishRewrite(segDir string) error {
+	tmp, old := segDir+".tmp", segDir+".old"
+	if _, err := os.Stat(segDir); os.IsNotExist(err) {
+		if _, err := os.Stat(old); err != nil {
+			// nothing was swapped, a new store
+			return nil
+		}
+		from := tmp
+		if _, err := os.Stat(tmp); err != nil {
+			from = old
+		}
+		log.Printf("finishing an interrupted rewrite of %s from %s", segDir, from)
+		if err := os.Rename(from, segDir); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(segDir)); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	os.RemoveAll(tmp)
+	os.RemoveAll(old)
+	return nil
+}
+
+// syncDir makes the entries of dir, such as renames into it, durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (s *encryptedStore) SchemaVersion() (int, error) {
+	return readSchemaVersion(s.dir)
+}
+
+func (s *encryptedStore) SetSchemaVersion(v int) error {
+	return writeSchemaVersion(s.dir, v)
+}
+
+func (s *encryptedStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// rewrap moves the data keys of segments wrapped by an old master key to
+// the current one
+func (s *encryptedStore) rewrap() {
+	current := s.master.ID()
+	for {
+		s.mutex.Lock()
+		var seg *encSegment
+		for _, candidate := range s.segments {
+			if candidate.master != current {
+				seg = candidate
+				break
+			}
+		}
+		s.mutex.Unlock()
+		if seg == nil {
+			log.Println("all storage segments are wrapped by master key", current)
+			return
+		}
+		if err := s.rewrapSegment(seg); err != nil {
+			log.Printf("re-wrapping segment %d failed, retrying: %v", seg.n, err)
+		}
+		time.Sleep(rewrapInterval)
+	}
+}
+
+// rewrapSegment re-wraps one data key. The master keys are called without
+// holding s.mutex, so a slow KMS doesn't hold up appends.
+func (s *encryptedStore) rewrapSegment(seg *encSegment) error {
+	raw, err := ioutil.ReadFile(s.segmentPath(seg.n, ".key"))
+	if err != nil {
+		return err
+	}
+	var k segmentKey
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return err
+	}
+	old, ok := s.keyring[k.Master]
+	if !ok {
+		return errors.New("unknown master key " + k.Master)
+	}
+	dataKey, err := old.Unwrap(k.Wrapped)
+	if err != nil {
+		return err
+	}
+	wrapped, err := s.master.Wrap(dataKey)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// a Rewrite in the meantime replaced the segment and its key
+	if seg.n >= len(s.segments) || s.segments[seg.n] != seg {
+		return nil
+	}
+	if err := s.writeSegmentKey(seg.n, segmentKey{s.master.ID(), wrapped}); err != nil {
+		return err
+	}
+	seg.master = s.master.ID()
+	return nil
+}
+
+func (s *encryptedStore) status() EncryptionStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st := EncryptionStatus{Master: s.master.ID(), Segments: len(s.segments), ByMaster: make(map[string]int)}
+	for _, seg := range s.segments {
+		st.ByMaster[seg.master]++
+		if seg.master != st.Master {
+			st.Rewrapping++
+		}
+	}
+	return st
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseMasterKey opens a passphrase:<VAR> or awskms:<key id> master key
+func parseMasterKey(ref, dataDir string) (masterKey, error) {
+	i := strings.Index(ref, ":")
+	if i <= 0 || i == len(ref)-1 {
+		return nil, errors.New("master keys look like passphrase:<VAR> or awskms:<key id>, got " + strconv.Quote(ref))
+	}
+	switch kind, name := ref[:i], ref[i+1:]; kind {
+	case "passphrase":
+		return newPassphraseKey(os.Getenv(name), dataDir)
+	case "awskms":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return &kmsMasterKey{kms.New(sess), name}, nil
+	default:
+		return nil, errors.New("unknown master key type " + kind)
+	}
+}
+
+// passphraseKey derives the key encryption key from a passphrase and the
+// salt in DATA_DIR/master.salt
+type passphraseKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newPassphraseKey(passphrase, dataDir string) (*passphraseKey, error) {
+	if len(passphrase) < 12 {
+		return nil, errors.New("storage passphrases must be at least 12 characters")
+	}
+	saltFile := filepath.Join(dataDir, "master.salt")
+	salt, err := ioutil.ReadFile(saltFile)
+	if os.IsNotExist(err) {
+		salt = make([]byte, 16)
+		if _, err = rand.Read(salt); err == nil {
+			err = ioutil.WriteFile(saltFile, salt, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	kek, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	// names the key without revealing it
+	sum := sha256.Sum256(kek)
+	return &passphraseKey{"passphrase:" + hex.EncodeToString(sum[:8]), aead}, nil
+}
+
+func (k *passphraseKey) ID() string { return k.id }
+
+func (k *passphraseKey) Wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (k *passphraseKey) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < k.aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	n := k.aead.NonceSize()
+	return k.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+}
+
+// kmsMasterKey wraps data keys with AWS KMS Encrypt and Decrypt
+type kmsMasterKey struct {
+	svc   *kms.KMS
+	keyID string
+}
+
+func (k *kmsMasterKey) ID() string { return "awskms:" + k.keyID }
+
+func (k *kmsMasterKey) Wrap(dataKey []byte) ([]byte, error) {
+	out, err := k.svc.Encrypt(&kms.EncryptInput{KeyId: aws.String(k.keyID), Plaintext: dataKey})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (k *kmsMasterKey) Unwrap(wrapped []byte) ([]byte, error) {
+	out, err := k.svc.Decrypt(&kms.DecryptInput{CiphertextBlob: wrapped, KeyId: aws.String(k.keyID)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestEncryptedStore opens the encrypted store in dir under a test
+// passphrase
+func openTestEncryptedStore(t *testing.T, dir string) *encryptedStore {
+	t.Helper()
+	t.Setenv("TEST_STORAGE_PASSPHRASE", "correct horse battery staple")
+	t.Setenv("STORAGE_MASTER_KEY", "passphrase:TEST_STORAGE_PASSPHRASE")
+	t.Setenv("STORAGE_OLD_MASTER_KEYS", "")
+	s, err := newEncryptedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// copyDir copies the files of src into a new directory dst
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	if err := os.Mkdir(dst, 0700); err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(filepath.Join(src, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dst, filepath.Base(name)), data, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncryptedStoreFinishesInterruptedRewrite(t *testing.T) {
+	before := []Block{{Index: 0, Event: "genesis", Hash: "h0"}, {Index: 1, Event: "door opened", Hash: "h1", PrevHash: "h0"}}
+	after := []Block{{Index: 0, Event: "genesis", Hash: "h0"}}
+
+	for _, tc := range []struct {
+		name string
+		// crash turns the rewritten store in dir into what a crash left
+		crash func(t *testing.T, segDir, saved string)
+		want  []Block
+	}{
+		{"after moving the old segments away", func(t *testing.T, segDir, saved string) {
+			if err := os.Rename(segDir, segDir+".tmp"); err != nil {
+				t.Fatal(err)
+			}
+			copyDir(t, saved, segDir+".old")
+		}, after},
+		{"with only the old segments", func(t *testing.T, segDir, saved string) {
+			if err := os.RemoveAll(segDir); err != nil {
+				t.Fatal(err)
+			}
+			copyDir(t, saved, segDir+".old")
+		}, before},
+		{"before removing the old segments", func(t *testing.T, segDir, saved string) {
+			copyDir(t, saved, segDir+".old")
+		}, after},
+		{"while writing the new segments", func(t *testing.T, segDir, saved string) {
+			if err := os.RemoveAll(segDir); err != nil {
+				t.Fatal(err)
+			}
+			copyDir(t, saved, segDir)
+			if err := os.Mkdir(segDir+".tmp", 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(segDir+".tmp", "000000.seg"), []byte("BLKENC01torn"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, before},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestEncryptedStore(t, dir)
+			if err := s.AppendBatch(before); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			saved := filepath.Join(t.TempDir(), "saved")
+			copyDir(t, s.segDir, saved)
+
+			s = openTestEncryptedStore(t, dir)
+			if err := s.Rewrite(after); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			tc.crash(t, s.segDir, saved)
+
+			s = openTestEncryptedStore(t, dir)
+			defer s.Close()
+			loaded, err := s.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != len(tc.want) || loaded[len(loaded)-1].Hash != tc.want[len(tc.want)-1].Hash {
+				t.Errorf("loaded %+v, want %+v", loaded, tc.want)
+			}
+			for _, leftover := range []string{s.segDir + ".tmp", s.segDir + ".old"} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s is still there", leftover)
+				}
+			}
+		})
+	}
+}
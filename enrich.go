@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Enrichment adds context to events before they are hashed. ENRICHMENT lists
+// the stages to run, in order, e.g. "normalize,geo,device,severity". Every
+// stage that applied is recorded under "enrichment" in the block's Metadata
+// with what it added, so the block shows how it was derived from the write
+// even after the site or device registries change. "enrichment" is
+// reserved: decodeWrite drops a write's own, except with REPLAY_MODE=true,
+// where it is kept and the stages are skipped so replayed writes hash like
+// the originals.
+
+// enrichStage is one step of the pipeline. apply may change m and returns
+// what it added, or false when it didn't apply. meta is the write's Metadata
+// so far. Register new stages in enrichStages.
+type enrichStage struct {
+	name  string
+	apply func(m *CreateBlockReq, meta map[string]json.RawMessage) (interface{}, bool)
+}
+
+var enrichStages = []enrichStage{
+	{"normalize", enrichNormalize},
+	{"geo", enrichGeo},
+	{"device", enrichDevice},
+	{"severity", enrichSeverity},
+}
+
+// EnrichmentRecord is one applied stage in a block's Metadata
+type EnrichmentRecord struct {
+	Stage  string      `json:"stage"`
+	Result interface{} `json:"result"`
+}
+
+// the stages configured by ENRICHMENT
+var enrichment []enrichStage
+var enrichmentMutex = &sync.RWMutex{}
+
+// loadEnrichment reads ENRICHMENT
+func loadEnrichment() error {
+	apply, err := prepareEnrichment(map[string]string{"ENRICHMENT": os.Getenv("ENRICHMENT")})
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareEnrichment validates a reloaded ENRICHMENT
+func prepareEnrichment(env map[string]string) (func(), error) {
+	var stages []enrichStage
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(env["ENRICHMENT"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, s := range enrichStages {
+			if s.name == name {
+				stages, found = append(stages, s), true
+			}
+		}
+		if !found {
+			return nil, errors.New("unknown enrichment stage " + name)
+		}
+		if seen[name] {
+			return nil, errors.New("enrichment stage " + name + " is listed twice")
+		}
+		seen[name] = true
+	}
+	return func() {
+		enrichmentMutex.Lock()
+		enrichment = stages
+		enrichmentMutex.Unlock()
+	}, nil
+}
+
+// enrichEvent runs the configured stages on m and records them in its
+// Metadata. Callers must not hold mutex: stages read the registries.
+func enrichEvent(m CreateBlockReq) CreateBlockReq {
+	enrichmentMutex.RLock()
+	stages := enrichment
+	enrichmentMutex.RUnlock()
+	if len(stages) == 0 {
+		return m
+	}
+
+	meta := make(map[string]json.RawMessage)
+	if len(m.metadata) > 0 {
+		if err := json.Unmarshal(m.metadata, &meta); err != nil {
+			log.Println("enrichment skipped, Metadata is not an object:", err)
+			return m
+		}
+	}
+	if _, ok := meta["enrichment"]; ok && os.Getenv("REPLAY_MODE") == "true" {
+		return m
+	}
+
+	records := make([]EnrichmentRecord, 0, len(stages))
+	for _, s := range stages {
+		if result, ok := s.apply(&m, meta); ok {
+			records = append(records, EnrichmentRecord{s.name, result})
+		}
+	}
+	if len(records) == 0 {
+		return m
+	}
+	raw, err := json.Marshal(records)
+	if err != nil {
+		log.Println("recording enrichment failed:", err)
+		return m
+	}
+	meta["enrichment"] = raw
+	if m.metadata, err = json.Marshal(meta); err != nil {
+		log.Println("recording enrichment failed:", err)
+	}
+	return m
+}
+
+// enrichNormalize trims the text fields and lower-cases FileHash. It
+// returns the fields it changed. Device signed events are left alone, their
+// HMAC covers the fields as sent.
+func enrichNormalize(m *CreateBlockReq, meta map[string]json.RawMessage) (interface{}, bool) {
+	if m.KeyID != "" {
+		return nil, false
+	}
+	var changed []string
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"FileHash", &m.FileHash}, {"Event", &m.Event}, {"EventTime", &m.EventTime},
+		{"Location", &m.Location}, {"Server", &m.Server},
+	} {
+		v := strings.TrimSpace(*f.value)
+		if f.name == "FileHash" {
+			v = strings.ToLower(v)
+		}
+		if v != *f.value {
+			*f.value = v
+			changed = append(changed, f.name)
+		}
+	}
+	return changed, len(changed) > 0
+}
+
+// enrichGeo adds the site named by Location, see lookupSite
+func enrichGeo(m *CreateBlockReq, meta map[string]json.RawMessage) (interface{}, bool) {
+	s, ok := lookupSite(m.Location)
+	return s, ok
+}
+
+// DeviceContext is what the device stage records about the Server
+type DeviceContext struct {
+	Name     string `json:"name"`
+	Owner    string `json:"owner"`
+	Location string `json:"location"`
+}
+
+// enrichDevice adds the registered device writing as Server
+func enrichDevice(m *CreateBlockReq, meta map[string]json.RawMessage) (interface{}, bool) {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	d, ok := devices[normalizeText(m.Server)]
+	if !ok {
+		return nil, false
+	}
+	return DeviceContext{d.Name, d.Owner, d.Location}, true
+}
+
+// severityRules map words in an Event to a severity, checked in order
+var severityRules = []struct {
+	words    []string
+	severity string
+}{
+	{[]string{"unauthorized", "unauthorised", "denied", "malware", "intrusion", "breach", "tamper"}, "high"},
+	{[]string{"fail", "error", "changed", "modified", "deleted", "silent"}, "medium"},
+}
+
+// enrichSeverity infers a severity from Event unless the write has one
+func enrichSeverity(m *CreateBlockReq, meta map[string]json.RawMessage) (interface{}, bool) {
+	if _, ok := meta["severity"]; ok {
+		return nil, false
+	}
+	event := strings.ToLower(m.Event)
+	for _, rule := range severityRules {
+		for _, w := range rule.words {
+			if strings.Contains(event, w) {
+				return rule.severity, true
+			}
+		}
+	}
+	return "low", true
+}
+
+// severityOf is a block's severity: the "severity" field of its Metadata or
+// else what the severity stage inferred, empty when it has neither
+func severityOf(b Block) string {
+	if len(b.Metadata) == 0 {
+		return ""
+	}
+	var meta struct {
+		Severity   interface{}        `json:"severity"`
+		Enrichment []EnrichmentRecord `json:"enrichment"`
+	}
+	if json.Unmarshal(b.Metadata, &meta) != nil {
+		return ""
+	}
+	if meta.Severity != nil {
+		return fmt.Sprint(meta.Severity)
+	}
+	for _, e := range meta.Enrichment {
+		if s, ok := e.Result.(string); ok && e.Stage == "severity" {
+			return s
+		}
+	}
+	return ""
+}
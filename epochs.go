@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Epochs cut the chain into periods of EPOCH_INTERVAL (24h gives UTC days).
+// Once a period is over the node appends an epoch block: FileHash is the
+// Merkle root (see merkleRoot) of the hashes of the blocks committed in the
+// period, Location the period as an RFC 3339 interval ("start/end") and
+// Metadata its EpochSummary. A day can then be audited, exported or pruned
+// on its own.
+//
+// With CONSENSUS=poa the node proposes the epoch block instead. It is only
+// committed once a quorum of validators voted for it, EPOCH_QUORUM when
+// that is higher than QUORUM, so every period carries a joint attestation
+// of the validators. The event is reserved, only epoch blocks the node
+// minted itself count (see nodeMinted).
+const epochEvent = "epoch"
+
+// EpochSummary is what an epoch block records about its period. First and
+// Last are the indexes of its blocks, Last is First-1 for an empty period.
+// Events counts the blocks per Event.
+type EpochSummary struct {
+	Start  string         `json:"start"`
+	End    string         `json:"end"`
+	First  int            `json:"first"`
+	Last   int            `json:"last"`
+	Blocks int            `json:"blocks"`
+	Events map[string]int `json:"events"`
+}
+
+// Epoch is one closed epoch, numbered from 0
+type Epoch struct {
+	Number     int      `json:"number"`
+	Block      BlockRef `json:"block"`
+	MerkleRoot string   `json:"merkle_root"`
+	EpochSummary
+}
+
+// EpochCheck is the response of GET /epochs/{n}: Valid says the blocks of
+// the period still have the Merkle root the epoch block committed to
+type EpochCheck struct {
+	Epoch
+	Valid bool `json:"valid"`
+}
+
+// epochInterval returns EPOCH_INTERVAL, zero when epochs are off
+func epochInterval() (time.Duration, error) {
+	v := os.Getenv("EPOCH_INTERVAL")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Minute {
+		return 0, errors.New("EPOCH_INTERVAL must be a duration of at least 1m, like 24h")
+	}
+	return d, nil
+}
+
+// startEpochs closes epochs as their periods end
+func startEpochs() error {
+	interval, err := epochInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+	if v := os.Getenv("EPOCH_QUORUM"); v != "" && poaEnabled() {
+		validatorMutex.RLock()
+		n := len(validators)
+		validatorMutex.RUnlock()
+		if q, err := strconv.Atoi(v); err != nil || q < 1 || q > n {
+			return errors.New("EPOCH_QUORUM must be between 1 and the number of validators")
+		}
+	}
+	check := time.Minute
+	if interval < check {
+		check = interval
+	}
+	go func() {
+		for {
+			if err := closeEpochs(interval, time.Now()); err != nil {
+				log.Println("closing epoch failed:", err)
+			}
+			time.Sleep(check)
+		}
+	}()
+	log.Println("closing an epoch every", interval)
+	return nil
+}
+
+// closeEpochs appends an epoch block for every period that ended by now,
+// including empty ones
+func closeEpochs(interval time.Duration, now time.Time) error {
+	mutex.Lock()
+	if len(Blockchain) == 0 {
+		mutex.Unlock()
+		return nil
+	}
+	start, first := nextEpochLocked(interval)
+	mutex.Unlock()
+
+	for end := start.Add(interval); !end.After(now); end = end.Add(interval) {
+		mutex.Lock()
+		summary, root := summarizeEpochLocked(start, end, first)
+		mutex.Unlock()
+
+		metadata, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		m := CreateBlockReq{
+			FileHash:  root,
+			Event:     epochEvent,
+			EventTime: summary.End,
+			Location:  summary.Start + "/" + summary.End,
+			Server:    nodeID(),
+			metadata:  metadata,
+			system:    true,
+		}
+		if poaEnabled() {
+			// the next epoch can only be proposed once this one is committed
+			return proposeEpoch(m)
+		}
+		b, err := addBlock(m, "")
+		if err != nil {
+			return err
+		}
+		log.Printf("closed epoch %s with %d blocks in block %d", summary.Start, summary.Blocks, b.Index)
+		start, first = end, summary.Last+1
+	}
+	return nil
+}
+
+// proposeEpoch proposes the epoch block m to the validators, unless a
+// proposal for it still extends the head. A proposal the head moved away
+// from is replaced, with the summary computed again.
+func proposeEpoch(m CreateBlockReq) error {
+	mutex.Lock()
+	head := Blockchain[len(Blockchain)-1]
+	candidate, err := mintBlock(head, m, "")
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	proposalMutex.Lock()
+	defer proposalMutex.Unlock()
+	pruneProposalsLocked()
+	for id, p := range proposals {
+		if p.State != proposalPending || p.Block.Event != epochEvent || p.Block.Location != candidate.Location {
+			continue
+		}
+		if p.Block.PrevHash == head.Hash {
+			return nil
+		}
+		// the head moved on, the old proposal can't be committed
+		delete(proposals, id)
+	}
+	now := time.Now()
+	proposals[candidate.Hash] = &Proposal{
+		ID:       candidate.Hash,
+		Proposer: nodeID(),
+		Block:    candidate,
+		Votes:    make(map[string]string),
+		State:    proposalPending,
+		Created:  now.String(),
+		created:  now,
+	}
+	log.Printf("proposed epoch %s as block %s", candidate.Location, candidate.Hash)
+	return nil
+}
+
+// requiredVotesLocked is the number of votes block b needs: EPOCH_QUORUM
+// for an epoch block when it is higher than QUORUM. Caller must hold
+// validatorMutex.
+func requiredVotesLocked(b Block) int {
+	if b.Event != epochEvent {
+		return quorum
+	}
+	if n, err := strconv.Atoi(os.Getenv("EPOCH_QUORUM")); err == nil && n > quorum && n <= len(validators) {
+		return n
+	}
+	return quorum
+}
+
+// nextEpochLocked returns the start and first block of the open epoch.
+// The first epoch starts with the period of the genesis block. Caller must
+// hold mutex.
+func nextEpochLocked(interval time.Duration) (time.Time, int) {
+	for i := len(Blockchain) - 1; i > 0; i-- {
+		if e, ok := epochOf(Blockchain[i]); ok {
+			if end, err := time.Parse(time.RFC3339, e.End); err == nil {
+				return end, e.Last + 1
+			}
+		}
+	}
+	t, ok := parseBlockTime(Blockchain[0].Timestamp)
+	if !ok {
+		t = time.Now()
+	}
+	return t.UTC().Truncate(interval), 0
+}
+
+// summarizeEpochLocked summarizes the blocks from first committed before
+// end. Caller must hold mutex.
+func summarizeEpochLocked(start, end time.Time, first int) (EpochSummary, string) {
+	summary := EpochSummary{
+		Start:  start.UTC().Format(time.RFC3339),
+		End:    end.UTC().Format(time.RFC3339),
+		First:  first,
+		Last:   first - 1,
+		Events: make(map[string]int),
+	}
+	var hashes []string
+	for i := first; i < len(Blockchain); i++ {
+		if t, ok := parseBlockTime(Blockchain[i].Timestamp); ok && !t.Before(end) {
+			break
+		}
+		summary.Last = i
+		summary.Blocks++
+		summary.Events[Blockchain[i].Event]++
+		hashes = append(hashes, Blockchain[i].Hash)
+	}
+	return summary, merkleRoot(hashes)
+}
+
+// epochOf decodes an epoch block. An epoch only covers blocks before its
+// own.
+func epochOf(b Block) (Epoch, bool) {
+	if b.Event != epochEvent || len(b.Metadata) == 0 || !nodeMinted(b) {
+		return Epoch{}, false
+	}
+	e := Epoch{Block: BlockRef{b.Index, b.Hash}, MerkleRoot: b.FileHash}
+	if json.Unmarshal(b.Metadata, &e.EpochSummary) != nil {
+		return Epoch{}, false
+	}
+	if e.First < 0 || e.First > e.Last+1 || e.Last >= b.Index {
+		return Epoch{}, false
+	}
+	return e, true
+}
+
+// epochsLocked lists the closed epochs. Caller must hold mutex.
+func epochsLocked() []Epoch {
+	epochs := make([]Epoch, 0)
+	for _, b := range Blockchain {
+		if e, ok := epochOf(b); ok {
+			e.Number = len(epochs)
+			epochs = append(epochs, e)
+		}
+	}
+	return epochs
+}
+
+// list the closed epochs
+func handleGetEpochs(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	epochs := epochsLocked()
+	mutex.Unlock()
+	respondWithList(w, r, http.StatusOK, epochs)
+}
+
+// epochParam finds epoch {n}, answering the request itself when it can't
+func epochParam(w http.ResponseWriter, r *http.Request) (Epoch, []Block, bool) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || n < 0 {
+		http.Error(w, "epoch must be a non-negative integer", http.StatusBadRequest)
+		return Epoch{}, nil, false
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	epochs := epochsLocked()
+	if n >= len(epochs) {
+		http.Error(w, "epoch not found", http.StatusNotFound)
+		return Epoch{}, nil, false
+	}
+	e := epochs[n]
+	if e.Last >= len(Blockchain) || e.First > e.Last+1 {
+		http.Error(w, "epoch block "+strconv.Itoa(e.Block.Index)+" names blocks the chain doesn't have", http.StatusInternalServerError)
+		return Epoch{}, nil, false
+	}
+	return e, append([]Block(nil), Blockchain[e.First:e.Last+1]...), true
+}
+
+// show epoch {n} and check its Merkle root against the chain
+func handleGetEpoch(w http.ResponseWriter, r *http.Request) {
+	e, blocks, ok := epochParam(w, r)
+	if !ok {
+		return
+	}
+	hashes := make([]string, len(blocks))
+	for i, b := range blocks {
+		hashes[i] = b.Hash
+	}
+	respondWithJSON(w, r, http.StatusOK, EpochCheck{e, merkleRoot(hashes) == e.MerkleRoot})
+}
+
+// export the blocks of epoch {n}
+func handleGetEpochBlocks(w http.ResponseWriter, r *http.Request) {
+	_, blocks, ok := epochParam(w, r)
+	if !ok {
+		return
+	}
+	respondWithBlocks(w, r, http.StatusOK, blocks)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Chain and store operations return these errors, wrapped in a BlockError
+// when they concern one block, so callers can branch on them with
+// errors.Is. Handlers answer them through respondWithError, which maps
+// every error kind to its HTTP status in one place.
+var (
+	ErrIndexGap        = errors.New("block index does not follow the previous block")
+	ErrInvalidPrevHash = errors.New("block does not link to the previous block's hash")
+	ErrHashMismatch    = errors.New("block hash does not match its contents")
+	ErrDuplicate       = errors.New("block is already on the chain")
+	ErrNotFound        = errors.New("block not found")
+)
+
+// reasons a block is invalid that embedders don't branch on
+var (
+	errBlockTime        = errors.New("block timestamp is not valid after the previous block")
+	errUnknownAlgorithm = errors.New("transition block names an unknown hash algorithm")
+)
+
+// BlockError is an error about the block at Index
+type BlockError struct {
+	Index int
+	Err   error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %d: %v", e.Index, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a block that no longer links to the head match errStaleBlock too
+func (e *BlockError) Is(target error) bool {
+	return target == errStaleBlock && (e.Err == ErrIndexGap || e.Err == ErrInvalidPrevHash)
+}
+
+// errorStatus is the HTTP status answering err
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errStaleBlock), errors.Is(err, ErrDuplicate):
+		return http.StatusConflict
+	case errors.Is(err, ErrHashMismatch), errors.Is(err, errBlockTime), errors.Is(err, errUnknownAlgorithm),
+		errors.Is(err, errInsufficientWork), errors.Is(err, errMerkleMismatch), errors.Is(err, errReservedEvent):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errBlockTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errWriteFrozen):
+		return http.StatusLocked
+	case errors.Is(err, errChainNotReady), errors.Is(err, errStandby), errors.Is(err, errChainCorrupt),
+		errors.Is(err, errNotLeader):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errStorageFull):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// respondWithError answers err with its status, telling clients when to
+// retry the errors that pass
+func respondWithError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errWriteFrozen):
+		w.Header().Set("Retry-After", retryAfterFreeze())
+	case errors.Is(err, errStorageFull):
+		w.Header().Set("Retry-After", retryAfterStorage)
+	case errors.Is(err, errChainNotReady):
+		w.Header().Set("Retry-After", "1")
+	case errors.Is(err, errNotLeader):
+		// retry once an election is over, or at the leader
+		w.Header().Set("Retry-After", "1")
+		if leader := raftLeader(); leader != "" {
+			http.Error(w, err.Error()+", the leader is "+leader, errorStatus(err))
+			return
+		}
+	}
+	http.Error(w, err.Error(), errorStatus(err))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventTime plausibility. With EVENT_TIME_MAX_AGE set, a write whose
+// EventTime is older than that, or later than EVENT_TIME_MAX_SKEW (default
+// 0) ahead of our clock, is rejected. EVENT_TIME_OVERRIDES gives single
+// Servers their own maximum age ("backfill-1:8760h", or "none" to skip the
+// check), for batch backfills of old events.
+
+// eventTimeWindow is the parsed configuration
+type eventTimeWindow struct {
+	maxAge    time.Duration
+	maxSkew   time.Duration
+	overrides map[string]time.Duration
+}
+
+// override value that turns the check off for a Server
+const eventTimeUnchecked = time.Duration(-1)
+
+var errEventTimeFormat = errors.New("EventTime must be an RFC 3339 time")
+
+var eventTimeConfig eventTimeWindow
+var eventTimeMutex = &sync.RWMutex{}
+
+// loadEventTimeWindow reads the EVENT_TIME_* settings
+func loadEventTimeWindow() error {
+	env := make(map[string]string)
+	for _, key := range []string{"EVENT_TIME_MAX_AGE", "EVENT_TIME_MAX_SKEW", "EVENT_TIME_OVERRIDES"} {
+		env[key] = os.Getenv(key)
+	}
+	apply, err := prepareEventTimeWindow(env)
+	if err != nil {
+		return err
+	}
+	apply()
+	if eventTimeConfig.maxAge > 0 {
+		log.Println("EventTime must be within", eventTimeConfig.maxAge, "of submission")
+	}
+	return nil
+}
+
+// prepareEventTimeWindow validates reloaded EVENT_TIME_* settings
+func prepareEventTimeWindow(env map[string]string) (func(), error) {
+	var w eventTimeWindow
+	var err error
+	if v := env["EVENT_TIME_MAX_AGE"]; v != "" {
+		if w.maxAge, err = time.ParseDuration(v); err != nil || w.maxAge <= 0 {
+			return nil, errors.New("EVENT_TIME_MAX_AGE must be a positive duration")
+		}
+	}
+	if v := env["EVENT_TIME_MAX_SKEW"]; v != "" {
+		if w.maxSkew, err = time.ParseDuration(v); err != nil || w.maxSkew < 0 {
+			return nil, errors.New("EVENT_TIME_MAX_SKEW must be a duration")
+		}
+	}
+	w.overrides = make(map[string]time.Duration)
+	for _, entry := range strings.Split(env["EVENT_TIME_OVERRIDES"], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, errors.New("EVENT_TIME_OVERRIDES entries look like server:720h or server:none")
+		}
+		age := eventTimeUnchecked
+		if v := entry[i+1:]; v != "none" {
+			if age, err = time.ParseDuration(v); err != nil || age <= 0 {
+				return nil, errors.New("bad maximum age in EVENT_TIME_OVERRIDES entry " + entry)
+			}
+		}
+		w.overrides[normalizeText(entry[:i])] = age
+	}
+	if len(w.overrides) > 0 && w.maxAge == 0 {
+		return nil, errors.New("EVENT_TIME_OVERRIDES requires EVENT_TIME_MAX_AGE")
+	}
+	return func() {
+		eventTimeMutex.Lock()
+		eventTimeConfig = w
+		eventTimeMutex.Unlock()
+	}, nil
+}
+
+// verifyEventTime rejects an event whose EventTime is outside the window.
+// Events without an EventTime pass, authorized backfills only need to be
+// in the past.
+func verifyEventTime(m CreateBlockReq) error {
+	eventTimeMutex.RLock()
+	w := eventTimeConfig
+	eventTimeMutex.RUnlock()
+	if w.maxAge == 0 || m.EventTime == "" {
+		return nil
+	}
+	maxAge := w.maxAge
+	if m.Backfill && m.importer != "" {
+		maxAge = eventTimeUnchecked
+	} else if age, ok := w.overrides[normalizeText(m.Server)]; ok {
+		if age == eventTimeUnchecked {
+			return nil
+		}
+		maxAge = age
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, m.EventTime)
+	if err != nil {
+		var ok bool
+		if t, ok = parseBlockTime(m.EventTime); !ok {
+			return errEventTimeFormat
+		}
+	}
+	now := time.Now()
+	if t.After(now.Add(w.maxSkew)) {
+		return errors.New("EventTime is in the future")
+	}
+	if maxAge != eventTimeUnchecked && t.Before(now.Add(-maxAge)) {
+		return errors.New("EventTime is older than " + maxAge.String())
+	}
+	return nil
+}
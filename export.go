@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /export?format= hands the chain's event history to security tooling
+// in a standard audit schema, one JSON event per line:
+//
+//	cadf  DMTF CADF (DSP0262) events: the recording node is the observer,
+//	      the Server the initiator and the FileHash, or else the Location,
+//	      the target. The event name is tagged "event:<Event>".
+//	ocsf  OCSF 1.1 Base Events (class 0, activity Other) with the Event as
+//	      activity_name and message, the Server and FileHash as observables.
+//
+// Both carry the block's index and hash, so an exported event can be traced
+// back to the chain and verified there. Events are timed by their
+// EventTime when it parses, by the commit Timestamp otherwise.
+
+// largest range one export returns
+const maxExportBlocks = 10000
+
+const (
+	cadfEventType = "http://schemas.dmtf.org/cloud/audit/1.0/event"
+	ocsfVersion   = "1.1.0"
+	// OCSF Base Event, activity Other, severity Informational
+	ocsfActivityOther = 99
+	ocsfSeverityInfo  = 1
+	// OCSF observable types
+	ocsfObservableHostname = 1
+	ocsfObservableHash     = 8
+)
+
+// CADFResource is a CADF initiator, target or observer
+type CADFResource struct {
+	TypeURI string `json:"typeURI"`
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+}
+
+// CADFAttachment carries the block reference of a CADF event
+type CADFAttachment struct {
+	TypeURI string      `json:"typeURI"`
+	Name    string      `json:"name"`
+	Content interface{} `json:"content"`
+}
+
+// CADFEvent is one block as a CADF event
+type CADFEvent struct {
+	TypeURI     string           `json:"typeURI"`
+	ID          string           `json:"id"`
+	EventType   string           `json:"eventType"`
+	EventTime   string           `json:"eventTime"`
+	Action      string           `json:"action"`
+	Outcome     string           `json:"outcome"`
+	Initiator   CADFResource     `json:"initiator"`
+	Target      CADFResource     `json:"target"`
+	Observer    CADFResource     `json:"observer"`
+	Tags        []string         `json:"tags,omitempty"`
+	Attachments []CADFAttachment `json:"attachments"`
+}
+
+// OCSFProduct names the product that produced an OCSF event
+type OCSFProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+// OCSFMetadata describes an OCSF event: UID is the block hash and Sequence
+// its index
+type OCSFMetadata struct {
+	Version    string      `json:"version"`
+	Product    OCSFProduct `json:"product"`
+	UID        string      `json:"uid"`
+	Sequence   int         `json:"sequence"`
+	LoggedTime int64       `json:"logged_time"`
+}
+
+// OCSFObservable is one value an OCSF event observed
+type OCSFObservable struct {
+	Name   string `json:"name"`
+	TypeID int    `json:"type_id"`
+	Value  string `json:"value"`
+}
+
+// OCSFEvent is one block as an OCSF Base Event
+type OCSFEvent struct {
+	ClassUID     int               `json:"class_uid"`
+	CategoryUID  int               `json:"category_uid"`
+	ActivityID   int               `json:"activity_id"`
+	ActivityName string            `json:"activity_name"`
+	TypeUID      int               `json:"type_uid"`
+	SeverityID   int               `json:"severity_id"`
+	Time         int64             `json:"time"`
+	Message      string            `json:"message"`
+	Metadata     OCSFMetadata      `json:"metadata"`
+	Observables  []OCSFObservable  `json:"observables,omitempty"`
+	Unmapped     map[string]string `json:"unmapped,omitempty"`
+}
+
+// eventTimeOf is when the block's event happened, as well as we know
+func eventTimeOf(b Block) time.Time {
+	if t, ok := parseBlockTime(b.EventTime); ok {
+		return t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, b.EventTime); err == nil {
+		return t
+	}
+	t, _ := parseBlockTime(b.Timestamp)
+	return t
+}
+
+// cadfEvent maps b to CADF. The chain records that an event was observed,
+// not whether it succeeded, so the action is monitor and the outcome
+// unknown.
+func cadfEvent(b Block, node string) CADFEvent {
+	e := CADFEvent{
+		TypeURI:   cadfEventType,
+		ID:        "blockchain:" + b.Hash,
+		EventType: "activity",
+		EventTime: eventTimeOf(b).Format("2006-01-02T15:04:05.000000-0700"),
+		Action:    "monitor",
+		Outcome:   "unknown",
+		Initiator: CADFResource{TypeURI: "service", ID: b.Server, Name: b.Server},
+		Observer:  CADFResource{TypeURI: "service/security", ID: node, Name: "blockchain"},
+		Attachments: []CADFAttachment{{
+			TypeURI: "application/json",
+			Name:    "block",
+			Content: BlockRef{b.Index, b.Hash},
+		}},
+	}
+	// CADF requires every resource to have an id
+	if e.Initiator.ID == "" {
+		e.Initiator.ID = "unknown"
+	}
+	switch {
+	case b.FileHash != "":
+		e.Target = CADFResource{TypeURI: "data/file", ID: b.FileHash}
+	case b.Location != "":
+		e.Target = CADFResource{TypeURI: "data", ID: b.Location, Name: b.Location}
+	default:
+		e.Target = CADFResource{TypeURI: "data", ID: "unknown"}
+	}
+	if b.Event != "" {
+		e.Tags = append(e.Tags, "event:"+b.Event)
+	}
+	if b.Location != "" {
+		e.Tags = append(e.Tags, "location:"+b.Location)
+	}
+	return e
+}
+
+// ocsfEvent maps b to an OCSF Base Event
+func ocsfEvent(b Block) OCSFEvent {
+	logged, _ := parseBlockTime(b.Timestamp)
+	e := OCSFEvent{
+		ActivityID:   ocsfActivityOther,
+		ActivityName: b.Event,
+		TypeUID:      ocsfActivityOther,
+		SeverityID:   ocsfSeverityInfo,
+		Time:         eventTimeOf(b).UnixNano() / int64(time.Millisecond),
+		Message:      b.Event,
+		Metadata: OCSFMetadata{
+			Version:    ocsfVersion,
+			Product:    OCSFProduct{Name: "blockchain", VendorName: "repenno"},
+			UID:        b.Hash,
+			Sequence:   b.Index,
+			LoggedTime: logged.UnixNano() / int64(time.Millisecond),
+		},
+		Unmapped: map[string]string{"prev_hash": b.PrevHash},
+	}
+	if b.Server != "" {
+		e.Observables = append(e.Observables, OCSFObservable{"server", ocsfObservableHostname, b.Server})
+	}
+	if b.FileHash != "" {
+		e.Observables = append(e.Observables, OCSFObservable{"file_hash", ocsfObservableHash, b.FileHash})
+	}
+	if b.Location != "" {
+		e.Unmapped["location"] = b.Location
+	}
+	return e
+}
+
+// export blocks ?from= to ?to= (inclusive, default the last 1000) as
+// newline delimited ?format=cadf or ocsf events, one per event of a batch
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "cadf" && format != "ocsf" {
+		http.Error(w, "format must be cadf or ocsf", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	head, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	from, to := head-999, head
+	if from < 0 {
+		from = 0
+	}
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			from = -1
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			to = -1
+		}
+	}
+	if from < 0 || to < from || to > head {
+		mutex.Unlock()
+		http.Error(w, "from and to must be a valid height range", http.StatusBadRequest)
+		return
+	}
+	if to-from >= maxExportBlocks {
+		mutex.Unlock()
+		http.Error(w, "at most "+strconv.Itoa(maxExportBlocks)+" blocks per export", http.StatusBadRequest)
+		return
+	}
+	blocks := make([]Block, to-from+1)
+	copy(blocks, Blockchain[from:to+1])
+	mutex.Unlock()
+
+	node := nodeID()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	for _, b := range blocks {
+		// REQUEST_DEADLINE_BULK
+		if r.Context().Err() != nil {
+			break
+		}
+		for _, tx := range eventsOf(b) {
+			// the events of a batch share its block, their hash tells them apart
+			id := b.Hash
+			if len(b.Transactions) > 0 {
+				id += "/" + txHash(tx)
+			}
+			var event interface{}
+			if format == "cadf" {
+				e := cadfEvent(eventBlock(b, tx), node)
+				e.ID = "blockchain:" + id
+				event = e
+			} else {
+				e := ocsfEvent(eventBlock(b, tx))
+				e.Metadata.UID = id
+				event = e
+			}
+			if err := enc.Encode(event); err != nil {
+				return
+			}
+		}
+	}
+	out.Flush()
+}
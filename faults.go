@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault injection lets multi-node test setups split the network and slow it
+// down without touching firewalls. With FAULT_INJECTION=true, PUT /faults
+// (on the admin routes) makes the peers it lists unreachable from this node
+// and delays every other peer request by Latency plus up to Jitter. A full
+// partition between two nodes is set on both of them; setting it on one
+// side only gives an asymmetric one. Never enable it in production.
+
+// Faults is the fault injection state, see PUT /faults
+type Faults struct {
+	Partitioned []string `json:"partitioned"`
+	Latency     string   `json:"latency,omitempty"`
+	Jitter      string   `json:"jitter,omitempty"`
+}
+
+var errPartitioned = errors.New("peer is partitioned by fault injection")
+
+var (
+	faults       = Faults{Partitioned: []string{}}
+	faultLatency time.Duration
+	faultJitter  time.Duration
+	faultMutex   = &sync.RWMutex{}
+)
+
+func faultInjectionEnabled() bool {
+	return os.Getenv("FAULT_INJECTION") == "true"
+}
+
+// faultTransport applies the injected faults to peer requests
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	faultMutex.RLock()
+	partitioned := faults.Partitioned
+	delay := faultLatency
+	if faultJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(faultJitter)))
+	}
+	faultMutex.RUnlock()
+
+	target := req.URL.String()
+	for _, p := range partitioned {
+		if strings.HasPrefix(target, p+"/") || target == p {
+			return nil, errPartitioned
+		}
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// show the injected faults
+func handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	faultMutex.RLock()
+	current := faults
+	faultMutex.RUnlock()
+	respondWithJSON(w, r, http.StatusOK, current)
+}
+
+// replace the injected faults; {} heals everything
+func handleSetFaults(w http.ResponseWriter, r *http.Request) {
+	var f Faults
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var latency, jitter time.Duration
+	var err error
+	if f.Latency != "" {
+		if latency, err = time.ParseDuration(f.Latency); err != nil || latency < 0 {
+			http.Error(w, "Latency must be a duration like 200ms", http.StatusBadRequest)
+			return
+		}
+	}
+	if f.Jitter != "" {
+		if jitter, err = time.ParseDuration(f.Jitter); err != nil || jitter < 0 {
+			http.Error(w, "Jitter must be a duration like 50ms", http.StatusBadRequest)
+			return
+		}
+	}
+	partitioned := make([]string, 0, len(f.Partitioned))
+	for _, p := range f.Partitioned {
+		if p = strings.TrimRight(strings.TrimSpace(p), "/"); p != "" {
+			partitioned = append(partitioned, p)
+		}
+	}
+	f.Partitioned = partitioned
+
+	faultMutex.Lock()
+	faults, faultLatency, faultJitter = f, latency, jitter
+	faultMutex.Unlock()
+	log.Printf("fault injection: %d peers partitioned, latency %v, jitter %v", len(partitioned), latency, jitter)
+	respondWithJSON(w, r, http.StatusOK, f)
+}
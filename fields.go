@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blockFields extracts the named fields of b. Names are the Block field
+// names, and Size and ChainSize for its sizes (see sizeOf).
+func blockFields(b Block, fields []string) map[string]interface{} {
+	m := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		switch f {
+		case "Index":
+			m[f] = b.Index
+		case "Timestamp":
+			m[f] = b.Timestamp
+		case "FileHash":
+			m[f] = b.FileHash
+		case "Event":
+			m[f] = b.Event
+		case "EventTime":
+			m[f] = b.EventTime
+		case "Location":
+			m[f] = b.Location
+		case "Server":
+			m[f] = b.Server
+		case "Hash":
+			m[f] = b.Hash
+		case "PrevHash":
+			m[f] = b.PrevHash
+		case "Approvals":
+			m[f] = b.Approvals
+		case "DeviceKey":
+			m[f] = b.DeviceKey
+		case "DeviceHMAC":
+			m[f] = b.DeviceHMAC
+		case "BackfilledBy":
+			m[f] = b.BackfilledBy
+		case "Signer":
+			m[f] = b.Signer
+		case "SignerCert":
+			m[f] = b.SignerCert
+		case "Metadata":
+			m[f] = b.Metadata
+		case "Difficulty":
+			m[f] = b.Difficulty
+		case "Nonce":
+			m[f] = b.Nonce
+		case "Transactions":
+			m[f] = b.Transactions
+		case "MerkleRoot":
+			m[f] = b.MerkleRoot
+		case "Size":
+			s, _ := sizeOf(b)
+			m[f] = s.size
+		case "ChainSize":
+			s, _ := sizeOf(b)
+			m[f] = s.total
+		}
+	}
+	return m
+}
+
+var blockFieldNames = map[string]bool{
+	"Index": true, "Timestamp": true, "FileHash": true, "Event": true, "EventTime": true,
+	"Location": true, "Server": true, "Hash": true, "PrevHash": true, "Approvals": true,
+	"DeviceKey": true, "DeviceHMAC": true, "BackfilledBy": true,
+	"Signer": true, "SignerCert": true, "Metadata": true, "Difficulty": true, "Nonce": true,
+	"Transactions": true, "MerkleRoot": true, "Size": true, "ChainSize": true,
+}
+
+// blockTags maps Block field names to their JSON tags, blockFieldsByTag back
+var blockTags, blockFieldsByTag = func() (map[string]string, map[string]string) {
+	tags, names := make(map[string]string), make(map[string]string)
+	for _, f := range jsonFields(reflect.TypeOf(Block{})) {
+		tags[f.Name], names[jsonName(f)] = jsonName(f), f.Name
+	}
+	tags["Size"], names["size"] = "size", "Size"
+	tags["ChainSize"], names["chain_size"] = "chain_size", "ChainSize"
+	return tags, names
+}()
+
+// requestedFields parses ?fields=Index,Hash,... (or the tags, index,hash,...)
+// and reports unknown names
+func requestedFields(r *http.Request) ([]string, string) {
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		return nil, ""
+	}
+	var fields []string
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if name, ok := blockFieldsByTag[f]; ok {
+			f = name
+		}
+		if !blockFieldNames[f] {
+			return nil, f
+		}
+		fields = append(fields, f)
+	}
+	return fields, ""
+}
+
+// respondWithBlocks writes one block or a list of blocks, honoring ?fields=,
+// ?ts=, ?tz= and ?compact=true
+func respondWithBlocks(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	if b, ok := payload.(Block); ok {
+		setSizeHeaders(w, b)
+	}
+	payload, err := selectBlockFields(r, payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	respondWithJSON(w, r, code, payload)
+}
+
+// selectBlockFields reduces a Block or []Block to the ?fields= requested,
+// after formatting its times as asked by ?ts= and ?tz=
+func selectBlockFields(r *http.Request, payload interface{}) (interface{}, error) {
+	fields, unknown := requestedFields(r)
+	if unknown != "" {
+		return nil, errors.New("unknown field " + unknown)
+	}
+	format, err := requestedTimeFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	if format != nil {
+		switch v := payload.(type) {
+		case Block:
+			payload = formatBlockTimes(v, format)
+		case []Block:
+			list := make([]Block, len(v))
+			for i, b := range v {
+				list[i] = formatBlockTimes(b, format)
+			}
+			payload = list
+		}
+	}
+	if fields == nil {
+		return payload, nil
+	}
+	switch v := payload.(type) {
+	case Block:
+		return taggedFields(r, blockFields(v, fields)), nil
+	case []Block:
+		list := make([]map[string]interface{}, 0, len(v))
+		for _, b := range v {
+			list = append(list, taggedFields(r, blockFields(b, fields)))
+		}
+		return list, nil
+	}
+	return payload, nil
+}
+
+// taggedFields renames the keys of a blockFields result to the JSON tags
+// on /v2 or when JSON_FIELD_NAMES=snake_case
+func taggedFields(r *http.Request, m map[string]interface{}) map[string]interface{} {
+	if apiVersionOf(r) != 2 && !jsonSnakeCase() {
+		return m
+	}
+	tagged := make(map[string]interface{}, len(m))
+	for f, v := range m {
+		tagged[blockTags[f]] = v
+	}
+	return tagged
+}
+
+// requestedTimeFormat parses ?ts=unix|rfc3339 and ?tz=<IANA zone>. The
+// result is nil when neither is given and times are returned as stored.
+func requestedTimeFormat(r *http.Request) (func(time.Time) string, error) {
+	q := r.URL.Query()
+	ts, tz := q.Get("ts"), q.Get("tz")
+	if ts == "" && tz == "" {
+		return nil, nil
+	}
+	loc := time.UTC
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, errors.New("unknown time zone " + tz)
+		}
+	}
+	switch ts {
+	case "unix":
+		return func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }, nil
+	case "", "rfc3339":
+		return func(t time.Time) string { return t.In(loc).Format(time.RFC3339Nano) }, nil
+	}
+	return nil, errors.New("ts must be unix or rfc3339")
+}
+
+// formatBlockTimes rewrites Timestamp, and EventTime when it is a time,
+// with format. Hashes cover the stored values, so blocks meant for
+// verification must be fetched without ?ts= and ?tz=.
+func formatBlockTimes(b Block, format func(time.Time) string) Block {
+	if t, ok := parseBlockTime(b.Timestamp); ok {
+		b.Timestamp = format(t)
+	}
+	if t, ok := parseBlockTime(b.EventTime); ok {
+		b.EventTime = format(t)
+	} else if t, err := time.Parse(time.RFC3339Nano, b.EventTime); err == nil {
+		b.EventTime = format(t)
+	}
+	return b
+}
+
+// marshalResponse indents JSON unless the client asked for ?compact=true
+func marshalResponse(r *http.Request, payload interface{}) ([]byte, error) {
+	payload = responseValue(r, payload)
+	if r.URL.Query().Get("compact") == "true" {
+		return json.Marshal(payload)
+	}
+	return json.MarshalIndent(payload, "", "  ")
+}
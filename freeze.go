@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write freeze windows (FREEZE_WINDOWS) stop appends on a schedule, e.g.
+// while evidence is being collected for an audit. Each entry is
+//
+//	[scope=]minute hour day-of-month month day-of-week duration
+//
+// separated by ";", where the five cron fields (all of which must match)
+// say when a window opens and duration how long it stays open. scope is
+// "main" (the event chain), "audit" (the audit chain) or "*" for both, the
+// default. During a main chain freeze only writes signed with
+// FREEZE_BREAK_GLASS_KEY (a DEVICE_KEYS key ID) are appended; audit entries
+// are held back and appended when the window closes. Windows opening and
+// closing are recorded on the main chain.
+
+// freeze scopes
+const (
+	freezeMain  = "main"
+	freezeAudit = "audit"
+	freezeAll   = "*"
+)
+
+// events recording freeze windows on the chain
+const (
+	freezeStartEvent = "write freeze started"
+	freezeEndEvent   = "write freeze ended"
+)
+
+// longest supported window, bounds the search for its opening minute
+const maxFreezeWindow = 7 * 24 * time.Hour
+
+var errWriteFrozen = errors.New("writes are frozen")
+
+// freezeWindow is one parsed FREEZE_WINDOWS entry
+type freezeWindow struct {
+	spec     string
+	scope    string
+	fields   [5]map[int]bool
+	duration time.Duration
+}
+
+var freezeWindows []freezeWindow
+var breakGlassKey string
+var freezeMutex = &sync.RWMutex{}
+
+// cron field ranges: minute, hour, day of month, month, day of week
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// loadFreezeWindows parses FREEZE_WINDOWS and starts recording windows on
+// the chain
+func loadFreezeWindows() error {
+	windows, err := parseFreezeWindows(os.Getenv("FREEZE_WINDOWS"))
+	if err != nil {
+		return err
+	}
+	if len(windows) > 0 && poaEnabled() {
+		return errors.New("FREEZE_WINDOWS is not supported with CONSENSUS=poa, freeze records would bypass the quorum")
+	}
+	freezeWindows, breakGlassKey = windows, os.Getenv("FREEZE_BREAK_GLASS_KEY")
+	if len(windows) > 0 {
+		log.Println("loaded", len(windows), "write freeze windows")
+	}
+	go watchFreezeWindows()
+	return nil
+}
+
+// prepareFreezeWindows validates reloaded FREEZE_WINDOWS
+func prepareFreezeWindows(env map[string]string) (func(), error) {
+	windows, err := parseFreezeWindows(env["FREEZE_WINDOWS"])
+	if err != nil {
+		return nil, err
+	}
+	if len(windows) > 0 && poaEnabled() {
+		return nil, errors.New("FREEZE_WINDOWS is not supported with CONSENSUS=poa")
+	}
+	if len(windows) > 0 && raftEnabled() {
+		return nil, errors.New("FREEZE_WINDOWS is not supported with CONSENSUS=raft")
+	}
+	return func() {
+		freezeMutex.Lock()
+		freezeWindows, breakGlassKey = windows, env["FREEZE_BREAK_GLASS_KEY"]
+		freezeMutex.Unlock()
+	}, nil
+}
+
+func parseFreezeWindows(list string) ([]freezeWindow, error) {
+	var windows []freezeWindow
+	for _, entry := range strings.Split(list, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		w := freezeWindow{spec: entry, scope: freezeAll}
+		if i := strings.Index(entry, "="); i >= 0 {
+			w.scope, entry = strings.TrimSpace(entry[:i]), entry[i+1:]
+		}
+		if w.scope != freezeMain && w.scope != freezeAudit && w.scope != freezeAll {
+			return nil, errors.New("freeze window scope must be main, audit or *: " + w.spec)
+		}
+		parts := strings.Fields(entry)
+		if len(parts) != 6 {
+			return nil, errors.New("freeze window needs five cron fields and a duration: " + w.spec)
+		}
+		for i := 0; i < 5; i++ {
+			set, err := parseCronField(parts[i], cronRanges[i][0], cronRanges[i][1])
+			if err != nil {
+				return nil, errors.New("freeze window " + w.spec + ": " + err.Error())
+			}
+			w.fields[i] = set
+		}
+		d, err := time.ParseDuration(parts[5])
+		if err != nil || d < time.Minute || d > maxFreezeWindow {
+			return nil, errors.New("freeze window duration must be between 1m and 168h: " + w.spec)
+		}
+		w.duration = d
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseCronField expands a cron field (*, n, a-b, */s, a-b/s and lists of
+// these) into the set of matching values
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, errors.New("invalid step in " + field)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = lo, nil
+			if len(bounds) == 2 {
+				hi, err2 = strconv.Atoi(bounds[1])
+			}
+			if err1 != nil || err2 != nil || lo < min || hi > max || lo > hi {
+				return nil, errors.New("invalid cron field " + field)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether a window opens at t's minute
+func (w freezeWindow) matches(t time.Time) bool {
+	return w.fields[0][t.Minute()] && w.fields[1][t.Hour()] && w.fields[2][t.Day()] &&
+		w.fields[3][int(t.Month())] && w.fields[4][int(t.Weekday())]
+}
+
+// openUntil returns when the window containing t closes, or the zero time
+// if t is outside the window
+func (w freezeWindow) openUntil(t time.Time) time.Time {
+	start := t.Truncate(time.Minute)
+	for s := start; t.Sub(s) < w.duration; s = s.Add(-time.Minute) {
+		if w.matches(s) {
+			return s.Add(w.duration)
+		}
+	}
+	return time.Time{}
+}
+
+// frozenUntil reports whether scope is frozen at t, and until when
+func frozenUntil(scope string, t time.Time) (time.Time, bool) {
+	freezeMutex.RLock()
+	defer freezeMutex.RUnlock()
+	var until time.Time
+	for _, w := range freezeWindows {
+		if w.scope != freezeAll && w.scope != scope {
+			continue
+		}
+		if end := w.openUntil(t); end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// checkFreeze rejects a main chain write during a freeze unless it is signed
+// with the break-glass key. The signature itself is verified by the handler.
+func checkFreeze(m CreateBlockReq) error {
+	if _, frozen := frozenUntil(freezeMain, time.Now()); !frozen {
+		return nil
+	}
+	freezeMutex.RLock()
+	key := breakGlassKey
+	freezeMutex.RUnlock()
+	if key != "" && m.KeyID == key {
+		log.Printf("break-glass write from %s during write freeze", m.Server)
+		return nil
+	}
+	return errWriteFrozen
+}
+
+// retryAfterFreeze is the Retry-After value for a frozen write
+func retryAfterFreeze() string {
+	until, _ := frozenUntil(freezeMain, time.Now())
+	secs := int(time.Until(until).Seconds()) + 1
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// watchFreezeWindows records main chain freezes opening and closing, and
+// flushes held back audit entries when an audit freeze ends
+func watchFreezeWindows() {
+	mainFrozen, auditFrozen := false, false
+	for {
+		now := time.Now()
+		_, m := frozenUntil(freezeMain, now)
+		_, a := frozenUntil(freezeAudit, now)
+		if m != mainFrozen {
+			event := freezeEndEvent
+			if m {
+				event = freezeStartEvent
+			}
+			if err := recordFreeze(event); err != nil {
+				log.Println("recording write freeze failed:", err)
+			} else {
+				mainFrozen = m
+			}
+		}
+		if a != auditFrozen {
+			auditFrozen = a
+			if !a {
+				flushAuditHeld()
+			}
+		}
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+	}
+}
+
+// recordFreeze appends a freeze start or end block, which freezes never block
+func recordFreeze(event string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(Blockchain) == 0 {
+		return errChainNotReady
+	}
+	if err := checkStandby(); err != nil {
+		return err
+	}
+	prev := Blockchain[len(Blockchain)-1]
+	b := generateBlock(prev, "", "", event, time.Now().UTC().Format(time.RFC3339), "", nodeID())
+	return appendBlockLocked(mineBlock(b, prev))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// largest range GET /graph renders
+const maxGraphBlocks = 1000
+
+// GraphNode is one block in a graph export
+type GraphNode struct {
+	Index  int    `json:"index"`
+	Hash   string `json:"hash"`
+	Event  string `json:"event"`
+	Server string `json:"server"`
+}
+
+// GraphEdge links two blocks. Kind is "prev" for the hash chain, "ref" when
+// a block's FileHash or Location names another block's hash, and "archive"
+// from an archive record to the last block it archived.
+type GraphEdge struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// Graph is the JSON form of GET /graph
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// buildGraphLocked collects the blocks from..to and their links. References
+// only resolve to blocks inside the range. Caller must hold mutex.
+func buildGraphLocked(from, to int) Graph {
+	g := Graph{Nodes: make([]GraphNode, 0, to-from+1), Edges: make([]GraphEdge, 0)}
+	byHash := make(map[string]int, to-from+1)
+	for i := from; i <= to; i++ {
+		byHash[Blockchain[i].Hash] = i
+	}
+	for i := from; i <= to; i++ {
+		b := Blockchain[i]
+		g.Nodes = append(g.Nodes, GraphNode{b.Index, b.Hash, b.Event, b.Server})
+		if i > from {
+			g.Edges = append(g.Edges, GraphEdge{b.Index, b.Index - 1, "prev"})
+		}
+		for _, tx := range eventsOf(b) {
+			for _, ref := range []string{tx.FileHash, tx.Location} {
+				if j, ok := byHash[ref]; ok && j != i && ref != "" {
+					g.Edges = append(g.Edges, GraphEdge{b.Index, j, "ref"})
+				}
+			}
+		}
+		if rec, ok := archiveRecord(b); ok && rec.To >= from && rec.To <= to {
+			g.Edges = append(g.Edges, GraphEdge{b.Index, rec.To, "archive"})
+		}
+	}
+	return g
+}
+
+// dot renders the graph for Graphviz
+func (g Graph) dot() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph chain {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		short := n.Hash
+		if i := strings.Index(short, ":"); i >= 0 {
+			short = short[i+1:]
+		}
+		if len(short) > 12 {
+			short = short[:12]
+		}
+		label := fmt.Sprintf("#%d %s\n%s\n%s", n.Index, n.Event, n.Server, short)
+		fmt.Fprintf(&buf, "\tb%d [label=%s];\n", n.Index, strconv.Quote(label))
+	}
+	for _, e := range g.Edges {
+		style := ""
+		switch e.Kind {
+		case "ref":
+			style = " [style=dashed, label=\"ref\"]"
+		case "archive":
+			style = " [style=dotted, label=\"archive\"]"
+		}
+		fmt.Fprintf(&buf, "\tb%d -> b%d%s;\n", e.From, e.To, style)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// export blocks ?from= to ?to= (inclusive, default the last 100) and their
+// links as Graphviz DOT, or JSON with ?format=json
+func handleGetGraph(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mutex.Lock()
+	head, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	from, to := head-99, head
+	if from < 0 {
+		from = 0
+	}
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			from = -1
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			to = -1
+		}
+	}
+	if from < 0 || to < from || to > head {
+		mutex.Unlock()
+		http.Error(w, "from and to must be a valid height range", http.StatusBadRequest)
+		return
+	}
+	if to-from >= maxGraphBlocks {
+		mutex.Unlock()
+		http.Error(w, "at most "+strconv.Itoa(maxGraphBlocks)+" blocks per graph", http.StatusBadRequest)
+		return
+	}
+	g := buildGraphLocked(from, to)
+	mutex.Unlock()
+
+	if q.Get("format") == "json" {
+		respondWithJSON(w, r, http.StatusOK, g)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vnd.graphviz")
+	w.Write(g.dot())
+}
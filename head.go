@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /.well-known/chain-head publishes the current head so third parties
+// can watch the chain cheaply and keep heads as external witnesses: a head
+// that later disappears from the chain proves it was rewritten. The head is
+// signed with the node key (see jws.go), over
+//
+//	chain-head:<chain_id>:<height>:<hash>:<iat>
+//
+// and the response carries the certificate chain (x5c) to check it with.
+// Without TLS_CERT_FILE heads are published unsigned.
+//
+// With HEAD_DNS_NAME the head is also published as a DNS TXT record,
+// "v=chainhead1 n=<height> h=<hash> t=<iat> s=<signature>", sent every
+// HEAD_DNS_INTERVAL (default 1m) when the head moved, as an RFC 2136 update
+// to HEAD_DNS_SERVER with nsupdate, signed with the TSIG key in
+// HEAD_DNS_KEY_FILE.
+
+// HeadPublication is a signed chain head. Signature is base64url, in the
+// JWS encoding of Alg.
+type HeadPublication struct {
+	Node      string   `json:"node"`
+	ChainID   string   `json:"chain_id"`
+	Height    int      `json:"height"`
+	Hash      string   `json:"hash"`
+	IssuedAt  int64    `json:"iat"`
+	Alg       string   `json:"alg,omitempty"`
+	Kid       string   `json:"kid,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+	X5c       []string `json:"x5c,omitempty"`
+}
+
+// the last head signed, so monitors polling an idle chain cost no signature
+var (
+	headPublication HeadPublication
+	headPubMutex    = &sync.Mutex{}
+)
+
+// signedHead returns the current head, signed once per head
+func signedHead() (HeadPublication, error) {
+	mutex.Lock()
+	if len(Blockchain) == 0 {
+		mutex.Unlock()
+		return HeadPublication{}, errChainNotReady
+	}
+	chainID := Blockchain[0].Hash
+	head := Blockchain[len(Blockchain)-1]
+	mutex.Unlock()
+
+	headPubMutex.Lock()
+	defer headPubMutex.Unlock()
+	if headPublication.Hash == head.Hash && headPublication.Height == head.Index {
+		return headPublication, nil
+	}
+	p := HeadPublication{Node: nodeID(), ChainID: chainID, Height: head.Index, Hash: head.Hash, IssuedAt: time.Now().Unix()}
+	receiptKeyOnce.Do(loadReceiptKey)
+	if receiptKeyErr == nil {
+		input := fmt.Sprintf("chain-head:%s:%d:%s:%d", p.ChainID, p.Height, p.Hash, p.IssuedAt)
+		sig, err := jwsSign(receiptHeader.Alg, []byte(input))
+		if err != nil {
+			return HeadPublication{}, err
+		}
+		p.Alg, p.Kid, p.X5c = receiptHeader.Alg, receiptHeader.Kid, receiptHeader.X5c
+		p.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	}
+	headPublication = p
+	return p, nil
+}
+
+// serve the signed head
+func handleGetChainHead(w http.ResponseWriter, r *http.Request) {
+	p, err := signedHead()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=5")
+	respondWithJSON(w, r, http.StatusOK, p)
+}
+
+// headTXT is the TXT record data for p. A TXT string holds 255 bytes, an
+// RSA signature needs more, so the record is split into quoted strings that
+// resolvers join back together.
+func headTXT(p HeadPublication) string {
+	txt := fmt.Sprintf("v=chainhead1 n=%d h=%s t=%d", p.Height, p.Hash, p.IssuedAt)
+	if p.Signature != "" {
+		txt += " s=" + p.Signature
+	}
+	var parts []string
+	for len(txt) > 255 {
+		parts = append(parts, strconv.Quote(txt[:255]))
+		txt = txt[255:]
+	}
+	return strings.Join(append(parts, strconv.Quote(txt)), " ")
+}
+
+// startHeadDNS publishes the head to HEAD_DNS_NAME when it moved
+func startHeadDNS() error {
+	name := os.Getenv("HEAD_DNS_NAME")
+	if name == "" {
+		return nil
+	}
+	server := os.Getenv("HEAD_DNS_SERVER")
+	if server == "" {
+		return errors.New("HEAD_DNS_NAME requires HEAD_DNS_SERVER")
+	}
+	if _, err := exec.LookPath("nsupdate"); err != nil {
+		return errors.New("HEAD_DNS_NAME requires nsupdate: " + err.Error())
+	}
+	interval := time.Minute
+	if v := os.Getenv("HEAD_DNS_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return errors.New("HEAD_DNS_INTERVAL must be a positive duration")
+		}
+	}
+	ttl := 60
+	if v := os.Getenv("HEAD_DNS_TTL"); v != "" {
+		var err error
+		if ttl, err = strconv.Atoi(v); err != nil || ttl < 0 {
+			return errors.New("HEAD_DNS_TTL must be a number of seconds")
+		}
+	}
+
+	go func() {
+		last := ""
+		for {
+			if p, err := signedHead(); err == nil && p.Hash != last {
+				if err := publishHeadDNS(p, name, server, ttl); err != nil {
+					log.Println("publishing the head to DNS failed:", err)
+				} else {
+					last = p.Hash
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return nil
+}
+
+// publishHeadDNS replaces the TXT records of name with p's
+func publishHeadDNS(p HeadPublication, name, server string, ttl int) error {
+	name = strings.TrimSuffix(name, ".") + "."
+	script := fmt.Sprintf("server %s\nupdate delete %s TXT\nupdate add %s %d TXT %s\nsend\n",
+		server, name, name, ttl, headTXT(p))
+	var args []string
+	if keyFile := os.Getenv("HEAD_DNS_KEY_FILE"); keyFile != "" {
+		args = append(args, "-k", keyFile)
+	}
+	cmd := exec.Command("nsupdate", args...)
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nsupdate: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Heartbeats: the node remembers when each Server last wrote an event. A
+// registered device with a Heartbeat interval that stays quiet for longer
+// is silent, and silence is a security signal in itself: with
+// SILENCE_BLOCKS=true the node appends a "source went silent" block for it,
+// once per silence.
+
+const silentEvent = "source went silent"
+
+// how often devices are checked for missed heartbeats
+const heartbeatCheckInterval = time.Minute
+
+// sourceActivity is what the chain says about one Server
+type sourceActivity struct {
+	lastSeen time.Time
+	// a silentEvent block was written after lastSeen
+	flagged bool
+}
+
+// SilentDevice is one entry of GET /devices/silent
+type SilentDevice struct {
+	Name      string `json:"name"`
+	LastSeen  string `json:"last_seen,omitempty"`
+	Silent    string `json:"silent"`
+	Heartbeat string `json:"heartbeat,omitempty"`
+}
+
+// sources is keyed by normalized Server. Guarded by mutex.
+var sources = make(map[string]*sourceActivity)
+
+// noteSourceLocked updates the activity of the Server of every event of b.
+// Caller must hold mutex.
+func noteSourceLocked(b Block) {
+	t, ok := parseBlockTime(b.Timestamp)
+	if !ok {
+		return
+	}
+	silent := b.Event == silentEvent && nodeMinted(b)
+	for _, tx := range eventsOf(b) {
+		if tx.Server == "" {
+			continue
+		}
+		name := normalizeText(tx.Server)
+		a := sources[name]
+		if a == nil {
+			a = &sourceActivity{}
+			sources[name] = a
+		}
+		if silent {
+			a.flagged = true
+			continue
+		}
+		if t.After(a.lastSeen) {
+			a.lastSeen = t
+		}
+		a.flagged = false
+	}
+}
+
+// rebuildSourcesLocked derives the activity of every Server from the chain.
+// Caller must hold mutex.
+func rebuildSourcesLocked() (int, error) {
+	sources = make(map[string]*sourceActivity)
+	for _, b := range Blockchain {
+		noteSourceLocked(b)
+	}
+	return len(sources), nil
+}
+
+// silentDevices lists registered devices without an event since cutoff.
+// A zero cutoff uses each device's own Heartbeat and skips devices without.
+func silentDevices(cutoff time.Time, now time.Time) []SilentDevice {
+	deviceMutex.Lock()
+	list := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, *d)
+	}
+	deviceMutex.Unlock()
+
+	silent := make([]SilentDevice, 0)
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, d := range list {
+		limit := cutoff
+		if limit.IsZero() {
+			interval, err := time.ParseDuration(d.Heartbeat)
+			if err != nil || interval <= 0 {
+				continue
+			}
+			limit = now.Add(-interval)
+		}
+		// a device that never wrote has been silent since it was registered
+		last, seen := time.Time{}, false
+		if a := sources[d.Name]; a != nil && !a.lastSeen.IsZero() {
+			last, seen = a.lastSeen, true
+		} else if registered, ok := parseBlockTime(d.Registered); ok {
+			last = registered
+		}
+		if !last.Before(limit) {
+			continue
+		}
+		s := SilentDevice{Name: d.Name, Silent: now.Sub(last).Round(time.Second).String(), Heartbeat: d.Heartbeat}
+		if seen {
+			s.LastSeen = last.UTC().Format(time.RFC3339)
+		}
+		silent = append(silent, s)
+	}
+	sort.Slice(silent, func(i, j int) bool { return silent[i].Name < silent[j].Name })
+	return silent
+}
+
+// registered devices that haven't written since ?since= (a duration like 1h
+// or an RFC 3339 time), by default those that missed their Heartbeat
+func handleGetSilentDevices(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var cutoff time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cutoff = now.Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			cutoff = t
+		} else {
+			http.Error(w, "since must be a duration like 1h or an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	respondWithList(w, r, http.StatusOK, silentDevices(cutoff, now))
+}
+
+// startSilenceWatch appends a silentEvent block for every device that
+// missed its heartbeat, when SILENCE_BLOCKS=true
+func startSilenceWatch() {
+	if os.Getenv("SILENCE_BLOCKS") != "true" {
+		return
+	}
+	go func() {
+		for range time.Tick(heartbeatCheckInterval) {
+			for _, s := range silentDevices(time.Time{}, time.Now()) {
+				mutex.Lock()
+				a := sources[s.Name]
+				flagged := a != nil && a.flagged
+				mutex.Unlock()
+				if flagged {
+					continue
+				}
+				detail := "no event since " + s.LastSeen
+				if s.LastSeen == "" {
+					detail = "no event since registration"
+				}
+				b, err := addBlock(CreateBlockReq{
+					Event:     silentEvent,
+					EventTime: time.Now().UTC().Format(time.RFC3339),
+					Location:  detail,
+					Server:    s.Name,
+					system:    true,
+				}, "")
+				if err != nil {
+					log.Printf("recording silence of %s failed: %v", s.Name, err)
+					continue
+				}
+				log.Printf("device %s went silent (%s), recorded in block %d", s.Name, s.Silent, b.Index)
+			}
+		}
+	}()
+	log.Println("recording devices that miss their heartbeat")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Writes carrying an Idempotency-Key header are committed at most once per
+// key: a retry with the same key and body gets the original block back, so
+// clients can retry after timeouts without writing duplicate blocks. Keys
+// are remembered for IDEMPOTENCY_TTL (default 24h) and, with DATA_DIR, kept
+// in idempotency.jsonl across restarts.
+
+// idempotencyEntry is the outcome of one keyed write
+type idempotencyEntry struct {
+	Key      string
+	BodyHash string
+	Block    BlockRef
+	Expires  time.Time
+	pending  bool
+}
+
+// longest accepted Idempotency-Key
+const maxIdempotencyKey = 255
+
+var (
+	errIdempotencyMismatch = errors.New("Idempotency-Key was already used with a different body")
+	errIdempotencyPending  = errors.New("a request with this Idempotency-Key is still in progress")
+)
+
+var idempotencyKeys = make(map[string]*idempotencyEntry)
+var idempotencyMutex = &sync.Mutex{}
+var idempotencyFile *os.File
+
+func idempotencyTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// loadIdempotency reads unexpired keys from DATA_DIR and compacts the file
+func loadIdempotency() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	path := filepath.Join(dir, "idempotency.jsonl")
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e idempotencyEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				log.Println("skipping bad idempotency record:", err)
+				continue
+			}
+			if time.Now().Before(e.Expires) {
+				idempotencyKeys[e.Key] = &e
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, e := range idempotencyKeys {
+		line, _ := json.Marshal(e)
+		tmp.Write(append(line, '\n'))
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	idempotencyFile, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// beginIdempotent claims key for a write of body. It returns the block of an
+// earlier identical write, or reserves the key until finishIdempotent.
+func beginIdempotent(key string, body []byte) (*BlockRef, error) {
+	if len(key) > maxIdempotencyKey {
+		return nil, errors.New("Idempotency-Key is too long")
+	}
+	bodyHash := hashBody(body)
+
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	if e, ok := idempotencyKeys[key]; ok && (e.pending || time.Now().Before(e.Expires)) {
+		switch {
+		case e.BodyHash != bodyHash:
+			return nil, errIdempotencyMismatch
+		case e.pending:
+			return nil, errIdempotencyPending
+		}
+		ref := e.Block
+		return &ref, nil
+	}
+	idempotencyKeys[key] = &idempotencyEntry{Key: key, BodyHash: bodyHash, pending: true}
+	return nil, nil
+}
+
+// finishIdempotent records the block a keyed write committed, or releases
+// the key when the write failed so it can be retried
+func finishIdempotent(key string, b *Block) {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	e, ok := idempotencyKeys[key]
+	if !ok {
+		return
+	}
+	if b == nil {
+		delete(idempotencyKeys, key)
+		return
+	}
+	e.Block = BlockRef{b.Index, b.Hash}
+	e.Expires = time.Now().Add(idempotencyTTL())
+	e.pending = false
+
+	// drop expired keys while we hold the lock anyway
+	for k, other := range idempotencyKeys {
+		if !other.pending && time.Now().After(other.Expires) {
+			delete(idempotencyKeys, k)
+		}
+	}
+
+	if idempotencyFile != nil {
+		line, _ := json.Marshal(e)
+		if _, err := idempotencyFile.Write(append(line, '\n')); err != nil {
+			log.Println("persisting idempotency key failed:", err)
+		}
+	}
+}
+
+// idempotentBlock fetches the block an earlier keyed write committed
+func idempotentBlock(ref BlockRef) (Block, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if ref.Index < 0 || ref.Index >= len(Blockchain) || Blockchain[ref.Index].Hash != ref.Hash {
+		return Block{}, false
+	}
+	return Blockchain[ref.Index], true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// events recorded by the file watcher. FileHash is the SHA-256 of the file
+// contents and Location its path.
+const (
+	fileCreatedEvent  = "file created"
+	fileModifiedEvent = "file modified"
+)
+
+// how long a file must stay quiet before it is hashed, so a file still being
+// written produces a single block
+const ingestSettle = time.Second
+
+// startIngest watches INGEST_DIRS (recursively) and appends a block whenever
+// a file is created or its contents change
+func startIngest() error {
+	var dirs []string
+	for _, d := range strings.Split(os.Getenv("INGEST_DIRS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	if poaEnabled() {
+		return errors.New("INGEST_DIRS is not supported with CONSENSUS=poa, ingested blocks would bypass the quorum")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// last hash seen per path, so touching a file without changing it is ignored
+	seen := make(map[string]string)
+	for _, d := range dirs {
+		if err := watchTree(watcher, d, seen); err != nil {
+			return err
+		}
+	}
+	log.Println("ingesting file changes from", strings.Join(dirs, ", "))
+
+	go func() {
+		pending := make(map[string]time.Time)
+		tick := time.NewTicker(ingestSettle / 4)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+					continue
+				}
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					if err := watchTree(watcher, event.Name, seen); err != nil {
+						log.Println("file ingest:", err)
+					}
+					continue
+				}
+				pending[event.Name] = time.Now()
+			case <-tick.C:
+				for path, changed := range pending {
+					if time.Since(changed) < ingestSettle {
+						continue
+					}
+					delete(pending, path)
+					if err := ingestFile(path, seen); err != nil {
+						log.Printf("file ingest of %s failed: %v", path, err)
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("file ingest watcher:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchTree watches root and every directory below it. Files already present
+// are hashed as a baseline but not recorded.
+func watchTree(watcher *fsnotify.Watcher, root string, seen map[string]string) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return watcher.Add(path)
+		}
+		if sum, err := hashFile(path); err == nil {
+			seen[path] = sum
+		}
+		return nil
+	})
+}
+
+// ingestFile records path if its contents differ from the last seen version
+func ingestFile(path string, seen map[string]string) error {
+	sum, err := hashFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	last, known := seen[path]
+	if sum == last {
+		return nil
+	}
+	seen[path] = sum
+
+	event := fileModifiedEvent
+	if !known {
+		event = fileCreatedEvent
+	}
+	abs, _ := filepath.Abs(path)
+	b, err := addBlock(CreateBlockReq{
+		FileHash:  sum,
+		Event:     event,
+		EventTime: time.Now().UTC().Format(time.RFC3339),
+		Location:  abs,
+		Server:    nodeID(),
+	}, "")
+	if err != nil {
+		return err
+	}
+	log.Printf("recorded %s %s in block %d", event, abs, b.Index)
+	return nil
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
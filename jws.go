@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Write receipts are also offered as compact JWS tokens, a proof of logging
+// that submitters can keep in a ticketing system and check with any JOSE
+// library. A write sent with "Accept: application/jose" is answered with the
+// token instead of the JSON receipt, and GET /block/{hash}/receipt issues
+// one for a block already on the chain.
+//
+// Tokens are signed with the node key (NODE_KEY, see nodeCertificate), so
+// they need TLS_CERT_FILE. The protected header carries the certificate
+// chain (x5c) and its SHA-256 fingerprint (kid) so tokens verify offline.
+
+// media type of a compact JWS
+const jwsMediaType = "application/jose"
+
+// ReceiptClaims is the payload of a JWS receipt. ChainID is the hash of the
+// genesis block, Time the block's Timestamp and IssuedAt when the token was
+// signed, in Unix seconds.
+type ReceiptClaims struct {
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ChainID   string `json:"chain_id"`
+	Index     int    `json:"index"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+	Time      string `json:"time"`
+}
+
+// jwsHeader is the protected header of a receipt
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	Typ string   `json:"typ"`
+	Kid string   `json:"kid"`
+	X5c []string `json:"x5c"`
+}
+
+// the node key, loaded once on first use
+var (
+	receiptKeyOnce sync.Once
+	receiptSigner  crypto.Signer
+	receiptHeader  jwsHeader
+	receiptKeyErr  error
+)
+
+func loadReceiptKey() {
+	cert, err := nodeCertificate()
+	if err != nil {
+		receiptKeyErr = errors.New("JWS receipts require TLS_CERT_FILE: " + err.Error())
+		return
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		receiptKeyErr = errors.New("the node key cannot sign receipts")
+		return
+	}
+	alg, err := jwsAlgorithm(signer.Public())
+	if err != nil {
+		receiptKeyErr = err
+		return
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	receiptHeader = jwsHeader{Alg: alg, Typ: "JWT", Kid: hex.EncodeToString(fingerprint[:])}
+	for _, der := range cert.Certificate {
+		receiptHeader.X5c = append(receiptHeader.X5c, base64.StdEncoding.EncodeToString(der))
+	}
+	receiptSigner = signer
+}
+
+// jwsAlgorithm picks the JWS algorithm for the node key
+func jwsAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return "ES256", nil
+		case 384:
+			return "ES384", nil
+		case 521:
+			return "ES512", nil
+		}
+	case *rsa.PublicKey:
+		return "PS256", nil
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	}
+	return "", errors.New("the node key type cannot sign JWS receipts")
+}
+
+// signReceipt returns the compact JWS receipt for b
+func signReceipt(b Block) (string, error) {
+	receiptKeyOnce.Do(loadReceiptKey)
+	if receiptKeyErr != nil {
+		return "", receiptKeyErr
+	}
+	mutex.Lock()
+	if len(Blockchain) == 0 {
+		mutex.Unlock()
+		return "", errChainNotReady
+	}
+	chainID := Blockchain[0].Hash
+	mutex.Unlock()
+
+	header, err := json.Marshal(receiptHeader)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(ReceiptClaims{nodeID(), time.Now().Unix(), chainID, b.Index, b.Hash, hashAlgorithmOf(b.Hash), b.Timestamp})
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig, err := jwsSign(receiptHeader.Alg, []byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// jwsSign signs input with the node key in the encoding alg requires
+func jwsSign(alg string, input []byte) ([]byte, error) {
+	var hash crypto.Hash
+	switch alg {
+	case "EdDSA":
+		return receiptSigner.Sign(nil, input, crypto.Hash(0))
+	case "PS256", "ES256":
+		hash = crypto.SHA256
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+	if alg == "PS256" {
+		return receiptSigner.Sign(nil, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	}
+
+	// crypto.Signer returns ASN.1 ECDSA signatures, JWS wants R and S
+	// concatenated at the size of the curve
+	der, err := receiptSigner.Sign(nil, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &rs); err != nil {
+		return nil, err
+	}
+	size := (receiptSigner.Public().(*ecdsa.PublicKey).Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rs.R.FillBytes(sig[:size])
+	rs.S.FillBytes(sig[size:])
+	return sig, nil
+}
+
+// wantsJWS reports whether the client asked for a JWS receipt
+func wantsJWS(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), jwsMediaType)
+}
+
+// respondWithReceipt answers a write with its receipt, as JSON or, when
+// asked for, as a JWS, and its Commit-Height
+func respondWithReceipt(w http.ResponseWriter, r *http.Request, code int, b Block) {
+	w.Header().Set(commitHeightHeader, strconv.Itoa(b.Index))
+	if !wantsJWS(r) {
+		respondWithJSON(w, r, code, writeReceipt(b))
+		return
+	}
+	token, err := signReceipt(b)
+	if err != nil {
+		// the block is written, an error would only make the client retry
+		log.Println("signing receipt for block", b.Index, "failed:", err)
+		respondWithJSON(w, r, code, writeReceipt(b))
+		return
+	}
+	w.Header().Set("Content-Type", jwsMediaType)
+	w.WriteHeader(code)
+	w.Write([]byte(token))
+}
+
+// issue a JWS receipt for a block on the chain
+func handleGetBlockReceipt(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(mux.Vars(r)["hash"])
+	mutex.Lock()
+	var b Block
+	block, ok := BlockMap[hash]
+	if ok {
+		b = *block
+	}
+	mutex.Unlock()
+	if !ok {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	token, err := signReceipt(b)
+	if err == errChainNotReady {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil && err == receiptKeyErr {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", jwsMediaType)
+	w.Write([]byte(token))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Writes can be held to reference known artifacts. A FileHash is known when
+// KNOWN_HASHES_FILE lists it (one hex SHA-256 per line, # starts a comment)
+// or it was registered with POST /known-hashes, which keeps it in
+// DATA_DIR/known_hashes.json. FILEHASH_CHECK says what happens to a write
+// naming any other: "reject" refuses it with 422, "flag" accepts it with
+// "unknown_file_hash": true in its Metadata. Writes without a FileHash are
+// not checked. The list and the mode are read again on config reload.
+
+var errUnknownFileHash = errors.New("FileHash is not a registered artifact")
+
+// KnownHash is a registered artifact
+type KnownHash struct {
+	FileHash   string `json:"file_hash"`
+	Source     string `json:"source"`
+	Registered string `json:"registered,omitempty"`
+}
+
+// RegisterHashesReq registers artifacts by hash
+type RegisterHashesReq struct {
+	Hashes []string `json:"hashes"`
+}
+
+// RegisterHashesResp counts the newly registered hashes
+type RegisterHashesResp struct {
+	Added int `json:"added"`
+	Known int `json:"known"`
+}
+
+var (
+	fileHashCheck    string
+	listedHashes     = make(map[string]bool)
+	registeredHashes = make(map[string]string) // hash to registration time
+	knownHashMutex   = &sync.RWMutex{}
+)
+
+// isSHA256Hex reports whether h is a lower-case hex SHA-256
+func isSHA256Hex(h string) bool {
+	raw, err := hex.DecodeString(h)
+	return err == nil && len(raw) == sha256.Size && h == strings.ToLower(h)
+}
+
+// loadKnownHashes reads FILEHASH_CHECK, KNOWN_HASHES_FILE and the
+// registered hashes
+func loadKnownHashes() error {
+	apply, err := prepareKnownHashes(map[string]string{
+		"FILEHASH_CHECK":    os.Getenv("FILEHASH_CHECK"),
+		"KNOWN_HASHES_FILE": os.Getenv("KNOWN_HASHES_FILE"),
+	})
+	if err != nil {
+		return err
+	}
+	apply()
+
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "known_hashes.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	knownHashMutex.Lock()
+	defer knownHashMutex.Unlock()
+	return json.Unmarshal(raw, &registeredHashes)
+}
+
+// prepareKnownHashes validates a reloaded FILEHASH_CHECK and
+// KNOWN_HASHES_FILE
+func prepareKnownHashes(env map[string]string) (func(), error) {
+	mode := env["FILEHASH_CHECK"]
+	if mode != "" && mode != "flag" && mode != "reject" {
+		return nil, errors.New("FILEHASH_CHECK must be empty, flag or reject")
+	}
+	listed := make(map[string]bool)
+	if path := env["KNOWN_HASHES_FILE"]; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			// sha256sum output names the file after the hash
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			h := strings.ToLower(fields[0])
+			if !isSHA256Hex(h) {
+				return nil, errors.New("KNOWN_HASHES_FILE line " + strconv.Itoa(n) + " is not a hex SHA-256")
+			}
+			listed[h] = true
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		knownHashMutex.Lock()
+		fileHashCheck, listedHashes = mode, listed
+		knownHashMutex.Unlock()
+		if len(listed) > 0 {
+			log.Println("loaded", len(listed), "known file hashes")
+		}
+	}, nil
+}
+
+// saveKnownHashesLocked writes the registered hashes atomically. Caller must
+// hold knownHashMutex.
+func saveKnownHashesLocked() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	raw, err := json.Marshal(registeredHashes)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "known_hashes.json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// lookupKnownHash finds a listed or registered artifact
+func lookupKnownHash(h string) (KnownHash, bool) {
+	h = strings.ToLower(strings.TrimSpace(h))
+	knownHashMutex.RLock()
+	defer knownHashMutex.RUnlock()
+	if t, ok := registeredHashes[h]; ok {
+		return KnownHash{h, "registered", t}, true
+	}
+	if listedHashes[h] {
+		return KnownHash{h, "list", ""}, true
+	}
+	return KnownHash{}, false
+}
+
+// checkFileHash applies FILEHASH_CHECK to m
+func checkFileHash(m CreateBlockReq) (CreateBlockReq, error) {
+	knownHashMutex.RLock()
+	mode := fileHashCheck
+	knownHashMutex.RUnlock()
+	if mode == "" || m.FileHash == "" {
+		return m, nil
+	}
+	if _, ok := lookupKnownHash(m.FileHash); ok {
+		return m, nil
+	}
+	if mode == "reject" {
+		return m, errUnknownFileHash
+	}
+
+	meta := make(map[string]json.RawMessage)
+	if len(m.metadata) > 0 {
+		if err := json.Unmarshal(m.metadata, &meta); err != nil {
+			return m, err
+		}
+	}
+	meta["unknown_file_hash"] = json.RawMessage("true")
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return m, err
+	}
+	m.metadata = raw
+	return m, nil
+}
+
+// register the hashes of a JSON body, or upload a file as the "file" of a
+// multipart form to register its SHA-256
+func handleRegisterHashes(w http.ResponseWriter, r *http.Request) {
+	var req RegisterHashesReq
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxVerifyFileBytes)
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Hashes = []string{hex.EncodeToString(h.Sum(nil))}
+	} else {
+		defer r.Body.Close()
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for i, h := range req.Hashes {
+		req.Hashes[i] = strings.ToLower(strings.TrimSpace(h))
+		if !isSHA256Hex(req.Hashes[i]) {
+			http.Error(w, "hashes must be hex SHA-256, got "+h, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Hashes) == 0 {
+		http.Error(w, "no hashes to register", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	knownHashMutex.Lock()
+	defer knownHashMutex.Unlock()
+	resp := RegisterHashesResp{}
+	for _, h := range req.Hashes {
+		if _, ok := registeredHashes[h]; ok {
+			resp.Known++
+			continue
+		}
+		registeredHashes[h] = now
+		resp.Added++
+	}
+	if err := saveKnownHashesLocked(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
+
+// whether {hash} is a known artifact
+func handleGetKnownHash(w http.ResponseWriter, r *http.Request) {
+	k, ok := lookupKnownHash(mux.Vars(r)["hash"])
+	if !ok {
+		http.Error(w, "unknown file hash", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, k)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter caps how many requests it lets run at once. Requests beyond the cap
+// queue by priority class (see priority.go), wait up to their class's queue
+// timeout for a slot and are then shed with 503. A limit of zero lets every
+// request through.
+type limiter struct {
+	name string
+
+	mu  sync.Mutex
+	max int
+	// most slots bulk requests may hold, zero for no cap of their own
+	maxBulk int
+	// how long each class may wait for a slot
+	queueTimeout [numPriorities]time.Duration
+	inFlight     [numPriorities]int
+	queues       [numPriorities][]chan struct{}
+	served       [numPriorities]uint64
+	shed         [numPriorities]uint64
+}
+
+// LimiterStats reports a limiter's load for GET /limits
+type LimiterStats struct {
+	Name     string       `json:"name"`
+	Limit    int          `json:"limit"`
+	InFlight int          `json:"in_flight"`
+	Served   uint64       `json:"served"`
+	Shed     uint64       `json:"shed"`
+	Classes  []ClassStats `json:"classes"`
+}
+
+// ClassStats is a limiter's load for one priority class
+type ClassStats struct {
+	Class    string `json:"class"`
+	InFlight int    `json:"in_flight"`
+	Queued   int    `json:"queued"`
+	Served   uint64 `json:"served"`
+	Shed     uint64 `json:"shed"`
+}
+
+// globalLimiter caps all requests (LIMIT_GLOBAL), chainLimiter caps the
+// expensive full chain dump GET / (LIMIT_CHAIN). Keeping LIMIT_CHAIN below
+// LIMIT_GLOBAL leaves slots for block writes during a flood of chain reads.
+// Both live as long as the process, a reload only changes their limits.
+var (
+	globalLimiter = &limiter{name: "global"}
+	chainLimiter  = &limiter{name: "chain"}
+)
+
+// limits is a parsed set of LIMIT_* settings
+type limits struct {
+	global, chain, bulk int
+	queueTimeout        [numPriorities]time.Duration
+}
+
+// loadLimits reads the concurrency limits, unset means unlimited
+func loadLimits() error {
+	l, err := parseLimits(os.Getenv)
+	if err != nil {
+		return err
+	}
+	l.apply()
+	return nil
+}
+
+// prepareLimits validates reloaded LIMIT_* settings
+func prepareLimits(env map[string]string) (func(), error) {
+	l, err := parseLimits(func(key string) string { return env[key] })
+	if err != nil {
+		return nil, err
+	}
+	return l.apply, nil
+}
+
+// parseLimits validates the LIMIT_* settings without applying them
+func parseLimits(getenv func(string) string) (limits, error) {
+	var l limits
+	var err error
+	if l.global, err = parseLimit("global", getenv("LIMIT_GLOBAL")); err != nil {
+		return l, err
+	}
+	if l.chain, err = parseLimit("chain", getenv("LIMIT_CHAIN")); err != nil {
+		return l, err
+	}
+	if v := getenv("LIMIT_BULK"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return l, errors.New("LIMIT_BULK must be a positive number")
+		}
+		if n < l.global {
+			l.bulk = n
+		}
+	} else if l.global > 1 {
+		l.bulk = l.global / 2
+	}
+
+	// how long a request may wait for a slot (LIMIT_QUEUE_TIMEOUT), per
+	// class with LIMIT_QUEUE_TIMEOUT_<CLASS>
+	wait := time.Second
+	if v := getenv("LIMIT_QUEUE_TIMEOUT"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil {
+			return l, err
+		}
+	}
+	for c, name := range priorityNames {
+		suffix := "_" + strings.ToUpper(name)
+		l.queueTimeout[c] = wait
+		if v := getenv("LIMIT_QUEUE_TIMEOUT" + suffix); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return l, errors.New("LIMIT_QUEUE_TIMEOUT" + suffix + " must be a duration like 1s")
+			}
+			l.queueTimeout[c] = d
+		}
+	}
+	return l, nil
+}
+
+func parseLimit(name, v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, errors.New("concurrency limit for " + name + " must be a positive number")
+	}
+	return n, nil
+}
+
+// apply sets the limits of the running limiters
+func (l limits) apply() {
+	globalLimiter.setLimits(l.global, l.bulk, l.queueTimeout)
+	chainLimiter.setLimits(l.chain, 0, l.queueTimeout)
+}
+
+// setLimits replaces the limiter's caps. Requests already holding a slot
+// keep it; queued requests get the slots a higher limit frees.
+func (l *limiter) setLimits(max, maxBulk int, queueTimeout [numPriorities]time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max != l.max {
+		if max > 0 {
+			log.Printf("limiting %s requests to %d at a time", l.name, max)
+		} else {
+			log.Printf("not limiting %s requests", l.name)
+		}
+	}
+	l.max, l.maxBulk, l.queueTimeout = max, maxBulk, queueTimeout
+	l.grantLocked()
+}
+
+// total adds up per class counts
+func total(counts [numPriorities]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// admitsLocked reports whether a request of class c may take a free slot.
+// Caller must hold l.mu.
+func (l *limiter) admitsLocked(c priorityClass) bool {
+	if l.max > 0 && total(l.inFlight) >= l.max {
+		return false
+	}
+	return c != priorityBulk || l.maxBulk == 0 || l.inFlight[priorityBulk] < l.maxBulk
+}
+
+// acquire takes a slot for class c, or gives up after the class's queue
+// timeout or when ctx is done. It doesn't overtake requests of the same or a
+// higher class that are already queued.
+func (l *limiter) acquire(ctx context.Context, c priorityClass) bool {
+	l.mu.Lock()
+	queued := false
+	for above := priorityDevice; above <= c; above++ {
+		queued = queued || len(l.queues[above]) > 0
+	}
+	if !queued && l.admitsLocked(c) {
+		l.inFlight[c]++
+		l.served[c]++
+		l.mu.Unlock()
+		return true
+	}
+	granted := make(chan struct{})
+	l.queues[c] = append(l.queues[c], granted)
+	wait := l.queueTimeout[c]
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-granted:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ch := range l.queues[c] {
+		if ch == granted {
+			l.queues[c] = append(l.queues[c][:i], l.queues[c][i+1:]...)
+			l.shed[c]++
+			return false
+		}
+	}
+	// granted while timing out
+	return true
+}
+
+// release gives back a slot of class c and hands free slots to the highest
+// classes waiting
+func (l *limiter) release(c priorityClass) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight[c]--
+	l.grantLocked()
+}
+
+// grantLocked hands free slots to the highest classes waiting. Caller must
+// hold l.mu.
+func (l *limiter) grantLocked() {
+	for next := priorityDevice; next < numPriorities; next++ {
+		for len(l.queues[next]) > 0 && l.admitsLocked(next) {
+			close(l.queues[next][0])
+			l.queues[next] = l.queues[next][1:]
+			l.inFlight[next]++
+			l.served[next]++
+		}
+	}
+}
+
+// limit runs next once l has a free slot
+func limit(l *limiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := priorityOf(r)
+		if !l.acquire(r.Context(), c) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		var once sync.Once
+		release := func() { once.Do(func() { l.release(c) }) }
+		defer release()
+		next(w, r.WithContext(context.WithValue(r.Context(), l, release)))
+	}
+}
+
+// releaseSlot gives back a request's slot in l early, for long-lived
+// requests such as event streams that would otherwise hold it for hours
+func releaseSlot(r *http.Request, l *limiter) {
+	if release, ok := r.Context().Value(l).(func()); ok {
+		release()
+	}
+}
+
+func (l *limiter) stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := LimiterStats{Name: l.name, Limit: l.max, InFlight: total(l.inFlight), Classes: make([]ClassStats, 0, numPriorities)}
+	for c, name := range priorityNames {
+		s.Served += l.served[c]
+		s.Shed += l.shed[c]
+		s.Classes = append(s.Classes, ClassStats{name, l.inFlight[c], len(l.queues[c]), l.served[c], l.shed[c]})
+	}
+	return s
+}
+
+// report served and shed requests per limiter and class
+func handleGetLimits(w http.ResponseWriter, r *http.Request) {
+	list := make([]LimiterStats, 0, 2)
+	for _, l := range []*limiter{globalLimiter, chainLimiter} {
+		if s := l.stats(); s.Limit > 0 {
+			list = append(list, s)
+		}
+	}
+	respondWithJSON(w, r, http.StatusOK, list)
+}
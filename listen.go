@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// serve runs s on the TCP addresses (when PORT is set, see listenAddrs) and the Unix socket
+// UNIX_SOCKET (when set) until either fails. TLS only applies to TCP: the
+// socket is meant for a local proxy and carries plain HTTP, so requests on
+// it never pass the certificate checks of mTLS protected routes.
+func serve(s *http.Server) error {
+	var listeners []func() error
+
+	if os.Getenv("PORT") != "" {
+		for _, addr := range listenAddrs() {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			log.Println("HTTP Server Listening on", l.Addr())
+			listeners = append(listeners, func() error {
+				if s.TLSConfig != nil {
+					// the node certificate is already in TLSConfig, see nodeCertificate
+					return s.ServeTLS(l, "", "")
+				}
+				return s.Serve(l)
+			})
+		}
+	}
+
+	if path := os.Getenv("UNIX_SOCKET"); path != "" {
+		// a socket left behind by a previous run would block the bind
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, 0660); err != nil {
+			return err
+		}
+		log.Println("HTTP Server Listening on unix socket", path)
+		listeners = append(listeners, func() error { return s.Serve(l) })
+	}
+
+	if len(listeners) == 0 {
+		return errors.New("set PORT or UNIX_SOCKET")
+	}
+	errs := make(chan error, len(listeners))
+	for _, listen := range listeners {
+		go func(listen func() error) { errs <- listen() }(listen)
+	}
+	return <-errs
+}
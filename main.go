@@ -1,10 +1,10 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
 	"encoding/json"
-	"io"
+	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -15,20 +15,41 @@ import (
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 )
 
 // Block represents each 'item' in the blockchain
 type Block struct {
-	Index     int
-	Timestamp string
-	FileHash  string
-	Event     string
-	EventTime string
-	Location  string
-	Server    string
-	Hash      string
-	PrevHash  string
+	Index     int        `json:"index"`
+	Timestamp string     `json:"timestamp"`
+	FileHash  string     `json:"file_hash"`
+	Event     string     `json:"event"`
+	EventTime string     `json:"event_time"`
+	Location  string     `json:"location"`
+	Server    string     `json:"server"`
+	Hash      string     `json:"hash"`
+	PrevHash  string     `json:"prev_hash"`
+	Approvals []Approval `json:"approvals,omitempty"`
+	// DeviceKey and DeviceHMAC record the appliance key that signed the event
+	DeviceKey  string `json:"device_key,omitempty"`
+	DeviceHMAC string `json:"device_hmac,omitempty"`
+	// BackfilledBy marks a historical event imported in backfill mode and
+	// names the importer
+	BackfilledBy string `json:"backfilled_by,omitempty"`
+	// Signer and SignerCert are the subject and SHA-256 fingerprint of the
+	// certificate that signed a CMS write
+	Signer     string `json:"signer,omitempty"`
+	SignerCert string `json:"signer_cert,omitempty"`
+	// Metadata holds the fields of the write this node didn't know, see
+	// decodeWrite
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// Difficulty is the number of zero hex digits the hash was mined to
+	// start with and Nonce what it took, see pow.go
+	Difficulty int    `json:"difficulty,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+	// Transactions are the events of a block sealed from the mempool and
+	// MerkleRoot the root over their hashes, see mempool.go
+	Transactions []Transaction `json:"transactions,omitempty"`
+	MerkleRoot   string        `json:"merkle_root,omitempty"`
 }
 
 // Blockchain is a series of validated Blocks
@@ -36,13 +57,31 @@ var Blockchain []Block
 
 var BlockMap map[string]*Block
 
-// Message takes incoming JSON payload for writing hash
+// Message takes incoming JSON payload for writing hash. KeyID and HMAC are
+// set by appliances that sign their events with a device key.
 type CreateBlockReq struct {
-	FileHash  string
-	Event     string
-	EventTime string
-	Location  string
-	Server    string
+	FileHash  string `json:"file_hash"`
+	Event     string `json:"event"`
+	EventTime string `json:"event_time"`
+	Location  string `json:"location"`
+	Server    string `json:"server"`
+	KeyID     string `json:"key_id,omitempty"`
+	HMAC      string `json:"hmac,omitempty"`
+	// SignedAt is when the device or validator signed the event, RFC 3339,
+	// see eventRecord
+	SignedAt string `json:"signed_at,omitempty"`
+	// Backfill imports a historical event, see authorizeBackfill
+	Backfill bool `json:"backfill,omitempty"`
+
+	importer string
+	// set for a verified CMS write, see openSignedWrite
+	signer, signerCert string
+	// unknown fields of the write, see decodeWrite
+	metadata json.RawMessage
+	// the events of a batch, see mempool.go
+	transactions []Transaction
+	// set for the blocks the node records on its own, see nodeMinted
+	system bool
 }
 
 //"FileHash": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
@@ -51,70 +90,310 @@ type CreateBlockReq struct {
 //"Location" : "San Jose, CA",
 //"Server" : "vpn-1-sjc.ssl.cisco.com"
 
+// WriteReceipt is the response to a block write: the block plus what its
+// hash was computed over, so the writer can recompute the hash itself
+type WriteReceipt struct {
+	Block
+	Algorithm string `json:"algorithm"`
+	Record    string `json:"record"`
+}
+
+func writeReceipt(b Block) WriteReceipt {
+	return WriteReceipt{b, hashAlgorithmOf(b.Hash), blockRecord(b)}
+}
+
 type ValidationReq struct {
-	CreateMessage CreateBlockReq
-	Hash          string
+	CreateMessage CreateBlockReq `json:"create_message"`
+	Hash          string         `json:"hash"`
 }
 
 type ValidationResp struct {
-	ValidationMessage ValidationReq
-	Result            bool
+	ValidationMessage ValidationReq `json:"validation_message"`
+	Result            bool          `json:"result"`
 }
 
+// errStaleBlock is returned when a block no longer extends the chain head
+var errStaleBlock = errors.New("block does not extend the current head")
+
+// errChainNotReady is returned while the chain has no genesis block yet
+var errChainNotReady = errors.New("chain is not initialized")
+
 var mutex = &sync.Mutex{}
 
 func main() {
-	err := godotenv.Load()
+	err := loadConfigFile()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := loadSecrets(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		runDoctorCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		runReindexCommand(os.Args[2:])
+		return
+	}
 
 	BlockMap = make(map[string]*Block)
+	loadPeerAllowlist()
+	if err := loadProxyConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadLimits(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadPriorities(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDeviceKeys(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAdminKeys(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadFreezeWindows(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadEventTimeWindow(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadCMSTrust(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSites(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadKnownHashes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadWritePuzzle(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadProofOfWork(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadEnrichment(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadValidators(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openRecorder(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openAudit(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openStore(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadChain(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadIdempotency(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadStats(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSearchIndex(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDevices(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAnnotations(); err != nil {
+		log.Fatal(err)
+	}
+	// the chain must exist before anything can write to it
+	if err := createGenesisBlock(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startStorageWatch(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startRaft(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startGroupCommit(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startMempool(); err != nil {
+		log.Fatal(err)
+	}
+	if err := watchConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startSecretsRefresh(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startArchiver(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startRetention(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startIngest(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startCollectors(); err != nil {
+		log.Fatal(err)
+	}
+	startSilenceWatch()
+	if err := startPeers(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startSync(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startStandby(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startNotarizer(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startHeadDNS(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startMetricsPush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startSinks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startEpochs(); err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(run())
 
-	go func() {
-		t := time.Now()
-		genesisBlock := Block{}
-		genesisBlock = Block{0, t.String(), "", "", "", "", "", calculateHash(genesisBlock), ""}
-		spew.Dump(genesisBlock)
+}
 
-		mutex.Lock()
-		Blockchain = append(Blockchain, genesisBlock)
-		mutex.Unlock()
-	}()
-	log.Fatal(run())
+// createGenesisBlock starts a new chain. A persisted chain already has its
+// genesis block and is left alone.
+func createGenesisBlock() error {
+	// a fixed genesis timestamp makes the chain reproducible (see cmd/replay)
+	t := time.Now().String()
+	if ts := os.Getenv("GENESIS_TIMESTAMP"); ts != "" {
+		t = ts
+	}
+	// the genesis hash has always been that of the empty block
+	genesisBlock := Block{Index: 0, Timestamp: t, Hash: calculateHash(Block{})}
 
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(Blockchain) > 0 {
+		return nil
+	}
+	if store != nil {
+		if err := store.Append(genesisBlock); err != nil {
+			return err
+		}
+	}
+	Blockchain = append(Blockchain, genesisBlock)
+	BlockMap[genesisBlock.Hash] = &genesisBlock
+	noteSizesLocked()
+	spew.Dump(genesisBlock)
+	return nil
 }
 
 // web server
 func run() error {
 	mux := makeMuxRouter()
-	httpPort := os.Getenv("PORT")
-	log.Println("HTTP Server Listening on port :", httpPort)
 	s := &http.Server{
-		Addr:           ":" + httpPort,
-		Handler:        mux,
+		Handler:        stripBasePath(prioritize(limit(globalLimiter, mux.ServeHTTP))),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	if err := s.ListenAndServe(); err != nil {
-		return err
+	// serve HTTPS (optionally with client certificates) when a cert is configured
+	if os.Getenv("TLS_CERT_FILE") != "" || acmeEnabled() {
+		cfg, err := tlsConfig()
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = cfg
 	}
 
-	return nil
+	if err := startAdmin(); err != nil {
+		return err
+	}
+	if err := startAggregates(); err != nil {
+		return err
+	}
+	return serve(s)
 }
 
 // create handlers
-func makeMuxRouter() http.Handler {
+func makeMuxRouter() *mux.Router {
 	muxRouter := mux.NewRouter()
-	muxRouter.HandleFunc("/", handleGetBlockchain).Methods("GET")
-	muxRouter.HandleFunc("/validation", handleValidation).Methods("POST")
-	muxRouter.HandleFunc("/block/{hash}", handleGetOneBlockChain).Methods("GET")
-	muxRouter.HandleFunc("/block", handleWriteBlock).Methods("POST")
+	// monitors get one fixed format, the v2 one
+	muxRouter.Handle("/.well-known/chain-head", apiVersion(2, false)(http.HandlerFunc(handleGetChainHead))).Methods("GET")
+	addVersionedRoutes(muxRouter, addRoutes)
 	return muxRouter
 }
 
+// addRoutes registers the API on muxRouter, once per version prefix
+func addRoutes(muxRouter *mux.Router) {
+	muxRouter.HandleFunc("/", limit(chainLimiter, compress(handleGetBlockchain))).Methods("GET")
+	muxRouter.HandleFunc("/validation", validateBody(ValidationReq{}, handleValidation)).Methods("POST")
+	muxRouter.HandleFunc("/verify-block", requireChain(validateBody(Block{}, handleVerifyBlock))).Methods("POST")
+	muxRouter.HandleFunc("/verify-file", handleVerifyFile).Methods("POST")
+	muxRouter.HandleFunc("/block/{hash}", handleGetOneBlockChain).Methods("GET")
+	muxRouter.HandleFunc("/block/index/{n}", handleGetBlockByIndex).Methods("GET")
+	muxRouter.HandleFunc("/block/{hash}/receipt", handleGetBlockReceipt).Methods("GET")
+	muxRouter.HandleFunc("/proof/{eventHash}", handleGetProof).Methods("GET")
+	muxRouter.HandleFunc("/block/{hash}/annotations", requireAuditor(handleGetBlockAnnotations)).Methods("GET")
+	muxRouter.HandleFunc("/block/{hash}/annotations", requireAuditor(validateBody(AnnotationReq{}, handleCreateAnnotation))).Methods("POST")
+	muxRouter.HandleFunc("/annotations", requireAuditor(handleSearchAnnotations)).Methods("GET")
+	muxRouter.HandleFunc("/blocks/latest", compress(handleGetLatestBlocks)).Methods("GET")
+	muxRouter.HandleFunc("/blocks/delta", requireChain(compress(handleGetBlockDelta))).Methods("GET")
+	muxRouter.HandleFunc("/snapshots", requireChain(handleCreateSnapshot)).Methods("POST")
+	muxRouter.HandleFunc("/block", requirePeerIdentity(requireChain(validateBody(CreateBlockReq{}, handleWriteBlock)))).Methods("POST")
+	muxRouter.HandleFunc("/submissions/{id}", handleGetSubmission).Methods("GET")
+	muxRouter.HandleFunc("/events/stream", handleEventStream).Methods("GET")
+	muxRouter.HandleFunc("/graph", requireChain(compress(handleGetGraph))).Methods("GET")
+	muxRouter.HandleFunc("/export", requireChain(compress(handleExport))).Methods("GET")
+	muxRouter.HandleFunc("/audit", compress(handleGetAudit)).Methods("GET")
+	muxRouter.HandleFunc("/audit/chain", compress(handleGetAuditChain)).Methods("GET")
+	muxRouter.HandleFunc("/archives", handleGetArchives).Methods("GET")
+	muxRouter.HandleFunc("/epochs", handleGetEpochs).Methods("GET")
+	muxRouter.HandleFunc("/epochs/{n}", handleGetEpoch).Methods("GET")
+	muxRouter.HandleFunc("/epochs/{n}/blocks", compress(handleGetEpochBlocks)).Methods("GET")
+	muxRouter.HandleFunc("/stats", handleGetStats).Methods("GET")
+	addAggregateRoutes(muxRouter)
+	muxRouter.HandleFunc("/search", compress(handleSearch)).Methods("GET")
+	muxRouter.HandleFunc("/puzzle", handleGetPuzzle).Methods("GET")
+	muxRouter.HandleFunc("/sites", handleGetSites).Methods("GET")
+	muxRouter.HandleFunc("/sites/{code}", handleGetSite).Methods("GET")
+	muxRouter.HandleFunc("/sites/{code}/blocks", compress(handleGetSiteBlocks)).Methods("GET")
+	muxRouter.HandleFunc("/minters", handleGetMinters).Methods("GET")
+	muxRouter.HandleFunc("/minters/{node}/blocks", compress(handleGetMinterBlocks)).Methods("GET")
+	muxRouter.HandleFunc("/baseline", requireChain(handleGetBaseline)).Methods("GET")
+	muxRouter.HandleFunc("/compare-baseline", requireChain(validateBody(Baseline{}, handleCompareBaseline))).Methods("POST")
+	muxRouter.HandleFunc("/peers/blocks", requirePeer(requireChain(validateBody(Block{}, handlePeerBlock)))).Methods("POST")
+	muxRouter.HandleFunc("/peers/digest", requirePeer(requireChain(handlePeerDigest))).Methods("GET")
+	muxRouter.HandleFunc("/peers/range", requirePeer(compress(handlePeerRange))).Methods("GET")
+	muxRouter.HandleFunc("/reanchor/{index}", handleGetAnchorManifest).Methods("GET")
+	muxRouter.HandleFunc("/keys", handleGetKeys).Methods("GET")
+	muxRouter.HandleFunc("/proposals", handleGetProposals).Methods("GET")
+	muxRouter.HandleFunc("/proposals", requirePeerIdentity(requireChain(validateBody(ProposalReq{}, handleCreateProposal)))).Methods("POST")
+	muxRouter.HandleFunc("/proposals/{id}", handleGetProposal).Methods("GET")
+	muxRouter.HandleFunc("/proposals/{id}/votes", requirePeerIdentity(validateBody(VoteReq{}, handleVoteProposal))).Methods("POST")
+	// without a separate admin listener the admin routes stay public
+	if !adminEnabled() {
+		addAdminRoutes(muxRouter)
+	}
+}
+
 // takes JSON payload as an input for log (fileHash)
 func handleValidation(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -131,43 +410,119 @@ func handleValidation(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	if block, ok := BlockMap[v.Hash]; ok {
-		if strings.Compare(block.Event, v.CreateMessage.Event) == 0 {
-			valid = true
-			status = http.StatusCreated
+		// the receipt of a batched write is its batch block
+		for _, tx := range eventsOf(*block) {
+			if normalizeText(tx.Event) == normalizeText(v.CreateMessage.Event) {
+				valid = true
+				status = http.StatusCreated
+				break
+			}
 		}
 	}
 
 	vResp.ValidationMessage = v
 	vResp.Result = valid
+	recordValidation(r, v, valid)
+	observeValidation(valid)
 
 	respondWithJSON(w, r, status, vResp)
 
 }
 
-// Get a specific Block
+// BlockRef identifies a block by index and hash
+type BlockRef struct {
+	Index int    `json:"index"`
+	Hash  string `json:"hash"`
+}
+
+// shortest hash prefix accepted by GET /block/{hash}
+const minHashPrefix = 4
+
+// Get a specific Block by its full hash or an unambiguous prefix
 func handleGetOneBlockChain(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	fileHash := vars["hash"]
-	block := BlockMap[fileHash]
-	// We pass pointed to block but Marshall converts the actual
-	// object
-	bytes, err := json.MarshalIndent(block, "", "  ")
+	fileHash := strings.ToLower(vars["hash"])
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
 		return
 	}
-	io.WriteString(w, string(bytes))
+	block, ok := BlockMap[fileHash]
+	if ok && block.Index > height {
+		block, ok = nil, false
+	}
+	var matches []BlockRef
+	if !ok && len(fileHash) >= minHashPrefix {
+		matches = findBlocksByPrefix(fileHash, height)
+		if len(matches) == 1 {
+			block = BlockMap[matches[0].Hash]
+		}
+	}
+	mutex.Unlock()
 
+	if len(matches) > 1 {
+		respondWithJSON(w, r, http.StatusMultipleChoices, matches)
+		return
+	}
+	if block == nil {
+		if len(fileHash) < minHashPrefix {
+			http.Error(w, "hash prefix too short", http.StatusBadRequest)
+			return
+		}
+		respondWithError(w, ErrNotFound)
+		return
+	}
+
+	// only a full hash names an immutable resource, a prefix may become ambiguous
+	if ok {
+		respondWithImmutableBlock(w, r, *block)
+		return
+	}
+	respondWithBlocks(w, r, http.StatusOK, *block)
+}
+
+// findBlocksByPrefix returns every block up to height whose hash starts
+// with prefix. Caller must hold mutex.
+func findBlocksByPrefix(prefix string, height int) []BlockRef {
+	var matches []BlockRef
+	for _, b := range Blockchain[:height+1] {
+		if strings.HasPrefix(b.Hash, prefix) {
+			matches = append(matches, BlockRef{b.Index, b.Hash})
+		}
+	}
+	return matches
 }
 
 // get blockchain when we receive an http request
 func handleGetBlockchain(w http.ResponseWriter, r *http.Request) {
-	bytes, err := json.MarshalIndent(Blockchain, "", "  ")
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
 		return
 	}
-	io.WriteString(w, string(bytes))
+	chain := Blockchain[:height+1]
+	mutex.Unlock()
+	// on /v2 the cursor is the index of the first block of the page
+	if apiVersionOf(r) == 2 {
+		from, to, next, err := pageBounds(r, len(chain))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := selectBlockFields(r, chain[from:to])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respondWithPage(w, r, http.StatusOK, page, next)
+		return
+	}
+	respondWithBlocks(w, r, http.StatusOK, chain)
 }
 
 // takes JSON payload as an input for log (fileHash)
@@ -176,37 +531,346 @@ func handleWriteBlock(w http.ResponseWriter, r *http.Request) {
 	var m CreateBlockReq
 	var statusCode = http.StatusCreated
 	var newBlock Block
+	start := time.Now()
 
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&m); err != nil {
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var signed signedContent
+	if isSignedWrite(r) {
+		if signed, err = openSignedWrite(body); err != nil {
+			recordRejection(r, body, err.Error())
+			if err == errCMSDisabled {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			} else if err == errCMSMalformed {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			}
+			return
+		}
+		body = signed.body
+	}
+	if m, err = decodeWrite(body); err != nil {
+		recordRejection(r, body, err.Error())
+		if err == errMetadataTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		respondWithJSON(w, r, http.StatusBadRequest, r.Body)
 		return
 	}
-	defer r.Body.Close()
+	m.signer, m.signerCert = signed.signer, signed.signerCert
 
-	if len(m.Event) != 0 {
+	if poaEnabled() {
+		http.Error(w, "proof-of-authority mode: submit blocks through /proposals", http.StatusForbidden)
+		return
+	}
 
-		mutex.Lock()
-		newBlock = generateBlock(Blockchain[len(Blockchain)-1], m.FileHash, m.Event, m.EventTime, m.Location, m.Server)
-		mutex.Unlock()
+	if err := checkReservedEvent(m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := verifyDeviceHMAC(m, true); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkDeviceKeyHeader(r, m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := verifyRegisteredDevice(m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := authorizeBackfill(r, &m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// spam is not recorded as rejected, that would store it anyway
+	if err := checkWritePuzzle(r, body, m); err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+	if err := verifyEventTime(m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := verifySite(m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if m, err = checkFileHash(m); err != nil {
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	m = enrichEvent(m)
+
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" && len(m.Event) != 0 {
+		ref, err := beginIdempotent(key, body)
+		switch {
+		case err == errIdempotencyPending:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case ref != nil:
+			b, ok := idempotentBlock(*ref)
+			if !ok {
+				http.Error(w, "the block written with this Idempotency-Key is no longer on the chain", http.StatusGone)
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			respondWithReceipt(w, r, http.StatusCreated, b)
+			return
+		}
+	}
 
-		if isBlockValid(newBlock, Blockchain[len(Blockchain)-1]) {
-			Blockchain = append(Blockchain, newBlock)
-			spew.Dump(Blockchain)
+	// claimed only now, so an idempotent retry isn't taken for a replay
+	if err := claimDeviceHMAC(m); err != nil {
+		if key != "" {
+			finishIdempotent(key, nil)
 		}
+		recordRejection(r, body, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-		// Add block to hash map so it can be searched in O(1)
-		BlockMap[newBlock.Hash] = &newBlock
+	if r.URL.Query().Get("async") == "true" && len(m.Event) != 0 {
+		s, err := submitAsync(m, key, r.URL.Query().Get("callback"))
+		if err != nil {
+			releaseDeviceHMAC(m)
+			if key != "" {
+				finishIdempotent(key, nil)
+			}
+			if err == errSubmissionQueueFull {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		respondWithJSON(w, r, http.StatusAccepted, s)
+		return
+	}
+
+	if len(m.Event) != 0 {
+		newBlock, err = addEvent(m, replayTimestamp(r))
+		if err != nil {
+			releaseDeviceHMAC(m)
+		}
+		if key != "" {
+			if err == nil {
+				finishIdempotent(key, &newBlock)
+			} else {
+				finishIdempotent(key, nil)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, errBlockTooLarge) {
+				recordRejection(r, body, err.Error())
+			}
+			respondWithError(w, err)
+			return
+		}
+		observeWrite(time.Since(start))
+		recordWrite(m, newBlock)
 	} else {
+		recordRejection(r, body, "Event is required")
 		statusCode = http.StatusBadRequest
 	}
 
+	if statusCode == http.StatusCreated {
+		respondWithReceipt(w, r, statusCode, newBlock)
+		return
+	}
 	respondWithJSON(w, r, statusCode, newBlock)
 
 }
 
+// addBlock mints a block for m on top of the current head and appends it.
+// timestamp is empty except when replaying recorded writes.
+func addBlock(m CreateBlockReq, timestamp string) (Block, error) {
+	if raftNode != nil {
+		return addBlockRaft(m, timestamp)
+	}
+	if groupCommitQueue != nil {
+		return addBlockGrouped(m, timestamp)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(Blockchain) == 0 {
+		return Block{}, errChainNotReady
+	}
+	newBlock, err := mintBlock(Blockchain[len(Blockchain)-1], m, timestamp)
+	if err != nil {
+		return Block{}, err
+	}
+	return newBlock, appendBlockLocked(newBlock)
+}
+
+// mintBlock builds the block for m on top of prev. Caller must hold mutex.
+func mintBlock(prev Block, m CreateBlockReq, timestamp string) (Block, error) {
+	m = normalizeEvent(m)
+	if err := checkChainIntact(); err != nil {
+		return Block{}, err
+	}
+	if err := checkStandby(); err != nil {
+		return Block{}, err
+	}
+	if err := checkFreeze(m); err != nil {
+		return Block{}, err
+	}
+	if err := checkStorage(); err != nil {
+		return Block{}, err
+	}
+	newBlock := generateBlock(prev, timestamp, m.FileHash, m.Event, m.EventTime, m.Location, m.Server)
+	if m.KeyID != "" {
+		newBlock.DeviceKey, newBlock.DeviceHMAC = m.KeyID, strings.ToLower(m.HMAC)
+	}
+	if m.Backfill && m.importer != "" {
+		newBlock.BackfilledBy = m.importer
+	}
+	newBlock.Signer, newBlock.SignerCert = m.signer, m.signerCert
+	if m.system {
+		newBlock.Metadata = stampSystem(m.metadata)
+	} else {
+		newBlock.Metadata = stampMinter(m.metadata, "")
+	}
+	if len(m.transactions) > 0 {
+		newBlock.Transactions, newBlock.MerkleRoot = m.transactions, transactionsRoot(m.transactions)
+	}
+	if newBlock.DeviceKey != "" || newBlock.BackfilledBy != "" || newBlock.SignerCert != "" || len(newBlock.Metadata) > 0 || newBlock.MerkleRoot != "" {
+		newBlock.Hash = hashFor(newBlock, prev)
+	}
+	newBlock = mineBlock(newBlock, prev)
+	if err := checkBlockSize(newBlock); err != nil {
+		return Block{}, err
+	}
+	return newBlock, nil
+}
+
+// commitBlock appends an already minted block if it still extends the head
+func commitBlock(newBlock Block) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return appendBlockLocked(newBlock)
+}
+
+// commitPeerBlock appends a block a peer already committed, see
+// appendCommittedLocked
+func commitPeerBlock(b Block) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := checkChainIntact(); err != nil {
+		return err
+	}
+	return appendCommittedLocked(b)
+}
+
+// appendBlockLocked validates, persists and appends newBlock. Caller must
+// hold mutex.
+func appendBlockLocked(newBlock Block) error {
+	if len(Blockchain) == 0 {
+		return errChainNotReady
+	}
+	if err := checkChainIntact(); err != nil {
+		return err
+	}
+	if _, dup := BlockMap[newBlock.Hash]; dup {
+		return &BlockError{newBlock.Index, ErrDuplicate}
+	}
+	if err := validateBlock(newBlock, Blockchain[len(Blockchain)-1]); err != nil {
+		return err
+	}
+	return persistBlockLocked(newBlock)
+}
+
+// appendCommittedLocked appends a block another node already committed,
+// checking only what the block itself proves (see validateLink), so every
+// node that applies it reaches the same chain. Caller must hold mutex.
+func appendCommittedLocked(newBlock Block) error {
+	if len(Blockchain) == 0 {
+		return errChainNotReady
+	}
+	if _, dup := BlockMap[newBlock.Hash]; dup {
+		return &BlockError{newBlock.Index, ErrDuplicate}
+	}
+	if err := validateLink(newBlock, Blockchain[len(Blockchain)-1]); err != nil {
+		return err
+	}
+	return persistBlockLocked(newBlock)
+}
+
+// persistBlockLocked stores a validated block and appends it. Caller must
+// hold mutex.
+func persistBlockLocked(newBlock Block) error {
+	if store != nil {
+		if err := store.Append(newBlock); err != nil {
+			log.Println("persisting block failed:", err)
+			noteStorageError(err)
+			return err
+		}
+	}
+	installBlockLocked(newBlock)
+	return nil
+}
+
+// installBlockLocked adds a validated, persisted block to the chain and
+// tells everyone who follows it. Caller must hold mutex.
+func installBlockLocked(newBlock Block) {
+	Blockchain = append(Blockchain, newBlock)
+	noteSizesLocked()
+	recordStatsLocked(newBlock)
+
+	// Add block to hash map so it can be searched in O(1)
+	BlockMap[newBlock.Hash] = &newBlock
+	noteSourceLocked(newBlock)
+	noteSiteLocked(newBlock)
+	noteMinterLocked(newBlock)
+	noteSearchLocked(newBlock)
+	noteTransactionsLocked(newBlock)
+	broadcastBlock(newBlock)
+	publishBlockLocked(newBlock)
+	forwardBlock(newBlock)
+	notifyHeadLocked()
+}
+
+// requireChain answers 503 until the chain has its genesis block
+func requireChain(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		ready := len(Blockchain) > 0
+		mutex.Unlock()
+		if !ready {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, errChainNotReady.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func respondWithJSON(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
-	response, err := json.MarshalIndent(payload, "", "  ")
+	response, err := marshalResponse(r, payload)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("HTTP 500: Internal Server Error"))
@@ -218,46 +882,127 @@ func respondWithJSON(w http.ResponseWriter, r *http.Request, code int, payload i
 
 // make sure block is valid by checking index, and comparing the hash of the previous block
 func isBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
-		return false
-	}
+	return validateBlock(newBlock, oldBlock) == nil
+}
 
-	if oldBlock.Hash != newBlock.PrevHash {
-		return false
+// validateBlock says why a new block does not extend oldBlock, see
+// BlockError. Besides validateLink it holds the block time to this node's
+// tolerance.
+func validateBlock(newBlock, oldBlock Block) error {
+	if err := validateLink(newBlock, oldBlock); err != nil {
+		return err
 	}
-
-	if calculateHash(newBlock) != newBlock.Hash {
-		return false
+	if !isBlockTimeValid(newBlock, oldBlock) {
+		return &BlockError{newBlock.Index, errBlockTime}
 	}
+	return nil
+}
 
-	return true
+// validateLink says why newBlock does not extend oldBlock from the two
+// blocks alone, independent of this node's clock and configuration
+func validateLink(newBlock, oldBlock Block) error {
+	var err error
+	switch {
+	case oldBlock.Index+1 != newBlock.Index:
+		err = ErrIndexGap
+	case oldBlock.Hash != newBlock.PrevHash:
+		err = ErrInvalidPrevHash
+	case hashFor(newBlock, oldBlock) != newBlock.Hash:
+		err = ErrHashMismatch
+	case transactionsRoot(newBlock.Transactions) != newBlock.MerkleRoot:
+		err = errMerkleMismatch
+	case !meetsDifficulty(newBlock.Hash, newBlock.Difficulty):
+		err = errInsufficientWork
+	// a transition must name an algorithm its successors can be hashed with
+	case newBlock.Event == reanchorEvent && nodeMinted(newBlock) && hashAlgorithms[newBlock.Location] == nil:
+		err = errUnknownAlgorithm
+	default:
+		return nil
+	}
+	return &BlockError{newBlock.Index, err}
 }
 
-// SHA256 hasing
+// SHA256 hasing with the original algorithm, see hashFor for re-anchored chains
 func calculateHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.Timestamp + block.FileHash + block.Event + block.EventTime + block.Location + block.Server + block.PrevHash
-	h := sha256.New()
-	h.Write([]byte(record))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
+	return hashBlockWith(block, legacyHashAlgorithm)
+}
+
+// blockRecord is the string a block hash is computed over
+func blockRecord(block Block) string {
+	return string(appendBlockRecord(nil, block))
+}
+
+// appendBlockRecord appends the block record to dst, so the hashing path can
+// reuse one buffer instead of concatenating strings. Changing the encoding
+// changes every block hash.
+func appendBlockRecord(dst []byte, block Block) []byte {
+	dst = strconv.AppendInt(dst, int64(block.Index), 10)
+	dst = append(dst, block.Timestamp...)
+	dst = append(dst, block.FileHash...)
+	dst = append(dst, block.Event...)
+	dst = append(dst, block.EventTime...)
+	dst = append(dst, block.Location...)
+	dst = append(dst, block.Server...)
+	dst = append(dst, block.PrevHash...)
+	// only signed events hash the device fields, older blocks keep their hashes
+	if block.DeviceKey != "" {
+		dst = append(dst, block.DeviceKey...)
+		dst = append(dst, block.DeviceHMAC...)
+	}
+	// PrevHash and DeviceHMAC are hex, so the marker can't be mistaken for them
+	if block.BackfilledBy != "" {
+		dst = append(dst, "backfill"...)
+		dst = append(dst, block.BackfilledBy...)
+	}
+	if block.SignerCert != "" {
+		dst = append(dst, "cms"...)
+		dst = append(dst, block.SignerCert...)
+		dst = append(dst, block.Signer...)
+	}
+	// peers and clients may reindent Metadata, the hash covers it compacted
+	if len(block.Metadata) > 0 {
+		dst = append(dst, "meta"...)
+		var buf bytes.Buffer
+		if json.Compact(&buf, block.Metadata) == nil {
+			dst = append(dst, buf.Bytes()...)
+		} else {
+			dst = append(dst, block.Metadata...)
+		}
+	}
+	// the root covers the transactions, Metadata is a JSON object so the
+	// marker can't be mistaken for it
+	if block.MerkleRoot != "" {
+		dst = append(dst, "merkle"...)
+		dst = append(dst, block.MerkleRoot...)
+	}
+	if block.Difficulty > 0 {
+		dst = append(dst, "pow"...)
+		dst = strconv.AppendInt(dst, int64(block.Difficulty), 10)
+		dst = append(dst, ':')
+		dst = append(dst, block.Nonce...)
+	}
+	return dst
 }
 
-// create a new block using previous block's hash
-func generateBlock(oldBlock Block, fileHash string, event string, eventTime string, location string, server string) Block {
+// create a new block using previous block's hash, stamped with the current
+// time unless an explicit timestamp is given
+func generateBlock(oldBlock Block, timestamp string, fileHash string, event string, eventTime string, location string, server string) Block {
 
 	var newBlock Block
 
-	t := time.Now()
+	if timestamp == "" {
+		timestamp = nextBlockTime(oldBlock)
+	}
 
 	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = t.String()
+	newBlock.Timestamp = timestamp
 	newBlock.FileHash = fileHash
 	newBlock.Event = event
 	newBlock.EventTime = eventTime
 	newBlock.Location = location
 	newBlock.Server = server
 	newBlock.PrevHash = oldBlock.Hash
-	newBlock.Hash = calculateHash(newBlock)
+	newBlock.Hash = hashFor(newBlock, oldBlock)
 
 	return newBlock
 }
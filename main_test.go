@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestChain starts a test from a fresh genesis block without storage and
+// returns the API router
+func newTestChain(t *testing.T) http.Handler {
+	t.Helper()
+	mutex.Lock()
+	Blockchain, BlockMap, store = nil, make(map[string]*Block), nil
+	mutex.Unlock()
+	if err := createGenesisBlock(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	reindexLocked()
+	mutex.Unlock()
+	return makeMuxRouter()
+}
+
+// call sends body (JSON encoded unless nil) to router and decodes the
+// response into out, if given. It returns the status code.
+func call(t *testing.T, router http.Handler, method, path string, body, out interface{}) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(method, path, &buf))
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+func TestGenesisBlock(t *testing.T) {
+	t.Setenv("GENESIS_TIMESTAMP", "2024-01-01 00:00:00 +0000 UTC")
+	newTestChain(t)
+	mutex.Lock()
+	genesis := Blockchain[0]
+	mutex.Unlock()
+	if genesis.Index != 0 || genesis.Timestamp != "2024-01-01 00:00:00 +0000 UTC" || genesis.PrevHash != "" {
+		t.Errorf("genesis block is %+v", genesis)
+	}
+	if genesis.Hash != calculateHash(Block{}) {
+		t.Errorf("genesis hash %s is not the hash of the empty block", genesis.Hash)
+	}
+}
+
+func TestBlockTimeToleranceOnlyJudgesNewWrites(t *testing.T) {
+	newTestChain(t)
+	t.Setenv("BLOCK_TIME_TOLERANCE", "0s")
+	mutex.Lock()
+	genesis := Blockchain[0]
+	mutex.Unlock()
+	genesisTime, _ := parseBlockTime(genesis.Timestamp)
+	// committed by a peer whose clock is behind ours
+	b, err := mintBlock(genesis, CreateBlockReq{Event: "login", EventTime: "2024-01-01T00:00:00Z", Server: "s1"}, genesisTime.Add(-time.Hour).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := commitBlock(b); !errors.Is(err, errBlockTime) {
+		t.Errorf("a new write stamped an hour early: %v", err)
+	}
+	if err := verifyChain([]Block{genesis, b}); err != nil {
+		t.Errorf("loading the committed block: %v", err)
+	}
+	if err := commitPeerBlock(b); err != nil {
+		t.Errorf("syncing the committed block: %v", err)
+	}
+}
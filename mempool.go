@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mempool: with MEMPOOL_INTERVAL set, events written to POST /block are not
+// minted into a block each. They collect in the mempool and are sealed into
+// one "batch" block every MEMPOOL_INTERVAL, or as soon as MEMPOOL_MAX_EVENTS
+// (default 1000) are pending. The block carries the events as Transactions
+// and the root of a Merkle tree over their hashes (see merkleRoot) as
+// MerkleRoot, which the block hash covers. A transaction's hash is the
+// SHA-256 of its compact JSON encoding; GET /proof/{eventHash} proves it is
+// in its block (see proof.go).
+//
+// A write waits for the seal, its receipt is the batch block. Async writes,
+// replayed writes, writes during a freeze and the blocks the node records
+// itself are still minted one block each.
+
+const (
+	batchEvent = "batch"
+	// pending events by default before a batch is sealed early
+	defaultMempoolMax = 1000
+)
+
+var errMerkleMismatch = errors.New("block merkle root does not match its transactions")
+
+// Transaction is one event of a batch block
+type Transaction struct {
+	FileHash     string          `json:"file_hash"`
+	Event        string          `json:"event"`
+	EventTime    string          `json:"event_time"`
+	Location     string          `json:"location"`
+	Server       string          `json:"server"`
+	DeviceKey    string          `json:"device_key,omitempty"`
+	DeviceHMAC   string          `json:"device_hmac,omitempty"`
+	BackfilledBy string          `json:"backfilled_by,omitempty"`
+	Signer       string          `json:"signer,omitempty"`
+	SignerCert   string          `json:"signer_cert,omitempty"`
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+}
+
+type pendingEvent struct {
+	tx   Transaction
+	done chan writeResult
+}
+
+// mempoolQueue is nil unless the mempool is enabled
+var mempoolQueue chan pendingEvent
+
+// startMempool reads MEMPOOL_INTERVAL and MEMPOOL_MAX_EVENTS and starts
+// sealing batches
+func startMempool() error {
+	v := os.Getenv("MEMPOOL_INTERVAL")
+	if v == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		return errors.New("MEMPOOL_INTERVAL must be a positive duration")
+	}
+	max := defaultMempoolMax
+	if v := os.Getenv("MEMPOOL_MAX_EVENTS"); v != "" {
+		if max, err = strconv.Atoi(v); err != nil || max < 1 {
+			return errors.New("MEMPOOL_MAX_EVENTS must be a positive number")
+		}
+	}
+	mempoolQueue = make(chan pendingEvent, 4*max)
+	go runMempool(mempoolQueue, interval, max)
+	log.Printf("mempool enabled, sealing every %s or at %d events", interval, max)
+	return nil
+}
+
+// transactionOf is the transaction recording m
+func transactionOf(m CreateBlockReq) Transaction {
+	m = normalizeEvent(m)
+	tx := Transaction{FileHash: m.FileHash, Event: m.Event, EventTime: m.EventTime, Location: m.Location, Server: m.Server, Metadata: m.metadata}
+	if m.KeyID != "" {
+		tx.DeviceKey, tx.DeviceHMAC = m.KeyID, strings.ToLower(m.HMAC)
+	}
+	if m.Backfill && m.importer != "" {
+		tx.BackfilledBy = m.importer
+	}
+	tx.Signer, tx.SignerCert = m.signer, m.signerCert
+	return tx
+}
+
+// txHash is the hash of tx, the leaf of the batch's Merkle tree
+func txHash(tx Transaction) string {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		// Metadata that isn't JSON can't match any root
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// transactionsRoot is the Merkle root over txs, empty for none
+func transactionsRoot(txs []Transaction) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	hashes := make([]string, len(txs))
+	for i, tx := range txs {
+		hashes[i] = txHash(tx)
+	}
+	return merkleRoot(hashes)
+}
+
+// eventsOf is what a block records: the events of a batch, or the block's
+// own. Everything that looks at events rather than blocks goes through it.
+func eventsOf(b Block) []Transaction {
+	if len(b.Transactions) > 0 {
+		return b.Transactions
+	}
+	return []Transaction{{FileHash: b.FileHash, Event: b.Event, EventTime: b.EventTime, Location: b.Location,
+		Server: b.Server, DeviceKey: b.DeviceKey, DeviceHMAC: b.DeviceHMAC, BackfilledBy: b.BackfilledBy,
+		Signer: b.Signer, SignerCert: b.SignerCert, Metadata: b.Metadata}}
+}
+
+// eventBlock is b as seen by a consumer that handles one event per block:
+// for a batch, the block with the fields of its event tx instead of the
+// batch's own and without the other transactions
+func eventBlock(b Block, tx Transaction) Block {
+	if len(b.Transactions) == 0 {
+		return b
+	}
+	b.FileHash, b.Event, b.EventTime, b.Location, b.Server = tx.FileHash, tx.Event, tx.EventTime, tx.Location, tx.Server
+	b.DeviceKey, b.DeviceHMAC, b.BackfilledBy = tx.DeviceKey, tx.DeviceHMAC, tx.BackfilledBy
+	b.Signer, b.SignerCert, b.Metadata = tx.Signer, tx.SignerCert, tx.Metadata
+	b.Transactions = nil
+	return b
+}
+
+// addEvent commits a client's event, through the mempool when it is enabled
+func addEvent(m CreateBlockReq, timestamp string) (Block, error) {
+	if err := checkReservedEvent(m); err != nil {
+		return Block{}, err
+	}
+	if mempoolQueue == nil || timestamp != "" {
+		return addBlock(m, timestamp)
+	}
+	// break-glass writes must not wait for a batch the freeze refuses
+	if _, frozen := frozenUntil(freezeMain, time.Now()); frozen {
+		return addBlock(m, timestamp)
+	}
+	p := pendingEvent{transactionOf(m), make(chan writeResult, 1)}
+	mempoolQueue <- p
+	res := <-p.done
+	return res.block, res.err
+}
+
+// runMempool collects a batch from queue starting with the first pending
+// event and seals it once the interval has passed or the batch is full. It
+// reads only the queue it was started with, never one a later startMempool
+// made.
+func runMempool(queue chan pendingEvent, interval time.Duration, max int) {
+	for first := range queue {
+		batch := []pendingEvent{first}
+		timer := time.NewTimer(interval)
+	collect:
+		for len(batch) < max {
+			select {
+			case p := <-queue:
+				batch = append(batch, p)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		sealBatch(batch)
+	}
+}
+
+// sealBatch appends the batch block and tells every waiting write. A batch
+// over MAX_BLOCK_SIZE is sealed in halves.
+func sealBatch(batch []pendingEvent) {
+	txs := make([]Transaction, len(batch))
+	for i, p := range batch {
+		txs[i] = p.tx
+	}
+	b, err := addBlock(CreateBlockReq{
+		Event:        batchEvent,
+		EventTime:    time.Now().UTC().Format(time.RFC3339),
+		Server:       nodeID(),
+		transactions: txs,
+		system:       true,
+	}, "")
+	if errors.Is(err, errBlockTooLarge) && len(batch) > 1 {
+		sealBatch(batch[:len(batch)/2])
+		sealBatch(batch[len(batch)/2:])
+		return
+	}
+	if err != nil {
+		log.Printf("sealing a batch of %d events failed: %v", len(batch), err)
+	}
+	for _, p := range batch {
+		p.done <- writeResult{b, err}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestMempool seals a batch as soon as max events are pending
+func startTestMempool(t *testing.T, max string) {
+	t.Helper()
+	t.Setenv("MEMPOOL_INTERVAL", "1m")
+	t.Setenv("MEMPOOL_MAX_EVENTS", max)
+	if err := startMempool(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mempoolQueue = nil })
+}
+
+// writeBatch writes events at once and returns their receipts
+func writeBatch(t *testing.T, router http.Handler, events []map[string]string) []WriteReceipt {
+	t.Helper()
+	receipts := make([]WriteReceipt, len(events))
+	var wg sync.WaitGroup
+	for i, e := range events {
+		wg.Add(1)
+		go func(i int, e map[string]string) {
+			defer wg.Done()
+			if code := call(t, router, "POST", "/v2/block", e, &receipts[i]); code != http.StatusCreated {
+				t.Errorf("writing %v: status %d", e, code)
+			}
+		}(i, e)
+	}
+	wg.Wait()
+	return receipts
+}
+
+func TestMempoolEventsReachEveryConsumer(t *testing.T) {
+	router := newTestChain(t)
+	startTestMempool(t, "3")
+	deviceMutex.Lock()
+	devices["sensor-1"] = &Device{Name: "sensor-1", Heartbeat: "1h", Registered: time.Now().Add(-2 * time.Hour).String()}
+	deviceMutex.Unlock()
+	t.Cleanup(func() {
+		deviceMutex.Lock()
+		delete(devices, "sensor-1")
+		deviceMutex.Unlock()
+	})
+
+	fileHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	receipts := writeBatch(t, router, []map[string]string{
+		{"event": "door opened", "location": "SJC", "server": "sensor-1", "file_hash": fileHash},
+		{"event": "door closed", "location": "SJC", "server": "sensor-1"},
+		{"event": "badge read", "location": "RTP", "server": "reader-2"},
+	})
+	batch := receipts[0]
+	for _, rc := range receipts {
+		if rc.Hash != batch.Hash {
+			t.Fatalf("events sealed into blocks %s and %s", batch.Hash, rc.Hash)
+		}
+	}
+	if batch.Event != batchEvent || len(batch.Transactions) != 3 {
+		t.Fatalf("receipt is %s with %d transactions", batch.Event, len(batch.Transactions))
+	}
+
+	var validation ValidationResp
+	req := ValidationReq{CreateMessage: CreateBlockReq{Event: "door closed"}, Hash: batch.Hash}
+	if call(t, router, "POST", "/v2/validation", req, &validation); !validation.Result {
+		t.Error("validation of a batched event failed")
+	}
+
+	var verified VerifyFileResp
+	if call(t, router, "POST", "/v2/verify-file", map[string]string{"file_hash": fileHash}, &verified); !verified.Result {
+		t.Error("file hash of a batched event not found")
+	}
+
+	var silent []SilentDevice
+	if call(t, router, "GET", "/devices/silent", nil, &silent); len(silent) != 0 {
+		t.Errorf("devices that just wrote are silent: %+v", silent)
+	}
+
+	var device DeviceSummary
+	call(t, router, "GET", "/v2/devices/sensor-1", nil, &device)
+	if device.Blocks != 1 || device.Events["door opened"] != 1 || device.Events["door closed"] != 1 {
+		t.Errorf("device summary is %+v", device)
+	}
+
+	var stats StatsResp
+	call(t, router, "GET", "/v2/stats", nil, &stats)
+	if stats.ByEvent["badge read"] != 1 || stats.ByServer["sensor-1"] != 2 || stats.ByEvent[batchEvent] != 0 {
+		t.Errorf("stats count %v by event and %v by server", stats.ByEvent, stats.ByServer)
+	}
+
+	var siteBlocks []Block
+	call(t, router, "GET", "/v2/sites/rtp/blocks?event=badge+read", nil, &siteBlocks)
+	if len(siteBlocks) != 1 || siteBlocks[0].Hash != batch.Hash {
+		t.Errorf("site RTP has blocks %+v", siteBlocks)
+	}
+}
+
+func TestMempoolRefusesSystemEvents(t *testing.T) {
+	newTestChain(t)
+	startTestMempool(t, "1")
+	if _, err := addEvent(CreateBlockReq{Event: batchEvent}, ""); err != errReservedEvent {
+		t.Fatalf("addEvent of a batch event: %v", err)
+	}
+}
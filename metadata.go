@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Fields of a write that this node doesn't know, typically from a newer
+// shipper, are not dropped: they become the block's Metadata, a JSON
+// object with sorted keys, and are covered by its hash. Only the keys the
+// node records itself (reservedMetadata) are dropped, unless REPLAY_MODE=true.
+
+// largest Metadata accepted, in bytes
+const maxMetadata = 64 << 10
+
+var errMetadataTooLarge = errors.New("unknown fields exceed " + strconv.Itoa(maxMetadata) + " bytes")
+
+// writeFieldNames are the keys a write may use for its known fields, the
+// tags and the legacy names, in lower case
+var writeFieldNames = func() map[string]bool {
+	names := make(map[string]bool)
+	for _, f := range jsonFields(reflect.TypeOf(CreateBlockReq{})) {
+		names[strings.ToLower(jsonName(f))] = true
+		names[strings.ToLower(f.Name)] = true
+	}
+	return names
+}()
+
+// decodeWrite decodes a write body, keeping its unknown fields
+func decodeWrite(data []byte) (CreateBlockReq, error) {
+	var m CreateBlockReq
+	if err := unmarshalCompat(data, &m); err != nil {
+		return m, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return m, err
+	}
+	replay := os.Getenv("REPLAY_MODE") == "true"
+	for k := range fields {
+		// encoding/json matches keys case-insensitively
+		if writeFieldNames[strings.ToLower(k)] || (reservedMetadata[strings.ToLower(k)] && !replay) {
+			delete(fields, k)
+		}
+	}
+	if len(fields) == 0 {
+		return m, nil
+	}
+	// Marshal sorts the keys and compacts the values, which makes the
+	// encoding canonical
+	metadata, err := json.Marshal(fields)
+	if err != nil {
+		return m, err
+	}
+	if len(metadata) > maxMetadata {
+		return m, errMetadataTooLarge
+	}
+	m.metadata = metadata
+	return m, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDecodeWriteDropsReservedMetadata(t *testing.T) {
+	body := []byte(`{"event":"door opened","Enrichment":[{"stage":"severity","result":"critical"}],` +
+		`"minter":{"node":"node-1","role":"leader"},"vendor":"acme"}`)
+
+	m, err := decodeWrite(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.metadata) != `{"vendor":"acme"}` {
+		t.Errorf("metadata is %s", m.metadata)
+	}
+	if s := severityOf(Block{Metadata: m.metadata}); s != "" {
+		t.Errorf("a write set its own severity %q", s)
+	}
+
+	t.Setenv("REPLAY_MODE", "true")
+	if m, err = decodeWrite(body); err != nil {
+		t.Fatal(err)
+	}
+	if s := severityOf(Block{Metadata: m.metadata}); s != "critical" {
+		t.Errorf("replayed write lost its enrichment: %s", m.metadata)
+	}
+}
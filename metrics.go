@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Push metrics for tooling that doesn't scrape. Every METRICS_INTERVAL
+// (default 10s) the node sends chain height, whether storage is full, write
+// counts and latency, rejected writes and validation results to a statsd
+// server over UDP (METRICS_STATSD) and/or a Graphite carbon server over TCP
+// (METRICS_GRAPHITE). Names start with METRICS_PREFIX, by default
+// "blockchain.<node>".
+
+// write latencies kept per interval for statsd timers
+const maxLatencySamples = 1000
+
+// nodeMetrics are counted between pushes. Counters are totals since start,
+// latencies are the samples of the current interval.
+type nodeMetrics struct {
+	mutex            sync.Mutex
+	writes           int64
+	rejected         int64
+	validations      int64
+	validationFailed int64
+	latencies        []time.Duration
+	latencySum       time.Duration
+	latencyCount     int64
+	latencyMax       time.Duration
+}
+
+var metrics = &nodeMetrics{}
+
+// observeWrite counts a committed write and how long it took
+func observeWrite(d time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.writes++
+	if len(metrics.latencies) < maxLatencySamples {
+		metrics.latencies = append(metrics.latencies, d)
+	}
+	metrics.latencySum += d
+	metrics.latencyCount++
+	if d > metrics.latencyMax {
+		metrics.latencyMax = d
+	}
+}
+
+// observeRejection counts a write that was refused
+func observeRejection() {
+	metrics.mutex.Lock()
+	metrics.rejected++
+	metrics.mutex.Unlock()
+}
+
+// observeValidation counts a /validation call and whether it failed
+func observeValidation(valid bool) {
+	metrics.mutex.Lock()
+	metrics.validations++
+	if !valid {
+		metrics.validationFailed++
+	}
+	metrics.mutex.Unlock()
+}
+
+// metricsSnapshot is one interval's worth of metrics
+type metricsSnapshot struct {
+	height           int
+	storageFull      bool
+	writes           int64
+	rejected         int64
+	validations      int64
+	validationFailed int64
+	latencies        []time.Duration
+	latencyAvg       time.Duration
+	latencyMax       time.Duration
+}
+
+// takeMetrics returns the current values and starts a new interval
+func takeMetrics() metricsSnapshot {
+	mutex.Lock()
+	height := len(Blockchain) - 1
+	mutex.Unlock()
+	_, full := storageDegraded()
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	s := metricsSnapshot{
+		height:           height,
+		storageFull:      full,
+		writes:           metrics.writes,
+		rejected:         metrics.rejected,
+		validations:      metrics.validations,
+		validationFailed: metrics.validationFailed,
+		latencies:        metrics.latencies,
+		latencyMax:       metrics.latencyMax,
+	}
+	if metrics.latencyCount > 0 {
+		s.latencyAvg = metrics.latencySum / time.Duration(metrics.latencyCount)
+	}
+	metrics.latencies, metrics.latencySum, metrics.latencyCount, metrics.latencyMax = nil, 0, 0, 0
+	return s
+}
+
+// startMetricsPush validates the endpoints and starts pushing
+func startMetricsPush() error {
+	statsd, graphite := os.Getenv("METRICS_STATSD"), os.Getenv("METRICS_GRAPHITE")
+	if statsd == "" && graphite == "" {
+		return nil
+	}
+	for _, addr := range []string{statsd, graphite} {
+		if _, _, err := net.SplitHostPort(addr); addr != "" && err != nil {
+			return errors.New("metrics endpoints must be host:port: " + err.Error())
+		}
+	}
+	interval := 10 * time.Second
+	if v := os.Getenv("METRICS_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return errors.New("METRICS_INTERVAL must be a positive duration")
+		}
+	}
+	prefix := os.Getenv("METRICS_PREFIX")
+	if prefix == "" {
+		prefix = "blockchain." + strings.Replace(nodeID(), ".", "_", -1)
+	}
+
+	go func() {
+		var last metricsSnapshot
+		for range time.Tick(interval) {
+			s := takeMetrics()
+			if statsd != "" {
+				if err := pushStatsd(statsd, prefix, s, last); err != nil {
+					log.Println("pushing metrics to statsd failed:", err)
+				}
+			}
+			if graphite != "" {
+				if err := pushGraphite(graphite, prefix, s); err != nil {
+					log.Println("pushing metrics to graphite failed:", err)
+				}
+			}
+			last = s
+		}
+	}()
+	log.Println("pushing metrics every", interval)
+	return nil
+}
+
+// statsd packets are kept below a safe UDP payload size
+const maxStatsdPacket = 1400
+
+// pushStatsd sends gauges, counter increments since last and one timer
+// sample per write
+func pushStatsd(addr, prefix string, s, last metricsSnapshot) error {
+	lines := []string{
+		fmt.Sprintf("%s.chain.height:%d|g", prefix, s.height),
+		fmt.Sprintf("%s.storage.full:%d|g", prefix, boolMetric(s.storageFull)),
+		fmt.Sprintf("%s.writes:%d|c", prefix, s.writes-last.writes),
+		fmt.Sprintf("%s.writes.rejected:%d|c", prefix, s.rejected-last.rejected),
+		fmt.Sprintf("%s.validations:%d|c", prefix, s.validations-last.validations),
+		fmt.Sprintf("%s.validations.failed:%d|c", prefix, s.validationFailed-last.validationFailed),
+	}
+	for _, d := range s.latencies {
+		lines = append(lines, fmt.Sprintf("%s.writes.latency:%.3f|ms", prefix, float64(d)/float64(time.Millisecond)))
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsdPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+// pushGraphite sends the plaintext protocol: counters as running totals,
+// latency as the interval's average and maximum in milliseconds
+func pushGraphite(addr, prefix string, s metricsSnapshot) error {
+	now := time.Now().Unix()
+	var buf bytes.Buffer
+	metric := func(name string, v interface{}) {
+		fmt.Fprintf(&buf, "%s.%s %v %d\n", prefix, name, v, now)
+	}
+	metric("chain.height", s.height)
+	metric("storage.full", boolMetric(s.storageFull))
+	metric("writes", s.writes)
+	metric("writes.rejected", s.rejected)
+	metric("validations", s.validations)
+	metric("validations.failed", s.validationFailed)
+	if len(s.latencies) > 0 {
+		metric("writes.latency.avg", fmt.Sprintf("%.3f", float64(s.latencyAvg)/float64(time.Millisecond)))
+		metric("writes.latency.max", fmt.Sprintf("%.3f", float64(s.latencyMax)/float64(time.Millisecond)))
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// migration upgrades persisted data from the previous schema version
+type migration struct {
+	version     int
+	description string
+	// apply performs the upgrade; with dryRun it only reports what it would do
+	apply func(s Store, dryRun bool) error
+}
+
+// migrations are applied in order. Append new versions, never edit old ones.
+var migrations = []migration{
+	{1, "initial layout: one JSON block per line", func(s Store, dryRun bool) error { return nil }},
+	{2, "STORAGE=mmap: chain.dat records with the fields added since BLKDAT01", upgradeMmapLayout},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// upgradeOnStart runs pending migrations when the node starts, unless
+// MIGRATE_ON_START=false, in which case an outdated store is an error
+func upgradeOnStart(s Store) error {
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		return migrate(s, false)
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current != latestSchemaVersion() {
+		return fmt.Errorf("storage schema %d does not match %d, run the migrate subcommand", current, latestSchemaVersion())
+	}
+	return nil
+}
+
+// migrate brings s forward to the latest schema version
+func migrate(s Store, dryRun bool) error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("storage schema %d is newer than this node supports (%d)", current, latestSchemaVersion())
+	}
+	if current == latestSchemaVersion() {
+		return nil
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if dryRun {
+			log.Printf("would migrate storage schema %d -> %d: %s", current, m.version, m.description)
+		} else {
+			log.Printf("migrating storage schema %d -> %d: %s", current, m.version, m.description)
+		}
+		if err := m.apply(s, dryRun); err != nil {
+			return fmt.Errorf("migration to schema %d failed: %v", m.version, err)
+		}
+		if !dryRun {
+			if err := s.SetSchemaVersion(m.version); err != nil {
+				return err
+			}
+		}
+		current = m.version
+	}
+	return nil
+}
+
+// runMigrateCommand implements `go run main.go migrate [-dry-run]`
+func runMigrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the migrations that would run")
+	fs.Parse(args)
+
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		log.Fatal("DATA_DIR is not set, nothing to migrate")
+	}
+	s, err := newStore(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	before, err := s.SchemaVersion()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := migrate(s, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+	after, _ := s.SchemaVersion()
+	fmt.Printf("storage schema: was %d, now %d, latest %d\n", before, after, latestSchemaVersion())
+}
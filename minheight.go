@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Read-your-writes: every committed write answers with a Commit-Height
+// header, the index of its block. A client that passes it back as
+// ?min_height= on a read is guaranteed to see its write: a node that is
+// behind, like a follower still syncing, holds the read for up to
+// MIN_HEIGHT_WAIT (default 2s) and answers 503 if it hasn't caught up.
+
+const commitHeightHeader = "Commit-Height"
+
+// default for MIN_HEIGHT_WAIT
+const defaultMinHeightWait = 2 * time.Second
+
+// headChanged is closed and replaced whenever a block is installed. Guarded
+// by mutex.
+var headChanged = make(chan struct{})
+
+// notifyHeadLocked wakes reads waiting for a height. Caller must hold mutex.
+func notifyHeadLocked() {
+	close(headChanged)
+	headChanged = make(chan struct{})
+}
+
+// minHeightWait reads MIN_HEIGHT_WAIT on every call so it can be hot
+// reloaded
+func minHeightWait() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("MIN_HEIGHT_WAIT"))
+	if err != nil || d < 0 {
+		return defaultMinHeightWait
+	}
+	return d
+}
+
+// waitForHeight reports whether the chain reached height n within wait
+func waitForHeight(n int, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		mutex.Lock()
+		reached, changed := len(Blockchain)-1 >= n, headChanged
+		mutex.Unlock()
+		if reached {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// requireMinHeight holds reads with ?min_height= until the chain is that
+// high
+func requireMinHeight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query().Get("min_height")
+		if v == "" || (r.Method != "GET" && r.Method != "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "min_height must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if !waitForHeight(n, minHeightWait()) {
+			mutex.Lock()
+			height := len(Blockchain) - 1
+			mutex.Unlock()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "node is at height "+strconv.Itoa(height)+", behind min_height "+v, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
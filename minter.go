@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// With RECORD_MINTER=true every block minted from a write records the node
+// that minted it and under what role under "minter" in its Metadata, so the
+// hash covers it. A node minting on its own authority is the leader; under
+// CONSENSUS=poa blocks are minted from a validator's proposal and also name
+// that validator. When a node is suspected compromised, GET /minters and
+// GET /minters/{node}/blocks show what it wrote.
+//
+// "minter" is reserved, like "enrichment" (see enrich.go): decodeWrite
+// drops a write's own, except with REPLAY_MODE=true, where it is kept so
+// replayed writes hash like the originals.
+//
+// The events of the blocks a node records on its own are reserved too:
+// writes naming one are refused, and the node always records itself as the
+// minter of such a block, whatever RECORD_MINTER says. Only a block with a
+// system event and a minter is taken for the node's own (see nodeMinted).
+
+const (
+	roleLeader    = "leader"
+	roleValidator = "validator"
+)
+
+// systemEvents are the events of the blocks nodes record on their own
+var systemEvents = map[string]bool{
+	reanchorEvent:        true,
+	archiveEvent:         true,
+	epochEvent:           true,
+	batchEvent:           true,
+	retentionPolicyEvent: true,
+	retentionRunEvent:    true,
+	silentEvent:          true,
+}
+
+var errReservedEvent = errors.New("event is reserved for blocks the node records itself")
+
+// reservedMetadata are the Metadata keys only the node records, in lower
+// case
+var reservedMetadata = map[string]bool{
+	"minter":     true,
+	"enrichment": true,
+}
+
+// Minter is what a block records about the node that minted it
+type Minter struct {
+	Node     string `json:"node"`
+	Role     string `json:"role"`
+	Proposer string `json:"proposer,omitempty"`
+}
+
+// MinterSummary counts the blocks a node minted
+type MinterSummary struct {
+	Node       string         `json:"node"`
+	Blocks     int            `json:"blocks"`
+	ByRole     map[string]int `json:"by_role"`
+	FirstBlock *BlockRef      `json:"first_block,omitempty"`
+	LastBlock  *BlockRef      `json:"last_block,omitempty"`
+}
+
+// minterBlocks maps node IDs to the indexes of the blocks they minted.
+// Guarded by mutex.
+var minterBlocks = make(map[string][]int)
+
+// minterRole is the role this node mints blocks under
+func minterRole() string {
+	if poaEnabled() {
+		return roleValidator
+	}
+	return roleLeader
+}
+
+// stampMinter records this node as the minter in a write's Metadata.
+// proposer names the validator that proposed the block, if any.
+func stampMinter(metadata json.RawMessage, proposer string) json.RawMessage {
+	meta := make(map[string]json.RawMessage)
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &meta); err != nil {
+			// decodeWrite only keeps objects, so this is not a write's Metadata
+			return metadata
+		}
+	}
+	if _, ok := meta["minter"]; ok && os.Getenv("REPLAY_MODE") == "true" {
+		return metadata
+	}
+	if os.Getenv("RECORD_MINTER") != "true" {
+		if _, ok := meta["minter"]; !ok {
+			return metadata
+		}
+		delete(meta, "minter")
+	} else {
+		raw, err := json.Marshal(Minter{nodeID(), minterRole(), proposer})
+		if err != nil {
+			log.Println("recording minter failed:", err)
+			return metadata
+		}
+		meta["minter"] = raw
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		log.Println("recording minter failed:", err)
+		return metadata
+	}
+	return raw
+}
+
+// stampSystem records this node as the minter of a block it records on its
+// own
+func stampSystem(metadata json.RawMessage) json.RawMessage {
+	meta := make(map[string]json.RawMessage)
+	if len(metadata) > 0 && json.Unmarshal(metadata, &meta) != nil {
+		return metadata
+	}
+	raw, err := json.Marshal(Minter{Node: nodeID(), Role: minterRole()})
+	if err != nil {
+		log.Println("recording minter failed:", err)
+		return metadata
+	}
+	meta["minter"] = raw
+	if raw, err = json.Marshal(meta); err != nil {
+		log.Println("recording minter failed:", err)
+		return metadata
+	}
+	return raw
+}
+
+// checkReservedEvent refuses a write naming a system event, in any case and
+// with any surrounding space, which the normalize enrichment stage trims
+func checkReservedEvent(m CreateBlockReq) error {
+	if systemEvents[strings.ToLower(strings.TrimSpace(normalizeText(m.Event)))] {
+		return errReservedEvent
+	}
+	return nil
+}
+
+// nodeMinted reports whether b is a block a node recorded on its own.
+// Writes can neither name a system event nor set a minter.
+func nodeMinted(b Block) bool {
+	if !systemEvents[b.Event] {
+		return false
+	}
+	_, ok := minterOf(b)
+	return ok
+}
+
+// minterOf is the minter a block records, if any
+func minterOf(b Block) (Minter, bool) {
+	if len(b.Metadata) == 0 {
+		return Minter{}, false
+	}
+	var meta struct {
+		Minter *Minter `json:"minter"`
+	}
+	if json.Unmarshal(b.Metadata, &meta) != nil || meta.Minter == nil || meta.Minter.Node == "" {
+		return Minter{}, false
+	}
+	return *meta.Minter, true
+}
+
+// noteMinterLocked indexes b by its minter. Caller must hold mutex.
+func noteMinterLocked(b Block) {
+	if m, ok := minterOf(b); ok {
+		minterBlocks[m.Node] = append(minterBlocks[m.Node], b.Index)
+	}
+}
+
+// rebuildMintersLocked indexes every block by minter again. Caller must
+// hold mutex.
+func rebuildMintersLocked() (int, error) {
+	minterBlocks = make(map[string][]int)
+	for _, b := range Blockchain {
+		noteMinterLocked(b)
+	}
+	return len(minterBlocks), nil
+}
+
+// summarizeMinterLocked counts the blocks node minted. Caller must hold
+// mutex.
+func summarizeMinterLocked(node string) MinterSummary {
+	s := MinterSummary{Node: node, ByRole: make(map[string]int)}
+	for _, i := range minterBlocks[node] {
+		if i >= len(Blockchain) {
+			break
+		}
+		b := Blockchain[i]
+		m, _ := minterOf(b)
+		s.Blocks++
+		s.ByRole[m.Role]++
+		if s.FirstBlock == nil {
+			s.FirstBlock = &BlockRef{b.Index, b.Hash}
+		}
+		s.LastBlock = &BlockRef{b.Index, b.Hash}
+	}
+	return s
+}
+
+// list the nodes that minted blocks with their per-role counts
+func handleGetMinters(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	summaries := make([]MinterSummary, 0, len(minterBlocks))
+	for node := range minterBlocks {
+		summaries = append(summaries, summarizeMinterLocked(node))
+	}
+	mutex.Unlock()
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Node < summaries[j].Node })
+	respondWithList(w, r, http.StatusOK, summaries)
+}
+
+// blocks minted by {node}, oldest first, optionally only those minted as
+// ?role=
+func handleGetMinterBlocks(w http.ResponseWriter, r *http.Request) {
+	role := r.URL.Query().Get("role")
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	blocks := make([]Block, 0)
+	for _, i := range minterBlocks[mux.Vars(r)["node"]] {
+		if i > height || i >= len(Blockchain) {
+			break
+		}
+		b := Blockchain[i]
+		if m, _ := minterOf(b); role != "" && m.Role != role {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	mutex.Unlock()
+	respondWithBlocks(w, r, http.StatusOK, blocks)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWritesCannotNameSystemEvents(t *testing.T) {
+	router := newTestChain(t)
+	// the normalize stage trims the event after the check
+	t.Setenv("ENRICHMENT", "normalize")
+	if err := loadEnrichment(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("ENRICHMENT")
+		loadEnrichment()
+	})
+	for event := range systemEvents {
+		for _, spelling := range []string{event, " " + strings.ToUpper(event) + " "} {
+			body := map[string]string{"event": spelling, "location": "sha384"}
+			if code := call(t, router, "POST", "/v2/block", body, nil); code != http.StatusUnprocessableEntity {
+				t.Errorf("writing event %q: status %d", spelling, code)
+			}
+		}
+	}
+	mutex.Lock()
+	height := len(Blockchain)
+	mutex.Unlock()
+	if height != 1 {
+		t.Errorf("chain grew to %d blocks", height)
+	}
+	if code := call(t, router, "POST", "/v2/block", map[string]string{"event": "door opened"}, nil); code != http.StatusCreated {
+		t.Errorf("writing an ordinary event: status %d", code)
+	}
+}
+
+func TestOnlyNodeMintedBlocksChangeTheHashAlgorithm(t *testing.T) {
+	forged := Block{Event: reanchorEvent, Location: "sha384", Hash: "h1",
+		Metadata: []byte(`{"vendor":"acme"}`)}
+	if alg := nextHashAlgorithm(forged); alg != "sha256" {
+		t.Errorf("a forged reanchor block switched the chain to %s", alg)
+	}
+	minted := forged
+	minted.Metadata = stampSystem(nil)
+	if alg := nextHashAlgorithm(minted); alg != "sha384" {
+		t.Errorf("a node minted reanchor block switched the chain to %s", alg)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on Windows")
+}
+
+func unmapFile(b []byte) {}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+)
+
+// mmapStore is the STORAGE=mmap layout, built to make restarts of long
+// chains cheap. DATA_DIR/chain.dat holds length-prefixed binary records and
+// DATA_DIR/chain.idx one fixed-size offset per block. At startup both files
+// are mapped read-only and loaded blocks point into the mapping instead of
+// being decoded from JSON, so loading costs little more than one slice
+// element per block.
+//
+// chain.dat starts with mmapDataMagic, then per block:
+//
+//	uint32 payload length, uint32 CRC-32 (IEEE) of the payload
+//	payload: int64 Index, 19 uint32 field lengths, the field bytes
+//
+// The fields are Timestamp, FileHash, Event, EventTime, Location, Server,
+// Hash, PrevHash, DeviceKey, DeviceHMAC, the JSON encoded Approvals,
+// BackfilledBy, Signer, SignerCert, Metadata, the decimal Difficulty (empty
+// for 0), Nonce, the JSON encoded Transactions and MerkleRoot.
+// chain.idx starts with mmapIndexMagic, then one uint64 offset into
+// chain.dat per block. All integers are little endian.
+//
+// Fields are only ever appended, so the records of an older layout are a
+// prefix of the current one. Such a chain.dat is read with the field count
+// mmapLayouts has for its magic and can't be appended to until the
+// migration running upgradeMmapLayout has rewritten it. A new field bumps
+// mmapDataMagic, adds it to mmapLayouts and appends such a migration.
+type mmapStore struct {
+	dir   string
+	dat   *os.File
+	idx   *os.File
+	size  int64 // end of the last complete record in chain.dat
+	count int64
+	// fields per record in chain.dat, mmapFields unless it is older
+	fields int
+	// mappings are never unmapped: loaded blocks point into them, and they
+	// stay valid even after Rewrite renames new files into place
+	mapped [][]byte
+}
+
+const (
+	mmapDataMagic  = "BLKDAT06"
+	mmapIndexMagic = "BLKIDX01"
+	// per record: payload length and CRC
+	mmapRecordHeader = 8
+	// per payload: Index and the field lengths
+	mmapBlockHeader = 8 + mmapFields*4
+	mmapFields      = 19
+)
+
+// fields per record of every chain.dat layout
+var mmapLayouts = map[string]int{
+	"BLKDAT01":    11,
+	"BLKDAT02":    12,
+	"BLKDAT03":    14,
+	"BLKDAT04":    15,
+	"BLKDAT05":    17,
+	mmapDataMagic: mmapFields,
+}
+
+var (
+	errMmapRecord = errors.New("damaged record in chain.dat")
+	errMmapLayout = errors.New("chain.dat has an older record layout, run the migrate subcommand")
+)
+
+func newMmapStore(dir string) (*mmapStore, error) {
+	if !mmapSupported {
+		return nil, errors.New("STORAGE=mmap is not supported on this platform")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &mmapStore{dir: dir}
+	var err error
+	var magic string
+	if s.dat, magic, err = openMagicFile(filepath.Join(dir, "chain.dat"), mmapDataMagic, mmapLayouts); err != nil {
+		return nil, err
+	}
+	s.fields = mmapLayouts[magic]
+	if s.idx, _, err = openMagicFile(filepath.Join(dir, "chain.idx"), mmapIndexMagic, nil); err != nil {
+		s.dat.Close()
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	// an empty file of an older layout has nothing to migrate
+	if s.count == 0 && s.fields != mmapFields {
+		if err := s.Rewrite(nil); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if s.count == 0 {
+		if err := s.importJSONL(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// openMagicFile opens name for reading and writing, stamping a new file
+// with magic and refusing a file that starts with anything but magic or one
+// of the older magics in also. It returns the magic the file starts with.
+func openMagicFile(name, magic string, also map[string]int) (*os.File, string, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	head := make([]byte, len(magic))
+	n, _ := f.ReadAt(head, 0)
+	found := string(head[:n])
+	_, older := also[found]
+	switch {
+	case n == 0:
+		if _, err = f.WriteAt([]byte(magic), 0); err == nil {
+			err = f.Sync()
+		}
+		found = magic
+	case found != magic && !older:
+		err = errors.New(name + " is not a " + magic + " file")
+	}
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return f, found, nil
+}
+
+// recover makes chain.idx and chain.dat agree after a crash. Records are
+// synced before their index entries are written, so index entries beyond
+// the data are dropped, records the index lost are indexed again, and a
+// torn last record is cut off.
+func (s *mmapStore) recover() error {
+	datInfo, err := s.dat.Stat()
+	if err != nil {
+		return err
+	}
+	idxInfo, err := s.idx.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := mapFile(s.dat, int(datInfo.Size()))
+	if err != nil {
+		return err
+	}
+	defer unmapFile(data)
+	index, err := mapFile(s.idx, int(idxInfo.Size()))
+	if err != nil {
+		return err
+	}
+	count := (int64(len(index)) - int64(len(mmapIndexMagic))) / 8
+	// drop trailing entries that don't point at a complete record
+	end := int64(len(mmapDataMagic))
+	for ; count > 0; count-- {
+		off := indexEntry(index, count-1)
+		if off < end || off >= int64(len(data)) {
+			continue
+		}
+		if _, next, err := decodeMmapRecord(data, off, s.fields, true); err == nil {
+			end = next
+			break
+		}
+	}
+	unmapFile(index)
+
+	// index whatever follows the last indexed record
+	var lost []byte
+	for end < int64(len(data)) {
+		_, next, err := decodeMmapRecord(data, end, s.fields, true)
+		if err != nil {
+			log.Printf("chain.dat: dropping %d bytes after the last complete record", int64(len(data))-end)
+			break
+		}
+		lost = binary.LittleEndian.AppendUint64(lost, uint64(end))
+		end = next
+	}
+	if end < int64(len(data)) {
+		if err := s.dat.Truncate(end); err != nil {
+			return err
+		}
+		if err := s.dat.Sync(); err != nil {
+			return err
+		}
+	}
+	idxEnd := int64(len(mmapIndexMagic)) + count*8
+	if idxEnd != idxInfo.Size() || len(lost) > 0 {
+		if err := s.idx.Truncate(idxEnd); err != nil {
+			return err
+		}
+		if _, err := s.idx.WriteAt(lost, idxEnd); err != nil {
+			return err
+		}
+		if err := s.idx.Sync(); err != nil {
+			return err
+		}
+		if len(lost) > 0 {
+			log.Printf("chain.idx: re-indexed %d blocks", len(lost)/8)
+		}
+	}
+	s.size, s.count = end, count+int64(len(lost)/8)
+	return nil
+}
+
+// importJSONL converts an existing chain.jsonl the first time STORAGE=mmap
+// is used on a data directory. chain.jsonl is left in place.
+func (s *mmapStore) importJSONL() error {
+	if _, err := os.Stat(filepath.Join(s.dir, "chain.jsonl")); err != nil {
+		return nil
+	}
+	old, err := newFileStore(s.dir)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	blocks, err := old.Load()
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+	if err := s.AppendBatch(blocks); err != nil {
+		return err
+	}
+	log.Printf("imported %d blocks from chain.jsonl into chain.dat; chain.jsonl is no longer used", len(blocks))
+	return nil
+}
+
+func (s *mmapStore) Append(b Block) error {
+	return s.AppendBatch([]Block{b})
+}
+
+// AppendBatch writes the records, syncs chain.dat once and then indexes
+// them. The index isn't synced: recover rebuilds entries lost in a crash.
+func (s *mmapStore) AppendBatch(blocks []Block) error {
+	if s.fields != mmapFields {
+		return errMmapLayout
+	}
+	var rec, entries []byte
+	off := s.size
+	for _, b := range blocks {
+		entries = binary.LittleEndian.AppendUint64(entries, uint64(off+int64(len(rec))))
+		var err error
+		if rec, err = appendMmapRecord(rec, b); err != nil {
+			return err
+		}
+	}
+	if _, err := s.dat.WriteAt(rec, off); err != nil {
+		return err
+	}
+	if err := s.dat.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(rec))
+	idxEnd := int64(len(mmapIndexMagic)) + s.count*8
+	if _, err := s.idx.WriteAt(entries, idxEnd); err != nil {
+		return err
+	}
+	s.count += int64(len(blocks))
+	return nil
+}
+
+// Reindex throws chain.idx away and indexes every record in chain.dat again
+func (s *mmapStore) Reindex() (int, error) {
+	if err := s.idx.Truncate(int64(len(mmapIndexMagic))); err != nil {
+		return 0, err
+	}
+	if err := s.recover(); err != nil {
+		return 0, err
+	}
+	return int(s.count), nil
+}
+
+// Load maps both files and builds the blocks in place
+func (s *mmapStore) Load() ([]Block, error) {
+	if s.count == 0 {
+		return nil, nil
+	}
+	data, err := mapFile(s.dat, int(s.size))
+	if err != nil {
+		return nil, err
+	}
+	s.mapped = append(s.mapped, data)
+	index, err := mapFile(s.idx, len(mmapIndexMagic)+int(s.count)*8)
+	if err != nil {
+		return nil, err
+	}
+	defer unmapFile(index)
+
+	blocks := make([]Block, s.count)
+	for i := range blocks {
+		// records were checked when they were written or recovered
+		if blocks[i], _, err = decodeMmapRecord(data, indexEntry(index, int64(i)), s.fields, false); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// Rewrite builds new files next to the old ones and renames them into
+// place. chain.idx is removed first: if the node dies half way, recover
+// rebuilds the index from whichever chain.dat is in place.
+func (s *mmapStore) Rewrite(blocks []Block) error {
+	tmp := &mmapStore{dir: s.dir, size: int64(len(mmapDataMagic)), fields: mmapFields}
+	datName, idxName := s.dat.Name(), s.idx.Name()
+	var err error
+	os.Remove(datName + ".tmp")
+	os.Remove(idxName + ".tmp")
+	if tmp.dat, _, err = openMagicFile(datName+".tmp", mmapDataMagic, nil); err != nil {
+		return err
+	}
+	if tmp.idx, _, err = openMagicFile(idxName+".tmp", mmapIndexMagic, nil); err != nil {
+		tmp.dat.Close()
+		return err
+	}
+	if len(blocks) > 0 {
+		err = tmp.AppendBatch(blocks)
+	}
+	if err == nil {
+		err = tmp.idx.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := os.Remove(idxName); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(datName+".tmp", datName); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(idxName+".tmp", idxName); err != nil {
+		tmp.Close()
+		return err
+	}
+	s.dat.Close()
+	s.idx.Close()
+	s.dat, s.idx, s.size, s.count, s.fields = tmp.dat, tmp.idx, tmp.size, tmp.count, tmp.fields
+	return nil
+}
+
+// upgradeMmapLayout rewrites a STORAGE=mmap chain.dat of an older layout in
+// the current one. Other stores have nothing to upgrade.
+func upgradeMmapLayout(s Store, dryRun bool) error {
+	ms, ok := s.(*mmapStore)
+	if !ok || ms.fields == mmapFields {
+		return nil
+	}
+	if dryRun {
+		log.Printf("would rewrite %d blocks of chain.dat in the %s layout", ms.count, mmapDataMagic)
+		return nil
+	}
+	blocks, err := ms.Load()
+	if err != nil {
+		return err
+	}
+	if err := ms.Rewrite(blocks); err != nil {
+		return err
+	}
+	log.Printf("rewrote %d blocks of chain.dat in the %s layout", len(blocks), mmapDataMagic)
+	return nil
+}
+
+func (s *mmapStore) SchemaVersion() (int, error) {
+	return readSchemaVersion(s.dir)
+}
+
+func (s *mmapStore) SetSchemaVersion(v int) error {
+	return writeSchemaVersion(s.dir, v)
+}
+
+func (s *mmapStore) Close() error {
+	s.idx.Close()
+	return s.dat.Close()
+}
+
+// appendMmapRecord appends the chain.dat record for b to dst
+func appendMmapRecord(dst []byte, b Block) ([]byte, error) {
+	var approvals []byte
+	if len(b.Approvals) > 0 {
+		var err error
+		if approvals, err = json.Marshal(b.Approvals); err != nil {
+			return nil, err
+		}
+	}
+	var transactions []byte
+	if len(b.Transactions) > 0 {
+		var err error
+		if transactions, err = json.Marshal(b.Transactions); err != nil {
+			return nil, err
+		}
+	}
+	difficulty := ""
+	if b.Difficulty > 0 {
+		difficulty = strconv.Itoa(b.Difficulty)
+	}
+	fields := [mmapFields]string{b.Timestamp, b.FileHash, b.Event, b.EventTime, b.Location, b.Server,
+		b.Hash, b.PrevHash, b.DeviceKey, b.DeviceHMAC, string(approvals), b.BackfilledBy, b.Signer, b.SignerCert, string(b.Metadata),
+		difficulty, b.Nonce, string(transactions), b.MerkleRoot}
+	size := mmapBlockHeader
+	for _, f := range fields {
+		size += len(f)
+	}
+
+	start := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(size))
+	dst = binary.LittleEndian.AppendUint32(dst, 0)
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(int64(b.Index)))
+	for _, f := range fields {
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(f)))
+	}
+	for _, f := range fields {
+		dst = append(dst, f...)
+	}
+	binary.LittleEndian.PutUint32(dst[start+4:], crc32.ChecksumIEEE(dst[start+mmapRecordHeader:]))
+	return dst, nil
+}
+
+// decodeMmapRecord decodes the record at off, of a layout with n fields, and
+// returns the offset of the next one. The fields the layout lacks are empty.
+// The block's strings point into data.
+func decodeMmapRecord(data []byte, off int64, n int, checksum bool) (Block, int64, error) {
+	if off < 0 || off+mmapRecordHeader > int64(len(data)) {
+		return Block{}, 0, errMmapRecord
+	}
+	size := int64(binary.LittleEndian.Uint32(data[off:]))
+	end := off + mmapRecordHeader + size
+	if size < int64(8+n*4) || end > int64(len(data)) {
+		return Block{}, 0, errMmapRecord
+	}
+	payload := data[off+mmapRecordHeader : end]
+	if checksum && crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[off+4:]) {
+		return Block{}, 0, errMmapRecord
+	}
+
+	var fields [mmapFields]string
+	pos := int64(8 + n*4)
+	for i := range fields[:n] {
+		length := int64(binary.LittleEndian.Uint32(payload[8+i*4:]))
+		if pos+length > size {
+			return Block{}, 0, errMmapRecord
+		}
+		fields[i] = mappedString(payload[pos : pos+length])
+		pos += length
+	}
+	b := Block{
+		Index:        int(int64(binary.LittleEndian.Uint64(payload))),
+		Timestamp:    fields[0],
+		FileHash:     fields[1],
+		Event:        fields[2],
+		EventTime:    fields[3],
+		Location:     fields[4],
+		Server:       fields[5],
+		Hash:         fields[6],
+		PrevHash:     fields[7],
+		DeviceKey:    fields[8],
+		DeviceHMAC:   fields[9],
+		BackfilledBy: fields[11],
+		Signer:       fields[12],
+		SignerCert:   fields[13],
+		Nonce:        fields[16],
+		MerkleRoot:   fields[18],
+	}
+	if fields[10] != "" {
+		if err := json.Unmarshal([]byte(fields[10]), &b.Approvals); err != nil {
+			return Block{}, 0, err
+		}
+	}
+	if fields[17] != "" {
+		if err := json.Unmarshal([]byte(fields[17]), &b.Transactions); err != nil {
+			return Block{}, 0, err
+		}
+	}
+	if fields[14] != "" {
+		b.Metadata = json.RawMessage(fields[14])
+	}
+	if fields[15] != "" {
+		var err error
+		if b.Difficulty, err = strconv.Atoi(fields[15]); err != nil {
+			return Block{}, 0, errMmapRecord
+		}
+	}
+	return b, end, nil
+}
+
+// indexEntry is the chain.dat offset of block i
+func indexEntry(index []byte, i int64) int64 {
+	return int64(binary.LittleEndian.Uint64(index[int64(len(mmapIndexMagic))+i*8:]))
+}
+
+// mappedString views b as a string without copying; b must never change
+func mappedString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
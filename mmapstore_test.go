@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyMmapRecord is the record for b in a layout with the first n fields
+func legacyMmapRecord(b Block, n int) []byte {
+	fields := []string{b.Timestamp, b.FileHash, b.Event, b.EventTime, b.Location, b.Server,
+		b.Hash, b.PrevHash, b.DeviceKey, b.DeviceHMAC, "", b.BackfilledBy, b.Signer, b.SignerCert, string(b.Metadata),
+		"", b.Nonce}[:n]
+	payload := binary.LittleEndian.AppendUint64(nil, uint64(b.Index))
+	for _, f := range fields {
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(f)))
+	}
+	for _, f := range fields {
+		payload = append(payload, f...)
+	}
+	rec := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	rec = binary.LittleEndian.AppendUint32(rec, crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+func TestMmapStoreUpgradesOlderLayouts(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("STORAGE=mmap is not supported on this platform")
+	}
+	for magic, n := range mmapLayouts {
+		if magic == mmapDataMagic {
+			continue
+		}
+		t.Run(magic, func(t *testing.T) {
+			dir := t.TempDir()
+			blocks := []Block{
+				{Index: 0, Timestamp: "2024-01-01 00:00:00", Event: "genesis", Hash: "h0"},
+				{Index: 1, Timestamp: "2024-01-01 00:00:01", Event: "door opened", Server: "s1", Hash: "h1", PrevHash: "h0"},
+			}
+			data := []byte(magic)
+			for _, b := range blocks {
+				data = append(data, legacyMmapRecord(b, n)...)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "chain.dat"), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := newMmapStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Append(Block{Index: 2}); err != errMmapLayout {
+				t.Fatalf("appending to an older layout: %v", err)
+			}
+			if err := migrate(s, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Append(Block{Index: 2, Event: "door closed", Hash: "h2", PrevHash: "h1"}); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			if s, err = newMmapStore(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			loaded, err := s.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != 3 || loaded[1].Event != "door opened" || loaded[1].Server != "s1" || loaded[2].PrevHash != "h1" {
+				t.Errorf("loaded %+v", loaded)
+			}
+		})
+	}
+}
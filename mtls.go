@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// peerAllowlist holds the client certificate identities (URI or DNS SANs,
+// e.g. "spiffe://example.org/appliance/vpn-1") allowed to submit events or
+// blocks. It is loaded once at startup and never modified afterwards.
+var peerAllowlist map[string]bool
+
+// adminAllowlist holds the client certificate identities allowed to use the
+// state changing admin routes on the public listener. It is separate from
+// peerAllowlist, so a write identity is not an admin identity, and is also
+// loaded once at startup.
+var adminAllowlist map[string]bool
+
+// loadPeerAllowlist reads ALLOWED_CLIENT_IDS and ADMIN_CLIENT_IDS, comma
+// separated lists of SANs
+func loadPeerAllowlist() {
+	peerAllowlist = parseIdentities(os.Getenv("ALLOWED_CLIENT_IDS"))
+	if len(peerAllowlist) > 0 {
+		log.Println("mTLS allowlist loaded with", len(peerAllowlist), "identities")
+	}
+	adminAllowlist = parseIdentities(os.Getenv("ADMIN_CLIENT_IDS"))
+	if len(adminAllowlist) > 0 {
+		log.Println("admin mTLS allowlist loaded with", len(adminAllowlist), "identities")
+	}
+}
+
+func parseIdentities(list string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(list, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// tlsConfig builds the server TLS config. Client certificates are verified
+// against TLS_CLIENT_CA_FILE when presented, so reads stay anonymous while
+// writes can require an allowlisted identity. Without a CA, certificates are
+// still requested so that pinned peers can be recognized.
+func tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if os.Getenv("TLS_CERT_FILE") != "" {
+		cert, err := nodeCertificate()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if acmeEnabled() {
+		if err := useACME(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if caFile == "" {
+		if len(peerAllowlist) > 0 || len(adminAllowlist) > 0 {
+			return nil, errors.New("ALLOWED_CLIENT_IDS and ADMIN_CLIENT_IDS require TLS_CLIENT_CA_FILE")
+		}
+		if len(peerPins) > 0 {
+			cfg.ClientAuth = tls.RequestClientCert
+		}
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return cfg, nil
+}
+
+// peerIdentities returns the SANs of the verified client certificate
+func peerIdentities(r *http.Request) []string {
+	var ids []string
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ids
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, u := range leaf.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, leaf.DNSNames...)
+	return ids
+}
+
+// peerIdentity returns the first allowlisted identity of the caller, if any
+func peerIdentity(r *http.Request) (string, bool) {
+	return allowedIdentity(r, peerAllowlist)
+}
+
+func allowedIdentity(r *http.Request, allowlist map[string]bool) (string, bool) {
+	for _, id := range peerIdentities(r) {
+		if allowlist[id] {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// requirePeerIdentity rejects requests whose client certificate does not
+// carry an allowlisted SAN. It is a no-op when no allowlist is configured.
+func requirePeerIdentity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(peerAllowlist) == 0 {
+			next(w, r)
+			return
+		}
+		id, ok := peerIdentity(r)
+		if !ok {
+			log.Printf("rejected write from %s: client identity %v not allowlisted", clientIP(r), peerIdentities(r))
+			http.Error(w, "client certificate identity not allowed", http.StatusForbidden)
+			return
+		}
+		log.Printf("write authorized for %s", id)
+		next(w, r)
+	}
+}
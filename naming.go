@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON field names: API structs are tagged snake_case, and that is what the
+// node writes to DATA_DIR. Until every reader has moved on, responses, peer
+// pushes and the event stream keep the legacy PascalCase names (the Go field
+// names) unless JSON_FIELD_NAMES=snake_case.
+//
+// Input always accepts both: a PascalCase key (matched case-insensitively,
+// as encoding/json did before the tags) is renamed to its tag before
+// decoding, so existing shippers and data files keep working.
+
+// jsonSnakeCase reads JSON_FIELD_NAMES on every call so it can be hot
+// reloaded
+func jsonSnakeCase() bool {
+	return os.Getenv("JSON_FIELD_NAMES") == "snake_case"
+}
+
+// apiValue returns what should be encoded for payload under the configured
+// field names
+func apiValue(payload interface{}) interface{} {
+	if jsonSnakeCase() {
+		return payload
+	}
+	return legacyValue(reflect.ValueOf(payload))
+}
+
+// responseValue is apiValue for a response to r; /v2 always uses the tags
+func responseValue(r *http.Request, payload interface{}) interface{} {
+	if apiVersionOf(r) == 2 {
+		return payload
+	}
+	return apiValue(payload)
+}
+
+// marshalAPI encodes v for API clients and peers
+func marshalAPI(v interface{}) ([]byte, error) {
+	return json.Marshal(apiValue(v))
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// legacyObject is a struct encoded under its Go field names, in field order
+type legacyObject []legacyField
+
+type legacyField struct {
+	name  string
+	value interface{}
+}
+
+func (o legacyObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(f.name))
+		buf.WriteByte(':')
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// legacyValue mirrors v with every struct replaced by a legacyObject. Map
+// keys are data, not field names, and are left alone.
+func legacyValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(marshalerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return legacyValue(v.Elem())
+	case reflect.Struct:
+		return appendLegacyFields(nil, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			if k.Kind() == reflect.String {
+				key = k.String()
+			}
+			m[key] = legacyValue(v.MapIndex(k))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = legacyValue(v.Index(i))
+		}
+		return list
+	}
+	return v.Interface()
+}
+
+// appendLegacyFields adds the encoded fields of struct v, inlining embedded
+// structs as encoding/json does
+func appendLegacyFields(o legacyObject, v reflect.Value) legacyObject {
+	if o == nil {
+		o = legacyObject{}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous && tag[0] == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct && !fv.Type().Implements(marshalerType) {
+				o = appendLegacyFields(o, fv)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if strings.Contains(f.Tag.Get("json"), ",omitempty") && isEmptyValue(fv) {
+			continue
+		}
+		o = append(o, legacyField{f.Name, legacyValue(fv)})
+	}
+	return o
+}
+
+// isEmptyValue is encoding/json's definition of empty for omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// unmarshalCompat is json.Unmarshal accepting legacy field names
+func unmarshalCompat(data []byte, v interface{}) error {
+	data, err := snakeCaseKeys(reflect.TypeOf(v), data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// snakeCaseKeys renames the legacy keys in data, a JSON encoding of t, to
+// the tagged names. data is returned as is when it has none.
+func snakeCaseKeys(t reflect.Type, data []byte) ([]byte, error) {
+	if !mayHaveLegacyKeys(t, data) {
+		return data, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as written, large integers don't survive float64
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if !renameLegacyKeys(t, doc) {
+		return data, nil
+	}
+	return json.Marshal(doc)
+}
+
+// renameLegacyKeys renames legacy keys of doc in place, following t, and
+// reports whether it changed anything
+func renameLegacyKeys(t reflect.Type, doc interface{}) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	changed := false
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		items, _ := doc.([]interface{})
+		for _, item := range items {
+			changed = renameLegacyKeys(t.Elem(), item) || changed
+		}
+	case reflect.Map:
+		obj, _ := doc.(map[string]interface{})
+		for _, item := range obj {
+			changed = renameLegacyKeys(t.Elem(), item) || changed
+		}
+	case reflect.Struct:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for _, f := range jsonFields(t) {
+			name := jsonName(f)
+			for k, item := range obj {
+				if strings.EqualFold(k, name) {
+					changed = renameLegacyKeys(f.Type, item) || changed
+					break
+				}
+				if strings.EqualFold(k, f.Name) && !hasKeyFold(obj, name) {
+					delete(obj, k)
+					obj[name] = item
+					renameLegacyKeys(f.Type, item)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return changed
+}
+
+func hasKeyFold(obj map[string]interface{}, name string) bool {
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFields lists the fields of struct t that are decoded, with embedded
+// structs inlined
+func jsonFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if jsonName(f) == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && f.Tag.Get("json") == "" && ft.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(ft)...)
+			continue
+		}
+		if f.PkgPath == "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// legacyKeyPatterns caches, per type, the quoted lower case Go names that
+// differ from their tags
+var legacyKeyPatterns sync.Map
+
+// mayHaveLegacyKeys is a cheap check that lets data without any legacy key
+// be decoded directly
+func mayHaveLegacyKeys(t reflect.Type, data []byte) bool {
+	patterns, ok := legacyKeyPatterns.Load(t)
+	if !ok {
+		set := make(map[string]bool)
+		collectLegacyKeys(t, set, make(map[reflect.Type]bool))
+		list := make([]string, 0, len(set))
+		for p := range set {
+			list = append(list, p)
+		}
+		sort.Strings(list)
+		patterns, _ = legacyKeyPatterns.LoadOrStore(t, list)
+	}
+	list := patterns.([]string)
+	if len(list) == 0 {
+		return false
+	}
+	lower := bytes.ToLower(data)
+	for _, p := range list {
+		if bytes.Contains(lower, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func collectLegacyKeys(t reflect.Type, set map[string]bool, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return
+	}
+	seen[t] = true
+	for _, f := range jsonFields(t) {
+		if !strings.EqualFold(f.Name, jsonName(f)) {
+			set[strconv.Quote(strings.ToLower(f.Name))] = true
+		}
+		collectLegacyKeys(f.Type, set, seen)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Nodes may be IPv6-only or dual-stack. Addresses in the config take IPv6
+// literals bare or bracketed (LISTEN_ADDR=2001:db8::10 or [2001:db8::10]);
+// URLs need the brackets, as in https://[2001:db8::10]:8080, and a zone is
+// written %25, as in https://[fe80::10%25eth0]:8080.
+
+// hostLiteral strips the brackets of an IPv6 address so it can be given to
+// net.JoinHostPort
+func hostLiteral(host string) string {
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// listenAddrs are the TCP addresses to listen on: PORT on every address in
+// LISTEN_ADDR, or on all interfaces of both families when it is empty
+func listenAddrs() []string {
+	var addrs []string
+	for _, host := range strings.Split(os.Getenv("LISTEN_ADDR"), ",") {
+		if host = hostLiteral(host); host != "" {
+			addrs = append(addrs, net.JoinHostPort(host, os.Getenv("PORT")))
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort("", os.Getenv("PORT")))
+	}
+	return addrs
+}
+
+// parseNodeURL parses a configured absolute URL with one of schemes
+func parseNodeURL(raw string, schemes ...string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if strings.Contains(raw, "[") && strings.Contains(raw, "%") {
+			return nil, errors.New("write the zone of an IPv6 address as %25, like [fe80::1%25eth0]")
+		}
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("URL has no host")
+	}
+	// url.Parse takes the last group of a bare IPv6 address for a port
+	if !strings.HasPrefix(u.Host, "[") && strings.Count(u.Host, ":") > 1 {
+		return nil, errors.New("put IPv6 addresses in brackets, like https://[2001:db8::1]:8080")
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return u, nil
+		}
+	}
+	return nil, errors.New("URL must use " + strings.Join(schemes, " or "))
+}
+
+// hopIP is the address in an X-Forwarded-For or X-Real-IP entry, which
+// proxies may write with a port or with brackets around IPv6
+func hopIP(hop string) string {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return host
+	}
+	return hostLiteral(hop)
+}
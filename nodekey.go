@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	gcpkms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// The node key is the private key of TLS_CERT_FILE, used to serve HTTPS and
+// to authenticate to peers. NODE_KEY says where it lives:
+//
+//	file (default)        TLS_KEY_FILE
+//	secret:<KEY>          the PEM key in setting KEY, see SECRETS_SOURCE
+//	pkcs11:<label>        an HSM token, see PKCS11_MODULE
+//	awskms:<key id/ARN>   AWS KMS, credentials from the environment
+//	gcpkms:<key version>  Google Cloud KMS, application default credentials
+//
+// With an HSM or KMS the key never leaves the device; every handshake
+// signature is delegated to it.
+
+// timeout for one remote signature
+const remoteSignTimeout = 5 * time.Second
+
+// remoteSigner is a crypto.Signer whose private key is held elsewhere.
+// schemes limits TLS to the signatures the key can make, nil allows all.
+type remoteSigner struct {
+	pub     crypto.PublicKey
+	schemes []tls.SignatureScheme
+	sign    func(digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(digest, opts)
+}
+
+// nodeCertificate loads TLS_CERT_FILE with the NODE_KEY private key
+func nodeCertificate() (tls.Certificate, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	ref := os.Getenv("NODE_KEY")
+	if ref == "" || ref == "file" {
+		return tls.LoadX509KeyPair(certFile, os.Getenv("TLS_KEY_FILE"))
+	}
+	if strings.HasPrefix(ref, "secret:") {
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEM, []byte(os.Getenv(strings.TrimPrefix(ref, "secret:"))))
+	}
+
+	var cert tls.Certificate
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return cert, err
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, errors.New("no certificates found in " + certFile)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return cert, err
+	}
+
+	var signer crypto.Signer
+	kind, name := ref, ""
+	if i := strings.Index(ref, ":"); i > 0 {
+		kind, name = ref[:i], ref[i+1:]
+	}
+	switch kind {
+	case "pkcs11":
+		signer, err = pkcs11Signer(name)
+	case "awskms":
+		signer, err = awsKMSSigner(name)
+	case "gcpkms":
+		signer, err = gcpKMSSigner(name)
+	default:
+		err = errors.New("NODE_KEY must be file, secret:<key>, pkcs11:<label>, awskms:<key> or gcpkms:<key version>")
+	}
+	if err != nil {
+		return cert, err
+	}
+	if !samePublicKey(signer.Public(), cert.Leaf.PublicKey) {
+		return cert, errors.New("NODE_KEY " + ref + " does not match the key of " + certFile)
+	}
+	cert.PrivateKey = signer
+	if s, ok := signer.(*remoteSigner); ok {
+		cert.SupportedSignatureAlgorithms = s.schemes
+	}
+	return cert, nil
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	ka, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	kb, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(ka, kb)
+}
+
+// curveSchemes limits an ECDSA key to the hash of its curve, which is all
+// KMS ECDSA keys sign with
+func curveSchemes(pub crypto.PublicKey) []tls.SignatureScheme {
+	if k, ok := pub.(*ecdsa.PublicKey); ok {
+		switch k.Curve {
+		case elliptic.P256():
+			return []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}
+		case elliptic.P384():
+			return []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}
+		}
+	}
+	return nil
+}
+
+// gcpKMSScheme maps a Cloud KMS algorithm such as RSA_SIGN_PSS_2048_SHA256
+// to the TLS signature it makes
+func gcpKMSScheme(alg string) (tls.SignatureScheme, bool) {
+	hash := alg[strings.LastIndex(alg, "_")+1:]
+	switch {
+	case alg == "EC_SIGN_P256_SHA256":
+		return tls.ECDSAWithP256AndSHA256, true
+	case alg == "EC_SIGN_P384_SHA384":
+		return tls.ECDSAWithP384AndSHA384, true
+	case strings.HasPrefix(alg, "RSA_SIGN_PSS_") && hash == "SHA256":
+		return tls.PSSWithSHA256, true
+	case strings.HasPrefix(alg, "RSA_SIGN_PSS_") && hash == "SHA512":
+		return tls.PSSWithSHA512, true
+	case strings.HasPrefix(alg, "RSA_SIGN_PKCS1_") && hash == "SHA256":
+		return tls.PKCS1WithSHA256, true
+	case strings.HasPrefix(alg, "RSA_SIGN_PKCS1_") && hash == "SHA512":
+		return tls.PKCS1WithSHA512, true
+	}
+	return 0, false
+}
+
+// awsKMSSigner signs with an asymmetric AWS KMS key
+func awsKMSSigner(keyID string) (crypto.Signer, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := kms.New(sess)
+	out, err := svc.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSigner{pub, curveSchemes(pub), func(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+		alg, err := awsSigningAlgorithm(pub, opts)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), remoteSignTimeout)
+		defer cancel()
+		res, err := svc.SignWithContext(ctx, &kms.SignInput{
+			KeyId:            aws.String(keyID),
+			Message:          digest,
+			MessageType:      aws.String(kms.MessageTypeDigest),
+			SigningAlgorithm: aws.String(alg),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.Signature, nil
+	}}, nil
+}
+
+func awsSigningAlgorithm(pub crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	_, pss := opts.(*rsa.PSSOptions)
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		switch opts.HashFunc() {
+		case crypto.SHA256:
+			return kms.SigningAlgorithmSpecEcdsaSha256, nil
+		case crypto.SHA384:
+			return kms.SigningAlgorithmSpecEcdsaSha384, nil
+		case crypto.SHA512:
+			return kms.SigningAlgorithmSpecEcdsaSha512, nil
+		}
+	case *rsa.PublicKey:
+		switch opts.HashFunc() {
+		case crypto.SHA256:
+			if pss {
+				return kms.SigningAlgorithmSpecRsassaPssSha256, nil
+			}
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, nil
+		case crypto.SHA384:
+			if pss {
+				return kms.SigningAlgorithmSpecRsassaPssSha384, nil
+			}
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384, nil
+		case crypto.SHA512:
+			if pss {
+				return kms.SigningAlgorithmSpecRsassaPssSha512, nil
+			}
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512, nil
+		}
+	}
+	return "", errors.New("AWS KMS cannot sign with " + opts.HashFunc().String() + " for this key")
+}
+
+// gcpKMSSigner signs with a Cloud KMS asymmetric key version
+// (projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*)
+func gcpKMSSigner(name string) (crypto.Signer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSignTimeout)
+	defer cancel()
+	client, err := gcpkms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: name})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		client.Close()
+		return nil, errors.New("Cloud KMS returned no public key for " + name)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	// a Cloud KMS key version has exactly one algorithm
+	scheme, ok := gcpKMSScheme(resp.Algorithm.String())
+	if !ok {
+		client.Close()
+		return nil, errors.New("Cloud KMS algorithm " + resp.Algorithm.String() + " cannot be used for TLS")
+	}
+	return &remoteSigner{pub, []tls.SignatureScheme{scheme}, func(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+		d := &kmspb.Digest{}
+		switch opts.HashFunc() {
+		case crypto.SHA256:
+			d.Digest = &kmspb.Digest_Sha256{Sha256: digest}
+		case crypto.SHA384:
+			d.Digest = &kmspb.Digest_Sha384{Sha384: digest}
+		case crypto.SHA512:
+			d.Digest = &kmspb.Digest_Sha512{Sha512: digest}
+		default:
+			return nil, errors.New("Cloud KMS cannot sign " + opts.HashFunc().String())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), remoteSignTimeout)
+		defer cancel()
+		res, err := client.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{Name: name, Digest: d})
+		if err != nil {
+			return nil, err
+		}
+		return res.Signature, nil
+	}}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// pkcs11Signer needs cgo to load the PKCS#11 module
+func pkcs11Signer(label string) (crypto.Signer, error) {
+	return nil, errors.New("PKCS#11 keys need a build with cgo enabled")
+}
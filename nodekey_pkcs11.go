@@ -0,0 +1,40 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"os"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// pkcs11Signer finds the key pair labelled label on the PKCS11_TOKEN token
+// of the PKCS11_MODULE library, logging in with PKCS11_PIN. The session
+// stays open for as long as the node runs.
+func pkcs11Signer(label string) (crypto.Signer, error) {
+	module := os.Getenv("PKCS11_MODULE")
+	if module == "" || label == "" {
+		return nil, errors.New("NODE_KEY=pkcs11:<label> requires PKCS11_MODULE")
+	}
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       module,
+		TokenLabel: os.Getenv("PKCS11_TOKEN"),
+		Pin:        os.Getenv("PKCS11_PIN"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ctx.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		ctx.Close()
+		return nil, err
+	}
+	if signer == nil {
+		ctx.Close()
+		return nil, errors.New("no key pair labelled " + label + " on the PKCS#11 token")
+	}
+	return signer, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizationEnabled reports whether event text is put in Unicode NFC
+// before it is hashed or compared. EVENT_NORMALIZATION=none turns it off,
+// e.g. to replay a chain recorded before normalization existed.
+func normalizationEnabled() bool {
+	return os.Getenv("EVENT_NORMALIZATION") != "none"
+}
+
+// normalizeText returns s in NFC, so "é" sent precomposed by one system and
+// as e plus a combining accent by another compare and hash the same
+func normalizeText(s string) string {
+	if !normalizationEnabled() {
+		return s
+	}
+	return norm.NFC.String(s)
+}
+
+// normalizeEvent normalizes every text field of an event. KeyID and HMAC are
+// identifiers, not event text, and are left alone.
+func normalizeEvent(m CreateBlockReq) CreateBlockReq {
+	m.FileHash = normalizeText(m.FileHash)
+	m.Event = normalizeText(m.Event)
+	m.EventTime = normalizeText(m.EventTime)
+	m.Location = normalizeText(m.Location)
+	m.Server = normalizeText(m.Server)
+	return m
+}
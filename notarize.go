@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Notarization sends the chain digest to external witnesses every
+// NOTARIZE_INTERVAL (default 24h) whenever the head moved: by email to
+// NOTARIZE_EMAIL_TO and/or as a commit to the Git working copy in
+// NOTARIZE_GIT_DIR. Either witness can later be checked against the chain
+// with POST /compare-baseline.
+
+// Notarization is the digest sent to witnesses
+type Notarization struct {
+	Node string `json:"node"`
+	Time string `json:"time"`
+	Baseline
+}
+
+// file in NOTARIZE_GIT_DIR that digests are appended to
+const notarizeGitFile = "chain-digests.jsonl"
+
+// startNotarizer validates the witness settings and starts notarizing
+func startNotarizer() error {
+	to := os.Getenv("NOTARIZE_EMAIL_TO")
+	gitDir := os.Getenv("NOTARIZE_GIT_DIR")
+	if to == "" && gitDir == "" {
+		return nil
+	}
+	if to != "" && (os.Getenv("SMTP_ADDR") == "" || os.Getenv("SMTP_FROM") == "") {
+		return errors.New("NOTARIZE_EMAIL_TO requires SMTP_ADDR and SMTP_FROM")
+	}
+	if gitDir != "" {
+		if _, err := os.Stat(filepath.Join(gitDir, ".git")); err != nil {
+			return errors.New("NOTARIZE_GIT_DIR must be a Git working copy: " + err.Error())
+		}
+	}
+	interval := 24 * time.Hour
+	if v := os.Getenv("NOTARIZE_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		last := ""
+		for {
+			if n, ok := currentNotarization(); ok && n.HeadHash != last {
+				if err := notarize(n, to, gitDir); err != nil {
+					log.Println("notarization failed:", err)
+				} else {
+					last = n.HeadHash
+					log.Printf("notarized head %d %s", n.Height, n.HeadHash)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return nil
+}
+
+func currentNotarization() (Notarization, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(Blockchain) == 0 {
+		return Notarization{}, false
+	}
+	return Notarization{nodeID(), time.Now().UTC().Format(time.RFC3339), baselineLocked(len(Blockchain)-1, 0)}, true
+}
+
+// notarize sends n to every configured witness, trying all of them even if
+// one fails
+func notarize(n Notarization, to, gitDir string) error {
+	var failed []string
+	if to != "" {
+		if err := notarizeEmail(n, to); err != nil {
+			failed = append(failed, "email: "+err.Error())
+		}
+	}
+	if gitDir != "" {
+		if err := notarizeGit(n, gitDir); err != nil {
+			failed = append(failed, "git: "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// notarizeEmail mails the digest through SMTP_ADDR, authenticating with
+// SMTP_USERNAME and SMTP_PASSWORD when set
+func notarizeEmail(n Notarization, to string) error {
+	body, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+	var rcpts []string
+	for _, addr := range strings.Split(to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			rcpts = append(rcpts, addr)
+		}
+	}
+	from := os.Getenv("SMTP_FROM")
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Chain digest %s at height %d\r\nDate: %s\r\n"+
+		"Content-Type: application/json\r\n\r\n%s\r\n",
+		from, strings.Join(rcpts, ", "), n.Node, n.Height, time.Now().Format(time.RFC1123Z), body)
+
+	addr := os.Getenv("SMTP_ADDR")
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(addr, auth, from, rcpts, []byte(msg))
+}
+
+// notarizeGit appends the digest to chain-digests.jsonl, commits it and,
+// with NOTARIZE_GIT_PUSH=true, pushes the commit
+func notarizeGit(n Notarization, dir string) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, notarizeGitFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	commit := []string{"commit", "-m", fmt.Sprintf("Chain digest %s at height %d", n.Node, n.Height)}
+	// commit as the node when the working copy has no identity configured
+	check := exec.Command("git", "config", "user.email")
+	check.Dir = dir
+	if err := check.Run(); err != nil {
+		commit = append([]string{"-c", "user.name=" + n.Node, "-c", "user.email=blockchain@" + n.Node}, commit...)
+	}
+	steps := [][]string{{"add", notarizeGitFile}, commit}
+	if os.Getenv("NOTARIZE_GIT_PUSH") == "true" {
+		steps = append(steps, []string{"push"})
+	}
+	for _, args := range steps {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
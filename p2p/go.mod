@@ -0,0 +1,3 @@
+module github.com/repenno/blockchain/p2p
+
+go 1.23
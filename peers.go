@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peer is another node this node gossips blocks with
+type Peer struct {
+	URL       string `json:"url"`
+	Height    int    `json:"height"`
+	LastSync  string `json:"last_sync"`
+	LastPush  string `json:"last_push"`
+	LastError string `json:"last_error"`
+	queue     chan Block
+}
+
+var peers []*Peer
+var peerMutex = &sync.Mutex{}
+
+// peerPins holds the SHA-256 fingerprints (hex) of the peer certificates we
+// trust. Peer traffic is always TLS and a peer must present a pinned
+// certificate in both directions, so a rogue node can't push blocks. Like
+// peers, it is set once at startup; changing PEERS or PEER_PINS needs a
+// restart.
+var peerPins map[string]bool
+
+var peerClient *http.Client
+
+// length of each peer's outbound queue; blocks beyond it are dropped
+const peerQueueSize = 256
+
+// startPeers reads PEERS (https base URLs) and PEER_PINS and starts one
+// sender per peer
+func startPeers() error {
+	peerPins = make(map[string]bool)
+	for _, pin := range strings.Split(os.Getenv("PEER_PINS"), ",") {
+		pin = strings.ToLower(strings.Replace(strings.TrimSpace(pin), ":", "", -1))
+		if pin != "" {
+			peerPins[pin] = true
+		}
+	}
+
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("PEERS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	if len(peerPins) == 0 {
+		return errors.New("PEERS requires PEER_PINS")
+	}
+
+	cert, err := nodeCertificate()
+	if err != nil {
+		return errors.New("PEERS requires TLS_CERT_FILE and TLS_KEY_FILE: " + err.Error())
+	}
+	peerClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+				// the pin replaces CA verification, see verifyPeerPin
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: verifyPeerPin,
+			},
+		},
+	}
+	if faultInjectionEnabled() {
+		log.Println("fault injection enabled for peer requests")
+		peerClient.Transport = &faultTransport{peerClient.Transport}
+	}
+
+	for _, raw := range urls {
+		if _, err := parseNodeURL(raw, "https"); err != nil {
+			return errors.New("invalid peer URL " + raw + ": " + err.Error())
+		}
+		p := &Peer{URL: strings.TrimRight(raw, "/"), queue: make(chan Block, peerQueueSize)}
+		peers = append(peers, p)
+		go p.send()
+	}
+	log.Println("gossiping with", len(peers), "peers")
+	return nil
+}
+
+// certFingerprint is the hex SHA-256 of a DER encoded certificate
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPeerPin accepts a TLS handshake only if the leaf certificate is pinned
+func verifyPeerPin(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 || !peerPins[certFingerprint(rawCerts[0])] {
+		return errors.New("peer certificate is not pinned")
+	}
+	return nil
+}
+
+// requirePeer only lets pinned peers through
+func requirePeer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 ||
+			!peerPins[certFingerprint(r.TLS.PeerCertificates[0].Raw)] {
+			log.Printf("rejected peer request from %s: certificate not pinned", r.RemoteAddr)
+			http.Error(w, "peer certificate not pinned", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// broadcastBlock queues a committed block for every peer without blocking
+// the write path. Caller holds mutex, so blocks are queued in chain order.
+func broadcastBlock(b Block) {
+	for _, p := range peers {
+		select {
+		case p.queue <- b:
+		default:
+			log.Printf("peer %s queue full, dropping block %d", p.URL, b.Index)
+		}
+	}
+}
+
+// send pushes queued blocks to the peer in order
+func (p *Peer) send() {
+	for b := range p.queue {
+		body, err := marshalAPI(b)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		status := ""
+		resp, err := peerClient.Post(p.URL+"/peers/blocks", "application/json", bytes.NewReader(body))
+		if err == nil {
+			status = resp.Status
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+
+		peerMutex.Lock()
+		p.LastPush = time.Now().String()
+		p.LastError = ""
+		if err != nil {
+			p.LastError = err.Error()
+			log.Printf("pushing block %d to %s failed: %v", b.Index, p.URL, err)
+		} else {
+			log.Printf("pushed block %d to %s: %s", b.Index, p.URL, status)
+		}
+		peerMutex.Unlock()
+	}
+}
+
+// accept a block gossiped by a pinned peer
+func handlePeerBlock(w http.ResponseWriter, r *http.Request) {
+	var b Block
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if poaEnabled() && !hasQuorum(b) {
+		http.Error(w, "block lacks a validator quorum", http.StatusForbidden)
+		return
+	}
+	if err := checkWork(b); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	mutex.Lock()
+	_, known := BlockMap[b.Hash]
+	mutex.Unlock()
+	if known {
+		respondWithJSON(w, r, http.StatusOK, b)
+		return
+	}
+
+	if err := commitPeerBlock(b); errors.Is(err, ErrDuplicate) {
+		// another peer pushed it first
+		respondWithJSON(w, r, http.StatusOK, b)
+		return
+	} else if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	log.Printf("accepted block %d from peer %s", b.Index, r.RemoteAddr)
+	respondWithJSON(w, r, http.StatusCreated, b)
+}
+
+// list configured peers and their last push result
+func handleGetPeers(w http.ResponseWriter, r *http.Request) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	list := make([]Peer, 0, len(peers))
+	for _, p := range peers {
+		list = append(list, Peer{URL: p.URL, Height: p.Height, LastSync: p.LastSync, LastPush: p.LastPush, LastError: p.LastError})
+	}
+	respondWithJSON(w, r, http.StatusOK, list)
+}
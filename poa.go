@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Approval is a validator's signature over a block hash
+type Approval struct {
+	Validator string `json:"validator"`
+	Signature string `json:"signature"`
+}
+
+// Proposal is a candidate block waiting for a quorum of validator votes
+type Proposal struct {
+	ID       string            `json:"id"`
+	Proposer string            `json:"proposer"`
+	Block    Block             `json:"block"`
+	Votes    map[string]string `json:"votes"`
+	State    string            `json:"state"`
+	Created  string            `json:"created"`
+
+	created time.Time
+}
+
+// ProposalReq is sent by a validator to propose a new block. Signature is the
+// hex ed25519 signature of the proposer over eventRecord(CreateMessage),
+// whose SignedAt must be within signatureWindow. Each signature is accepted
+// once.
+type ProposalReq struct {
+	Validator     string         `json:"validator"`
+	CreateMessage CreateBlockReq `json:"create_message"`
+	Signature     string         `json:"signature"`
+}
+
+// KeyExport lists the public keys block approvals can be verified with, as
+// consumed by cmd/verify
+type KeyExport struct {
+	Consensus string `json:"consensus"`
+	Quorum    int    `json:"quorum,omitempty"`
+	// EpochQuorum is set when epoch blocks need more votes than Quorum
+	EpochQuorum int               `json:"epoch_quorum,omitempty"`
+	Validators  map[string]string `json:"validators,omitempty"`
+}
+
+// VoteReq carries a validator's hex ed25519 signature over the proposed block
+// hash. The hash is fixed-length hex, so nothing can shift inside the message;
+// it is what block approvals have always signed.
+type VoteReq struct {
+	Validator string `json:"validator"`
+	Signature string `json:"signature"`
+}
+
+const (
+	proposalPending   = "pending"
+	proposalCommitted = "committed"
+	proposalStale     = "stale"
+	// pending proposals are dropped after this long without a quorum
+	proposalLifetime = 10 * time.Minute
+)
+
+// validators maps validator names to their public keys (CONSENSUS=poa only)
+var validators map[string]ed25519.PublicKey
+
+// quorum is the number of distinct validator votes needed to commit a block
+var quorum int
+
+// validatorMutex guards validators and quorum, which can be hot reloaded
+var validatorMutex = &sync.RWMutex{}
+
+// proposals holds the pending proposals, guarded by proposalMutex. They are
+// removed once committed, found stale or expired.
+var proposals = make(map[string]*Proposal)
+var proposalMutex = &sync.Mutex{}
+
+func poaEnabled() bool {
+	return os.Getenv("CONSENSUS") == "poa"
+}
+
+// loadValidators parses VALIDATORS ("name:base64pubkey,...") and QUORUM
+func loadValidators() error {
+	if !poaEnabled() {
+		return nil
+	}
+
+	set, n, err := parseValidators(os.Getenv("VALIDATORS"), os.Getenv("QUORUM"))
+	if err != nil {
+		return err
+	}
+	validators, quorum = set, n
+	log.Printf("proof-of-authority mode: %d validators, quorum %d", len(validators), quorum)
+	return nil
+}
+
+// prepareValidators validates a reloaded VALIDATORS/QUORUM pair
+func prepareValidators(env map[string]string) (func(), error) {
+	if !poaEnabled() {
+		return func() {}, nil
+	}
+	set, n, err := parseValidators(env["VALIDATORS"], env["QUORUM"])
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		validatorMutex.Lock()
+		validators, quorum = set, n
+		validatorMutex.Unlock()
+		log.Printf("proof-of-authority mode: %d validators, quorum %d", len(set), n)
+	}, nil
+}
+
+// parseValidators validates a validator list and quorum without applying them
+func parseValidators(list, q string) (map[string]ed25519.PublicKey, int, error) {
+	set := make(map[string]ed25519.PublicKey)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, 0, errors.New("invalid validator entry " + entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid public key for validator " + parts[0])
+		}
+		set[parts[0]] = ed25519.PublicKey(key)
+	}
+	if len(set) == 0 {
+		return nil, 0, errors.New("CONSENSUS=poa requires VALIDATORS")
+	}
+
+	// default to a simple majority
+	n := len(set)/2 + 1
+	if q != "" {
+		var err error
+		n, err = strconv.Atoi(q)
+		if err != nil || n < 1 || n > len(set) {
+			return nil, 0, errors.New("QUORUM must be between 1 and the number of validators")
+		}
+	}
+	return set, n, nil
+}
+
+// verifyValidator checks that sig is a valid signature of msg by validator name
+func verifyValidator(name, msg, sig string) bool {
+	validatorMutex.RLock()
+	key, ok := validators[name]
+	validatorMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	raw, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, []byte(msg), raw)
+}
+
+func handleCreateProposal(w http.ResponseWriter, r *http.Request) {
+	if !poaEnabled() {
+		http.Error(w, "proof-of-authority mode is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var p ProposalReq
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(p.CreateMessage.Event) == 0 {
+		http.Error(w, "Event is required", http.StatusBadRequest)
+		return
+	}
+	if err := checkReservedEvent(p.CreateMessage); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	signedAt, err := checkSignedAt(p.CreateMessage.SignedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !verifyValidator(p.Validator, eventRecord(p.CreateMessage), p.Signature) {
+		http.Error(w, "invalid validator signature", http.StatusForbidden)
+		return
+	}
+	if err := claimSignature("proposal:"+strings.ToLower(p.Signature), signedAt); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	m := normalizeEvent(p.CreateMessage)
+	mutex.Lock()
+	prev := Blockchain[len(Blockchain)-1]
+	candidate := generateBlock(prev, "", m.FileHash, m.Event, m.EventTime, m.Location, m.Server)
+	if candidate.Metadata = stampMinter(nil, p.Validator); len(candidate.Metadata) > 0 {
+		candidate.Hash = hashFor(candidate, prev)
+	}
+	mutex.Unlock()
+
+	now := time.Now()
+	proposal := &Proposal{
+		ID:       candidate.Hash,
+		Proposer: p.Validator,
+		Block:    candidate,
+		Votes:    make(map[string]string),
+		State:    proposalPending,
+		Created:  now.String(),
+		created:  now,
+	}
+
+	proposalMutex.Lock()
+	pruneProposalsLocked()
+	proposals[proposal.ID] = proposal
+	proposalMutex.Unlock()
+
+	log.Printf("validator %s proposed block %s", p.Validator, proposal.ID)
+	respondWithJSON(w, r, http.StatusCreated, proposal)
+}
+
+func handleVoteProposal(w http.ResponseWriter, r *http.Request) {
+	var v VoteReq
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	proposalMutex.Lock()
+	defer proposalMutex.Unlock()
+
+	pruneProposalsLocked()
+	proposal, ok := proposals[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "proposal not found", http.StatusNotFound)
+		return
+	}
+	if proposal.State != proposalPending {
+		respondWithJSON(w, r, http.StatusConflict, proposal)
+		return
+	}
+	if !verifyValidator(v.Validator, proposal.Block.Hash, v.Signature) {
+		http.Error(w, "invalid validator signature", http.StatusForbidden)
+		return
+	}
+	proposal.Votes[v.Validator] = v.Signature
+
+	validatorMutex.RLock()
+	approved := len(proposal.Votes) >= requiredVotesLocked(proposal.Block)
+	validatorMutex.RUnlock()
+	if approved {
+		commitProposal(proposal)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, proposal)
+}
+
+// pruneProposalsLocked drops the proposals pending for longer than
+// proposalLifetime. Caller must hold proposalMutex.
+func pruneProposalsLocked() {
+	for id, p := range proposals {
+		if time.Since(p.created) > proposalLifetime {
+			log.Printf("proposal %s expired with %d votes", id, len(p.Votes))
+			delete(proposals, id)
+		}
+	}
+}
+
+// commitProposal appends a quorum-approved block, or marks it stale when the
+// head moved on since it was proposed, and forgets the proposal either way.
+// Caller must hold proposalMutex.
+func commitProposal(proposal *Proposal) {
+	delete(proposals, proposal.ID)
+	b := proposal.Block
+	names := make([]string, 0, len(proposal.Votes))
+	for name := range proposal.Votes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.Approvals = append(b.Approvals, Approval{name, proposal.Votes[name]})
+	}
+
+	if err := commitBlock(b); err != nil {
+		proposal.State = proposalStale
+		log.Printf("proposal %s not committed: %v", proposal.ID, err)
+		return
+	}
+	proposal.Block = b
+	proposal.State = proposalCommitted
+	log.Printf("proposal %s committed with %d votes", proposal.ID, len(proposal.Votes))
+}
+
+// hasQuorum checks that a block carries enough valid validator approvals
+func hasQuorum(b Block) bool {
+	seen := make(map[string]bool)
+	for _, a := range b.Approvals {
+		if !seen[a.Validator] && verifyValidator(a.Validator, b.Hash, a.Signature) {
+			seen[a.Validator] = true
+		}
+	}
+	validatorMutex.RLock()
+	defer validatorMutex.RUnlock()
+	return len(seen) >= requiredVotesLocked(b)
+}
+
+// export the validator public keys and quorum
+func handleGetKeys(w http.ResponseWriter, r *http.Request) {
+	export := KeyExport{Consensus: os.Getenv("CONSENSUS")}
+	validatorMutex.RLock()
+	if len(validators) > 0 {
+		export.Quorum = quorum
+		if n := requiredVotesLocked(Block{Event: epochEvent}); n > quorum {
+			export.EpochQuorum = n
+		}
+		export.Validators = make(map[string]string, len(validators))
+		for name, key := range validators {
+			export.Validators[name] = base64.StdEncoding.EncodeToString(key)
+		}
+	}
+	validatorMutex.RUnlock()
+	respondWithJSON(w, r, http.StatusOK, export)
+}
+
+// list in-flight proposals
+func handleGetProposals(w http.ResponseWriter, r *http.Request) {
+	pending := make([]*Proposal, 0)
+
+	proposalMutex.Lock()
+	pruneProposalsLocked()
+	for _, p := range proposals {
+		if p.State == proposalPending {
+			pending = append(pending, p)
+		}
+	}
+	// a stable order keeps /v2 pages consistent
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	respondWithList(w, r, http.StatusOK, pending)
+	proposalMutex.Unlock()
+}
+
+func handleGetProposal(w http.ResponseWriter, r *http.Request) {
+	proposalMutex.Lock()
+	defer proposalMutex.Unlock()
+
+	proposal, ok := proposals[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "proposal not found", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, proposal)
+}
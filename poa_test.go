@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProposalsAreSignedOnceAndForgotten(t *testing.T) {
+	router := newTestChain(t)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONSENSUS", "poa")
+	t.Setenv("VALIDATORS", "v1:"+base64.StdEncoding.EncodeToString(pub))
+	t.Setenv("QUORUM", "1")
+	if err := loadValidators(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		proposalMutex.Lock()
+		proposals = make(map[string]*Proposal)
+		proposalMutex.Unlock()
+	})
+	sign := func(msg string) string { return hex.EncodeToString(ed25519.Sign(priv, []byte(msg))) }
+
+	m := CreateBlockReq{Event: "door opened", EventTime: "2024-01-01T00:00:00Z", Server: "s1",
+		SignedAt: time.Now().UTC().Format(time.RFC3339)}
+	req := ProposalReq{Validator: "v1", CreateMessage: m, Signature: sign(eventRecord(m))}
+	var p Proposal
+	if code := call(t, router, "POST", "/v2/proposals", req, &p); code != http.StatusCreated {
+		t.Fatalf("proposal: status %d", code)
+	}
+	if code := call(t, router, "POST", "/v2/proposals", req, nil); code != http.StatusForbidden {
+		t.Errorf("the same signed proposal again: status %d", code)
+	}
+
+	// moving a byte from one field to the next breaks the signature
+	shifted := m
+	shifted.Event, shifted.EventTime = "door opene", "d"+m.EventTime
+	forged := ProposalReq{Validator: "v1", CreateMessage: m, Signature: sign(eventRecord(shifted))}
+	if code := call(t, router, "POST", "/v2/proposals", forged, nil); code != http.StatusForbidden {
+		t.Errorf("a proposal with shifted fields: status %d", code)
+	}
+
+	vote := VoteReq{Validator: "v1", Signature: sign(p.Block.Hash)}
+	if code := call(t, router, "POST", "/v2/proposals/"+p.ID+"/votes", vote, &p); code != http.StatusOK || p.State != proposalCommitted {
+		t.Fatalf("vote: status %d, proposal %s", code, p.State)
+	}
+	proposalMutex.Lock()
+	left := len(proposals)
+	proposalMutex.Unlock()
+	if left != 0 {
+		t.Errorf("%d proposals kept after the commit", left)
+	}
+
+	proposalMutex.Lock()
+	proposals["old"] = &Proposal{ID: "old", State: proposalPending, created: time.Now().Add(-2 * proposalLifetime)}
+	proposalMutex.Unlock()
+	var pending struct{ Items []Proposal }
+	call(t, router, "GET", "/v2/proposals", nil, &pending)
+	if len(pending.Items) != 0 {
+		t.Errorf("an expired proposal is still pending: %+v", pending.Items)
+	}
+	proposalMutex.Lock()
+	_, kept := proposals["old"]
+	proposalMutex.Unlock()
+	if kept {
+		t.Error("an expired proposal was not deleted")
+	}
+}
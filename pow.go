@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With CONSENSUS=pow every block this node mints is mined: the Nonce is
+// counted up until the block hash starts with POW_DIFFICULTY zero hex digits
+// (default 4), and the block records the Difficulty it was mined to. Blocks
+// pushed or synced from peers must carry at least POW_MIN_DIFFICULTY
+// (default 1), so a peer can't extend the chain without doing the work; 0
+// accepts unmined blocks, for a chain that switched to pow along the way.
+// Both are read again on config reload; raising POW_DIFFICULTY applies to
+// the next block. Every node checks that a block's hash meets the
+// Difficulty it claims, whatever its consensus.
+//
+// Mining happens while the chain is locked, each digit multiplies the work
+// by 16: 4 takes milliseconds, 6 around ten seconds per block.
+
+// mining more than this would stall writes for hours
+const maxPowDifficulty = 8
+
+var errInsufficientWork = errors.New("block hash does not meet its proof-of-work difficulty")
+
+var (
+	powDifficultySetting = 4
+	powMinDifficulty     = 1
+	powMutex             = &sync.Mutex{}
+)
+
+func powEnabled() bool {
+	return os.Getenv("CONSENSUS") == "pow"
+}
+
+// loadProofOfWork reads POW_DIFFICULTY and POW_MIN_DIFFICULTY
+func loadProofOfWork() error {
+	apply, err := prepareProofOfWork(map[string]string{
+		"POW_DIFFICULTY":     os.Getenv("POW_DIFFICULTY"),
+		"POW_MIN_DIFFICULTY": os.Getenv("POW_MIN_DIFFICULTY"),
+	})
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareProofOfWork validates reloaded difficulties
+func prepareProofOfWork(env map[string]string) (func(), error) {
+	difficulty, min := 4, 1
+	if v := env["POW_DIFFICULTY"]; v != "" {
+		var err error
+		if difficulty, err = strconv.Atoi(v); err != nil || difficulty < 1 || difficulty > maxPowDifficulty {
+			return nil, errors.New("POW_DIFFICULTY must be between 1 and " + strconv.Itoa(maxPowDifficulty))
+		}
+	}
+	if v := env["POW_MIN_DIFFICULTY"]; v != "" {
+		var err error
+		if min, err = strconv.Atoi(v); err != nil || min < 0 || min > maxPowDifficulty {
+			return nil, errors.New("POW_MIN_DIFFICULTY must be between 0 and " + strconv.Itoa(maxPowDifficulty))
+		}
+	}
+	if difficulty < min {
+		return nil, errors.New("POW_DIFFICULTY must not be below POW_MIN_DIFFICULTY")
+	}
+	return func() {
+		powMutex.Lock()
+		powDifficultySetting, powMinDifficulty = difficulty, min
+		powMutex.Unlock()
+		if powEnabled() {
+			log.Println("mining blocks to difficulty", difficulty)
+		}
+	}, nil
+}
+
+// powDifficulty is the difficulty to mine new blocks to, 0 without
+// CONSENSUS=pow
+func powDifficulty() int {
+	if !powEnabled() {
+		return 0
+	}
+	powMutex.Lock()
+	defer powMutex.Unlock()
+	return powDifficultySetting
+}
+
+// meetsDifficulty reports whether blockHash starts with difficulty zero hex
+// digits. The algorithm prefix of a re-anchored hash doesn't count.
+func meetsDifficulty(blockHash string, difficulty int) bool {
+	if i := strings.Index(blockHash, ":"); i >= 0 {
+		blockHash = blockHash[i+1:]
+	}
+	return len(blockHash) >= difficulty && strings.Count(blockHash[:difficulty], "0") == difficulty
+}
+
+// mineBlock finds a Nonce that gives b a hash meeting the configured
+// difficulty. Without CONSENSUS=pow b is returned as it is.
+func mineBlock(b, prev Block) Block {
+	difficulty := powDifficulty()
+	if difficulty == 0 {
+		return b
+	}
+	b.Difficulty = difficulty
+	for nonce := uint64(0); ; nonce++ {
+		b.Nonce = strconv.FormatUint(nonce, 16)
+		b.Hash = hashFor(b, prev)
+		if meetsDifficulty(b.Hash, difficulty) {
+			return b
+		}
+	}
+}
+
+// checkWork refuses blocks from peers mined to less than POW_MIN_DIFFICULTY
+func checkWork(b Block) error {
+	if !powEnabled() {
+		return nil
+	}
+	powMutex.Lock()
+	min := powMinDifficulty
+	powMutex.Unlock()
+	if b.Difficulty < min {
+		return &BlockError{b.Index, errInsufficientWork}
+	}
+	return nil
+}
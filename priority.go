@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Every request falls in a priority class. When the concurrency limits are
+// reached, requests queue per class and a freed slot goes to the highest
+// class waiting:
+//
+//	device       block writes from registered devices: a verified client
+//	             certificate, a CMS signature or a Device-Key header naming
+//	             a device key (the write must then carry that key_id)
+//	interactive  everything else
+//	bulk         GET / and /export, /graph, /blocks/delta, /audit/chain,
+//	             /aggregates/... and the .../blocks listings
+//
+// Bulk requests hold at most LIMIT_BULK of the LIMIT_GLOBAL slots (half by
+// default), so exports can't take the slots ingestion needs during an
+// incident. Each class waits up to LIMIT_QUEUE_TIMEOUT_<CLASS> for a slot,
+// LIMIT_QUEUE_TIMEOUT by default, and REQUEST_DEADLINE_<CLASS> bounds a
+// request from its arrival: its context is cancelled then, which stops
+// exports between blocks. The event stream has no deadline.
+type priorityClass int
+
+const (
+	priorityDevice priorityClass = iota
+	priorityInteractive
+	priorityBulk
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"device", "interactive", "bulk"}
+
+// how long each class may take, zero for no deadline
+var classDeadline [numPriorities]time.Duration
+
+type priorityKey struct{}
+
+// loadPriorities reads the per class deadlines; the queue timeouts are
+// limits (see loadLimits)
+func loadPriorities() error {
+	for c, name := range priorityNames {
+		suffix := "_" + strings.ToUpper(name)
+		classDeadline[c] = 0
+		if v := os.Getenv("REQUEST_DEADLINE" + suffix); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return errors.New("REQUEST_DEADLINE" + suffix + " must be a positive duration")
+			}
+			classDeadline[c] = d
+		}
+	}
+	return nil
+}
+
+// requestPriority classifies r by its route and credentials
+func requestPriority(r *http.Request) priorityClass {
+	p := r.URL.Path
+	for _, prefix := range []string{"/v1", "/v2"} {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			p = strings.TrimPrefix(p, prefix)
+			break
+		}
+	}
+	if p == "" {
+		p = "/"
+	}
+	switch r.Method {
+	case "POST":
+		if p != "/block" {
+			return priorityInteractive
+		}
+		if len(peerIdentities(r)) > 0 || isSignedWrite(r) {
+			return priorityDevice
+		}
+		if id := r.Header.Get("Device-Key"); id != "" {
+			if _, ok := lookupDeviceKey(id); ok {
+				return priorityDevice
+			}
+		}
+	case "GET":
+		switch p {
+		case "/", "/export", "/graph", "/blocks/delta", "/audit/chain":
+			return priorityBulk
+		}
+		if strings.HasSuffix(p, "/blocks") || strings.HasPrefix(p, "/aggregates/") {
+			return priorityBulk
+		}
+	}
+	return priorityInteractive
+}
+
+// priorityOf is the class prioritize gave r, interactive without one
+func priorityOf(r *http.Request) priorityClass {
+	if c, ok := r.Context().Value(priorityKey{}).(priorityClass); ok {
+		return c
+	}
+	return priorityInteractive
+}
+
+// prioritize tags requests with their class and applies its deadline
+func prioritize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := requestPriority(r)
+		ctx := context.WithValue(r.Context(), priorityKey{}, c)
+		if d := classDeadline[c]; d > 0 && !strings.HasSuffix(r.URL.Path, "/events/stream") {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// checkDeviceKeyHeader refuses writes whose Device-Key header, which got
+// them device priority, isn't the key they are signed with
+func checkDeviceKeyHeader(r *http.Request, m CreateBlockReq) error {
+	if id := r.Header.Get("Device-Key"); id != "" && id != m.KeyID {
+		return errors.New("Device-Key header does not match the write's key_id")
+	}
+	return nil
+}
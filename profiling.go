@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Profiling is only served on the admin listener, behind ADMIN_TOKEN:
+// /debug/pprof/ for live profiles, and POST /debug/dumps to write a heap
+// profile and a goroutine dump to DUMP_DIR (default DATA_DIR/dumps, or the
+// temp directory) for later analysis.
+
+// DumpResult names the files a dump wrote
+type DumpResult struct {
+	Heap         string `json:"heap"`
+	Goroutines   string `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	NumGC        uint32 `json:"num_gc"`
+	NumGoroutine int    `json:"num_goroutine"`
+	Blocks       int    `json:"blocks"`
+}
+
+// addProfilingRoutes registers pprof and the dump API
+func addProfilingRoutes(muxRouter *mux.Router, guard func(http.HandlerFunc) http.HandlerFunc) {
+	muxRouter.HandleFunc("/debug/pprof/", pprof.Index).Methods("GET")
+	muxRouter.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline).Methods("GET")
+	muxRouter.HandleFunc("/debug/pprof/profile", withoutWriteDeadline(pprof.Profile)).Methods("GET")
+	muxRouter.HandleFunc("/debug/pprof/symbol", pprof.Symbol).Methods("GET", "POST")
+	muxRouter.HandleFunc("/debug/pprof/trace", withoutWriteDeadline(pprof.Trace)).Methods("GET")
+	// named profiles: heap, goroutine, allocs, block, mutex, threadcreate
+	muxRouter.HandleFunc("/debug/pprof/{profile}", pprof.Index).Methods("GET")
+	muxRouter.HandleFunc("/debug/dumps", guard(handleCreateDump)).Methods("POST")
+}
+
+// withoutWriteDeadline lets CPU profiles and traces run longer than the
+// admin server's write timeout
+func withoutWriteDeadline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		next(w, r)
+	}
+}
+
+func dumpDir() string {
+	if dir := os.Getenv("DUMP_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return filepath.Join(dir, "dumps")
+	}
+	return filepath.Join(os.TempDir(), "blockchain-dumps")
+}
+
+// write a heap profile and a goroutine dump to DUMP_DIR
+func handleCreateDump(w http.ResponseWriter, r *http.Request) {
+	dir := dumpDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stamp := time.Now().UTC().Format("20060102T150405.000")
+	res := DumpResult{
+		Heap:       filepath.Join(dir, "heap-"+stamp+".pprof"),
+		Goroutines: filepath.Join(dir, "goroutines-"+stamp+".txt"),
+	}
+
+	// collect first so the profile shows live memory
+	runtime.GC()
+	if err := writeProfile(res.Heap, "heap", 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeProfile(res.Goroutines, "goroutine", 2); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	res.HeapAlloc, res.NumGC, res.NumGoroutine = mem.HeapAlloc, mem.NumGC, runtime.NumGoroutine()
+	mutex.Lock()
+	res.Blocks = len(Blockchain)
+	mutex.Unlock()
+	respondWithJSON(w, r, http.StatusCreated, res)
+}
+
+func writeProfile(path, name string, debug int) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := runtimepprof.Lookup(name).WriteTo(f, debug); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
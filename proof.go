@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /proof/{eventHash} proves that an event sealed into a batch block (see
+// mempool.go) is on the chain, without the rest of the chain or even the
+// rest of the block. eventHash is the event's transaction hash. The proof
+// holds the transaction, the block header with the record its hash is
+// computed over, and the Merkle audit path from the transaction to the
+// header's MerkleRoot. To check it:
+//
+//	node = SHA-256(0x00 || event_hash)
+//	for each step: node = SHA-256(0x01 || hash || node) if left,
+//	                      SHA-256(0x01 || node || hash) otherwise
+//
+// node must equal the header's merkle_root, and hashing the header's record
+// must give its hash. Levels where the node was carried up unpaired have no
+// step.
+
+// ProofStep is the sibling of the path's node at one level of the tree
+type ProofStep struct {
+	Hash string `json:"hash"`
+	// Left is set when the sibling is the left child
+	Left bool `json:"left,omitempty"`
+}
+
+// InclusionProof is the response of GET /proof/{eventHash}. Header is the
+// block without its transactions.
+type InclusionProof struct {
+	EventHash   string       `json:"event_hash"`
+	Transaction Transaction  `json:"transaction"`
+	Position    int          `json:"position"`
+	Count       int          `json:"count"`
+	Path        []ProofStep  `json:"path"`
+	Header      WriteReceipt `json:"header"`
+}
+
+// txRef locates a transaction in the chain
+type txRef struct {
+	index, position int
+}
+
+// txIndex maps transaction hashes to the first block holding them, guarded
+// by mutex
+var txIndex = make(map[string]txRef)
+
+// noteTransactionsLocked indexes the transactions of b. Caller must hold
+// mutex.
+func noteTransactionsLocked(b Block) {
+	for i, tx := range b.Transactions {
+		h := txHash(tx)
+		if _, ok := txIndex[h]; !ok {
+			txIndex[h] = txRef{b.Index, i}
+		}
+	}
+}
+
+// rebuildTransactionsLocked indexes every transaction again. Caller must
+// hold mutex.
+func rebuildTransactionsLocked() (int, error) {
+	txIndex = make(map[string]txRef)
+	for _, b := range Blockchain {
+		noteTransactionsLocked(b)
+	}
+	return len(txIndex), nil
+}
+
+// merklePath is the audit path of the leaf at position among hashes, in
+// the tree merkleRoot builds
+func merklePath(hashes []string, position int) []ProofStep {
+	level := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		sum := sha256.Sum256(append([]byte{0}, h...))
+		level[i] = sum[:]
+	}
+	path := make([]ProofStep, 0)
+	for len(level) > 1 {
+		if sibling := position ^ 1; sibling < len(level) {
+			path = append(path, ProofStep{hex.EncodeToString(level[sibling]), sibling < position})
+		}
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{1}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level, position = next, position/2
+	}
+	return path
+}
+
+// prove an event's inclusion in its block
+func handleGetProof(w http.ResponseWriter, r *http.Request) {
+	eventHash := strings.ToLower(mux.Vars(r)["eventHash"])
+	mutex.Lock()
+	ref, ok := txIndex[eventHash]
+	if !ok || ref.index >= len(Blockchain) {
+		mutex.Unlock()
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	b := Blockchain[ref.index]
+	mutex.Unlock()
+	if ref.position >= len(b.Transactions) {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+
+	hashes := make([]string, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		hashes[i] = txHash(tx)
+	}
+	p := InclusionProof{
+		EventHash:   eventHash,
+		Transaction: b.Transactions[ref.position],
+		Position:    ref.position,
+		Count:       len(hashes),
+		Path:        merklePath(hashes, ref.position),
+	}
+	b.Transactions = nil
+	p.Header = writeReceipt(b)
+	respondWithJSON(w, r, http.StatusOK, p)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/repenno/blockchain/client"
+)
+
+func TestInclusionProofsVerifyWithTheClient(t *testing.T) {
+	router := newTestChain(t)
+	startTestMempool(t, "5")
+	events := make([]map[string]string, 5)
+	for i := range events {
+		events[i] = map[string]string{"event": "door opened", "location": "SJC", "server": "reader-" + string(rune('a'+i))}
+	}
+	receipts := writeBatch(t, router, events)
+
+	mutex.Lock()
+	b := *BlockMap[receipts[0].Hash]
+	mutex.Unlock()
+	if len(b.Transactions) != len(events) {
+		t.Fatalf("batch holds %d transactions", len(b.Transactions))
+	}
+	txs := make([]client.Transaction, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		txs[i] = client.Transaction(tx)
+	}
+	if root := client.TransactionsRoot(txs); root != b.MerkleRoot {
+		t.Fatalf("client computes root %s, the block has %s", root, b.MerkleRoot)
+	}
+
+	for i, tx := range b.Transactions {
+		var p client.Proof
+		if code := call(t, router, "GET", "/v2/proof/"+txHash(tx), nil, &p); code != http.StatusOK {
+			t.Fatalf("proof of transaction %d: status %d", i, code)
+		}
+		if p.Position != i || p.Count != len(events) {
+			t.Errorf("proof of transaction %d is at %d of %d", i, p.Position, p.Count)
+		}
+		if err := client.VerifyProof(p); err != nil {
+			t.Errorf("proof of transaction %d: %v", i, err)
+		}
+		if len(p.Path) > 0 {
+			p.Path[0].Left = !p.Path[0].Left
+			if client.VerifyProof(p) == nil {
+				t.Errorf("proof of transaction %d verifies with a wrong path", i)
+			}
+		}
+	}
+
+	if code := call(t, router, "GET", "/v2/proof/"+txHash(Transaction{Event: "never written"}), nil, nil); code != http.StatusNotFound {
+		t.Errorf("proof of an unknown event: status %d", code)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the networks (TRUSTED_PROXIES) whose X-Forwarded-For
+// and X-Real-IP headers are believed. "unix" trusts the UNIX_SOCKET listener.
+var trustedProxies []*net.IPNet
+var trustUnixProxy bool
+
+// basePath is the URL prefix (BASE_PATH) the proxy mounts the node under
+var basePath string
+
+// loadProxyConfig reads TRUSTED_PROXIES (IPs or CIDRs) and BASE_PATH
+func loadProxyConfig() error {
+	trustedProxies, trustUnixProxy = nil, false
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = hostLiteral(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "unix":
+			trustUnixProxy = true
+			continue
+		case !strings.Contains(entry, "/"):
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return errors.New("invalid TRUSTED_PROXIES entry " + entry)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	basePath = strings.TrimRight(os.Getenv("BASE_PATH"), "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		return errors.New("BASE_PATH must start with /")
+	}
+	if basePath != "" {
+		log.Println("serving under base path", basePath)
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether a connection's remote address is a proxy
+// we accept forwarding headers from
+func isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// Unix socket peers have no IP address
+		return trustUnixProxy && !strings.Contains(remoteAddr, ".") && !strings.Contains(remoteAddr, ":")
+	}
+	ip := net.ParseIP(host)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the real client. Behind trusted proxies it is
+// the right-most X-Forwarded-For entry that isn't itself a trusted proxy,
+// or X-Real-IP; otherwise the connection's remote address.
+func clientIP(r *http.Request) string {
+	if !isTrustedProxy(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := hopIP(hops[i])
+			if hop == "" {
+				continue
+			}
+			if i == 0 || !isTrustedProxy(net.JoinHostPort(hop, "0")) {
+				return hop
+			}
+		}
+	}
+	if ip := hopIP(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// stripBasePath serves next under basePath and 404s everything outside it
+func stripBasePath(next http.HandlerFunc) http.HandlerFunc {
+	if basePath == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if p != basePath && !strings.HasPrefix(p, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = strings.TrimPrefix(p, basePath)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+		r2.URL = &u
+		next(w, r2)
+	}
+}
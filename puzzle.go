@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Public nodes can make anonymous writes pay for themselves with a
+// hashcash-style puzzle. With WRITE_PUZZLE_BITS=n a write that is not device
+// signed, CMS signed or made with a verified client certificate must carry
+//
+//	Write-Puzzle: <challenge>:<nonce>
+//
+// where challenge comes from GET /puzzle and the SHA-256 of
+// "<challenge>:<nonce>:" followed by the request body starts with n zero
+// bits. Solving takes the client about 2^n hashes, checking takes the node
+// one. Challenges are signed with a key made at startup, expire after
+// writePuzzleTTL and are accepted once, so a solution can't be replayed.
+
+// how long a challenge can be solved for
+const writePuzzleTTL = 5 * time.Minute
+
+// more bits than this would take clients hours
+const maxWritePuzzleBits = 32
+
+var errPuzzleRequired = errors.New("anonymous writes need a solved Write-Puzzle header, see GET /puzzle")
+
+// Puzzle is the response of GET /puzzle
+type Puzzle struct {
+	Challenge string `json:"challenge"`
+	Bits      int    `json:"bits"`
+	Expires   string `json:"expires"`
+}
+
+var (
+	writePuzzleBits int
+	puzzleKey       = make([]byte, 32)
+	spentPuzzles    = make(map[string]time.Time) // challenge to expiry
+	puzzleMutex     = &sync.Mutex{}
+)
+
+// loadWritePuzzle reads WRITE_PUZZLE_BITS and makes the challenge key
+func loadWritePuzzle() error {
+	if _, err := rand.Read(puzzleKey); err != nil {
+		return err
+	}
+	apply, err := prepareWritePuzzle(map[string]string{"WRITE_PUZZLE_BITS": os.Getenv("WRITE_PUZZLE_BITS")})
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareWritePuzzle validates a reloaded WRITE_PUZZLE_BITS
+func prepareWritePuzzle(env map[string]string) (func(), error) {
+	n := 0
+	if v := env["WRITE_PUZZLE_BITS"]; v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 || n > maxWritePuzzleBits {
+			return nil, errors.New("WRITE_PUZZLE_BITS must be between 0 and " + strconv.Itoa(maxWritePuzzleBits))
+		}
+	}
+	return func() {
+		puzzleMutex.Lock()
+		writePuzzleBits = n
+		puzzleMutex.Unlock()
+		if n > 0 {
+			log.Println("anonymous writes need a puzzle of", n, "bits")
+		}
+	}, nil
+}
+
+// puzzleMAC signs the random part and expiry of a challenge
+func puzzleMAC(nonce, expires string) string {
+	mac := hmac.New(sha256.New, puzzleKey)
+	mac.Write([]byte(nonce + "." + expires))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// leadingZeroBits counts the zero bits a digest starts with
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// checkWritePuzzle requires a solved puzzle of anonymous writes
+func checkWritePuzzle(r *http.Request, body []byte, m CreateBlockReq) error {
+	puzzleMutex.Lock()
+	need := writePuzzleBits
+	puzzleMutex.Unlock()
+	if need == 0 || m.KeyID != "" || m.signerCert != "" || len(peerIdentities(r)) > 0 {
+		return nil
+	}
+
+	header := r.Header.Get("Write-Puzzle")
+	i := strings.LastIndex(header, ":")
+	if i < 0 {
+		return errPuzzleRequired
+	}
+	challenge := header[:i]
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(puzzleMAC(parts[0], parts[1])), []byte(parts[2])) {
+		return errors.New("Write-Puzzle challenge was not issued by this node")
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	expires := time.Unix(unix, 0)
+	if err != nil || time.Now().After(expires) {
+		return errors.New("Write-Puzzle challenge expired, get a new one")
+	}
+	h := sha256.New()
+	h.Write([]byte(header + ":"))
+	h.Write(body)
+	if leadingZeroBits(h.Sum(nil)) < need {
+		return errors.New("Write-Puzzle is not solved, the hash needs " + strconv.Itoa(need) + " leading zero bits")
+	}
+
+	puzzleMutex.Lock()
+	defer puzzleMutex.Unlock()
+	now := time.Now()
+	for c, exp := range spentPuzzles {
+		if now.After(exp) {
+			delete(spentPuzzles, c)
+		}
+	}
+	if _, spent := spentPuzzles[challenge]; spent {
+		return errors.New("Write-Puzzle challenge was already used")
+	}
+	spentPuzzles[challenge] = expires
+	return nil
+}
+
+// issue a challenge for an anonymous write
+func handleGetPuzzle(w http.ResponseWriter, r *http.Request) {
+	puzzleMutex.Lock()
+	need := writePuzzleBits
+	puzzleMutex.Unlock()
+	if need == 0 {
+		http.Error(w, "writes need no puzzle", http.StatusNotFound)
+		return
+	}
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce := hex.EncodeToString(raw)
+	expires := time.Now().Add(writePuzzleTTL).Truncate(time.Second)
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, r, http.StatusOK, Puzzle{nonce + "." + unix + "." + puzzleMAC(nonce, unix), need, expires.UTC().Format(time.RFC3339)})
+}
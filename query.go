@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// default and maximum page size for GET /blocks/latest
+const (
+	defaultLatestBlocks = 20
+	maxLatestBlocks     = 1000
+)
+
+// Get a specific Block by its position in the chain
+func handleGetBlockByIndex(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || n < 0 {
+		http.Error(w, "index must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if n > height {
+		mutex.Unlock()
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	block := Blockchain[n]
+	mutex.Unlock()
+
+	respondWithBlocks(w, r, http.StatusOK, block)
+}
+
+// beforeParam reads ?before=, the index a newest first page stops below.
+// Clients page back by passing the index of the last block they got.
+func beforeParam(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("before")
+	if v == "" {
+		return int(^uint(0) >> 1), nil
+	}
+	before, err := strconv.Atoi(v)
+	if err != nil || before < 0 {
+		return 0, errors.New("before must be a non-negative integer")
+	}
+	return before, nil
+}
+
+// Get the last n blocks (?n=, default 20) below ?before=, newest first
+func handleGetLatestBlocks(w http.ResponseWriter, r *http.Request) {
+	n := defaultLatestBlocks
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLatestBlocks {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxLatestBlocks), http.StatusBadRequest)
+			return
+		}
+	}
+	before, err := beforeParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if before <= height {
+		height = before - 1
+	}
+	if n > height+1 {
+		n = height + 1
+	}
+	latest := make([]Block, 0, n)
+	for i := height; i > height-n; i-- {
+		latest = append(latest, Blockchain[i])
+	}
+	mutex.Unlock()
+
+	respondWithBlocks(w, r, http.StatusOK, latest)
+}
+
+// BlockDelta answers GET /blocks/delta: the blocks after the caller's last
+// known position, or OnChain false when that position is no longer on the
+// chain (the node was rolled back or the caller followed a fork)
+type BlockDelta struct {
+	OnChain bool     `json:"on_chain"`
+	Reason  string   `json:"reason,omitempty"`
+	Head    BlockRef `json:"head"`
+	// the chain's block at last_index, when OnChain is false
+	Canonical *BlockRef `json:"canonical,omitempty"`
+	Blocks    []Block   `json:"blocks"`
+	// more blocks follow; ask again from the last one returned
+	More bool `json:"more"`
+}
+
+// Get the blocks after ?last_hash= (and ?last_index=, checked when given),
+// oldest first, at most ?n= of them. Without last_hash it starts at genesis.
+func handleGetBlockDelta(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n := maxLatestBlocks
+	if v := q.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLatestBlocks {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxLatestBlocks), http.StatusBadRequest)
+			return
+		}
+	}
+	lastHash := strings.ToLower(q.Get("last_hash"))
+	lastIndex := -1
+	if v := q.Get("last_index"); v != "" {
+		var err error
+		lastIndex, err = strconv.Atoi(v)
+		if err != nil || lastIndex < 0 {
+			http.Error(w, "last_index must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if lastHash == "" {
+			http.Error(w, "last_index needs last_hash", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	delta := BlockDelta{OnChain: true, Head: BlockRef{height, Blockchain[height].Hash}, Blocks: make([]Block, 0)}
+	from := 0
+	if lastHash != "" {
+		block, ok := BlockMap[lastHash]
+		switch {
+		case !ok || block.Index > height:
+			delta.OnChain, delta.Reason = false, "last_hash is not on the chain"
+		case lastIndex >= 0 && block.Index != lastIndex:
+			delta.OnChain, delta.Reason = false, "last_hash is block "+strconv.Itoa(block.Index)+", not "+strconv.Itoa(lastIndex)
+		default:
+			from = block.Index + 1
+		}
+		if !delta.OnChain && lastIndex > height {
+			delta.Reason = "the chain is shorter than last_index"
+		} else if !delta.OnChain && lastIndex >= 0 {
+			delta.Canonical = &BlockRef{lastIndex, Blockchain[lastIndex].Hash}
+		}
+	}
+	if delta.OnChain {
+		for i := from; i <= height && len(delta.Blocks) < n; i++ {
+			delta.Blocks = append(delta.Blocks, Blockchain[i])
+		}
+		delta.More = from+len(delta.Blocks) <= height
+	}
+	mutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusOK, delta)
+}
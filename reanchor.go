@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Re-anchoring moves the chain to a new hash algorithm without starting a
+// fresh chain. A transition block (Event "reanchor", Location the new
+// algorithm) is hashed with the old algorithm and carries in FileHash the
+// new-algorithm root of a manifest binding every earlier block's old hash to
+// a new digest. Every block after it is hashed with the new algorithm, and
+// those hashes are prefixed with the algorithm name ("sha512-256:..."), so
+// the algorithm of any block follows from its predecessor alone. Only a
+// transition the node recorded itself counts (see nodeMinted), a write
+// can't name the event.
+const reanchorEvent = "reanchor"
+
+// legacyHashAlgorithm is the original, unprefixed SHA-256 block hash
+const legacyHashAlgorithm = "sha256"
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	legacyHashAlgorithm: sha256.New,
+	"sha512-256":        sha512.New512_256,
+	"sha384":            sha512.New384,
+}
+
+// AnchorEntry binds one historical block's old hash to its new digest
+type AnchorEntry struct {
+	Index   int    `json:"index"`
+	OldHash string `json:"old_hash"`
+	NewHash string `json:"new_hash"`
+}
+
+// AnchorManifest is the full binding committed to by a transition block
+type AnchorManifest struct {
+	Transition BlockRef      `json:"transition"`
+	Algorithm  string        `json:"algorithm"`
+	Root       string        `json:"root"`
+	Valid      bool          `json:"valid"`
+	Entries    []AnchorEntry `json:"entries"`
+}
+
+// ReanchorReq asks the node to move to a new hash algorithm
+type ReanchorReq struct {
+	Algorithm string `json:"algorithm"`
+}
+
+// hashAlgorithmOf returns the algorithm a block hash was computed with
+func hashAlgorithmOf(blockHash string) string {
+	if i := strings.Index(blockHash, ":"); i > 0 {
+		return blockHash[:i]
+	}
+	return legacyHashAlgorithm
+}
+
+// nextHashAlgorithm is the algorithm for the block following prev
+func nextHashAlgorithm(prev Block) string {
+	if prev.Event == reanchorEvent && nodeMinted(prev) {
+		return prev.Location
+	}
+	return hashAlgorithmOf(prev.Hash)
+}
+
+// blockHasher is a hash state with scratch buffers, reused across blocks
+type blockHasher struct {
+	h      hash.Hash
+	record []byte
+	sum    []byte
+	out    []byte
+}
+
+// blockHashers pools a blockHasher per algorithm; every write and every
+// validation hashes blocks, so the hot path only allocates the result
+var blockHashers = func() map[string]*sync.Pool {
+	pools := make(map[string]*sync.Pool, len(hashAlgorithms))
+	for name, newHash := range hashAlgorithms {
+		newHash := newHash
+		pools[name] = &sync.Pool{New: func() interface{} {
+			return &blockHasher{h: newHash()}
+		}}
+	}
+	return pools
+}()
+
+// hashBlockWith hashes a block's record with the named algorithm. Only the
+// legacy algorithm produces unprefixed hashes.
+func hashBlockWith(block Block, algorithm string) string {
+	pool, ok := blockHashers[algorithm]
+	if !ok {
+		return ""
+	}
+	bh := pool.Get().(*blockHasher)
+	defer pool.Put(bh)
+
+	bh.record = appendBlockRecord(bh.record[:0], block)
+	bh.h.Reset()
+	bh.h.Write(bh.record)
+	bh.sum = bh.h.Sum(bh.sum[:0])
+
+	bh.out = bh.out[:0]
+	if algorithm != legacyHashAlgorithm {
+		bh.out = append(bh.out, algorithm...)
+		bh.out = append(bh.out, ':')
+	}
+	bh.out = hex.AppendEncode(bh.out, bh.sum)
+	return string(bh.out)
+}
+
+// hashFor computes the hash of block as the successor of prev
+func hashFor(block, prev Block) string {
+	return hashBlockWith(block, nextHashAlgorithm(prev))
+}
+
+// buildManifest digests blocks with algorithm. Each new digest covers the
+// block record and its old hash, so it binds both.
+func buildManifest(blocks []Block, algorithm string) ([]AnchorEntry, string) {
+	newHash := hashAlgorithms[algorithm]
+	root := newHash()
+	entries := make([]AnchorEntry, 0, len(blocks))
+	for _, b := range blocks {
+		h := newHash()
+		h.Write([]byte(blockRecord(b) + b.Hash))
+		digest := hex.EncodeToString(h.Sum(nil))
+		entries = append(entries, AnchorEntry{b.Index, b.Hash, digest})
+		root.Write([]byte(digest))
+	}
+	return entries, hex.EncodeToString(root.Sum(nil))
+}
+
+// reanchor appends a transition block to the new algorithm
+func reanchor(algorithm string) (Block, error) {
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return Block{}, errors.New("unknown hash algorithm " + algorithm)
+	}
+
+	if err := checkStandby(); err != nil {
+		return Block{}, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	head := Blockchain[len(Blockchain)-1]
+	if nextHashAlgorithm(head) == algorithm {
+		return Block{}, errors.New("chain already uses " + algorithm)
+	}
+	_, root := buildManifest(Blockchain, algorithm)
+	transition := generateBlock(head, "", root, reanchorEvent, time.Now().UTC().Format(time.RFC3339), algorithm, nodeID())
+	transition.Metadata = stampSystem(nil)
+	transition.Hash = hashFor(transition, head)
+	transition = mineBlock(transition, head)
+	if err := appendBlockLocked(transition); err != nil {
+		return Block{}, err
+	}
+	log.Printf("re-anchored chain to %s at block %d", algorithm, transition.Index)
+	return transition, nil
+}
+
+// move the chain to a new hash algorithm
+func handleReanchor(w http.ResponseWriter, r *http.Request) {
+	if poaEnabled() {
+		http.Error(w, "proof-of-authority mode: submit blocks through /proposals", http.StatusForbidden)
+		return
+	}
+	if raftEnabled() {
+		http.Error(w, "cluster mode: re-anchoring is not replicated through the Raft log", http.StatusForbidden)
+		return
+	}
+	var req ReanchorReq
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	b, err := reanchor(req.Algorithm)
+	if errors.Is(err, errStaleBlock) || errors.Is(err, errStandby) {
+		respondWithError(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	respondWithJSON(w, r, http.StatusCreated, b)
+}
+
+// recompute the manifest of the transition block at {index} and check it
+// against the root committed on-chain
+func handleGetAnchorManifest(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil || n < 0 {
+		http.Error(w, "index must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	if n >= len(Blockchain) || Blockchain[n].Event != reanchorEvent || !nodeMinted(Blockchain[n]) {
+		mutex.Unlock()
+		http.Error(w, "no transition block at this index", http.StatusNotFound)
+		return
+	}
+	transition := Blockchain[n]
+	history := Blockchain[:n]
+	mutex.Unlock()
+
+	if _, ok := hashAlgorithms[transition.Location]; !ok {
+		http.Error(w, "unknown hash algorithm "+transition.Location, http.StatusInternalServerError)
+		return
+	}
+	entries, root := buildManifest(history, transition.Location)
+	respondWithJSON(w, r, http.StatusOK, AnchorManifest{
+		Transition: BlockRef{transition.Index, transition.Hash},
+		Algorithm:  transition.Location,
+		Root:       root,
+		Valid:      root == transition.FileHash,
+		Entries:    entries,
+	})
+}
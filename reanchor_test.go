@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// hashedBlock is hashed over
+//
+//	"1" + Timestamp + FileHash + Event + EventTime + Location + Server + PrevHash
+var hashedBlock = Block{
+	Index:     1,
+	Timestamp: "2024-01-01T00:00:00Z",
+	FileHash:  "d41d8cd98f00b204e9800998ecf8427e",
+	Event:     "login failed",
+	EventTime: "2024-01-01T00:00:00Z",
+	Location:  "dc1",
+	Server:    "vpn-1",
+	PrevHash:  "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+}
+
+// The hashes of existing chains must not change with the hashing code.
+func TestBlockHashIsPinned(t *testing.T) {
+	for algorithm, want := range map[string]string{
+		"sha256":     "9c0e4de83fe31bdbbdd6138ad7b62ad4c4a3717dbb1ccc764b33777595c2c356",
+		"sha512-256": "sha512-256:c043fbbd080a5e69e7600cb4fe5e49c367f0626bc5c6f4bc3468dc2c7b2114ae",
+		"sha384":     "sha384:8836cefd6bbfa39f4e9ddf6504defcb5f1b8001a4e4332bbc36e5fa8de3b41ad06ecf2f36cbec87d7539e787ae85b282",
+	} {
+		// twice, the second time with a hasher back from the pool
+		for i := 0; i < 2; i++ {
+			if got := hashBlockWith(hashedBlock, algorithm); got != want {
+				t.Errorf("%s: got %s, want %s", algorithm, got, want)
+			}
+		}
+	}
+	if got := calculateHash(hashedBlock); got != hashBlockWith(hashedBlock, legacyHashAlgorithm) {
+		t.Errorf("calculateHash %s differs from the legacy algorithm", got)
+	}
+}
+
+// BenchmarkHashBlock compares the pooled hashers with hashing a freshly
+// built record string, as blocks were hashed before the pools
+func BenchmarkHashBlock(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			hashBlockWith(hashedBlock, legacyHashAlgorithm)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h := sha256.New()
+			h.Write([]byte(blockRecord(hashedBlock)))
+			hex.EncodeToString(h.Sum(nil))
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// RecordedRequest is one committed write captured to RECORD_FILE. The
+// cmd/replay tool sends these back to a fresh node to reproduce the chain.
+type RecordedRequest struct {
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Body      CreateBlockReq `json:"body"`
+	Timestamp string         `json:"timestamp"`
+	Hash      string         `json:"hash"`
+	// Metadata holds the unknown fields of the write, see decodeWrite
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+var recordFile *os.File
+var recordMutex = &sync.Mutex{}
+
+// openRecorder starts appending committed writes to RECORD_FILE, if set
+func openRecorder() error {
+	path := os.Getenv("RECORD_FILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	recordFile = f
+	log.Println("recording writes to", path)
+	return nil
+}
+
+// recordWrite appends a committed write as one JSON line. Writes are always
+// recorded as POST /block, which is how cmd/replay re-submits them.
+func recordWrite(m CreateBlockReq, b Block) {
+	if recordFile == nil {
+		return
+	}
+	line, err := json.Marshal(RecordedRequest{"POST", "/block", m, b.Timestamp, b.Hash, b.Metadata})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+	if _, err := recordFile.Write(append(line, '\n')); err != nil {
+		log.Println("recording write failed:", err)
+	}
+}
+
+// replayTimestamp returns the X-Replay-Timestamp header when the node runs
+// with REPLAY_MODE=true, so replayed writes hash exactly like the originals.
+// It is ignored otherwise; clients must never choose block timestamps.
+func replayTimestamp(r *http.Request) string {
+	if os.Getenv("REPLAY_MODE") != "true" {
+		return ""
+	}
+	return r.Header.Get("X-Replay-Timestamp")
+}
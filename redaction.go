@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// POST /redactions/preview simulates a redaction or retention policy and
+// reports exactly which blocks and fields it would touch. Nothing is
+// changed: redaction is irreversible, so operators review the impact first.
+
+// RedactionPolicy selects blocks with a stream style Filter
+// ("Event=login,Server~vpn") and/or by age, and names the Fields to clear.
+// Without Fields the whole block body is in scope, as retention would drop.
+// KeepEpochs limits the policy to closed epochs (see epochs.go) before the
+// last KeepEpochs ones.
+type RedactionPolicy struct {
+	Filter     string   `json:"filter"`
+	OlderThan  string   `json:"older_than"`
+	Fields     []string `json:"fields"`
+	KeepEpochs int      `json:"keep_epochs,omitempty"`
+}
+
+// RedactedBlock is one block a policy would touch
+type RedactedBlock struct {
+	Index  int      `json:"index"`
+	Hash   string   `json:"hash"`
+	Fields []string `json:"fields"`
+}
+
+// RedactionImpact is the response of POST /redactions/preview
+type RedactionImpact struct {
+	Through int `json:"through"`
+	Blocks  int `json:"blocks"`
+	// Values counts the non-empty values that would be cleared, per field
+	Values map[string]int `json:"values"`
+	// Affected lists the blocks, up to maxRedactionPreview of them
+	Affected  []RedactedBlock `json:"affected"`
+	Truncated bool            `json:"truncated"`
+}
+
+// most affected blocks listed in one preview
+const maxRedactionPreview = 1000
+
+// fields a policy may clear; the chain structure itself is never redactable
+var redactableFields = []string{"FileHash", "Event", "EventTime", "Location", "Server", "DeviceKey", "DeviceHMAC", "Metadata"}
+
+// report the blocks and fields a redaction policy would affect
+func handlePreviewRedaction(w http.ResponseWriter, r *http.Request) {
+	var p RedactionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	filters, err := parseStreamFilter(p.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cutoff time.Time
+	if p.OlderThan != "" {
+		age, err := time.ParseDuration(p.OlderThan)
+		if err != nil || age < 0 {
+			http.Error(w, "OlderThan must be a duration like 720h", http.StatusBadRequest)
+			return
+		}
+		cutoff = time.Now().Add(-age)
+	}
+	fields := p.Fields
+	if len(fields) == 0 {
+		fields = redactableFields
+	}
+	for _, f := range fields {
+		if !isRedactableField(f) {
+			http.Error(w, "field "+f+" cannot be redacted, use one of "+strings.Join(redactableFields, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if p.KeepEpochs < 0 {
+		http.Error(w, "KeepEpochs must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	through := len(Blockchain) - 1
+	if p.KeepEpochs > 0 {
+		epochs := epochsLocked()
+		through = 0
+		if len(epochs) > p.KeepEpochs {
+			through = epochs[len(epochs)-p.KeepEpochs-1].Last
+		}
+	}
+	impact := previewRedactionLocked(filters, cutoff, fields, through)
+	mutex.Unlock()
+	respondWithJSON(w, r, http.StatusOK, impact)
+}
+
+// previewRedactionLocked applies the policy to every block but genesis, up
+// to through.
+// Blocks whose Timestamp doesn't parse never match an age limit. Caller
+// must hold mutex.
+func previewRedactionLocked(filters []streamFilter, cutoff time.Time, fields []string, through int) RedactionImpact {
+	impact := RedactionImpact{Through: through, Values: make(map[string]int), Affected: make([]RedactedBlock, 0)}
+	for _, b := range Blockchain[1 : through+1] {
+		if !cutoff.IsZero() {
+			t, ok := parseBlockTime(b.Timestamp)
+			if !ok || !t.Before(cutoff) {
+				continue
+			}
+		}
+		if !streamMatches(b, filters) {
+			continue
+		}
+		values := blockFields(b, fields)
+		var touched []string
+		for _, f := range fields {
+			if !isEmptyValue(reflect.ValueOf(values[f])) {
+				touched = append(touched, f)
+				impact.Values[f]++
+			}
+		}
+		if len(touched) == 0 {
+			continue
+		}
+		impact.Blocks++
+		if len(impact.Affected) < maxRedactionPreview {
+			impact.Affected = append(impact.Affected, RedactedBlock{b.Index, b.Hash, touched})
+		} else {
+			impact.Truncated = true
+		}
+	}
+	return impact
+}
+
+func isRedactableField(f string) bool {
+	for _, name := range redactableFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
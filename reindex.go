@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Secondary indexes are derived from the blocks and can always be rebuilt
+// from them: after index corruption, or when a new index type is added. The
+// reindex subcommand does it offline, POST /reindex on a running node.
+
+// secondaryIndex rebuilds one index from Blockchain and returns how many
+// entries it now holds. Register new index types in secondaryIndexes.
+type secondaryIndex struct {
+	name    string
+	rebuild func() (int, error)
+}
+
+var secondaryIndexes = []secondaryIndex{
+	{"storage", rebuildStorageIndexLocked},
+	{"hashes", rebuildBlockMapLocked},
+	{"stats", rebuildStatsLocked},
+	{"cache", purgeBlockCache},
+	{"sources", rebuildSourcesLocked},
+	{"sizes", rebuildSizesLocked},
+	{"sites", rebuildSitesLocked},
+	{"minters", rebuildMintersLocked},
+	{"search", rebuildSearchLocked},
+	{"transactions", rebuildTransactionsLocked},
+}
+
+// ReindexResult reports one rebuilt index
+type ReindexResult struct {
+	Index    string `json:"index"`
+	Entries  int    `json:"entries"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// storeReindexer is implemented by stores that keep an index of their own
+type storeReindexer interface {
+	// Reindex rebuilds the index from the block records and returns the
+	// number of blocks indexed
+	Reindex() (int, error)
+}
+
+// reindexLocked rebuilds every secondary index, carrying on past failures.
+// Caller must hold mutex.
+func reindexLocked() []ReindexResult {
+	results := make([]ReindexResult, 0, len(secondaryIndexes))
+	for _, idx := range secondaryIndexes {
+		start := time.Now()
+		n, err := idx.rebuild()
+		res := ReindexResult{Index: idx.name, Entries: n, Duration: time.Since(start).String()}
+		if err != nil {
+			res.Error = err.Error()
+			log.Printf("rebuilding %s index failed: %v", idx.name, err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// rebuildStorageIndexLocked rebuilds the store's own index, if it has one
+func rebuildStorageIndexLocked() (int, error) {
+	if s, ok := store.(storeReindexer); ok {
+		return s.Reindex()
+	}
+	return 0, nil
+}
+
+// rebuildBlockMapLocked recreates the hash lookup table
+func rebuildBlockMapLocked() (int, error) {
+	BlockMap = make(map[string]*Block, len(Blockchain))
+	for i := range Blockchain {
+		BlockMap[Blockchain[i].Hash] = &Blockchain[i]
+	}
+	return len(BlockMap), nil
+}
+
+// rebuildStatsLocked recomputes the per-day aggregates and saves them
+func rebuildStatsLocked() (int, error) {
+	chainStats.Through = 0
+	chainStats.Periods = make(map[string]*PeriodStats)
+	for _, b := range Blockchain {
+		foldStatsLocked(b)
+	}
+	return len(chainStats.Periods), saveStatsLocked()
+}
+
+// purgeBlockCache drops every cached representation; they refill on demand
+func purgeBlockCache() (int, error) {
+	cachedBlocks.mutex.Lock()
+	defer cachedBlocks.mutex.Unlock()
+	n := len(cachedBlocks.entries)
+	cachedBlocks.entries = make(map[string]*list.Element)
+	cachedBlocks.order.Init()
+	return n, nil
+}
+
+// rebuild every secondary index from the chain
+func handleReindex(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	results := reindexLocked()
+	mutex.Unlock()
+
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			code = http.StatusInternalServerError
+		}
+	}
+	respondWithJSON(w, r, code, results)
+}
+
+// runReindexCommand implements `go run *.go reindex`. Stop the node first,
+// or use POST /reindex while it runs.
+func runReindexCommand(args []string) {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	fs.Parse(args)
+
+	if os.Getenv("DATA_DIR") == "" {
+		log.Fatal("DATA_DIR is not set, there are no persisted indexes")
+	}
+	BlockMap = make(map[string]*Block)
+	if err := openStore(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadChain(); err != nil {
+		log.Fatal(err)
+	}
+
+	mutex.Lock()
+	results := reindexLocked()
+	mutex.Unlock()
+	store.Close()
+	failed := false
+	for _, res := range results {
+		status := "ok"
+		if res.Error != "" {
+			status, failed = res.Error, true
+		}
+		fmt.Printf("%-8s %8d entries  %-12s %s\n", res.Index, res.Entries, res.Duration, status)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rejection is a write the node refused, kept so operators can see why and
+// re-submit it once the payload is fixed
+type Rejection struct {
+	ID          int             `json:"id"`
+	Time        string          `json:"time"`
+	Client      string          `json:"client"`
+	Path        string          `json:"path"`
+	Reason      string          `json:"reason"`
+	Digest      string          `json:"digest"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Resubmitted string          `json:"resubmitted,omitempty"`
+}
+
+// number of rejections kept, oldest are dropped first
+const maxRejections = 1000
+
+// largest payload kept for re-submission; bigger ones only keep their digest
+const maxRejectedPayload = 64 << 10
+
+var rejections []*Rejection
+var nextRejectionID = 1
+var rejectionMutex = &sync.Mutex{}
+
+// recordRejection adds a refused write to the dead-letter queue
+func recordRejection(r *http.Request, payload []byte, reason string) {
+	observeRejection()
+	sum := sha256.Sum256(payload)
+	rej := &Rejection{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Client: clientIP(r),
+		Path:   r.URL.Path,
+		Reason: reason,
+		Digest: hex.EncodeToString(sum[:]),
+	}
+	if id, ok := peerIdentity(r); ok {
+		rej.Client = id
+	}
+	if len(payload) <= maxRejectedPayload && json.Valid(payload) {
+		rej.Payload = payload
+	}
+
+	rejectionMutex.Lock()
+	defer rejectionMutex.Unlock()
+	rej.ID = nextRejectionID
+	nextRejectionID++
+	rejections = append(rejections, rej)
+	if len(rejections) > maxRejections {
+		rejections = rejections[len(rejections)-maxRejections:]
+	}
+}
+
+func findRejection(id string) *Rejection {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil
+	}
+	for _, rej := range rejections {
+		if rej.ID == n {
+			return rej
+		}
+	}
+	return nil
+}
+
+// list recent rejections, newest first, without their payloads
+func handleGetRejected(w http.ResponseWriter, r *http.Request) {
+	rejectionMutex.Lock()
+	list := make([]Rejection, 0, len(rejections))
+	for i := len(rejections) - 1; i >= 0; i-- {
+		rej := *rejections[i]
+		rej.Payload = nil
+		list = append(list, rej)
+	}
+	rejectionMutex.Unlock()
+
+	respondWithList(w, r, http.StatusOK, list)
+}
+
+func handleGetRejection(w http.ResponseWriter, r *http.Request) {
+	rejectionMutex.Lock()
+	defer rejectionMutex.Unlock()
+
+	rej := findRejection(mux.Vars(r)["id"])
+	if rej == nil {
+		http.Error(w, "rejection not found", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, rej)
+}
+
+// re-submit a rejected write. The body is the corrected CreateBlockReq; an
+// empty body re-submits the original payload unchanged.
+func handleResubmitRejection(w http.ResponseWriter, r *http.Request) {
+	if poaEnabled() {
+		http.Error(w, "proof-of-authority mode: submit blocks through /proposals", http.StatusForbidden)
+		return
+	}
+
+	rejectionMutex.Lock()
+	rej := findRejection(mux.Vars(r)["id"])
+	var original json.RawMessage
+	resubmitted := ""
+	if rej != nil {
+		original, resubmitted = rej.Payload, rej.Resubmitted
+	}
+	rejectionMutex.Unlock()
+	if rej == nil {
+		http.Error(w, "rejection not found", http.StatusNotFound)
+		return
+	}
+	if resubmitted != "" {
+		http.Error(w, "already re-submitted as block "+resubmitted, http.StatusConflict)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := decodeWrite(body)
+	if err == errMetadataTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		if original == nil {
+			http.Error(w, "original payload was not kept, send the corrected payload", http.StatusBadRequest)
+			return
+		}
+		if m, err = decodeWrite(original); err != nil {
+			http.Error(w, "original payload is still invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(m.Event) == 0 {
+		http.Error(w, "Event is required", http.StatusBadRequest)
+		return
+	}
+	if err := checkReservedEvent(m); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	// the original was signed long ago, only its MAC is checked
+	if err := verifyDeviceHMAC(m, false); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := verifyRegisteredDevice(m); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := authorizeBackfill(r, &m); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := verifyEventTime(m); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := verifySite(m); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if m, err = checkFileHash(m); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	m = enrichEvent(m)
+
+	b, err := addBlock(m, "")
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	recordWrite(m, b)
+
+	rejectionMutex.Lock()
+	rej.Resubmitted = b.Hash
+	rejectionMutex.Unlock()
+	respondWithReceipt(w, r, http.StatusCreated, b)
+}
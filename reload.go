@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/joho/godotenv"
+)
+
+const configFile = ".env"
+
+// reloader validates a candidate configuration and returns a function that
+// applies it. Nothing is applied unless every reloader accepts the new file.
+type reloader struct {
+	name    string
+	prepare func(env map[string]string) (apply func(), err error)
+}
+
+var reloaders = []reloader{
+	{"validators", prepareValidators},
+	{"device keys", prepareDeviceKeys},
+	{"freeze windows", prepareFreezeWindows},
+	{"admin keys", prepareAdminKeys},
+	{"event time window", prepareEventTimeWindow},
+	{"cms trust", prepareCMSTrust},
+	{"sites", prepareSites},
+	{"enrichment", prepareEnrichment},
+	{"known hashes", prepareKnownHashes},
+	{"write puzzle", prepareWritePuzzle},
+	{"proof of work", prepareProofOfWork},
+	{"sinks", prepareSinks},
+	{"limits", prepareLimits},
+}
+
+// restartKeys cannot change at runtime; edits to them are reported and ignored.
+// ALLOWED_CLIENT_IDS and ADMIN_CLIENT_IDS are deliberately write-once. PEERS
+// and PEER_PINS feed the per peer senders, the TLS client auth mode and the
+// standby and cluster checks made at startup.
+var restartKeys = []string{
+	"PORT", "LISTEN_ADDR", "UNIX_SOCKET", "TRUSTED_PROXIES", "BASE_PATH",
+	"ADMIN_PORT", "ADMIN_ADDR", "ADMIN_TOKEN", "AGGREGATE_PORT", "AGGREGATE_ADDR",
+	"DATA_DIR", "CONSENSUS", "RECORD_FILE", "GENESIS_TIMESTAMP",
+	"TLS_CERT_FILE", "TLS_KEY_FILE", "ACME_HOSTS", "ACME_CACHE_DIR", "ACME_HTTP_ADDR", "TLS_CLIENT_CA_FILE", "ALLOWED_CLIENT_IDS", "ADMIN_CLIENT_IDS",
+	"NODE_KEY", "PKCS11_MODULE", "PKCS11_TOKEN", "PKCS11_PIN",
+	"AUDIT_DIR", "AUDIT_CHAIN",
+	"REQUEST_DEADLINE_DEVICE", "REQUEST_DEADLINE_INTERACTIVE", "REQUEST_DEADLINE_BULK",
+	"STORAGE", "STORAGE_MASTER_KEY", "STORAGE_OLD_MASTER_KEYS", "GROUP_COMMIT_WINDOW", "MEMPOOL_INTERVAL", "MEMPOOL_MAX_EVENTS", "STORAGE_MIN_FREE_MB", "STORAGE_RESUME_FREE_MB",
+	"METRICS_STATSD", "METRICS_GRAPHITE", "METRICS_PREFIX", "METRICS_INTERVAL",
+	"EPOCH_INTERVAL", "FAULT_INJECTION",
+	"SECRETS_SOURCE", "SECRETS_REFRESH", "VAULT_ADDR",
+	"PEERS", "PEER_PINS", "STANDBY_PRIMARY", "STANDBY_INTERVAL",
+	"RAFT_ADDR", "RAFT_BIND", "RAFT_DIR", "RAFT_BOOTSTRAP",
+}
+
+func isRestartKey(key string) bool {
+	for _, k := range restartKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+var reloadMutex = &sync.Mutex{}
+
+// configKeys are the keys the config file set when it was last loaded,
+// guarded by reloadMutex. A reload unsets the ones the file no longer has.
+var configKeys = make(map[string]bool)
+
+// loadConfigFile sets the keys of the config file the environment doesn't
+// already set, like godotenv.Load, and remembers them
+func loadConfigFile() error {
+	env, err := godotenv.Read(configFile)
+	if err != nil {
+		return err
+	}
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	for key, value := range env {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		os.Setenv(key, value)
+		configKeys[key] = true
+	}
+	return nil
+}
+
+// watchConfig reloads the config file whenever it changes (CONFIG_WATCH=true)
+func watchConfig() error {
+	if os.Getenv("CONFIG_WATCH") != "true" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// watch the directory, editors often replace the file instead of writing it
+	path, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	log.Println("watching", path, "for configuration changes")
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					debounce = time.After(250 * time.Millisecond)
+				}
+			case <-debounce:
+				if err := reloadConfig(); err != nil {
+					log.Println("config reload rejected, keeping previous configuration:", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("config watcher:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadConfig re-reads the config file and applies it all-or-nothing
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	env, err := godotenv.Read(configFile)
+	if err != nil {
+		return err
+	}
+	fileKeys := make(map[string]bool, len(env))
+	for key := range env {
+		fileKeys[key] = true
+	}
+	overlaySecrets(env)
+	var removed []string
+	for key := range configKeys {
+		if _, ok := env[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	if err := applyConfigLocked(env, removed); err != nil {
+		return err
+	}
+	configKeys = fileKeys
+	log.Println("configuration reloaded from", configFile)
+	return nil
+}
+
+// applyConfigLocked validates env and applies it all-or-nothing, unsetting
+// the keys in removed. Caller must hold reloadMutex.
+func applyConfigLocked(env map[string]string, removed []string) error {
+	for _, key := range restartKeys {
+		if env[key] != os.Getenv(key) {
+			log.Printf("config reload: %s changed, restart required to apply it", key)
+			env[key] = os.Getenv(key)
+		}
+	}
+
+	// validate everything before touching the running configuration
+	var applies []func()
+	for _, r := range reloaders {
+		apply, err := r.prepare(env)
+		if err != nil {
+			return fmt.Errorf("%s: %v", r.name, err)
+		}
+		applies = append(applies, apply)
+	}
+
+	for _, key := range removed {
+		if !isRestartKey(key) {
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadUnsetsRemovedKeys(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, key := range []string{"AGGREGATE_MIN_COUNT", "EPOCH_INTERVAL", "PEER_PINS"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	configKeys = make(map[string]bool)
+
+	if err := ioutil.WriteFile(configFile, []byte("AGGREGATE_MIN_COUNT=5\nEPOCH_INTERVAL=1h\nPEER_PINS=3f2a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("AGGREGATE_MIN_COUNT") != "5" {
+		t.Fatalf("AGGREGATE_MIN_COUNT is %q after loading", os.Getenv("AGGREGATE_MIN_COUNT"))
+	}
+
+	if err := ioutil.WriteFile(configFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if v, set := os.LookupEnv("AGGREGATE_MIN_COUNT"); set {
+		t.Errorf("AGGREGATE_MIN_COUNT is still %q after it was removed", v)
+	}
+	if os.Getenv("EPOCH_INTERVAL") != "1h" {
+		t.Errorf("restart key EPOCH_INTERVAL changed to %q without a restart", os.Getenv("EPOCH_INTERVAL"))
+	}
+	if os.Getenv("PEER_PINS") != "3f2a" {
+		t.Errorf("restart key PEER_PINS changed to %q without a restart", os.Getenv("PEER_PINS"))
+	}
+}
+
+func TestReloadLimits(t *testing.T) {
+	t.Cleanup(func() { globalLimiter.setLimits(0, 0, [numPriorities]time.Duration{}) })
+	apply, err := prepareLimits(map[string]string{"LIMIT_GLOBAL": "1", "LIMIT_QUEUE_TIMEOUT": "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply()
+	if !globalLimiter.acquire(context.Background(), priorityInteractive) {
+		t.Fatal("no slot under a limit of 1")
+	}
+
+	// a request queued behind the old limit gets a slot when it is raised
+	granted := make(chan bool)
+	go func() { granted <- globalLimiter.acquire(context.Background(), priorityInteractive) }()
+	for globalLimiter.stats().Classes[priorityInteractive].Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	apply, err = prepareLimits(map[string]string{"LIMIT_GLOBAL": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply()
+	if !<-granted {
+		t.Error("the queued request was shed after the limit was raised")
+	}
+	if s := globalLimiter.stats(); s.Limit != 2 || s.InFlight != 2 {
+		t.Errorf("after the reload: limit %d, %d in flight", s.Limit, s.InFlight)
+	}
+	globalLimiter.release(priorityInteractive)
+	globalLimiter.release(priorityInteractive)
+
+	if _, err := prepareLimits(map[string]string{"LIMIT_GLOBAL": "-1"}); err == nil {
+		t.Error("a negative limit was accepted")
+	}
+}
+
+func TestReloadSinks(t *testing.T) {
+	router := newTestChain(t)
+	received := make(chan []SinkRecord, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var records []SinkRecord
+		json.NewDecoder(r.Body).Decode(&records)
+		received <- records
+	}))
+	defer hook.Close()
+	reload := func(env map[string]string) {
+		t.Helper()
+		apply, err := prepareSinks(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apply()
+	}
+	t.Cleanup(func() { reload(map[string]string{}) })
+
+	reload(map[string]string{"SINKS": "webhook:" + hook.URL})
+	sinkMutex.Lock()
+	first := sinks[0]
+	sinkMutex.Unlock()
+	write := CreateBlockReq{Event: "login", EventTime: "2024-01-01T00:00:00Z", Server: "s1"}
+	if code := call(t, router, "POST", "/block", write, nil); code != http.StatusCreated {
+		t.Fatalf("write: status %d", code)
+	}
+	select {
+	case records := <-received:
+		if len(records) != 1 || records[0].Event != "login" {
+			t.Errorf("the added sink got %+v", records)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the added sink got nothing")
+	}
+
+	reload(map[string]string{"SINKS": "webhook:" + hook.URL, "SINK_FILTER_WEBHOOK": "Event=logout"})
+	sinkMutex.Lock()
+	kept := len(sinks) == 1 && sinks[0] == first
+	sinkMutex.Unlock()
+	if !kept {
+		t.Error("an unchanged sink was restarted by the reload")
+	}
+
+	reload(map[string]string{})
+	select {
+	case <-first.stop:
+	default:
+		t.Error("a removed sink was not stopped")
+	}
+	if _, err := prepareSinks(map[string]string{"SINKS": "carrier-pigeon:https://example.org"}); err == nil {
+		t.Error("an unknown sink type was accepted")
+	}
+}
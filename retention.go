@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Retention policies say how long blocks of an Event and/or severity (see
+// enrich.go) must be kept. Policies are defined on-chain: POST
+// /retention/policies appends a "retention-policy" block with the policy as
+// Metadata and its name as Location, the latest block for a name wins and
+// DELETE records the policy as retired.
+//
+// Every RETENTION_INTERVAL (default 24h), or on POST /retention/run, each
+// policy is enforced on the blocks committed since its last run that are now
+// older than OlderThan. The run makes sure they are archived (when ARCHIVE
+// is set) and appends a "retention-run" block whose FileHash is the SHA-256
+// of their hashes in order, Metadata its RetentionRun. Blocks stay linked in
+// the chain, so storage may drop their bodies only once a run recorded them;
+// the run block is the audit trail of what was due and when.
+const (
+	retentionPolicyEvent = "retention-policy"
+	retentionRunEvent    = "retention-run"
+)
+
+// RetentionPolicy selects blocks by Event and Severity, empty for any, that
+// are older than OlderThan
+type RetentionPolicy struct {
+	Name      string `json:"name"`
+	Event     string `json:"event,omitempty"`
+	Severity  string `json:"severity,omitempty"`
+	OlderThan string `json:"older_than"`
+	Retired   bool   `json:"retired,omitempty"`
+	// Index is the block that defined the policy
+	Index int `json:"index"`
+}
+
+// RetentionRun is one enforcement of a policy on blocks First to Last, all
+// of its blocks up to Through. Blocks counts the blocks that matched.
+type RetentionRun struct {
+	Index       int    `json:"index"`
+	Policy      string `json:"policy"`
+	PolicyIndex int    `json:"policy_index"`
+	Cutoff      string `json:"cutoff"`
+	Through     int    `json:"through"`
+	Blocks      int    `json:"blocks"`
+	First       int    `json:"first"`
+	Last        int    `json:"last"`
+	Digest      string `json:"digest"`
+	Archived    bool   `json:"archived"`
+}
+
+var retentionNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// the audit trail is never subject to a policy
+func isRetentionRecord(b Block) bool {
+	return (b.Event == retentionPolicyEvent || b.Event == retentionRunEvent) && nodeMinted(b)
+}
+
+// policyCovers reports whether p selects b. A batch block is only due when
+// the policy selects every one of its events.
+func policyCovers(p RetentionPolicy, b Block) bool {
+	for _, tx := range eventsOf(b) {
+		if (p.Event != "" && tx.Event != p.Event) || (p.Severity != "" && severityOf(eventBlock(b, tx)) != p.Severity) {
+			return false
+		}
+	}
+	return true
+}
+
+// startRetention enforces the policies every RETENTION_INTERVAL. With
+// CONSENSUS=poa policies and runs would bypass the quorum, so there are none.
+func startRetention() error {
+	if poaEnabled() {
+		if os.Getenv("RETENTION_INTERVAL") != "" {
+			return errors.New("RETENTION_INTERVAL is not supported with CONSENSUS=poa, retention records would bypass the quorum")
+		}
+		return nil
+	}
+	interval := 24 * time.Hour
+	if v := os.Getenv("RETENTION_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return errors.New("RETENTION_INTERVAL must be a positive duration")
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, err := enforceRetention(); err != nil {
+				log.Println("enforcing retention failed:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// retentionPolicyOf decodes a policy block
+func retentionPolicyOf(b Block) (RetentionPolicy, bool) {
+	var p RetentionPolicy
+	if b.Event != retentionPolicyEvent || !nodeMinted(b) || json.Unmarshal(b.Metadata, &p) != nil || p.Name != b.Location {
+		return RetentionPolicy{}, false
+	}
+	p.Index = b.Index
+	return p, true
+}
+
+// retentionRunOf decodes a run block
+func retentionRunOf(b Block) (RetentionRun, bool) {
+	var run RetentionRun
+	if b.Event != retentionRunEvent || !nodeMinted(b) || json.Unmarshal(b.Metadata, &run) != nil || run.Policy != b.Location {
+		return RetentionRun{}, false
+	}
+	run.Index = b.Index
+	return run, true
+}
+
+// retentionPoliciesLocked returns the current policies, retired ones only
+// with retired set. Caller must hold mutex.
+func retentionPoliciesLocked(retired bool) []RetentionPolicy {
+	latest := make(map[string]RetentionPolicy)
+	for _, b := range Blockchain {
+		if p, ok := retentionPolicyOf(b); ok {
+			latest[p.Name] = p
+		}
+	}
+	policies := make([]RetentionPolicy, 0, len(latest))
+	for _, p := range latest {
+		if retired || !p.Retired {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
+
+// lastRetentionRunsLocked maps each policy name to the Through of its last
+// run. Caller must hold mutex.
+func lastRetentionRunsLocked() map[string]int {
+	through := make(map[string]int)
+	for _, b := range Blockchain {
+		if run, ok := retentionRunOf(b); ok {
+			through[run.Policy] = run.Through
+		}
+	}
+	return through
+}
+
+// dueBlocksLocked applies p to the blocks after from that are older than
+// cutoff. Blocks are committed in order, so the scan stops at the first one
+// that isn't. Caller must hold mutex.
+func dueBlocksLocked(p RetentionPolicy, from int, cutoff time.Time) RetentionRun {
+	run := RetentionRun{Policy: p.Name, PolicyIndex: p.Index, Cutoff: cutoff.UTC().Format(time.RFC3339Nano), Through: from - 1, First: -1, Last: -1}
+	digest := sha256.New()
+	for _, b := range Blockchain[from:] {
+		t, ok := parseBlockTime(b.Timestamp)
+		if !ok || !t.Before(cutoff) {
+			break
+		}
+		run.Through = b.Index
+		if isRetentionRecord(b) || !policyCovers(p, b) {
+			continue
+		}
+		if run.First < 0 {
+			run.First = b.Index
+		}
+		run.Last = b.Index
+		run.Blocks++
+		digest.Write([]byte(b.Hash))
+	}
+	run.Digest = hex.EncodeToString(digest.Sum(nil))
+	return run
+}
+
+// enforceRetention runs every current policy and returns the runs it
+// recorded. A policy with no blocks due records nothing.
+func enforceRetention() ([]RetentionRun, error) {
+	now := time.Now()
+	mutex.Lock()
+	policies := retentionPoliciesLocked(false)
+	last := lastRetentionRunsLocked()
+	mutex.Unlock()
+
+	runs := make([]RetentionRun, 0)
+	for _, p := range policies {
+		age, err := time.ParseDuration(p.OlderThan)
+		if err != nil {
+			log.Printf("retention policy %s has an invalid older_than %q", p.Name, p.OlderThan)
+			continue
+		}
+		from := 1
+		if through, ok := last[p.Name]; ok {
+			from = through + 1
+		}
+
+		mutex.Lock()
+		run := dueBlocksLocked(p, from, now.Add(-age))
+		mutex.Unlock()
+		if run.Blocks == 0 {
+			continue
+		}
+
+		if run.Archived, err = archiveThrough(run.Last); err != nil {
+			return runs, err
+		}
+		metadata, err := json.Marshal(run)
+		if err != nil {
+			return runs, err
+		}
+		b, err := addBlock(CreateBlockReq{
+			FileHash:  run.Digest,
+			Event:     retentionRunEvent,
+			EventTime: now.UTC().Format(time.RFC3339),
+			Location:  p.Name,
+			Server:    nodeID(),
+			metadata:  metadata,
+			system:    true,
+		}, "")
+		if err != nil {
+			return runs, err
+		}
+		run.Index = b.Index
+		log.Printf("retention policy %s: %d blocks due up to block %d, recorded in block %d", p.Name, run.Blocks, run.Last, b.Index)
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// archiveThrough makes sure the archive covers block last, archiving
+// pending blocks if it doesn't. It reports false when archiving is off.
+func archiveThrough(last int) (bool, error) {
+	if archiver == nil {
+		return false, nil
+	}
+	mutex.Lock()
+	covered := nextArchiveIndexLocked() > last
+	mutex.Unlock()
+	if covered {
+		return true, nil
+	}
+	if err := archivePending(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// list the current policies, ?retired=true includes retired ones
+func handleGetRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	policies := retentionPoliciesLocked(r.URL.Query().Get("retired") == "true")
+	mutex.Unlock()
+	respondWithList(w, r, http.StatusOK, policies)
+}
+
+// define or replace a policy by recording it on-chain
+func handleSetRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	var p RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !retentionNameRe.MatchString(p.Name) {
+		http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if age, err := time.ParseDuration(p.OlderThan); err != nil || age <= 0 {
+		http.Error(w, "older_than must be a duration like 720h", http.StatusBadRequest)
+		return
+	}
+	p.Retired = false
+	recordRetentionPolicy(w, r, p, http.StatusCreated)
+}
+
+// retire a policy by recording it on-chain
+func handleRetireRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	mutex.Lock()
+	var p RetentionPolicy
+	found := false
+	for _, current := range retentionPoliciesLocked(false) {
+		if current.Name == name {
+			p, found = current, true
+		}
+	}
+	mutex.Unlock()
+	if !found {
+		http.Error(w, "no retention policy "+name, http.StatusNotFound)
+		return
+	}
+	p.Retired = true
+	recordRetentionPolicy(w, r, p, http.StatusOK)
+}
+
+func recordRetentionPolicy(w http.ResponseWriter, r *http.Request, p RetentionPolicy, status int) {
+	if poaEnabled() {
+		http.Error(w, "proof-of-authority mode: retention policies are not supported", http.StatusForbidden)
+		return
+	}
+	p.Index = 0
+	metadata, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := addBlock(CreateBlockReq{
+		Event:     retentionPolicyEvent,
+		EventTime: time.Now().UTC().Format(time.RFC3339),
+		Location:  p.Name,
+		Server:    nodeID(),
+		metadata:  metadata,
+		system:    true,
+	}, "")
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	p.Index = b.Index
+	respondWithJSON(w, r, status, p)
+}
+
+// list recorded runs, ?policy= for one policy's
+func handleGetRetentionRuns(w http.ResponseWriter, r *http.Request) {
+	policy := r.URL.Query().Get("policy")
+	runs := make([]RetentionRun, 0)
+	mutex.Lock()
+	for _, b := range Blockchain {
+		if run, ok := retentionRunOf(b); ok && (policy == "" || run.Policy == policy) {
+			runs = append(runs, run)
+		}
+	}
+	mutex.Unlock()
+	respondWithList(w, r, http.StatusOK, runs)
+}
+
+// enforce every policy now
+func handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	if poaEnabled() {
+		http.Error(w, "proof-of-authority mode: retention policies are not supported", http.StatusForbidden)
+		return
+	}
+	runs, err := enforceRetention()
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, runs)
+}
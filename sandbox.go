@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sandbox is a private fork of the chain for what-if analysis. Blocks added
+// to it never reach the canonical chain, storage or peers. Its chain is the
+// canonical chain up to ForkAt, shared with Blockchain rather than copied,
+// followed by the blocks added to the sandbox.
+type Sandbox struct {
+	ID      string `json:"id"`
+	ForkAt  int    `json:"fork_at"`
+	Created string `json:"created"`
+	// fork is Blockchain[:ForkAt+1] with its capacity cut to its length, so
+	// an append can never write into the canonical chain's array. Committed
+	// blocks are never modified in place.
+	fork  []Block
+	added []Block
+}
+
+// head is the last block of the sandbox chain
+func (sb *Sandbox) head() Block {
+	if len(sb.added) > 0 {
+		return sb.added[len(sb.added)-1]
+	}
+	return sb.fork[len(sb.fork)-1]
+}
+
+// chain is the whole sandbox chain
+func (sb *Sandbox) chain() []Block {
+	return append(sb.fork, sb.added...)
+}
+
+// MarshalJSON lists the whole sandbox chain as blocks
+func (sb *Sandbox) MarshalJSON() ([]byte, error) {
+	type sandbox Sandbox
+	return json.Marshal(struct {
+		*sandbox
+		Blocks []Block `json:"blocks"`
+	}{(*sandbox)(sb), sb.chain()})
+}
+
+// SandboxValidation reports whether every link of a sandbox chain holds
+type SandboxValidation struct {
+	ID      string `json:"id"`
+	Valid   bool   `json:"valid"`
+	Height  int    `json:"height"`
+	Invalid []int  `json:"invalid,omitempty"`
+}
+
+// maximum number of sandboxes alive at once
+const maxSandboxes = 16
+
+var sandboxes = make(map[string]*Sandbox)
+var sandboxMutex = &sync.Mutex{}
+
+// fork the chain at ?at= (default: the head)
+func handleCreateSandbox(w http.ResponseWriter, r *http.Request) {
+	// refuse before forking the chain; checked again when it is added
+	sandboxMutex.Lock()
+	full := len(sandboxes) >= maxSandboxes
+	sandboxMutex.Unlock()
+	if full {
+		http.Error(w, "too many sandboxes, delete one first", http.StatusConflict)
+		return
+	}
+
+	mutex.Lock()
+	at := len(Blockchain) - 1
+	if v := r.URL.Query().Get("at"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > at {
+			mutex.Unlock()
+			http.Error(w, "at must be a height between 0 and "+strconv.Itoa(at), http.StatusBadRequest)
+			return
+		}
+		at = n
+	}
+	fork := Blockchain[: at+1 : at+1]
+	mutex.Unlock()
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sb := &Sandbox{ID: hex.EncodeToString(id), ForkAt: at, Created: time.Now().String(), fork: fork}
+
+	sandboxMutex.Lock()
+	defer sandboxMutex.Unlock()
+	if len(sandboxes) >= maxSandboxes {
+		http.Error(w, "too many sandboxes, delete one first", http.StatusConflict)
+		return
+	}
+	sandboxes[sb.ID] = sb
+	respondWithJSON(w, r, http.StatusCreated, sb)
+}
+
+func handleGetSandbox(w http.ResponseWriter, r *http.Request) {
+	sandboxMutex.Lock()
+	defer sandboxMutex.Unlock()
+
+	sb, ok := sandboxes[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "sandbox not found", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, sb)
+}
+
+func handleDeleteSandbox(w http.ResponseWriter, r *http.Request) {
+	sandboxMutex.Lock()
+	defer sandboxMutex.Unlock()
+
+	id := mux.Vars(r)["id"]
+	if _, ok := sandboxes[id]; !ok {
+		http.Error(w, "sandbox not found", http.StatusNotFound)
+		return
+	}
+	delete(sandboxes, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// append a hypothetical block, either minted from a CreateBlockReq or a full
+// Block (with Hash set) that is appended as given so invalid blocks can be
+// tried out too
+func handleSandboxBlock(w http.ResponseWriter, r *http.Request) {
+	var b Block
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if err := checkReservedEvent(CreateBlockReq{Event: b.Event}); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	sandboxMutex.Lock()
+	defer sandboxMutex.Unlock()
+
+	sb, ok := sandboxes[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "sandbox not found", http.StatusNotFound)
+		return
+	}
+	head := sb.head()
+	if b.Hash == "" {
+		if len(b.Event) == 0 {
+			http.Error(w, "Event is required", http.StatusBadRequest)
+			return
+		}
+		b = generateBlock(head, "", b.FileHash, b.Event, b.EventTime, b.Location, b.Server)
+	}
+	sb.added = append(sb.added, b)
+
+	status := http.StatusCreated
+	if !isBlockValid(b, head) {
+		status = http.StatusAccepted
+	}
+	respondWithJSON(w, r, status, b)
+}
+
+// check every link of the sandbox chain
+func handleValidateSandbox(w http.ResponseWriter, r *http.Request) {
+	sandboxMutex.Lock()
+	defer sandboxMutex.Unlock()
+
+	sb, ok := sandboxes[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "sandbox not found", http.StatusNotFound)
+		return
+	}
+	blocks := sb.chain()
+	v := SandboxValidation{ID: sb.ID, Height: len(blocks) - 1}
+	for i := 1; i < len(blocks); i++ {
+		if !isBlockValid(blocks[i], blocks[i-1]) {
+			v.Invalid = append(v.Invalid, i)
+		}
+	}
+	v.Valid = len(v.Invalid) == 0
+	respondWithJSON(w, r, http.StatusOK, v)
+}
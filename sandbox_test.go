@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSandboxRoutesNeedAdmin(t *testing.T) {
+	router := newTestChain(t)
+	adminAllowlist = nil
+	adminKeyMutex.Lock()
+	adminKeys = nil
+	adminKeyMutex.Unlock()
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/sandbox"},
+		{"DELETE", "/sandbox/0123456789abcdef"},
+		{"POST", "/sandbox/0123456789abcdef/blocks"},
+	} {
+		if code := call(t, router, route.method, route.path, Block{}, nil); code != http.StatusForbidden {
+			t.Errorf("%s %s without admin credentials: status %d", route.method, route.path, code)
+		}
+	}
+}
+
+func TestSandboxLimit(t *testing.T) {
+	newTestChain(t)
+	t.Cleanup(func() {
+		sandboxMutex.Lock()
+		sandboxes = make(map[string]*Sandbox)
+		sandboxMutex.Unlock()
+	})
+	for i := 0; i <= maxSandboxes; i++ {
+		rec := httptest.NewRecorder()
+		handleCreateSandbox(rec, httptest.NewRequest("POST", "/sandbox", nil))
+		want := http.StatusCreated
+		if i == maxSandboxes {
+			want = http.StatusConflict
+		}
+		if rec.Code != want {
+			t.Fatalf("sandbox %d: status %d, want %d", i+1, rec.Code, want)
+		}
+	}
+}
+
+func TestSandboxSharesTheCommittedChain(t *testing.T) {
+	router := newTestChain(t)
+	t.Cleanup(func() {
+		sandboxMutex.Lock()
+		sandboxes = make(map[string]*Sandbox)
+		sandboxMutex.Unlock()
+	})
+	if code := call(t, router, "POST", "/block", CreateBlockReq{Event: "login", Server: "s1"}, nil); code != http.StatusCreated {
+		t.Fatalf("write: status %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	handleCreateSandbox(rec, httptest.NewRequest("POST", "/sandbox", nil))
+	var created struct {
+		ID     string
+		Blocks []Block
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || len(created.Blocks) != 2 {
+		t.Fatalf("sandbox %s: %v", rec.Body.String(), err)
+	}
+	sandboxMutex.Lock()
+	sb := sandboxes[created.ID]
+	sandboxMutex.Unlock()
+	mutex.Lock()
+	shared := &sb.fork[0] == &Blockchain[0]
+	mutex.Unlock()
+	if !shared {
+		t.Error("the sandbox copied the committed chain")
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/sandbox/"+sb.ID+"/blocks", strings.NewReader(`{"event":"what if"}`)), map[string]string{"id": sb.ID})
+	rec = httptest.NewRecorder()
+	handleSandboxBlock(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("sandbox block: status %d", rec.Code)
+	}
+	if code := call(t, router, "POST", "/block", CreateBlockReq{Event: "logout", Server: "s1"}, nil); code != http.StatusCreated {
+		t.Fatalf("write: status %d", code)
+	}
+
+	mutex.Lock()
+	canonical := Blockchain[2].Event
+	mutex.Unlock()
+	sandboxMutex.Lock()
+	blocks := sb.chain()
+	sandboxMutex.Unlock()
+	if canonical != "logout" || len(blocks) != 3 || blocks[2].Event != "what if" {
+		t.Errorf("canonical block 2 is %q, sandbox chain %+v", canonical, blocks)
+	}
+}
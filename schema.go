@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// There is no OpenAPI document for the API yet, so request schemas are
+// derived from the request structs themselves: every route that takes a JSON
+// body names its struct and validateBody checks the body against it before
+// the handler decodes it. Unknown fields are not checked; writes keep them as
+// block Metadata (see decodeWrite).
+
+// SchemaError is one structural problem, located by a JSON pointer
+type SchemaError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// SchemaErrors is the 400 response for a body that doesn't match its schema
+type SchemaErrors struct {
+	Errors []SchemaError `json:"errors"`
+}
+
+// largest request body accepted by validateBody
+const maxRequestBody = 1 << 20
+
+// validateBody rejects bodies that don't match the shape of schema (a
+// struct value) with pointer-style errors, then hands the body on with
+// legacy field names renamed to the tagged ones
+func validateBody(schema interface{}, next http.HandlerFunc) http.HandlerFunc {
+	t := reflect.TypeOf(schema)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// CMS signed writes are decoded once the handler has opened them
+		if isSignedWrite(r) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+			next(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// legacy field names are renamed first; invalid JSON is reported below
+		original := body
+		if renamed, err := snakeCaseKeys(t, body); err == nil {
+			body = renamed
+		}
+
+		var doc interface{}
+		var errs []SchemaError
+		if err := json.Unmarshal(body, &doc); err != nil {
+			errs = []SchemaError{{"", "body is not valid JSON: " + err.Error()}}
+		} else {
+			errs = checkSchema(t, doc, "")
+		}
+		if len(errs) > 0 {
+			// failed writes still belong in the dead-letter queue
+			if t == reflect.TypeOf(CreateBlockReq{}) {
+				recordRejection(r, original, errs[0].Pointer+": "+errs[0].Message)
+			}
+			respondWithJSON(w, r, http.StatusBadRequest, SchemaErrors{errs})
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// checkSchema compares a decoded JSON value with a Go type
+func checkSchema(t reflect.Type, v interface{}, pointer string) []SchemaError {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// null leaves the zero value, as encoding/json does
+	if v == nil {
+		return nil
+	}
+	mismatch := func(want string) []SchemaError {
+		return []SchemaError{{pointer, fmt.Sprintf("expected %s, got %s", want, jsonKind(v))}}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return mismatch("string")
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return mismatch("boolean")
+		}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		f, ok := v.(float64)
+		if !ok {
+			return mismatch("integer")
+		}
+		if f != float64(int64(f)) {
+			return []SchemaError{{pointer, "expected integer, got fraction"}}
+		}
+	case reflect.Float64, reflect.Float32:
+		if _, ok := v.(float64); !ok {
+			return mismatch("number")
+		}
+	case reflect.Slice:
+		items, ok := v.([]interface{})
+		if !ok {
+			return mismatch("array")
+		}
+		var errs []SchemaError
+		for i, item := range items {
+			errs = append(errs, checkSchema(t.Elem(), item, fmt.Sprintf("%s/%d", pointer, i))...)
+		}
+		return errs
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		var errs []SchemaError
+		for k, item := range obj {
+			errs = append(errs, checkSchema(t.Elem(), item, pointer+"/"+escapePointer(k))...)
+		}
+		return errs
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		var errs []SchemaError
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := jsonName(f)
+			if name == "-" {
+				continue
+			}
+			// encoding/json matches keys case-insensitively
+			for k, item := range obj {
+				if strings.EqualFold(k, name) {
+					errs = append(errs, checkSchema(f.Type, item, pointer+"/"+escapePointer(k))...)
+					break
+				}
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+// jsonName is the key a struct field is encoded under
+func jsonName(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+		return tag
+	}
+	return f.Name
+}
+
+// escapePointer escapes a key for use in a JSON pointer (RFC 6901)
+func escapePointer(k string) string {
+	return strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// GET /search?q= finds blocks by the words of their Event, Location, Server,
+// FileHash and Signer through an inverted index. With DATA_DIR the index is
+// saved to search.json every searchSaveInterval, so after a restart it is
+// loaded as saved and only the blocks appended since are folded in, in the
+// background. Search answers during that warm-up with what is indexed so
+// far and says how far that is in the Search-Through header.
+
+// blocks folded in per hold of mutex while warming up
+const searchWarmBatch = 1000
+
+// how often a changed index is saved
+const searchSaveInterval = time.Minute
+
+// searchState is the inverted index. Terms maps each term to the ascending
+// indexes of the blocks containing it; Through is the last block folded in
+// and ThroughHash its hash, which must still be on the chain when loaded.
+type searchState struct {
+	Through     int              `json:"through"`
+	ThroughHash string           `json:"through_hash"`
+	Terms       map[string][]int `json:"terms"`
+}
+
+var searchIndex = searchState{Through: -1, Terms: make(map[string][]int)}
+
+// searchWarm is set once the index has caught up with the chain; from then
+// on appended blocks are folded in as they arrive. searchDirty marks changes
+// since the last save. All three are guarded by searchMutex, which is taken
+// after mutex when both are held.
+var searchWarm, searchDirty bool
+var searchMutex = &sync.RWMutex{}
+
+// searchTerms splits text into lower-cased words
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(normalizeText(text)), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// foldSearchLocked adds b, which must follow Through, to the index. Caller
+// must hold searchMutex.
+func foldSearchLocked(b Block) {
+	seen := make(map[string]bool)
+	texts := []string{b.Event, b.Location, b.Server, b.FileHash, b.Signer}
+	for _, tx := range b.Transactions {
+		texts = append(texts, tx.Event, tx.Location, tx.Server, tx.FileHash, tx.Signer)
+	}
+	for _, text := range texts {
+		for _, t := range searchTerms(text) {
+			if !seen[t] {
+				seen[t] = true
+				searchIndex.Terms[t] = append(searchIndex.Terms[t], b.Index)
+			}
+		}
+	}
+	searchIndex.Through, searchIndex.ThroughHash = b.Index, b.Hash
+	searchDirty = true
+}
+
+// noteSearchLocked folds in the blocks up to b once the index is warm.
+// Caller must hold mutex.
+func noteSearchLocked(b Block) {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	if !searchWarm {
+		return
+	}
+	for i := searchIndex.Through + 1; i <= b.Index && i < len(Blockchain); i++ {
+		foldSearchLocked(Blockchain[i])
+	}
+}
+
+// loadSearchIndex reads search.json and warms the index up in the
+// background. An index that doesn't match the loaded chain is rebuilt.
+func loadSearchIndex() error {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "search.json"))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		default:
+			var saved searchState
+			if err := json.Unmarshal(raw, &saved); err != nil {
+				log.Println("search index unreadable, rebuilding it:", err)
+				break
+			}
+			mutex.Lock()
+			ok := saved.Through < len(Blockchain) && (saved.Through < 0 || Blockchain[saved.Through].Hash == saved.ThroughHash)
+			mutex.Unlock()
+			if !ok || saved.Terms == nil {
+				log.Println("search index does not match the chain, rebuilding it")
+				break
+			}
+			searchMutex.Lock()
+			searchIndex = saved
+			searchMutex.Unlock()
+			log.Printf("loaded search index through block %d", saved.Through)
+		}
+	}
+	go warmSearch()
+	return nil
+}
+
+// warmSearch folds in the blocks the index is missing a batch at a time,
+// then saves it every searchSaveInterval
+func warmSearch() {
+	start := time.Now()
+	for {
+		mutex.Lock()
+		searchMutex.Lock()
+		from := searchIndex.Through + 1
+		to := from + searchWarmBatch
+		if to >= len(Blockchain) {
+			to = len(Blockchain)
+			searchWarm = true
+		}
+		for i := from; i < to; i++ {
+			foldSearchLocked(Blockchain[i])
+		}
+		warm := searchWarm
+		searchMutex.Unlock()
+		mutex.Unlock()
+		if warm {
+			break
+		}
+	}
+	log.Printf("search index warm after %v", time.Since(start).Round(time.Millisecond))
+	if err := saveSearchIndex(); err != nil {
+		log.Println("saving search index failed:", err)
+	}
+	for range time.Tick(searchSaveInterval) {
+		if err := saveSearchIndex(); err != nil {
+			log.Println("saving search index failed:", err)
+		}
+	}
+}
+
+// saveSearchIndex writes the index atomically if it changed
+func saveSearchIndex() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	searchMutex.Lock()
+	if !searchDirty {
+		searchMutex.Unlock()
+		return nil
+	}
+	raw, err := json.Marshal(searchIndex)
+	searchDirty = false
+	searchMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "search.json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// rebuildSearchLocked indexes every block again. Caller must hold mutex.
+func rebuildSearchLocked() (int, error) {
+	searchMutex.Lock()
+	searchIndex = searchState{Through: -1, Terms: make(map[string][]int)}
+	for _, b := range Blockchain {
+		foldSearchLocked(b)
+	}
+	searchWarm = true
+	n := len(searchIndex.Terms)
+	searchMutex.Unlock()
+	return n, saveSearchIndex()
+}
+
+// blocks containing every word of ?q=, newest first, at most ?n= (default
+// 20) of those below ?before=
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	terms := searchTerms(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "q must contain a word to search for", http.StatusBadRequest)
+		return
+	}
+	n := defaultLatestBlocks
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLatestBlocks {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxLatestBlocks), http.StatusBadRequest)
+			return
+		}
+	}
+	before, err := beforeParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	searchMutex.RLock()
+	through, warm := searchIndex.Through, searchWarm
+	lists := make([][]int, len(terms))
+	for i, t := range terms {
+		lists[i] = searchIndex.Terms[t]
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	blocks := make([]Block, 0)
+	for k := sort.SearchInts(lists[0], before) - 1; k >= 0 && len(blocks) < n; k-- {
+		i := lists[0][k]
+		if i > height || i >= len(Blockchain) {
+			continue
+		}
+		all := true
+		for _, list := range lists[1:] {
+			if j := sort.SearchInts(list, i); j == len(list) || list[j] != i {
+				all = false
+				break
+			}
+		}
+		if all {
+			blocks = append(blocks, Blockchain[i])
+		}
+	}
+	searchMutex.RUnlock()
+	mutex.Unlock()
+
+	w.Header().Set("Search-Through", strconv.Itoa(through))
+	if !warm {
+		w.Header().Set("Search-Warming", "true")
+	}
+	respondWithBlocks(w, r, http.StatusOK, blocks)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Secrets can live in a secrets manager instead of the .env file.
+// SECRETS_SOURCE says where:
+//
+//	vault:<path>        a HashiCorp Vault KV secret, e.g. secret/data/blockchain
+//	awssm:<secret id>   an AWS Secrets Manager secret holding a JSON object
+//
+// Every key of the secret is a setting, like ADMIN_TOKEN, SPLUNK_HEC_TOKEN or
+// STORAGE_PASSPHRASE, and overrides the .env file. Secrets are fetched before
+// anything else reads the configuration and again every SECRETS_REFRESH
+// (default 15m); changed values are applied like a config reload. With
+// NODE_KEY=secret:<KEY> the PEM node key is one of them.
+//
+// Vault is reached at VAULT_ADDR with VAULT_TOKEN, or with a token from an
+// AppRole login (VAULT_ROLE_ID, VAULT_SECRET_ID). The token is renewed at
+// every refresh, and an AppRole login is repeated when it can't be.
+
+// secretsProvider fetches the secret settings. Register new providers in
+// newSecretsProvider.
+type secretsProvider interface {
+	// Fetch returns the secret values by setting name
+	Fetch() (map[string]string, error)
+	// Renew keeps the provider's credentials valid
+	Renew() error
+}
+
+const defaultSecretsRefresh = 15 * time.Minute
+
+var (
+	secrets       secretsProvider
+	secretValues  map[string]string
+	secretsMutex  = &sync.Mutex{}
+	secretsClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// newSecretsProvider opens a vault:<path> or awssm:<secret id> source
+func newSecretsProvider(ref string) (secretsProvider, error) {
+	i := strings.Index(ref, ":")
+	if i <= 0 || i == len(ref)-1 {
+		return nil, errors.New("SECRETS_SOURCE looks like vault:<path> or awssm:<secret id>")
+	}
+	switch kind, name := ref[:i], ref[i+1:]; kind {
+	case "vault":
+		return newVaultProvider(name)
+	case "awssm":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return &awsSecretsProvider{secretsmanager.New(sess), name}, nil
+	default:
+		return nil, errors.New("unknown secrets source " + kind + ", use vault or awssm")
+	}
+}
+
+// loadSecrets fetches the secrets into the environment
+func loadSecrets() error {
+	ref := os.Getenv("SECRETS_SOURCE")
+	if ref == "" {
+		return nil
+	}
+	p, err := newSecretsProvider(ref)
+	if err != nil {
+		return err
+	}
+	values, err := p.Fetch()
+	if err != nil {
+		return errors.New("fetching secrets: " + err.Error())
+	}
+	for k, v := range values {
+		os.Setenv(k, v)
+	}
+	secretsMutex.Lock()
+	secrets, secretValues = p, values
+	secretsMutex.Unlock()
+	log.Println("loaded", len(values), "secrets from", ref)
+	return nil
+}
+
+// overlaySecrets puts the current secret values over a configuration read
+// from the .env file
+func overlaySecrets(env map[string]string) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	for k, v := range secretValues {
+		env[k] = v
+	}
+}
+
+// startSecretsRefresh renews the provider's credentials and fetches the
+// secrets again every SECRETS_REFRESH
+func startSecretsRefresh() error {
+	secretsMutex.Lock()
+	p := secrets
+	secretsMutex.Unlock()
+	if p == nil {
+		return nil
+	}
+	interval := defaultSecretsRefresh
+	if v := os.Getenv("SECRETS_REFRESH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return errors.New("SECRETS_REFRESH must be a duration of at least 1m, like 15m")
+		}
+		interval = d
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := refreshSecrets(p); err != nil {
+				log.Println("refreshing secrets failed, keeping the previous ones:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// refreshSecrets applies changed secrets like a config reload
+func refreshSecrets(p secretsProvider) error {
+	if err := p.Renew(); err != nil {
+		return err
+	}
+	values, err := p.Fetch()
+	if err != nil {
+		return err
+	}
+	secretsMutex.Lock()
+	changed := len(values) != len(secretValues)
+	for k, v := range values {
+		if old, ok := secretValues[k]; !ok || old != v {
+			changed = true
+		}
+	}
+	secretsMutex.Unlock()
+	if !changed {
+		return nil
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for k, v := range values {
+		env[k] = v
+	}
+	if err := applyConfigLocked(env, nil); err != nil {
+		return err
+	}
+	secretsMutex.Lock()
+	secretValues = values
+	secretsMutex.Unlock()
+	log.Println("secrets changed, configuration reloaded")
+	return nil
+}
+
+// secretStrings flattens a secret's JSON object; values that aren't
+// strings keep their JSON encoding
+func secretStrings(data map[string]json.RawMessage) map[string]string {
+	values := make(map[string]string, len(data))
+	for k, raw := range data {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			values[k] = s
+		} else {
+			values[k] = string(raw)
+		}
+	}
+	return values
+}
+
+// vaultProvider reads a KV secret, version 1 or 2, over the HTTP API
+type vaultProvider struct {
+	addr     string
+	path     string
+	roleID   string
+	secretID string
+
+	mutex sync.Mutex
+	token string
+}
+
+func newVaultProvider(path string) (*vaultProvider, error) {
+	v := &vaultProvider{
+		addr:     strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		path:     strings.Trim(path, "/"),
+		roleID:   os.Getenv("VAULT_ROLE_ID"),
+		secretID: os.Getenv("VAULT_SECRET_ID"),
+		token:    os.Getenv("VAULT_TOKEN"),
+	}
+	if v.addr == "" {
+		return nil, errors.New("vault secrets need VAULT_ADDR")
+	}
+	if v.token == "" {
+		if v.roleID == "" {
+			return nil, errors.New("vault secrets need VAULT_TOKEN or VAULT_ROLE_ID and VAULT_SECRET_ID")
+		}
+		if err := v.login(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// call makes a Vault API request and decodes its response into out
+func (v *vaultProvider) call(method, path string, body interface{}, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, v.addr+"/v1/"+path, payload)
+	if err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	v.mutex.Unlock()
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+	}
+	return json.Unmarshal(reply, out)
+}
+
+// login gets a token with the AppRole credentials
+func (v *vaultProvider) login() error {
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err := v.call("POST", "auth/approle/login", map[string]string{"role_id": v.roleID, "secret_id": v.secretID}, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.Auth.ClientToken == "" {
+		return errors.New("vault AppRole login returned no token")
+	}
+	v.mutex.Lock()
+	v.token = resp.Auth.ClientToken
+	v.mutex.Unlock()
+	return nil
+}
+
+func (v *vaultProvider) Renew() error {
+	var resp json.RawMessage
+	err := v.call("POST", "auth/token/renew-self", map[string]string{}, &resp)
+	if err != nil && v.roleID != "" {
+		return v.login()
+	}
+	return err
+}
+
+func (v *vaultProvider) Fetch() (map[string]string, error) {
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := v.call("GET", v.path, nil, &resp); err != nil {
+		return nil, err
+	}
+	// KV version 2 nests the secret under data.data
+	if inner, ok := resp.Data["data"]; ok {
+		if _, versioned := resp.Data["metadata"]; versioned {
+			var data map[string]json.RawMessage
+			if err := json.Unmarshal(inner, &data); err != nil {
+				return nil, err
+			}
+			return secretStrings(data), nil
+		}
+	}
+	return secretStrings(resp.Data), nil
+}
+
+// awsSecretsProvider reads an AWS Secrets Manager secret holding a JSON
+// object. The SDK renews its own credentials.
+type awsSecretsProvider struct {
+	svc *secretsmanager.SecretsManager
+	id  string
+}
+
+func (p *awsSecretsProvider) Fetch() (map[string]string, error) {
+	out, err := p.svc.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(p.id)})
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(aws.StringValue(out.SecretString)), &data); err != nil {
+		return nil, errors.New("secret " + p.id + " must hold a JSON object")
+	}
+	return secretStrings(data), nil
+}
+
+func (p *awsSecretsProvider) Renew() error { return nil }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Each sink can be given its own rules, named after its type:
+//
+//	SINK_FILTER_SLACK=Severity=high,Event~unauthorized
+//	SINK_FIELDS_SPLUNK=Event:event_type,Server:host,Hash
+//	SINK_TEMPLATE_SLACK={{.Event}} on {{.Server}} ({{.Severity}})
+//
+// A filter is written like ?filter= on /events/stream: Field=value or
+// Field~value terms, ANDed, where a value may list alternatives as a|b.
+// Besides the block fields it knows Severity, see severityOf. Blocks a sink
+// filters out still move its offset. Fields sends only the listed block
+// fields, renamed after a colon, and the watermark. A template turns each
+// record into text; it gets the record's fields and Severity. The rules are
+// read again when the config is reloaded.
+
+// sinkFilter is one filter term
+type sinkFilter struct {
+	field    string
+	values   []string
+	contains bool
+}
+
+// sinkField sends a block field under another name
+type sinkField struct {
+	field string
+	name  string
+}
+
+// sinkRules is what a sink sends. The zero value sends every block whole.
+type sinkRules struct {
+	filters  []sinkFilter
+	fields   []sinkField
+	template *template.Template
+}
+
+// sinkTemplateData is what a sink template is executed with
+type sinkTemplateData struct {
+	SinkRecord
+	Severity string
+}
+
+// default template of the slack sink
+const defaultSlackTemplate = "{{.Event}} on {{.Server}} at {{.Location}} (block {{.Index}}, severity {{.Severity}})"
+
+// sinkRuleKey is the config key of one rule of the sink named name
+func sinkRuleKey(rule, name string) string {
+	return "SINK_" + rule + "_" + strings.ToUpper(name)
+}
+
+func parseSinkRules(name string, env map[string]string) (sinkRules, error) {
+	var rules sinkRules
+	key := sinkRuleKey("FILTER", name)
+	for _, term := range strings.Split(env[key], ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		i := strings.IndexAny(term, "=~")
+		if i <= 0 {
+			return rules, errors.New(key + ": terms look like Field=value or Field~value")
+		}
+		f := sinkFilter{term[:i], strings.Split(term[i+1:], "|"), term[i] == '~'}
+		if !blockFieldNames[f.field] && f.field != "Severity" {
+			return rules, errors.New(key + ": unknown field " + f.field)
+		}
+		rules.filters = append(rules.filters, f)
+	}
+
+	key = sinkRuleKey("FIELDS", name)
+	for _, entry := range strings.Split(env[key], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		f := sinkField{entry, entry}
+		if i := strings.Index(entry, ":"); i >= 0 {
+			f = sinkField{entry[:i], entry[i+1:]}
+		}
+		if !blockFieldNames[f.field] || f.name == "" || f.name == "watermark" {
+			return rules, errors.New(key + ": entries look like Field or Field:name")
+		}
+		rules.fields = append(rules.fields, f)
+	}
+
+	key = sinkRuleKey("TEMPLATE", name)
+	text := env[key]
+	if text == "" && name == "slack" {
+		text = defaultSlackTemplate
+	}
+	if text != "" {
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return rules, errors.New(key + ": " + err.Error())
+		}
+		// field names are only checked when the template runs
+		if err := t.Execute(&bytes.Buffer{}, sinkTemplateData{}); err != nil {
+			return rules, errors.New(key + ": " + err.Error())
+		}
+		rules.template = t
+	}
+	return rules, nil
+}
+
+// matches reports whether b passes every filter term
+func (rules sinkRules) matches(b Block) bool {
+	for _, f := range rules.filters {
+		var got string
+		switch f.field {
+		case "Severity":
+			got = severityOf(b)
+		case "Metadata":
+			got = string(b.Metadata)
+		default:
+			got = fmt.Sprint(blockFields(b, []string{f.field})[f.field])
+		}
+		ok := false
+		for _, v := range f.values {
+			if f.contains && strings.Contains(got, v) || !f.contains && got == v {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// shape is what the sink sends for rec: the text of its template, the
+// mapped fields, or the record itself
+func (rules sinkRules) shape(rec SinkRecord) (interface{}, error) {
+	if rules.template != nil {
+		var buf bytes.Buffer
+		if err := rules.template.Execute(&buf, sinkTemplateData{rec, severityOf(rec.Block)}); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	}
+	if rules.fields == nil {
+		return rec, nil
+	}
+	names := make([]string, len(rules.fields))
+	for i, f := range rules.fields {
+		names[i] = f.field
+	}
+	values := blockFields(rec.Block, names)
+	m := make(map[string]interface{}, len(rules.fields)+1)
+	for _, f := range rules.fields {
+		m[f.name] = values[f.field]
+	}
+	m["watermark"] = rec.Watermark
+	return m, nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SIEM sinks receive every committed block. SINKS lists them as type:url:
+//
+//	splunk:https://splunk:8088/services/collector/event   (SPLUNK_HEC_TOKEN)
+//	elastic:https://es:9200/<index>                       (ELASTIC_API_KEY)
+//	kafka:https://kafka-rest:8082/topics/<topic>          (Kafka REST Proxy v2)
+//	webhook:https://hooks.example.org/blocks              (a JSON array)
+//	slack:https://hooks.slack.com/services/...             (incoming webhook)
+//
+// What each sink receives can be narrowed and reshaped, see sinkRules.
+// Each forwarded record carries a Watermark: the block's index and hash and
+// the chain head when it was sent, so a downstream copy can be verified
+// against the chain on its own later.
+//
+// Delivery goes through an outbox. The chain itself is the outbox log: a
+// committed block is pending for every sink until the sink's offset, the
+// index of the last block it acknowledged, passes it. Failed batches are
+// retried with backoff until they succeed, never dropped, and with DATA_DIR
+// the offsets are saved to outbox.json so a restart resumes where delivery
+// stopped. Delivery is at least once: a crash between a delivery and saving
+// its offset sends the batch again. GET /sinks/status shows each sink's lag.
+// SINKS is read again when the config is reloaded, see prepareSinks.
+
+// SinkRecord is what a sink receives for one block, for each event of a
+// batch block (see eventBlock)
+type SinkRecord struct {
+	Block
+	Watermark ChainWatermark `json:"watermark"`
+}
+
+// ChainWatermark places a forwarded block on the chain
+type ChainWatermark struct {
+	Node      string `json:"node"`
+	Index     int    `json:"index"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+	HeadIndex int    `json:"head_index"`
+	HeadHash  string `json:"head_hash"`
+}
+
+// SinkStatus is one entry of GET /sinks/status. Offset is the index of the
+// last block the sink acknowledged and Lag the number of committed blocks
+// after it.
+type SinkStatus struct {
+	Name          string `json:"name"`
+	URL           string `json:"url"`
+	Offset        int    `json:"offset"`
+	Head          int    `json:"head"`
+	Lag           int    `json:"lag"`
+	Delivered     int    `json:"delivered"`
+	Filtered      int    `json:"filtered"`
+	LastDelivered string `json:"last_delivered,omitempty"`
+	Failures      int    `json:"failures"`
+	LastError     string `json:"last_error,omitempty"`
+	NextRetry     string `json:"next_retry,omitempty"`
+}
+
+// sink forwards blocks to one external system
+type sink struct {
+	name string
+	url  string
+	// format builds a request body; values are what the rules make of
+	// each record
+	format func(records []SinkRecord, values []interface{}) ([]byte, string, error)
+	// auth returns the Authorization header, read per request so rotated
+	// credentials apply without a restart
+	auth func() string
+	// wake is signalled when blocks are committed
+	wake chan struct{}
+	// stop is closed when a reload removes the sink
+	stop chan struct{}
+	// guarded by sinkMutex
+	status SinkStatus
+	rules  sinkRules
+}
+
+// most blocks sent to a sink in one request
+const sinkBatchSize = 100
+
+// delay before the first retry of a failed batch, doubling up to the maximum
+const (
+	sinkBackoff    = time.Second
+	sinkMaxBackoff = 5 * time.Minute
+)
+
+// sinks is replaced when SINKS is reloaded, guarded by sinkMutex
+var sinks []*sink
+var sinkMutex = &sync.Mutex{}
+
+var sinkClient = &http.Client{Timeout: 10 * time.Second}
+
+// startSinks parses SINKS and starts one sender per sink
+func startSinks() error {
+	configured, err := parseSinks(os.Getenv("SINKS"))
+	if err != nil {
+		return err
+	}
+	env := make(map[string]string)
+	for _, s := range configured {
+		for _, rule := range []string{"FILTER", "FIELDS", "TEMPLATE"} {
+			env[sinkRuleKey(rule, s.name)] = os.Getenv(sinkRuleKey(rule, s.name))
+		}
+	}
+	apply, err := sinkReplacement(configured, env)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareSinks validates a reloaded SINKS and the rules of each sink. Sinks
+// that keep their type and URL keep their sender and offset, new ones start
+// like they would at startup and removed ones stop.
+func prepareSinks(env map[string]string) (func(), error) {
+	configured, err := parseSinks(env["SINKS"])
+	if err != nil {
+		return nil, err
+	}
+	return sinkReplacement(configured, env)
+}
+
+// parseSinks builds the sinks SINKS lists, without starting them
+func parseSinks(list string) ([]*sink, error) {
+	var configured []*sink
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			return nil, errors.New("SINKS entries look like splunk:https://host:8088/services/collector/event")
+		}
+		kind, raw := entry[:i], entry[i+1:]
+		u, err := parseNodeURL(raw, "http", "https")
+		if err != nil {
+			return nil, errors.New("invalid sink URL " + raw + ": " + err.Error())
+		}
+		s := &sink{name: kind, url: raw, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+		switch kind {
+		case "splunk":
+			s.format = splunkRecords
+			s.auth = func() string { return "Splunk " + os.Getenv("SPLUNK_HEC_TOKEN") }
+		case "elastic":
+			index := strings.Trim(u.Path, "/")
+			if index == "" || strings.Contains(index, "/") {
+				return nil, errors.New("elastic sink URL must name the index, like https://host:9200/blockchain")
+			}
+			s.format = elasticRecords(index)
+			u.Path = "/_bulk"
+			s.url = u.String()
+			s.auth = func() string {
+				if key := os.Getenv("ELASTIC_API_KEY"); key != "" {
+					return "ApiKey " + key
+				}
+				return ""
+			}
+		case "kafka":
+			s.format = kafkaRecords
+		case "webhook":
+			s.format = webhookRecords
+		case "slack":
+			s.format = slackRecords
+		default:
+			return nil, errors.New("unknown sink type " + kind + ", use splunk, elastic, kafka, webhook or slack")
+		}
+		for _, other := range configured {
+			if other.name == s.name {
+				return nil, errors.New("SINKS lists " + kind + " twice")
+			}
+		}
+		configured = append(configured, s)
+	}
+	return configured, nil
+}
+
+// sinkReplacement validates the rules of the configured sinks and returns
+// the function that makes them the running sinks
+func sinkReplacement(configured []*sink, env map[string]string) (func(), error) {
+	rules := make([]sinkRules, len(configured))
+	for i, s := range configured {
+		var err error
+		if rules[i], err = parseSinkRules(s.name, env); err != nil {
+			return nil, err
+		}
+	}
+	offsets := make(map[string]int)
+	if len(configured) > 0 {
+		var err error
+		if offsets, err = loadOutbox(); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() {
+		mutex.Lock()
+		head := len(Blockchain) - 1
+		mutex.Unlock()
+
+		sinkMutex.Lock()
+		defer sinkMutex.Unlock()
+		running := make(map[string]*sink, len(sinks))
+		for _, s := range sinks {
+			running[s.name] = s
+		}
+		next := make([]*sink, 0, len(configured))
+		started := 0
+		for i, s := range configured {
+			old, ok := running[s.name]
+			if ok && old.url == s.url {
+				old.rules = rules[i]
+				next = append(next, old)
+				delete(running, s.name)
+				continue
+			}
+			s.rules = rules[i]
+			s.status = SinkStatus{Name: s.name, Offset: head}
+			// webhook paths and queries may hold secrets
+			if u, err := url.Parse(s.url); err == nil {
+				s.status.URL = u.Scheme + "://" + u.Host
+			}
+			// a sink moved to another URL carries on from where it was; a
+			// new sink starts with the blocks committed from now on
+			if ok {
+				s.status.Offset = old.status.Offset
+			} else if offset, saved := offsets[s.name]; saved && offset <= head {
+				s.status.Offset = offset
+			}
+			go s.dispatch()
+			next = append(next, s)
+			started++
+		}
+		for _, s := range running {
+			close(s.stop)
+		}
+		sinks = next
+		if started > 0 || len(running) > 0 {
+			log.Println("forwarding blocks to", len(sinks), "sinks")
+		}
+	}, nil
+}
+
+// loadOutbox reads the saved sink offsets
+func loadOutbox() (map[string]int, error) {
+	offsets := make(map[string]int)
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return offsets, nil
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "outbox.json"))
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return offsets, json.Unmarshal(raw, &offsets)
+}
+
+// saveOutboxLocked writes the sink offsets atomically. Caller must hold
+// sinkMutex.
+func saveOutboxLocked() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	offsets := make(map[string]int, len(sinks))
+	for _, s := range sinks {
+		offsets[s.name] = s.status.Offset
+	}
+	raw, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "outbox.json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// forwardBlock tells every sink a block was committed, without blocking the
+// write path. The block is already in the outbox: it is on the chain.
+func forwardBlock(b Block) {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+	for _, s := range sinks {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pending returns the next batch of blocks past the sink's offset and the
+// head to watermark them with
+func (s *sink) pending() ([]Block, Block) {
+	sinkMutex.Lock()
+	from := s.status.Offset + 1
+	sinkMutex.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	head := Blockchain[len(Blockchain)-1]
+	if from >= len(Blockchain) {
+		return nil, head
+	}
+	to := from + sinkBatchSize
+	if to > len(Blockchain) {
+		to = len(Blockchain)
+	}
+	return append([]Block(nil), Blockchain[from:to]...), head
+}
+
+// dispatch delivers the outbox in batches, in chain order, retrying a
+// failed batch until it goes through or the sink is removed
+func (s *sink) dispatch() {
+	backoff := sinkBackoff
+	for {
+		batch, head := s.pending()
+		if len(batch) == 0 {
+			select {
+			case <-s.wake:
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+		sinkMutex.Lock()
+		rules := s.rules
+		sinkMutex.Unlock()
+		var records []SinkRecord
+		events := 0
+		for _, b := range batch {
+			for _, tx := range eventsOf(b) {
+				events++
+				if e := eventBlock(b, tx); rules.matches(e) {
+					records = append(records, SinkRecord{e, ChainWatermark{nodeID(), b.Index, b.Hash, hashAlgorithmOf(b.Hash), head.Index, head.Hash}})
+				}
+			}
+		}
+
+		if err := s.post(records, rules); err != nil {
+			log.Printf("forwarding blocks %d-%d to %s failed, retrying in %v: %v", batch[0].Index, batch[len(batch)-1].Index, s.name, backoff, err)
+			sinkMutex.Lock()
+			s.status.Failures++
+			s.status.LastError = err.Error()
+			s.status.NextRetry = time.Now().Add(backoff).Format(time.RFC3339)
+			sinkMutex.Unlock()
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+			if backoff *= 2; backoff > sinkMaxBackoff {
+				backoff = sinkMaxBackoff
+			}
+			continue
+		}
+		backoff = sinkBackoff
+
+		sinkMutex.Lock()
+		s.status.Offset = batch[len(batch)-1].Index
+		s.status.Delivered += len(records)
+		s.status.Filtered += events - len(records)
+		s.status.LastDelivered = time.Now().Format(time.RFC3339)
+		s.status.LastError, s.status.NextRetry = "", ""
+		if err := saveOutboxLocked(); err != nil {
+			log.Println("saving sink offsets failed:", err)
+		}
+		sinkMutex.Unlock()
+	}
+}
+
+// show the delivery offset and lag of every sink
+func handleGetSinkStatus(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	head := len(Blockchain) - 1
+	mutex.Unlock()
+
+	sinkMutex.Lock()
+	list := make([]SinkStatus, 0, len(sinks))
+	for _, s := range sinks {
+		st := s.status
+		st.Head = head
+		if st.Lag = head - st.Offset; st.Lag < 0 {
+			st.Lag = 0
+		}
+		list = append(list, st)
+	}
+	sinkMutex.Unlock()
+	respondWithList(w, r, http.StatusOK, list)
+}
+
+// post sends records shaped by rules, nothing when every block of the batch
+// was filtered out
+func (s *sink) post(records []SinkRecord, rules sinkRules) error {
+	if len(records) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(records))
+	for i, rec := range records {
+		v, err := rules.shape(rec)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	body, contentType, err := s.format(records, values)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.auth != nil {
+		if auth := s.auth(); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+	}
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(reply))
+	}
+	// the bulk API answers 200 even when single documents failed
+	if s.name == "elastic" {
+		var bulk struct{ Errors bool }
+		if json.Unmarshal(reply, &bulk) == nil && bulk.Errors {
+			return errors.New("elastic rejected documents in the bulk request")
+		}
+	}
+	return nil
+}
+
+// splunkRecords builds HEC events, one JSON object after the other
+func splunkRecords(records []SinkRecord, values []interface{}) ([]byte, string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, rec := range records {
+		var t int64
+		if ts, ok := parseBlockTime(rec.Timestamp); ok {
+			t = ts.Unix()
+		}
+		if err := enc.Encode(map[string]interface{}{
+			"time":       t,
+			"host":       rec.Watermark.Node,
+			"source":     "blockchain",
+			"sourcetype": "blockchain:block",
+			"event":      values[i],
+		}); err != nil {
+			return nil, "", err
+		}
+	}
+	return buf.Bytes(), "application/json", nil
+}
+
+// elasticRecords builds a bulk request indexing each block under its hash,
+// so a resent block replaces its earlier copy
+func elasticRecords(index string) func([]SinkRecord, []interface{}) ([]byte, string, error) {
+	return func(records []SinkRecord, values []interface{}) ([]byte, string, error) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for i, rec := range records {
+			action := map[string]interface{}{"index": map[string]string{"_index": index, "_id": rec.Hash}}
+			if err := enc.Encode(action); err != nil {
+				return nil, "", err
+			}
+			if err := enc.Encode(values[i]); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+}
+
+// webhookRecords posts the records as a JSON array
+func webhookRecords(records []SinkRecord, values []interface{}) ([]byte, string, error) {
+	body, err := json.Marshal(values)
+	return body, "application/json", err
+}
+
+// slackRecords posts one message with a line per record
+func slackRecords(records []SinkRecord, values []interface{}) ([]byte, string, error) {
+	lines := make([]string, len(values))
+	for i, v := range values {
+		lines[i] = fmt.Sprint(v)
+	}
+	body, err := json.Marshal(map[string]string{"text": strings.Join(lines, "\n")})
+	return body, "application/json", err
+}
+
+// kafkaRecords builds a REST Proxy v2 produce request keyed by block hash
+func kafkaRecords(records []SinkRecord, values []interface{}) ([]byte, string, error) {
+	type kafkaRecord struct {
+		Key   string      `json:"key"`
+		Value interface{} `json:"value"`
+	}
+	msg := struct {
+		Records []kafkaRecord `json:"records"`
+	}{}
+	for i, rec := range records {
+		msg.Records = append(msg.Records, kafkaRecord{rec.Hash, values[i]})
+	}
+	body, err := json.Marshal(msg)
+	return body, "application/vnd.kafka.json.v2+json", err
+}
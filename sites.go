@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sites give Location structure. SITES_FILE is a JSON list of Site, and a
+// write whose Location is a site code (e.g. "SJC1") is tied to that site.
+// Blocks keep only the code: the hash covers what was sent, and the city,
+// country and coordinates of a site can be corrected later without touching
+// the chain. With REQUIRE_SITE=true writes must name a registered site.
+//
+// Blocks are indexed by Location as they are appended, so GET
+// /sites/{code}/blocks answers per-datacenter incident queries without a
+// scan of the chain.
+
+// Site is one entry of SITES_FILE. Country is an ISO 3166 alpha-2 code.
+type Site struct {
+	Code      string  `json:"code"`
+	Name      string  `json:"name,omitempty"`
+	City      string  `json:"city"`
+	Country   string  `json:"country"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// SiteSummary is a site with the number of blocks written from it
+type SiteSummary struct {
+	Site
+	Blocks    int       `json:"blocks"`
+	LastBlock *BlockRef `json:"last_block,omitempty"`
+}
+
+var errUnknownSite = errors.New("Location must be the code of a registered site")
+
+// sites is keyed by siteKey(Code)
+var sites = make(map[string]Site)
+var siteMutex = &sync.RWMutex{}
+
+// siteBlocks maps siteKey(Location) to the indexes of its blocks. Guarded
+// by mutex.
+var siteBlocks = make(map[string][]int)
+
+// siteKey is how codes and Locations are compared
+func siteKey(s string) string {
+	return strings.ToUpper(strings.TrimSpace(normalizeText(s)))
+}
+
+// loadSites reads SITES_FILE
+func loadSites() error {
+	apply, err := prepareSites(map[string]string{"SITES_FILE": os.Getenv("SITES_FILE")})
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareSites validates a reloaded SITES_FILE
+func prepareSites(env map[string]string) (func(), error) {
+	registry := make(map[string]Site)
+	if path := env["SITES_FILE"]; path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var list []Site
+		if err := unmarshalCompat(raw, &list); err != nil {
+			return nil, errors.New("SITES_FILE: " + err.Error())
+		}
+		for _, s := range list {
+			if err := checkSite(s); err != nil {
+				return nil, errors.New("SITES_FILE: " + err.Error())
+			}
+			if _, dup := registry[siteKey(s.Code)]; dup {
+				return nil, errors.New("SITES_FILE: duplicate site " + s.Code)
+			}
+			s.Country = strings.ToUpper(s.Country)
+			registry[siteKey(s.Code)] = s
+		}
+	}
+	return func() {
+		siteMutex.Lock()
+		sites = registry
+		siteMutex.Unlock()
+		if len(registry) > 0 {
+			log.Println("loaded", len(registry), "sites")
+		}
+	}, nil
+}
+
+func checkSite(s Site) error {
+	switch {
+	case s.Code == "" || strings.ContainsAny(s.Code, " /"):
+		return errors.New("site codes must be non-empty without spaces or slashes")
+	case len(s.Country) != 2:
+		return errors.New("site " + s.Code + " needs a two letter Country")
+	case s.Latitude < -90 || s.Latitude > 90 || s.Longitude < -180 || s.Longitude > 180:
+		return errors.New("site " + s.Code + " has coordinates out of range")
+	}
+	return nil
+}
+
+// lookupSite finds the site a Location names
+func lookupSite(location string) (Site, bool) {
+	siteMutex.RLock()
+	defer siteMutex.RUnlock()
+	s, ok := sites[siteKey(location)]
+	return s, ok
+}
+
+// verifySite rejects writes from unknown sites when REQUIRE_SITE=true
+func verifySite(m CreateBlockReq) error {
+	if os.Getenv("REQUIRE_SITE") != "true" {
+		return nil
+	}
+	if _, ok := lookupSite(m.Location); !ok {
+		return errUnknownSite
+	}
+	return nil
+}
+
+// noteSiteLocked indexes b by the Location of its events, once per site.
+// Caller must hold mutex.
+func noteSiteLocked(b Block) {
+	noted := make(map[string]bool)
+	for _, tx := range eventsOf(b) {
+		if key := siteKey(tx.Location); key != "" && !noted[key] {
+			noted[key] = true
+			siteBlocks[key] = append(siteBlocks[key], b.Index)
+		}
+	}
+}
+
+// siteEventIn reports whether b holds event at the site key
+func siteEventIn(b Block, key, event string) bool {
+	for _, tx := range eventsOf(b) {
+		if siteKey(tx.Location) == key && normalizeText(tx.Event) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildSitesLocked indexes every block by Location again. Caller must hold
+// mutex.
+func rebuildSitesLocked() (int, error) {
+	siteBlocks = make(map[string][]int)
+	for _, b := range Blockchain {
+		noteSiteLocked(b)
+	}
+	return len(siteBlocks), nil
+}
+
+// summarizeSiteLocked counts the blocks of s. Caller must hold mutex.
+func summarizeSiteLocked(s Site) SiteSummary {
+	summary := SiteSummary{Site: s}
+	indexes := siteBlocks[siteKey(s.Code)]
+	summary.Blocks = len(indexes)
+	if n := len(indexes); n > 0 && indexes[n-1] < len(Blockchain) {
+		last := Blockchain[indexes[n-1]]
+		summary.LastBlock = &BlockRef{last.Index, last.Hash}
+	}
+	return summary
+}
+
+// list the registered sites with their block counts
+func handleGetSites(w http.ResponseWriter, r *http.Request) {
+	siteMutex.RLock()
+	list := make([]Site, 0, len(sites))
+	for _, s := range sites {
+		list = append(list, s)
+	}
+	siteMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+
+	summaries := make([]SiteSummary, len(list))
+	mutex.Lock()
+	for i, s := range list {
+		summaries[i] = summarizeSiteLocked(s)
+	}
+	mutex.Unlock()
+	respondWithList(w, r, http.StatusOK, summaries)
+}
+
+// show a site and the number of blocks written from it
+func handleGetSite(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSite(mux.Vars(r)["code"])
+	if !ok {
+		http.Error(w, "site not found", http.StatusNotFound)
+		return
+	}
+	mutex.Lock()
+	summary := summarizeSiteLocked(s)
+	mutex.Unlock()
+	respondWithJSON(w, r, http.StatusOK, summary)
+}
+
+// blocks written from site {code}, oldest first, optionally only those with
+// ?event= and committed between ?from= and ?to= (RFC 3339 times). Codes that
+// are not registered still match blocks with that Location.
+func handleGetSiteBlocks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, p.name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+	event := normalizeText(q.Get("event"))
+
+	mutex.Lock()
+	height, err := viewHeightLocked(r)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	blocks := make([]Block, 0)
+	key := siteKey(mux.Vars(r)["code"])
+	for _, i := range siteBlocks[key] {
+		if i > height || i >= len(Blockchain) {
+			break
+		}
+		b := Blockchain[i]
+		if event != "" && !siteEventIn(b, key, event) {
+			continue
+		}
+		if !from.IsZero() || !to.IsZero() {
+			t, ok := parseBlockTime(b.Timestamp)
+			if !ok || (!from.IsZero() && t.Before(from)) || (!to.IsZero() && t.After(to)) {
+				continue
+			}
+		}
+		blocks = append(blocks, b)
+	}
+	mutex.Unlock()
+	respondWithBlocks(w, r, http.StatusOK, blocks)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Block sizes are maintained as blocks are appended. Size is the length of a
+// block's JSON encoding, the line the jsonl store writes for it, and
+// ChainSize the sum of the sizes up to and including it. Neither is part of
+// the block or its hash, every node derives the same values.
+//
+// Block responses offer them as ?fields=size,chain_size, and single block
+// responses always carry them as the Block-Size and Chain-Size headers. With
+// MAX_BLOCK_SIZE set, writes that would mint a larger block are refused.
+
+var errBlockTooLarge = errors.New("block exceeds MAX_BLOCK_SIZE")
+
+// blockSize is the size of the block at its index in Blockchain
+type blockSize struct {
+	hash  string
+	size  int
+	total int64
+}
+
+// blockSizes has its own lock so block responses can read it without
+// holding mutex. Entries are appended while holding mutex.
+var blockSizes = struct {
+	mutex   sync.RWMutex
+	entries []blockSize
+}{}
+
+// encodedSize is the length of b's JSON encoding
+func encodedSize(b Block) int {
+	raw, err := json.Marshal(b)
+	if err != nil {
+		return 0
+	}
+	return len(raw)
+}
+
+// maxBlockSize reads MAX_BLOCK_SIZE on every call so it can be hot
+// reloaded. Zero means no limit.
+func maxBlockSize() int {
+	n, err := strconv.Atoi(os.Getenv("MAX_BLOCK_SIZE"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// checkBlockSize refuses blocks larger than MAX_BLOCK_SIZE
+func checkBlockSize(b Block) error {
+	if max := maxBlockSize(); max > 0 && encodedSize(b) > max {
+		return errBlockTooLarge
+	}
+	return nil
+}
+
+// noteSizesLocked adds the sizes of the blocks appended since the last
+// call. Caller must hold mutex.
+func noteSizesLocked() {
+	blockSizes.mutex.Lock()
+	defer blockSizes.mutex.Unlock()
+	var total int64
+	if n := len(blockSizes.entries); n > 0 {
+		total = blockSizes.entries[n-1].total
+	}
+	for i := len(blockSizes.entries); i < len(Blockchain); i++ {
+		size := encodedSize(Blockchain[i])
+		total += int64(size)
+		blockSizes.entries = append(blockSizes.entries, blockSize{Blockchain[i].Hash, size, total})
+	}
+}
+
+// rebuildSizesLocked computes the sizes of every block again. Caller must
+// hold mutex.
+func rebuildSizesLocked() (int, error) {
+	blockSizes.mutex.Lock()
+	blockSizes.entries = nil
+	blockSizes.mutex.Unlock()
+	noteSizesLocked()
+	return len(Blockchain), nil
+}
+
+// sizeOf returns the sizes of b, if it is on the chain
+func sizeOf(b Block) (blockSize, bool) {
+	blockSizes.mutex.RLock()
+	defer blockSizes.mutex.RUnlock()
+	if b.Index < 0 || b.Index >= len(blockSizes.entries) || blockSizes.entries[b.Index].hash != b.Hash {
+		return blockSize{}, false
+	}
+	return blockSizes.entries[b.Index], true
+}
+
+// chainSize is the sum of the sizes of every block
+func chainSize() int64 {
+	blockSizes.mutex.RLock()
+	defer blockSizes.mutex.RUnlock()
+	if n := len(blockSizes.entries); n > 0 {
+		return blockSizes.entries[n-1].total
+	}
+	return 0
+}
+
+// setSizeHeaders adds the Block-Size and Chain-Size headers for b
+func setSizeHeaders(w http.ResponseWriter, b Block) {
+	if s, ok := sizeOf(b); ok {
+		w.Header().Set("Block-Size", strconv.Itoa(s.size))
+		w.Header().Set("Chain-Size", strconv.FormatInt(s.total, 10))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// POST /snapshots pins the current head and returns a token. Reads given
+// ?snapshot=<token> are answered as of the pinned height, so an audit made
+// of several requests sees one consistent chain while writes continue.
+// Tokens expire SNAPSHOT_TTL (default 1h) after they were taken.
+
+// Snapshot is a pinned view of the chain
+type Snapshot struct {
+	ID       string `json:"id"`
+	Height   int    `json:"height"`
+	HeadHash string `json:"head_hash"`
+	Created  string `json:"created"`
+	Expires  string `json:"expires"`
+
+	expires time.Time
+}
+
+var errSnapshotNotFound = errors.New("unknown or expired snapshot")
+
+var snapshots = make(map[string]*Snapshot)
+var snapshotMutex = &sync.Mutex{}
+
+func snapshotTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SNAPSHOT_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return time.Hour
+}
+
+// pin the current head for later ?snapshot= reads
+func handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	s := &Snapshot{ID: hex.EncodeToString(raw), Created: now.UTC().Format(time.RFC3339), expires: now.Add(snapshotTTL())}
+	s.Expires = s.expires.UTC().Format(time.RFC3339)
+
+	mutex.Lock()
+	s.Height = len(Blockchain) - 1
+	s.HeadHash = Blockchain[s.Height].Hash
+	mutex.Unlock()
+
+	snapshotMutex.Lock()
+	for id, old := range snapshots {
+		if now.After(old.expires) {
+			delete(snapshots, id)
+		}
+	}
+	snapshots[s.ID] = s
+	snapshotMutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusCreated, s)
+}
+
+// viewHeightLocked is the last block index a read may see: the pinned
+// height with ?snapshot=, the head otherwise. Caller must hold mutex.
+func viewHeightLocked(r *http.Request) (int, error) {
+	id := r.URL.Query().Get("snapshot")
+	if id == "" {
+		return len(Blockchain) - 1, nil
+	}
+	snapshotMutex.Lock()
+	s, ok := snapshots[id]
+	if ok && time.Now().After(s.expires) {
+		delete(snapshots, id)
+		ok = false
+	}
+	snapshotMutex.Unlock()
+	if !ok || s.Height >= len(Blockchain) || Blockchain[s.Height].Hash != s.HeadHash {
+		return 0, errSnapshotNotFound
+	}
+	return s.Height, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A warm standby follows a primary and takes over its writes when it dies.
+// With STANDBY_PRIMARY set to the URL of one of the PEERS the node refuses
+// writes and pulls the primary's new blocks every STANDBY_INTERVAL (default
+// 1s), on top of the blocks the primary pushes to it. Blocks go through the
+// usual append path, so every index is current when the node is promoted.
+//
+// POST /promote makes the standby a primary. While the primary still
+// answers promotion is refused without ?force=true, so two nodes don't take
+// writes, and a forced promotion first fetches what the standby is missing.
+// A promoted node records it in DATA_DIR/promoted.json and stays primary
+// after a restart; remove STANDBY_PRIMARY from its config.
+
+var errStandby = errors.New("node is a standby, write to the primary")
+
+// StandbyStatus is the response of GET /standby
+type StandbyStatus struct {
+	Standby     bool     `json:"standby"`
+	Primary     string   `json:"primary,omitempty"`
+	PrimaryHead int      `json:"primary_head"`
+	Head        BlockRef `json:"head"`
+	Lag         int      `json:"lag"`
+	LastSync    string   `json:"last_sync,omitempty"`
+	LastError   string   `json:"last_error,omitempty"`
+	Promoted    string   `json:"promoted,omitempty"`
+}
+
+// standby is guarded by standbyMutex. primary is nil on a primary.
+var standby struct {
+	primary   *Peer
+	lastSync  time.Time
+	lastError string
+	promoted  string
+}
+var standbyMutex = &sync.Mutex{}
+
+// isStandby reports whether writes go to another node
+func isStandby() bool {
+	standbyMutex.Lock()
+	defer standbyMutex.Unlock()
+	return standby.primary != nil
+}
+
+// checkStandby refuses to mint blocks on a standby
+func checkStandby() error {
+	if isStandby() {
+		return errStandby
+	}
+	return nil
+}
+
+// startStandby follows STANDBY_PRIMARY unless this node was promoted
+func startStandby() error {
+	url := strings.TrimRight(os.Getenv("STANDBY_PRIMARY"), "/")
+	if url == "" {
+		return nil
+	}
+	if poaEnabled() {
+		return errors.New("STANDBY_PRIMARY is not supported with CONSENSUS=poa, validators already replicate the chain")
+	}
+	if promoted, ok := loadPromotion(); ok {
+		standby.promoted = promoted
+		log.Println("promoted from standby at", promoted, "- remove STANDBY_PRIMARY from the config")
+		return nil
+	}
+	var primary *Peer
+	for _, p := range peers {
+		if p.URL == url {
+			primary = p
+		}
+	}
+	if primary == nil {
+		return errors.New("STANDBY_PRIMARY must be one of PEERS")
+	}
+	interval := time.Second
+	if v := os.Getenv("STANDBY_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return errors.New("STANDBY_INTERVAL must be a positive duration")
+		}
+	}
+
+	standbyMutex.Lock()
+	standby.primary = primary
+	standbyMutex.Unlock()
+	go func() {
+		for range time.Tick(interval) {
+			standbyMutex.Lock()
+			p := standby.primary
+			standbyMutex.Unlock()
+			if p == nil {
+				return
+			}
+			followPrimary(p)
+		}
+	}()
+	log.Println("warm standby of", url)
+	return nil
+}
+
+// followPrimary applies the primary's new blocks and records the outcome
+func followPrimary(p *Peer) error {
+	err := syncFromPeer(p)
+	standbyMutex.Lock()
+	defer standbyMutex.Unlock()
+	if err != nil {
+		standby.lastError = err.Error()
+		return err
+	}
+	standby.lastSync, standby.lastError = time.Now(), ""
+	return nil
+}
+
+// loadPromotion reads the time this node was promoted, if it was
+func loadPromotion() (string, bool) {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return "", false
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "promoted.json"))
+	if err != nil {
+		return "", false
+	}
+	var p struct {
+		Promoted string `json:"promoted"`
+	}
+	if json.Unmarshal(raw, &p) != nil || p.Promoted == "" {
+		return "", false
+	}
+	return p.Promoted, true
+}
+
+// savePromotion records the promotion so a restart keeps the node primary
+func savePromotion(promoted string) error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	raw, err := json.Marshal(map[string]string{"promoted": promoted})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "promoted.json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// standbyStatus compares our head with the primary's last known one
+func standbyStatus() StandbyStatus {
+	standbyMutex.Lock()
+	s := StandbyStatus{Standby: standby.primary != nil, LastError: standby.lastError, Promoted: standby.promoted}
+	if !standby.lastSync.IsZero() {
+		s.LastSync = standby.lastSync.UTC().Format(time.RFC3339)
+	}
+	p := standby.primary
+	standbyMutex.Unlock()
+
+	mutex.Lock()
+	if len(Blockchain) > 0 {
+		head := Blockchain[len(Blockchain)-1]
+		s.Head = BlockRef{head.Index, head.Hash}
+	}
+	mutex.Unlock()
+	if p != nil {
+		peerMutex.Lock()
+		s.Primary, s.PrimaryHead = p.URL, p.Height
+		peerMutex.Unlock()
+		if s.PrimaryHead > s.Head.Index {
+			s.Lag = s.PrimaryHead - s.Head.Index
+		}
+	}
+	return s
+}
+
+// replication state of a standby
+func handleGetStandby(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, http.StatusOK, standbyStatus())
+}
+
+// promote this standby to primary, see the comment at the top
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	standbyMutex.Lock()
+	p := standby.primary
+	standbyMutex.Unlock()
+	if p == nil {
+		http.Error(w, "node is not a standby", http.StatusConflict)
+		return
+	}
+
+	// a primary that answers is alive: only take over if told to, after
+	// catching up with it
+	if _, err := fetchDigest(p, nil); err == nil {
+		if r.URL.Query().Get("force") != "true" {
+			http.Error(w, "primary "+p.URL+" is still answering, promote with ?force=true to take over anyway", http.StatusConflict)
+			return
+		}
+		if err := followPrimary(p); err != nil {
+			log.Println("final sync from the primary failed:", err)
+		}
+	} else {
+		log.Println("primary unreachable, promoting:", err)
+	}
+
+	promoted := time.Now().UTC().Format(time.RFC3339)
+	if err := savePromotion(promoted); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	standbyMutex.Lock()
+	standby.primary, standby.promoted = nil, promoted
+	standbyMutex.Unlock()
+	log.Println("promoted to primary, taking writes")
+	respondWithJSON(w, r, http.StatusOK, standbyStatus())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Statistics are kept as per-day aggregates folded in as blocks are
+// appended, never recomputed from block bodies. With DATA_DIR they are saved
+// to stats.json, so ranges whose bodies were archived and pruned still count.
+// Bytes only counts blocks folded in since sizes were recorded, POST
+// /reindex recounts the blocks still loaded.
+
+// PeriodStats aggregates the blocks written on one UTC day
+type PeriodStats struct {
+	Period   string         `json:"period"`
+	Blocks   int            `json:"blocks"`
+	Bytes    int64          `json:"bytes"`
+	ByEvent  map[string]int `json:"by_event"`
+	ByServer map[string]int `json:"by_server"`
+	ByMinter map[string]int `json:"by_minter,omitempty"`
+}
+
+// StatsResp is the response of GET /stats. ChainSize is the size of the
+// whole loaded chain and MaxBlockSize the MAX_BLOCK_SIZE in force.
+type StatsResp struct {
+	Through      int            `json:"through"`
+	Blocks       int            `json:"blocks"`
+	Bytes        int64          `json:"bytes"`
+	ChainSize    int64          `json:"chain_size"`
+	MaxBlockSize int            `json:"max_block_size,omitempty"`
+	ByEvent      map[string]int `json:"by_event"`
+	ByServer     map[string]int `json:"by_server"`
+	ByMinter     map[string]int `json:"by_minter"`
+	Periods      []PeriodStats  `json:"periods,omitempty"`
+}
+
+// chainStats is guarded by mutex. Through is the index of the last block
+// folded in.
+var chainStats = struct {
+	Through int
+	Periods map[string]*PeriodStats
+}{Periods: make(map[string]*PeriodStats)}
+
+// loadStats reads stats.json and folds in any loaded blocks it doesn't cover
+func loadStats() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "stats.json"))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		default:
+			if err := unmarshalCompat(raw, &chainStats); err != nil {
+				return err
+			}
+		}
+	}
+	for _, b := range Blockchain {
+		if b.Index > chainStats.Through {
+			foldStatsLocked(b)
+		}
+	}
+	return saveStatsLocked()
+}
+
+// foldStatsLocked adds a block to the aggregates. Caller must hold mutex.
+func foldStatsLocked(b Block) {
+	if b.Index <= chainStats.Through {
+		return
+	}
+	period := "unknown"
+	if t, ok := parseBlockTime(b.Timestamp); ok {
+		period = t.UTC().Format("2006-01-02")
+	}
+	p, ok := chainStats.Periods[period]
+	if !ok {
+		p = &PeriodStats{Period: period, ByEvent: make(map[string]int), ByServer: make(map[string]int)}
+		chainStats.Periods[period] = p
+	}
+	p.Blocks++
+	p.Bytes += int64(encodedSize(b))
+	for _, tx := range eventsOf(b) {
+		p.ByEvent[tx.Event]++
+		p.ByServer[tx.Server]++
+	}
+	if m, ok := minterOf(b); ok {
+		// stats.json saved before minters were recorded has no ByMinter
+		if p.ByMinter == nil {
+			p.ByMinter = make(map[string]int)
+		}
+		p.ByMinter[m.Node]++
+	}
+	chainStats.Through = b.Index
+}
+
+// saveStatsLocked writes the aggregates atomically. Caller must hold mutex.
+func saveStatsLocked() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	raw, err := json.Marshal(chainStats)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "stats.json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// recordStatsLocked folds in a newly appended block and saves. A failed save
+// only loses the aggregates since the last save, which loadStats rebuilds
+// from blocks still on disk.
+func recordStatsLocked(b Block) {
+	foldStatsLocked(b)
+	if err := saveStatsLocked(); err != nil {
+		log.Println("saving stats failed:", err)
+	}
+}
+
+// block counts over the whole history, optionally limited to the UTC days
+// ?from=YYYY-MM-DD and ?to=YYYY-MM-DD; ?periods=true adds per-day rows
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	for _, d := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			http.Error(w, "from and to must be dates like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := StatsResp{ChainSize: chainSize(), MaxBlockSize: maxBlockSize(), ByEvent: make(map[string]int), ByServer: make(map[string]int), ByMinter: make(map[string]int)}
+	mutex.Lock()
+	resp.Through = chainStats.Through
+	for _, p := range chainStats.Periods {
+		if (from != "" && p.Period < from) || (to != "" && p.Period > to) {
+			continue
+		}
+		resp.Blocks += p.Blocks
+		resp.Bytes += p.Bytes
+		for k, n := range p.ByEvent {
+			resp.ByEvent[k] += n
+		}
+		for k, n := range p.ByServer {
+			resp.ByServer[k] += n
+		}
+		for k, n := range p.ByMinter {
+			resp.ByMinter[k] += n
+		}
+		if r.URL.Query().Get("periods") == "true" {
+			row := PeriodStats{p.Period, p.Blocks, p.Bytes, make(map[string]int), make(map[string]int), nil}
+			for k, n := range p.ByEvent {
+				row.ByEvent[k] = n
+			}
+			for k, n := range p.ByServer {
+				row.ByServer[k] = n
+			}
+			if len(p.ByMinter) > 0 {
+				row.ByMinter = make(map[string]int)
+				for k, n := range p.ByMinter {
+					row.ByMinter[k] = n
+				}
+			}
+			resp.Periods = append(resp.Periods, row)
+		}
+	}
+	mutex.Unlock()
+
+	sort.Slice(resp.Periods, func(i, j int) bool { return resp.Periods[i].Period < resp.Periods[j].Period })
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
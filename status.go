@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// NodeStatus is a one-document summary of the node for fleet monitoring
+type NodeStatus struct {
+	Node       string            `json:"node"`
+	Consensus  string            `json:"consensus"`
+	Height     int               `json:"height"`
+	Head       BlockRef          `json:"head"`
+	Peers      int               `json:"peers"`
+	PeerLag    int               `json:"peer_lag"`
+	Storage    string            `json:"storage"`
+	StorageErr string            `json:"storage_err,omitempty"`
+	ChainErr   string            `json:"chain_err,omitempty"`
+	Encryption *EncryptionStatus `json:"encryption,omitempty"`
+	Pending    PendingStatus     `json:"pending"`
+	Streams    int               `json:"streams"`
+	Started    string            `json:"started"`
+	Uptime     string            `json:"uptime"`
+}
+
+// PendingStatus counts work accepted but not yet finished
+type PendingStatus struct {
+	Proposals int `json:"proposals"`
+	PeerQueue int `json:"peer_queue"`
+}
+
+var startTime = time.Now()
+
+// nodeID names this node in status output, NODE_ID or the hostname
+func nodeID() string {
+	if id := os.Getenv("NODE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// storageHealth reports "memory" without DATA_DIR, "full" while writes are
+// suspended for lack of space, otherwise whether the store still answers
+func storageHealth() (string, error) {
+	if store == nil {
+		return "memory", nil
+	}
+	if reason, full := storageDegraded(); full {
+		return "full", errors.New(reason)
+	}
+	if _, err := store.SchemaVersion(); err != nil {
+		return "error", err
+	}
+	return "ok", nil
+}
+
+// consolidated node status
+func handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	s := NodeStatus{
+		Node:      nodeID(),
+		Consensus: "single",
+		Started:   startTime.String(),
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+	if poaEnabled() {
+		s.Consensus = "poa"
+	}
+	if powEnabled() {
+		s.Consensus = "pow"
+	}
+	if raftEnabled() {
+		s.Consensus = "raft"
+	}
+
+	mutex.Lock()
+	s.Height = len(Blockchain) - 1
+	if s.Height >= 0 {
+		head := Blockchain[s.Height]
+		s.Head = BlockRef{head.Index, head.Hash}
+	}
+	if chainCorruption != nil {
+		s.ChainErr = chainCorruption.Error()
+	}
+	mutex.Unlock()
+
+	// lag is how far we are behind the highest peer seen during sync
+	peerMutex.Lock()
+	s.Peers = len(peers)
+	for _, p := range peers {
+		if p.Height-s.Height > s.PeerLag {
+			s.PeerLag = p.Height - s.Height
+		}
+		s.Pending.PeerQueue += len(p.queue)
+	}
+	peerMutex.Unlock()
+
+	s.Streams = streamClients()
+
+	proposalMutex.Lock()
+	for _, p := range proposals {
+		if p.State == proposalPending {
+			s.Pending.Proposals++
+		}
+	}
+	proposalMutex.Unlock()
+
+	status := http.StatusOK
+	health, err := storageHealth()
+	s.Storage = health
+	if err != nil {
+		s.StorageErr = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	if s.ChainErr != "" {
+		status = http.StatusServiceUnavailable
+	}
+	if es, ok := store.(*encryptedStore); ok {
+		st := es.status()
+		s.Encryption = &st
+	}
+	respondWithJSON(w, r, status, s)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Store persists blocks so the chain survives restarts
+type Store interface {
+	// Append durably writes a block after the current last one
+	Append(b Block) error
+	// Load returns all persisted blocks in chain order
+	Load() ([]Block, error)
+	// Rewrite replaces every persisted block, used by migrations
+	Rewrite(blocks []Block) error
+	// SchemaVersion is the layout version the data was written with
+	SchemaVersion() (int, error)
+	SetSchemaVersion(v int) error
+	Close() error
+}
+
+// store is nil when DATA_DIR is unset and the chain only lives in memory
+var store Store
+
+// openStore opens the store in DATA_DIR and brings it to the latest schema
+func openStore() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		log.Println("DATA_DIR not set, chain will not be persisted")
+		return nil
+	}
+
+	s, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+	if err := upgradeOnStart(s); err != nil {
+		s.Close()
+		return err
+	}
+	store = s
+	return nil
+}
+
+// newStore opens the storage layout selected by STORAGE: jsonl (default),
+// mmap, see mmapStore, encrypted, see encryptedStore, or bolt, see boltStore
+func newStore(dir string) (Store, error) {
+	switch os.Getenv("STORAGE") {
+	case "", "jsonl":
+		return newFileStore(dir)
+	case "mmap":
+		return newMmapStore(dir)
+	case "encrypted":
+		return newEncryptedStore(dir)
+	case "bolt":
+		return newBoltStore(dir)
+	default:
+		return nil, errors.New("STORAGE must be jsonl, mmap, encrypted or bolt")
+	}
+}
+
+// loadChain reads the persisted chain into Blockchain and BlockMap
+func loadChain() error {
+	if store == nil {
+		return nil
+	}
+	blocks, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	Blockchain = blocks
+	if err := verifyLoadedChainLocked(); err != nil {
+		return err
+	}
+	for i := range Blockchain {
+		BlockMap[Blockchain[i].Hash] = &Blockchain[i]
+	}
+	rebuildSourcesLocked()
+	rebuildSitesLocked()
+	rebuildMintersLocked()
+	rebuildSizesLocked()
+	rebuildTransactionsLocked()
+	log.Println("loaded", len(Blockchain), "blocks from storage")
+	return nil
+}
+
+// fileStore keeps one JSON encoded block per line in DATA_DIR/chain.jsonl
+// and the schema version in DATA_DIR/SCHEMA
+type fileStore struct {
+	dir  string
+	file *os.File
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "chain.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir, file: f}, nil
+}
+
+func (s *fileStore) Append(b Block) error {
+	line, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// AppendBatch writes several blocks with one write and one fsync
+func (s *fileStore) AppendBatch(blocks []Block) error {
+	var buf []byte
+	for _, b := range blocks {
+		line, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileStore) Load() ([]Block, error) {
+	f, err := os.Open(s.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var blocks []Block
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var b Block
+		if err := unmarshalCompat(scanner.Bytes(), &b); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, scanner.Err()
+}
+
+// Rewrite writes the new log next to the old one and renames it into place
+func (s *fileStore) Rewrite(blocks []Block) error {
+	tmp := s.file.Name() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, b := range blocks {
+		line, err := json.Marshal(b)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.file.Name()); err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file, err = os.OpenFile(s.file.Name(), os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func (s *fileStore) SchemaVersion() (int, error) {
+	return readSchemaVersion(s.dir)
+}
+
+func (s *fileStore) SetSchemaVersion(v int) error {
+	return writeSchemaVersion(s.dir, v)
+}
+
+func (s *fileStore) Close() error {
+	return s.file.Close()
+}
+
+// readSchemaVersion returns 0 for a data directory that was never stamped
+func readSchemaVersion(dir string) (int, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "SCHEMA"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(raw)))
+}
+
+func writeSchemaVersion(dir string, v int) error {
+	return ioutil.WriteFile(filepath.Join(dir, "SCHEMA"), []byte(strconv.Itoa(v)+"\n"), 0600)
+}
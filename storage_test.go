@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// storageTestBlocks use every Block field a store must keep
+func storageTestBlocks() []Block {
+	txs := []Transaction{
+		{Event: "door opened", Server: "reader-1", Metadata: json.RawMessage(`{"badge":"42"}`)},
+		{Event: "door closed", Server: "reader-1", DeviceKey: "k1", DeviceHMAC: "00ff"},
+	}
+	return []Block{
+		{Index: 0, Timestamp: "2024-01-01 00:00:00 +0000 UTC", Hash: calculateHash(Block{})},
+		{Index: 1, Timestamp: "2024-01-01 00:00:01 +0000 UTC", FileHash: "abc", Event: "login", EventTime: "2024-01-01T00:00:00Z",
+			Location: "SJC", Server: "s1", Hash: "h1", PrevHash: calculateHash(Block{}), Approvals: []Approval{{Validator: "v1", Signature: "sig"}},
+			DeviceKey: "k1", DeviceHMAC: "00ff", BackfilledBy: "importer", Signer: "CN=appliance", SignerCert: "cafe",
+			Metadata: json.RawMessage(`{"vendor":"acme"}`), Difficulty: 2, Nonce: "17"},
+		{Index: 2, Timestamp: "2024-01-01 00:00:02 +0000 UTC", Event: batchEvent, Hash: "h2", PrevHash: "h1",
+			Transactions: txs, MerkleRoot: transactionsRoot(txs)},
+	}
+}
+
+// sameBlocks compares blocks by their JSON encoding
+func sameBlocks(t *testing.T, got, want []Block) bool {
+	t.Helper()
+	a, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(a) == string(b)
+}
+
+func TestStoresRoundTripAndReopen(t *testing.T) {
+	for _, layout := range []string{"jsonl", "mmap", "encrypted", "bolt"} {
+		t.Run(layout, func(t *testing.T) {
+			if layout == "mmap" && !mmapSupported {
+				t.Skip("STORAGE=mmap is not supported on this platform")
+			}
+			t.Setenv("STORAGE", layout)
+			t.Setenv("TEST_STORAGE_PASSPHRASE", "correct horse battery staple")
+			t.Setenv("STORAGE_MASTER_KEY", "passphrase:TEST_STORAGE_PASSPHRASE")
+			t.Setenv("STORAGE_OLD_MASTER_KEYS", "")
+			dir := t.TempDir()
+			blocks := storageTestBlocks()
+
+			s, err := newStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := upgradeOnStart(s); err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range blocks {
+				if err := s.Append(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			loaded, err := s.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameBlocks(t, loaded, blocks) {
+				t.Errorf("loaded %+v", loaded)
+			}
+			s.Close()
+
+			// reopening finds the blocks and the schema version
+			if s, err = newStore(dir); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := s.SchemaVersion(); err != nil || v != latestSchemaVersion() {
+				t.Errorf("schema version %d (%v) after reopening", v, err)
+			}
+			if loaded, err = s.Load(); err != nil {
+				t.Fatal(err)
+			}
+			if !sameBlocks(t, loaded, blocks) {
+				t.Errorf("loaded %+v after reopening", loaded)
+			}
+			next := Block{Index: 3, Timestamp: "2024-01-01 00:00:03 +0000 UTC", Event: "logout", Hash: "h3", PrevHash: "h2"}
+			if err := s.Append(next); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Rewrite(blocks[:2]); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			if s, err = newStore(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if loaded, err = s.Load(); err != nil {
+				t.Fatal(err)
+			}
+			if !sameBlocks(t, loaded, blocks[:2]) {
+				t.Errorf("loaded %+v after a rewrite", loaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Storage full degradation. When free space in DATA_DIR drops below
+// STORAGE_MIN_FREE_MB (default 256), or an append fails with ENOSPC, the
+// node stops accepting writes with 507 Insufficient Storage and keeps
+// serving reads. Writes resume by themselves once STORAGE_RESUME_FREE_MB
+// (default twice the minimum) is free again, e.g. after pruning old files.
+
+// how often free space is checked
+const storageCheckInterval = 10 * time.Second
+
+var errStorageFull = errors.New("storage is full, writes are suspended")
+
+// storageState is whether writes are suspended for lack of space
+type storageState struct {
+	mutex    sync.Mutex
+	degraded bool
+	since    time.Time
+	reason   string
+	free     uint64
+	minFree  uint64
+	resume   uint64
+}
+
+var storageSpace = &storageState{}
+
+// startStorageWatch reads the thresholds and checks free space until exit
+func startStorageWatch() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+	minFree, err := megabytesSetting("STORAGE_MIN_FREE_MB", 256)
+	if err != nil {
+		return err
+	}
+	resume, err := megabytesSetting("STORAGE_RESUME_FREE_MB", 2*minFree>>20)
+	if err != nil {
+		return err
+	}
+	if resume < minFree {
+		return errors.New("STORAGE_RESUME_FREE_MB must not be below STORAGE_MIN_FREE_MB")
+	}
+	storageSpace.mutex.Lock()
+	storageSpace.minFree, storageSpace.resume = minFree, resume
+	storageSpace.mutex.Unlock()
+
+	if _, err := freeBytes(dir); err != nil {
+		log.Println("free space checks disabled:", err)
+		return nil
+	}
+	checkStorageSpace(dir)
+	go func() {
+		for range time.Tick(storageCheckInterval) {
+			checkStorageSpace(dir)
+		}
+	}()
+	return nil
+}
+
+func megabytesSetting(key string, def uint64) (uint64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def << 20, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, errors.New(key + " must be a number of MiB")
+	}
+	return n << 20, nil
+}
+
+// checkStorageSpace enters or leaves degraded mode for the free space in dir
+func checkStorageSpace(dir string) {
+	free, err := freeBytes(dir)
+	if err != nil {
+		log.Println("checking free space failed:", err)
+		return
+	}
+	storageSpace.mutex.Lock()
+	defer storageSpace.mutex.Unlock()
+	storageSpace.free = free
+	switch {
+	case !storageSpace.degraded && free < storageSpace.minFree:
+		storageSpace.enterLocked("free space below STORAGE_MIN_FREE_MB")
+	case storageSpace.degraded && free >= storageSpace.resume:
+		log.Printf("ALERT storage recovered: %d MiB free, resuming writes after %s",
+			free>>20, time.Since(storageSpace.since).Round(time.Second))
+		storageSpace.degraded, storageSpace.reason = false, ""
+	}
+}
+
+func (s *storageState) enterLocked(reason string) {
+	s.degraded, s.since, s.reason = true, time.Now(), reason
+	log.Printf("ALERT storage full (%s): %d MiB free, rejecting writes until %d MiB are free",
+		reason, s.free>>20, s.resume>>20)
+}
+
+// noteStorageError puts the node in degraded mode when a write failed
+// because the disk is full
+func noteStorageError(err error) {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+	storageSpace.mutex.Lock()
+	if !storageSpace.degraded {
+		storageSpace.enterLocked("append failed: " + err.Error())
+	}
+	storageSpace.mutex.Unlock()
+}
+
+// checkStorage rejects writes while storage is degraded
+func checkStorage() error {
+	storageSpace.mutex.Lock()
+	defer storageSpace.mutex.Unlock()
+	if storageSpace.degraded {
+		return errStorageFull
+	}
+	return nil
+}
+
+// storageDegraded reports the reason writes are suspended, if they are
+func storageDegraded() (string, bool) {
+	storageSpace.mutex.Lock()
+	defer storageSpace.mutex.Unlock()
+	return storageSpace.reason, storageSpace.degraded
+}
+
+// retry-after for a write refused for lack of space
+const retryAfterStorage = "60"
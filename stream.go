@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /events/stream sends committed blocks as Server-Sent Events. Each
+// event's id is the block index, so a reconnecting client (browsers do this
+// by themselves) resumes after the last block it saw via Last-Event-ID.
+
+// how often an idle stream sends a comment to keep proxies from closing it
+const streamHeartbeat = 15 * time.Second
+
+// blocks buffered per subscriber; a client that falls further behind is
+// disconnected and has to resume with Last-Event-ID
+const streamBuffer = 256
+
+// streamFilter is one Field=value (exact) or Field~value (substring) term
+type streamFilter struct {
+	field    string
+	value    string
+	contains bool
+}
+
+var streamSubscribers = make(map[chan Block]bool)
+var streamMutex = &sync.Mutex{}
+
+// parseStreamFilter parses ?filter=Event=login,Server~vpn. Terms are ANDed.
+func parseStreamFilter(v string) ([]streamFilter, error) {
+	var filters []streamFilter
+	for _, term := range strings.Split(v, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		i := strings.IndexAny(term, "=~")
+		if i <= 0 {
+			return nil, errors.New("filter terms look like Field=value or Field~value")
+		}
+		f := streamFilter{term[:i], term[i+1:], term[i] == '~'}
+		if !blockFieldNames[f.field] {
+			return nil, errors.New("unknown filter field " + f.field)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// streamMatches reports whether any event of b passes every filter term
+func streamMatches(b Block, filters []streamFilter) bool {
+	for _, tx := range eventsOf(b) {
+		if eventMatches(eventBlock(b, tx), filters) {
+			return true
+		}
+	}
+	return false
+}
+
+func eventMatches(b Block, filters []streamFilter) bool {
+	for _, f := range filters {
+		got := fmt.Sprint(blockFields(b, []string{f.field})[f.field])
+		if f.field == "Metadata" {
+			got = string(b.Metadata)
+		}
+		if f.contains && !strings.Contains(got, f.value) || !f.contains && got != f.value {
+			return false
+		}
+	}
+	return true
+}
+
+// publishBlockLocked hands a committed block to every stream. Caller must
+// hold mutex, which keeps blocks in order.
+func publishBlockLocked(b Block) {
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+	for ch := range streamSubscribers {
+		select {
+		case ch <- b:
+		default:
+			// too slow, the handler notices the closed channel and hangs up
+			delete(streamSubscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// stream committed blocks matching ?filter= as Server-Sent Events
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseStreamFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after := -1
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if after, err = strconv.Atoi(v); err != nil || after < -1 {
+			http.Error(w, "Last-Event-ID must be a block index", http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe and take the backlog under the chain lock so no block is
+	// missed or sent twice
+	ch := make(chan Block, streamBuffer)
+	mutex.Lock()
+	var backlog []Block
+	if after >= 0 {
+		for i := after + 1; i < len(Blockchain); i++ {
+			backlog = append(backlog, Blockchain[i])
+		}
+	}
+	streamMutex.Lock()
+	streamSubscribers[ch] = true
+	streamMutex.Unlock()
+	mutex.Unlock()
+	defer func() {
+		streamMutex.Lock()
+		if streamSubscribers[ch] {
+			delete(streamSubscribers, ch)
+			close(ch)
+		}
+		streamMutex.Unlock()
+	}()
+
+	// the stream outlives the server's write timeout and shouldn't hold a
+	// concurrency slot
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	releaseSlot(r, globalLimiter)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+
+	send := func(b Block) bool {
+		if !streamMatches(b, filters) {
+			return true
+		}
+		data, err := json.Marshal(responseValue(r, b))
+		if err != nil {
+			log.Println(err)
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: block\ndata: %s\n\n", b.Index, data)
+		return err == nil
+	}
+	for _, b := range backlog {
+		if !send(b) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case b, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !send(b) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// streamClients is the number of open event streams, for GET /status
+func streamClients() int {
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+	return len(streamSubscribers)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Writes sent with ?async=true are queued and answered with 202 and a
+// submission ID. A single worker commits them in order and, if the write
+// named a ?callback= URL, POSTs the final Submission there. GET
+// /submissions/{id} reports the state until SUBMISSION_RETENTION (default
+// 24h) after the submission finished.
+
+// submission states
+const (
+	submissionQueued    = "queued"
+	submissionCommitted = "committed"
+	submissionRejected  = "rejected"
+)
+
+// Submission tracks one asynchronous write
+type Submission struct {
+	ID       string    `json:"id"`
+	State    string    `json:"state"`
+	Block    *BlockRef `json:"block,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Callback string    `json:"callback,omitempty"`
+	Created  string    `json:"created"`
+	Finished string    `json:"finished,omitempty"`
+
+	req      CreateBlockReq
+	key      string
+	finished time.Time
+}
+
+// callback delivery attempts and the delay before the first retry
+const callbackAttempts = 5
+const callbackBackoff = time.Second
+
+var errSubmissionQueueFull = errors.New("submission queue is full")
+
+var submissions = make(map[string]*Submission)
+var submissionMutex = &sync.Mutex{}
+var submissionQueue chan *Submission
+var submissionOnce sync.Once
+
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// submitAsync validates the callback URL and queues m for the worker
+func submitAsync(m CreateBlockReq, key, callback string) (Submission, error) {
+	if callback != "" {
+		if _, err := parseNodeURL(callback, "http", "https"); err != nil {
+			return Submission{}, errors.New("callback must be an absolute http or https URL: " + err.Error())
+		}
+	}
+	submissionOnce.Do(startSubmissionWorker)
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return Submission{}, err
+	}
+	s := &Submission{
+		ID:       hex.EncodeToString(raw),
+		State:    submissionQueued,
+		Callback: callback,
+		Created:  time.Now().String(),
+		req:      m,
+		key:      key,
+	}
+
+	submissionMutex.Lock()
+	defer submissionMutex.Unlock()
+	pruneSubmissionsLocked()
+	select {
+	case submissionQueue <- s:
+	default:
+		return Submission{}, errSubmissionQueueFull
+	}
+	submissions[s.ID] = s
+	return *s, nil
+}
+
+// startSubmissionWorker starts the goroutine that commits queued writes.
+// ASYNC_QUEUE bounds the queue (default 1000).
+func startSubmissionWorker() {
+	size := 1000
+	if n, err := strconv.Atoi(os.Getenv("ASYNC_QUEUE")); err == nil && n > 0 {
+		size = n
+	}
+	submissionQueue = make(chan *Submission, size)
+	go func() {
+		for s := range submissionQueue {
+			processSubmission(s)
+		}
+	}()
+}
+
+// processSubmission commits one queued write and reports the outcome
+func processSubmission(s *Submission) {
+	b, err := addBlock(s.req, "")
+	if s.key != "" {
+		if err == nil {
+			finishIdempotent(s.key, &b)
+		} else {
+			finishIdempotent(s.key, nil)
+		}
+	}
+
+	submissionMutex.Lock()
+	s.finished = time.Now()
+	s.Finished = s.finished.String()
+	if err != nil {
+		s.State, s.Reason = submissionRejected, err.Error()
+	} else {
+		s.State, s.Block = submissionCommitted, &BlockRef{b.Index, b.Hash}
+	}
+	result := *s
+	submissionMutex.Unlock()
+
+	if err == nil {
+		recordWrite(s.req, b)
+	} else {
+		log.Printf("submission %s rejected: %v", s.ID, err)
+	}
+	if result.Callback != "" {
+		go deliverCallback(result)
+	}
+}
+
+// deliverCallback POSTs the final submission to its callback URL, retrying
+// with backoff until it gets a 2xx
+func deliverCallback(s Submission) {
+	body, err := marshalAPI(s)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	delay := callbackBackoff
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		resp, err := callbackClient.Post(s.Callback, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("callback for submission %s failed (attempt %d): %v", s.ID, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func submissionRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SUBMISSION_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// pruneSubmissionsLocked forgets submissions that finished longer than the
+// retention window ago. Caller must hold submissionMutex.
+func pruneSubmissionsLocked() {
+	cutoff := time.Now().Add(-submissionRetention())
+	for id, s := range submissions {
+		if s.State != submissionQueued && s.finished.Before(cutoff) {
+			delete(submissions, id)
+		}
+	}
+}
+
+// report the state of an asynchronous write
+func handleGetSubmission(w http.ResponseWriter, r *http.Request) {
+	submissionMutex.Lock()
+	pruneSubmissionsLocked()
+	s, ok := submissions[mux.Vars(r)["id"]]
+	var result Submission
+	if ok {
+		result = *s
+	}
+	submissionMutex.Unlock()
+
+	if !ok {
+		http.Error(w, "submission not found or expired", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, result)
+}
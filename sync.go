@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Digest is a compact summary of a peer's chain: its head plus the block
+// hashes at the heights that were asked for. Because every block hash
+// commits to all earlier blocks, two chains agree up to height h exactly
+// when their hashes at h match, so comparing sampled heights is enough to
+// find where they diverge without sending the blocks themselves.
+type Digest struct {
+	Head   BlockRef   `json:"head"`
+	Hashes []BlockRef `json:"hashes"`
+}
+
+// number of heights sampled per reconciliation round
+const digestSamples = 16
+
+// maximum number of blocks returned by GET /peers/range
+const maxRangeBlocks = 500
+
+// startSync catches up with the peers before the node serves anything, so a
+// node joining late starts with the chain, then pulls missing blocks from
+// every peer each SYNC_INTERVAL
+func startSync() error {
+	if len(peers) == 0 {
+		return nil
+	}
+	interval := 30 * time.Second
+	if v := os.Getenv("SYNC_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+	syncPeers()
+	go func() {
+		for {
+			time.Sleep(interval)
+			syncPeers()
+		}
+	}()
+	return nil
+}
+
+// syncPeers runs one sync round with every peer
+func syncPeers() {
+	for _, p := range peers {
+		if err := syncFromPeer(p); err != nil {
+			log.Printf("sync with %s failed: %v", p.URL, err)
+		}
+	}
+}
+
+// syncFromPeer finds the highest block we share with p and fetches only the
+// blocks after it
+func syncFromPeer(p *Peer) error {
+	theirs, err := fetchDigest(p, nil)
+	if err != nil {
+		return err
+	}
+	peerMutex.Lock()
+	p.Height = theirs.Head.Index
+	p.LastSync = time.Now().String()
+	peerMutex.Unlock()
+
+	mutex.Lock()
+	_, known := BlockMap[theirs.Head.Hash]
+	ourHead := len(Blockchain) - 1
+	mutex.Unlock()
+	if known {
+		return nil
+	}
+	if ourHead == 0 {
+		if err := adoptGenesis(p); err != nil {
+			return err
+		}
+	}
+
+	common, err := findCommonHeight(p, ourHead, theirs.Head.Index)
+	if err != nil {
+		return err
+	}
+	if common < ourHead {
+		return fmt.Errorf("chains diverge after height %d", common)
+	}
+
+	for from := common + 1; from <= theirs.Head.Index; from += maxRangeBlocks {
+		blocks, err := fetchRange(p, from, from+maxRangeBlocks-1)
+		if err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if poaEnabled() && !hasQuorum(b) {
+				return fmt.Errorf("block %d lacks a validator quorum", b.Index)
+			}
+			if err := checkWork(b); err != nil {
+				return err
+			}
+			if err := commitPeerBlock(b); err != nil {
+				return fmt.Errorf("block %d: %v", b.Index, err)
+			}
+		}
+		if len(blocks) == 0 {
+			break
+		}
+	}
+	log.Printf("synced blocks %d-%d from %s", common+1, theirs.Head.Index, p.URL)
+	return nil
+}
+
+// adoptGenesis takes p's genesis block on a node that holds nothing else.
+// The genesis hash doesn't cover its timestamp, so nodes started apart share
+// the hash but not the time, and unless they share GENESIS_TIMESTAMP the
+// first block a late node fetches looks stamped before its own genesis.
+func adoptGenesis(p *Peer) error {
+	blocks, err := fetchRange(p, 0, 0)
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	adopted, err := adoptGenesisLocked(blocks[0])
+	if adopted {
+		log.Println("adopted the genesis block of", p.URL)
+	}
+	return err
+}
+
+// adoptGenesisLocked replaces our genesis block with g when the chain holds
+// nothing else and g only differs in its timestamp. Caller must hold mutex.
+func adoptGenesisLocked(g Block) (bool, error) {
+	if len(Blockchain) != 1 || g.Index != 0 || g.Hash != Blockchain[0].Hash || g.Timestamp == Blockchain[0].Timestamp {
+		return false, nil
+	}
+	if store != nil {
+		if err := store.Rewrite([]Block{g}); err != nil {
+			return false, err
+		}
+	}
+	// a new array, sandboxes may share the old one
+	Blockchain = []Block{g}
+	BlockMap[g.Hash] = &Blockchain[0]
+	rebuildSizesLocked()
+	return true, nil
+}
+
+// findCommonHeight narrows [lo, hi] down to the highest height where both
+// chains hold the same hash, sampling digestSamples heights per round
+func findCommonHeight(p *Peer, ourHead, theirHead int) (int, error) {
+	// peers share a genesis block (same GENESIS_TIMESTAMP), see createGenesisBlock
+	lo, hi := 0, ourHead
+	if theirHead < hi {
+		hi = theirHead
+	}
+	if hi == 0 {
+		return 0, nil
+	}
+
+	// first check the top of the shared range
+	heights := []int{hi}
+	for {
+		theirs, err := fetchDigest(p, heights)
+		if err != nil {
+			return 0, err
+		}
+		mismatch := -1
+		for _, ref := range theirs.Hashes {
+			if hashAt(ref.Index) == ref.Hash {
+				if ref.Index > lo {
+					lo = ref.Index
+				}
+			} else if mismatch == -1 || ref.Index < mismatch {
+				mismatch = ref.Index
+			}
+		}
+		if mismatch == -1 {
+			return lo, nil
+		}
+		hi = mismatch
+		if hi-lo <= 1 {
+			return lo, nil
+		}
+
+		heights = heights[:0]
+		step := (hi - lo) / (digestSamples + 1)
+		if step == 0 {
+			step = 1
+		}
+		for h := lo + step; h < hi && len(heights) < digestSamples; h += step {
+			heights = append(heights, h)
+		}
+	}
+}
+
+// hashAt returns our block hash at height h, or "" past our head
+func hashAt(h int) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if h < 0 || h >= len(Blockchain) {
+		return ""
+	}
+	return Blockchain[h].Hash
+}
+
+func fetchDigest(p *Peer, heights []int) (Digest, error) {
+	var d Digest
+	var hs []string
+	for _, h := range heights {
+		hs = append(hs, strconv.Itoa(h))
+	}
+	err := peerGet(p.URL+"/peers/digest?heights="+strings.Join(hs, ","), &d)
+	return d, err
+}
+
+func fetchRange(p *Peer, from, to int) ([]Block, error) {
+	var blocks []Block
+	err := peerGet(fmt.Sprintf("%s/peers/range?from=%d&to=%d", p.URL, from, to), &blocks)
+	return blocks, err
+}
+
+func peerGet(url string, v interface{}) error {
+	resp, err := peerClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return unmarshalCompat(body, v)
+}
+
+// serve our head and the hashes at ?heights=a,b,c
+func handlePeerDigest(w http.ResponseWriter, r *http.Request) {
+	var d Digest
+	mutex.Lock()
+	head := Blockchain[len(Blockchain)-1]
+	d.Head = BlockRef{head.Index, head.Hash}
+	for _, v := range strings.Split(r.URL.Query().Get("heights"), ",") {
+		h, err := strconv.Atoi(v)
+		if err != nil || h < 0 || h >= len(Blockchain) {
+			continue
+		}
+		d.Hashes = append(d.Hashes, BlockRef{h, Blockchain[h].Hash})
+	}
+	mutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusOK, d)
+}
+
+// serve full blocks ?from= to ?to= (inclusive)
+func handlePeerRange(w http.ResponseWriter, r *http.Request) {
+	from, err1 := strconv.Atoi(r.URL.Query().Get("from"))
+	to, err2 := strconv.Atoi(r.URL.Query().Get("to"))
+	if err1 != nil || err2 != nil || from < 0 || to < from {
+		http.Error(w, "from and to must be a valid height range", http.StatusBadRequest)
+		return
+	}
+	if to-from >= maxRangeBlocks {
+		to = from + maxRangeBlocks - 1
+	}
+
+	blocks := make([]Block, 0)
+	mutex.Lock()
+	for h := from; h <= to && h < len(Blockchain); h++ {
+		blocks = append(blocks, Blockchain[h])
+	}
+	mutex.Unlock()
+
+	respondWithJSON(w, r, http.StatusOK, blocks)
+}
@@ -0,0 +1,277 @@
+// Package testchain generates deterministic chains for testing code that
+// verifies the node's blocks: the same Options always give the same blocks,
+// byte for byte, and the hashes are the ones a node would compute.
+//
+//	chain := testchain.Generate(testchain.Default())
+//	if err := testchain.Verify(chain); err != nil { ... }
+//
+// The golden directory holds fixtures made from Default() for SDKs in other
+// languages, see WriteGolden. Chains use the original SHA-256 block hash;
+// re-anchored chains are not generated.
+package testchain
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Block mirrors the node's block, tagged like its /v2 responses and data
+// files
+type Block struct {
+	Index        int             `json:"index"`
+	Timestamp    string          `json:"timestamp"`
+	FileHash     string          `json:"file_hash"`
+	Event        string          `json:"event"`
+	EventTime    string          `json:"event_time"`
+	Location     string          `json:"location"`
+	Server       string          `json:"server"`
+	Hash         string          `json:"hash"`
+	PrevHash     string          `json:"prev_hash"`
+	DeviceKey    string          `json:"device_key,omitempty"`
+	DeviceHMAC   string          `json:"device_hmac,omitempty"`
+	BackfilledBy string          `json:"backfilled_by,omitempty"`
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+}
+
+// legacyBlock is Block under the Go field names, which nodes answer with
+// unless JSON_FIELD_NAMES=snake_case
+type legacyBlock struct {
+	Index        int
+	Timestamp    string
+	FileHash     string
+	Event        string
+	EventTime    string
+	Location     string
+	Server       string
+	Hash         string
+	PrevHash     string
+	DeviceKey    string          `json:",omitempty"`
+	DeviceHMAC   string          `json:",omitempty"`
+	BackfilledBy string          `json:",omitempty"`
+	Metadata     json.RawMessage `json:",omitempty"`
+}
+
+// Options control a generated chain. Blocks excludes the genesis block.
+type Options struct {
+	Seed     int64         `json:"seed"`
+	Blocks   int           `json:"blocks"`
+	Genesis  string        `json:"genesis"`
+	Start    time.Time     `json:"start"`
+	Interval time.Duration `json:"interval"`
+}
+
+// DeviceKeyID and DeviceSecret sign the device events of generated chains.
+// They predate signed_at: a node accepts them only with REPLAY_MODE=true.
+const DeviceKeyID = "testchain-device"
+
+var DeviceSecret = []byte("testchain device secret")
+
+// Importer names the importer of backfilled blocks
+const Importer = "testchain-importer"
+
+// blockTimeLayout is how the node formats block timestamps
+const blockTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Default is the chain the golden fixtures are made from
+func Default() Options {
+	return Options{
+		Seed:     1,
+		Blocks:   20,
+		Genesis:  "2018-04-23 18:25:43.511 +0000 UTC",
+		Start:    time.Date(2018, 4, 23, 18, 30, 0, 0, time.UTC),
+		Interval: time.Minute,
+	}
+}
+
+var (
+	events    = []string{"login", "logout", "unauthorized access", "file uploaded", "config changed"}
+	servers   = []string{"vpn-1-sjc.ssl.cisco.com", "vpn-2-rtp.ssl.cisco.com", "fw-1-ams"}
+	locations = []string{"San Jose, CA", "Raleigh, NC", "Amsterdam, NL"}
+)
+
+// Generate builds a chain from o. Blocks are plain events, device signed
+// events, backfilled events and events with Metadata, in an order picked
+// by Seed.
+func Generate(o Options) []Block {
+	rng := rand.New(rand.NewSource(o.Seed))
+	genesis := Block{Index: 0, Timestamp: o.Genesis}
+	// the node hashes an empty block for its genesis
+	genesis.Hash = Hash(Block{})
+	chain := []Block{genesis}
+
+	for i := 1; i <= o.Blocks; i++ {
+		prev := chain[len(chain)-1]
+		t := o.Start.Add(time.Duration(i-1) * o.Interval).UTC()
+		digest := sha256.Sum256([]byte("file " + strconv.Itoa(rng.Int())))
+		b := Block{
+			Index:     i,
+			Timestamp: t.Format(blockTimeLayout),
+			FileHash:  hex.EncodeToString(digest[:]),
+			Event:     events[rng.Intn(len(events))],
+			EventTime: t.Add(-time.Duration(rng.Intn(60)) * time.Second).Format(time.RFC3339),
+			Location:  locations[rng.Intn(len(locations))],
+			Server:    servers[rng.Intn(len(servers))],
+			PrevHash:  prev.Hash,
+		}
+		switch rng.Intn(4) {
+		case 1:
+			mac := hmac.New(sha256.New, DeviceSecret)
+			mac.Write([]byte(b.FileHash + b.Event + b.EventTime + b.Location + b.Server))
+			b.DeviceKey, b.DeviceHMAC = DeviceKeyID, hex.EncodeToString(mac.Sum(nil))
+		case 2:
+			b.BackfilledBy = Importer
+			b.EventTime = o.Start.AddDate(0, 0, -rng.Intn(30)-1).UTC().Format(time.RFC3339)
+		case 3:
+			b.Metadata, _ = json.Marshal(map[string]interface{}{
+				"severity": rng.Intn(10),
+				"user":     "user" + strconv.Itoa(rng.Intn(100)),
+			})
+		}
+		b.Hash = Hash(b)
+		chain = append(chain, b)
+	}
+	return chain
+}
+
+// Record is the string the node hashes for b
+func Record(b Block) string {
+	record := strconv.Itoa(b.Index) + b.Timestamp + b.FileHash + b.Event + b.EventTime + b.Location + b.Server + b.PrevHash
+	if b.DeviceKey != "" {
+		record += b.DeviceKey + b.DeviceHMAC
+	}
+	if b.BackfilledBy != "" {
+		record += "backfill" + b.BackfilledBy
+	}
+	if len(b.Metadata) > 0 {
+		var buf bytes.Buffer
+		if json.Compact(&buf, b.Metadata) == nil {
+			record += "meta" + buf.String()
+		} else {
+			record += "meta" + string(b.Metadata)
+		}
+	}
+	return record
+}
+
+// Hash is the SHA-256 block hash of b
+func Hash(b Block) string {
+	sum := sha256.Sum256([]byte(Record(b)))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyError locates the first block of a chain that doesn't verify
+type VerifyError struct {
+	Index  int
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("block %d: %s", e.Index, e.Reason)
+}
+
+// Verify checks indexes, hash links and block hashes. It is the reference
+// for the checks the fixtures expect.
+func Verify(chain []Block) error {
+	for i, b := range chain {
+		switch {
+		case b.Index != i:
+			return &VerifyError{i, "index is " + strconv.Itoa(b.Index)}
+		case i > 0 && b.PrevHash != chain[i-1].Hash:
+			return &VerifyError{i, "PrevHash does not match the previous block"}
+		case i > 0 && b.Hash != Hash(b):
+			return &VerifyError{i, "Hash does not match the block contents"}
+		}
+	}
+	return nil
+}
+
+// TamperEvent returns a copy of chain with the Event of block i changed and
+// the hash left alone, as an edit in place would
+func TamperEvent(chain []Block, i int) []Block {
+	tampered := append([]Block(nil), chain...)
+	tampered[i].Event += " (edited)"
+	return tampered
+}
+
+// BreakLink returns a copy of chain with block i rehashed after an edit, so
+// only the link from block i+1 reveals it
+func BreakLink(chain []Block, i int) []Block {
+	broken := append([]Block(nil), chain...)
+	broken[i].Location = "Nowhere"
+	broken[i].Hash = Hash(broken[i])
+	return broken
+}
+
+// Fixture describes one golden file and what verifying it must give.
+// FailsAt is the index Verify reports, -1 for a valid chain.
+type Fixture struct {
+	File    string `json:"file"`
+	Naming  string `json:"naming"`
+	Valid   bool   `json:"valid"`
+	FailsAt int    `json:"fails_at"`
+	Head    string `json:"head"`
+}
+
+// Manifest is golden/manifest.json
+type Manifest struct {
+	Options      Options   `json:"options"`
+	DeviceKeyID  string    `json:"device_key_id"`
+	DeviceSecret string    `json:"device_secret"`
+	Fixtures     []Fixture `json:"fixtures"`
+}
+
+// WriteGolden writes the fixtures of Default() to dir: the chain with
+// legacy and snake_case field names, two broken copies and manifest.json
+// describing them
+func WriteGolden(dir string) error {
+	chain := Generate(Default())
+	files := []struct {
+		name   string
+		naming string
+		chain  []Block
+	}{
+		{"chain.json", "legacy", chain},
+		{"chain.v2.json", "snake_case", chain},
+		{"tampered-event.json", "snake_case", TamperEvent(chain, 5)},
+		{"broken-link.json", "snake_case", BreakLink(chain, 7)},
+	}
+
+	m := Manifest{Options: Default(), DeviceKeyID: DeviceKeyID, DeviceSecret: base64.StdEncoding.EncodeToString(DeviceSecret)}
+	for _, f := range files {
+		var v interface{} = f.chain
+		if f.naming == "legacy" {
+			legacy := make([]legacyBlock, len(f.chain))
+			for i, b := range f.chain {
+				legacy[i] = legacyBlock(b)
+			}
+			v = legacy
+		}
+		if err := writeJSON(filepath.Join(dir, f.name), v); err != nil {
+			return err
+		}
+		fixture := Fixture{File: f.name, Naming: f.naming, Valid: true, FailsAt: -1, Head: f.chain[len(f.chain)-1].Hash}
+		if err, ok := Verify(f.chain).(*VerifyError); ok {
+			fixture.Valid, fixture.FailsAt = false, err.Index
+		}
+		m.Fixtures = append(m.Fixtures, fixture)
+	}
+	return writeJSON(filepath.Join(dir, "manifest.json"), m)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
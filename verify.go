@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// VerifyBlockResp reports whether a supplied block is part of the chain.
+// HashValid says the supplied block's Hash matches its own contents; Exists
+// says the chain holds that hash at the claimed Index. PrevHash and NextHash
+// are the neighbouring links in the chain, Head is the current chain head.
+type VerifyBlockResp struct {
+	Block        Block    `json:"block"`
+	Result       bool     `json:"result"`
+	HashValid    bool     `json:"hash_valid"`
+	Exists       bool     `json:"exists"`
+	Mismatches   []string `json:"mismatches,omitempty"`
+	ComputedHash string   `json:"computed_hash"`
+	PrevHash     string   `json:"prev_hash"`
+	NextHash     string   `json:"next_hash"`
+	Head         BlockRef `json:"head"`
+}
+
+// VerifyFileResp lists every block attesting to a file's SHA-256
+type VerifyFileResp struct {
+	FileHash string            `json:"file_hash"`
+	Result   bool              `json:"result"`
+	Blocks   []FileAttestation `json:"blocks"`
+}
+
+// FileAttestation is one block recording a FileHash
+type FileAttestation struct {
+	Index     int    `json:"index"`
+	Hash      string `json:"hash"`
+	Timestamp string `json:"timestamp"`
+	Event     string `json:"event"`
+	EventTime string `json:"event_time"`
+	Location  string `json:"location"`
+	Server    string `json:"server"`
+}
+
+// largest upload accepted by POST /verify-file
+const maxVerifyFileBytes = 1 << 30
+
+// takes a multipart upload (field "file") or a JSON {"FileHash": ...} and
+// lists the blocks that attest to its SHA-256
+func handleVerifyFile(w http.ResponseWriter, r *http.Request) {
+	var fileHash string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxVerifyFileBytes)
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fileHash = hex.EncodeToString(h.Sum(nil))
+	} else {
+		var m CreateBlockReq
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		fileHash = strings.ToLower(m.FileHash)
+		if raw, err := hex.DecodeString(fileHash); err != nil || len(raw) != sha256.Size {
+			http.Error(w, "FileHash must be a hex SHA-256", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := VerifyFileResp{FileHash: fileHash, Blocks: make([]FileAttestation, 0)}
+	mutex.Lock()
+	for _, b := range Blockchain {
+		for _, tx := range eventsOf(b) {
+			if strings.ToLower(tx.FileHash) == fileHash {
+				resp.Blocks = append(resp.Blocks, FileAttestation{b.Index, b.Hash, b.Timestamp, tx.Event, tx.EventTime, tx.Location, tx.Server})
+			}
+		}
+	}
+	mutex.Unlock()
+	resp.Result = len(resp.Blocks) > 0
+
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
+
+// takes a full Block JSON and checks it against the chain
+func handleVerifyBlock(w http.ResponseWriter, r *http.Request) {
+	var b Block
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	resp := VerifyBlockResp{Block: b}
+
+	mutex.Lock()
+	// the genesis hash is computed over an empty block, later ones with the
+	// algorithm their predecessor selects (see reanchor.go)
+	switch {
+	case b.Index == 0:
+		resp.ComputedHash = calculateHash(Block{})
+	case b.Index > 0 && b.Index <= len(Blockchain):
+		resp.ComputedHash = hashFor(b, Blockchain[b.Index-1])
+	default:
+		resp.ComputedHash = hashBlockWith(b, hashAlgorithmOf(b.Hash))
+	}
+	resp.HashValid = resp.ComputedHash == b.Hash
+
+	head := Blockchain[len(Blockchain)-1]
+	resp.Head = BlockRef{head.Index, head.Hash}
+	if b.Index >= 0 && b.Index < len(Blockchain) {
+		stored := Blockchain[b.Index]
+		resp.Exists = stored.Hash == b.Hash
+		resp.Mismatches = diffBlocks(stored, b)
+		resp.PrevHash = stored.PrevHash
+		if b.Index+1 < len(Blockchain) {
+			resp.NextHash = Blockchain[b.Index+1].Hash
+		}
+	} else {
+		resp.Mismatches = []string{"Index"}
+	}
+	mutex.Unlock()
+
+	resp.Result = resp.HashValid && resp.Exists && len(resp.Mismatches) == 0
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
+
+// diffBlocks lists the hashed fields that differ between two blocks
+func diffBlocks(a, b Block) []string {
+	var fields []string
+	if a.Timestamp != b.Timestamp {
+		fields = append(fields, "Timestamp")
+	}
+	if a.FileHash != b.FileHash {
+		fields = append(fields, "FileHash")
+	}
+	if a.Event != b.Event {
+		fields = append(fields, "Event")
+	}
+	if a.EventTime != b.EventTime {
+		fields = append(fields, "EventTime")
+	}
+	if a.Location != b.Location {
+		fields = append(fields, "Location")
+	}
+	if a.Server != b.Server {
+		fields = append(fields, "Server")
+	}
+	if a.Hash != b.Hash {
+		fields = append(fields, "Hash")
+	}
+	if a.PrevHash != b.PrevHash {
+		fields = append(fields, "PrevHash")
+	}
+	if a.DeviceKey != b.DeviceKey {
+		fields = append(fields, "DeviceKey")
+	}
+	if a.DeviceHMAC != b.DeviceHMAC {
+		fields = append(fields, "DeviceHMAC")
+	}
+	if a.BackfilledBy != b.BackfilledBy {
+		fields = append(fields, "BackfilledBy")
+	}
+	if a.Signer != b.Signer || a.SignerCert != b.SignerCert {
+		fields = append(fields, "Signer")
+	}
+	if !bytes.Equal(a.Metadata, b.Metadata) {
+		fields = append(fields, "Metadata")
+	}
+	if a.Difficulty != b.Difficulty || a.Nonce != b.Nonce {
+		fields = append(fields, "Nonce")
+	}
+	if a.MerkleRoot != b.MerkleRoot || transactionsRoot(a.Transactions) != transactionsRoot(b.Transactions) {
+		fields = append(fields, "Transactions")
+	}
+	return fields
+}
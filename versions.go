@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API versions. Every route is served under two prefixes:
+//
+//	/v1  the API as it always was: field names as JSON_FIELD_NAMES says,
+//	     plain text errors, whole lists
+//	/v2  snake_case field names, JSON error envelopes (APIError) and lists
+//	     paged with ?cursor= and ?limit= (Page)
+//
+// Unprefixed paths still behave like /v1 but are deprecated: their
+// responses carry a Deprecation header and a Link to the /v1 path. Once
+// API_V1_SUNSET (an RFC 3339 time) is set, /v1 and unprefixed responses
+// announce it in a Sunset header. The admin listener is not versioned.
+
+type apiVersionKey struct{}
+
+// default and maximum page size of /v2 lists
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// APIError is the body of every /v2 error response
+type APIError struct {
+	Error APIErrorBody `json:"error"`
+}
+
+// APIErrorBody describes one error. Code is the status text in snake_case;
+// Details holds the structured body a v1 handler answered with, if any.
+type APIErrorBody struct {
+	Status  int             `json:"status"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+// Page is a /v2 list response. Next is the cursor of the following page,
+// empty on the last one.
+type Page struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// addVersionedRoutes registers the routes of add under /v1, /v2 and,
+// deprecated, without a prefix
+func addVersionedRoutes(muxRouter *mux.Router, add func(*mux.Router)) {
+	v1 := muxRouter.PathPrefix("/v1").Subrouter()
+	v1.Use(apiVersion(1, false), requireMinHeight)
+	add(v1)
+	v2 := muxRouter.PathPrefix("/v2").Subrouter()
+	v2.Use(apiVersion(2, false), requireMinHeight)
+	add(v2)
+	unversioned := muxRouter.NewRoute().Subrouter()
+	unversioned.Use(apiVersion(1, true), requireMinHeight)
+	add(unversioned)
+
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	}
+	muxRouter.NotFoundHandler = v2Errors(http.HandlerFunc(notFound))
+	muxRouter.MethodNotAllowedHandler = v2Errors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+}
+
+// apiVersion tags requests with their API version
+func apiVersion(version int, deprecated bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+			if version == 1 {
+				if deprecated {
+					w.Header().Set("Deprecation", "true")
+					w.Header().Set("Link", "<"+basePath+"/v1"+r.URL.Path+`>; rel="successor-version"`)
+				}
+				if sunset, err := time.Parse(time.RFC3339, os.Getenv("API_V1_SUNSET")); err == nil {
+					w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			v2Errors(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiVersionOf returns the API version of a routed request
+func apiVersionOf(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// v2Errors turns the error responses of v1 handlers into APIError bodies.
+// Unrouted requests only get them under /v2.
+func v2Errors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiVersionOf(r) != 2 && !strings.HasPrefix(r.URL.Path, "/v2/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &envelopeWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// envelopeWriter holds back error bodies and rewrites them as an APIError
+type envelopeWriter struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+func (w *envelopeWriter) WriteHeader(code int) {
+	if code >= 400 && w.body == nil {
+		w.status, w.body = code, &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps event streams working
+func (w *envelopeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.body == nil {
+		f.Flush()
+	}
+}
+
+func (w *envelopeWriter) finish() {
+	if w.body == nil {
+		return
+	}
+	// errors from compressed handlers are compressed too; the envelope isn't
+	raw := w.body.Bytes()
+	var zr io.Reader
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		zr, _ = gzip.NewReader(w.body)
+	case "deflate":
+		zr, _ = zlib.NewReader(w.body)
+	}
+	if zr != nil {
+		raw, _ = ioutil.ReadAll(zr)
+	}
+	raw = bytes.TrimSpace(raw)
+
+	e := APIErrorBody{
+		Status:  w.status,
+		Code:    strings.ToLower(strings.Replace(http.StatusText(w.status), " ", "_", -1)),
+		Message: string(raw),
+	}
+	if len(raw) > 0 && (raw[0] == '{' || raw[0] == '[') && json.Valid(raw) {
+		e.Message, e.Details = http.StatusText(w.status), raw
+	}
+	body, _ := json.Marshal(APIError{e})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// respondWithList answers with list, a slice: whole on v1, as one Page on
+// v2
+func respondWithList(w http.ResponseWriter, r *http.Request, code int, list interface{}) {
+	if apiVersionOf(r) != 2 {
+		respondWithJSON(w, r, code, list)
+		return
+	}
+	v := reflect.ValueOf(list)
+	from, to, next, err := pageBounds(r, v.Len())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	respondWithPage(w, r, code, v.Slice(from, to).Interface(), next)
+}
+
+// pageBounds reads ?cursor= and ?limit= for a list of n items
+func pageBounds(r *http.Request, n int) (from, to int, next string, err error) {
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, "", errPageLimit
+		}
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil || from < 0 {
+			return 0, 0, "", errPageCursor
+		}
+	}
+	if from > n {
+		from = n
+	}
+	to = from + limit
+	if to >= n {
+		return from, n, "", nil
+	}
+	return from, to, strconv.Itoa(to), nil
+}
+
+var errPageLimit = errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+var errPageCursor = errors.New("cursor is not valid")
+
+// respondWithPage writes one page of items, with a Link to the next one
+func respondWithPage(w http.ResponseWriter, r *http.Request, code int, items interface{}, next string) {
+	if next != "" {
+		q := r.URL.Query()
+		q.Set("cursor", next)
+		w.Header().Set("Link", "<"+basePath+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+	}
+	respondWithJSON(w, r, code, Page{items, next})
+}